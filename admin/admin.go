@@ -0,0 +1,390 @@
+// Package admin implements a registry of the clients currently connected to
+// the server, and a small HTTP server that allows operators to list them
+// and to disconnect ("kick") them.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/network/stats"
+)
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	Protocol    string            `json:"protocol"`
+	RemoteAddr  string            `json:"remote_addr"`
+	IPXAddr     string            `json:"ipx_addr,omitempty"`
+	ConnectTime time.Time         `json:"connect_time"`
+	Stats       *stats.Statistics `json:"stats,omitempty"`
+
+	// LastReceived is set for clients (such as uplinks) that track when
+	// they were last heard from.
+	LastReceived *time.Time `json:"last_received,omitempty"`
+
+	// SwitchPort is the client's port number in the routing table.
+	SwitchPort *int `json:"switch_port,omitempty"`
+}
+
+// RouteInfo describes an entry in the switch's routing table.
+type RouteInfo struct {
+	Network  string    `json:"network"`
+	Addr     string    `json:"addr"`
+	Port     int       `json:"port"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// DrainStatus reports whether the server is draining, and how many
+// clients are still connected.
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	Sessions int  `json:"sessions"`
+}
+
+// BridgeStatus describes the link to a physical network. It has the same
+// fields as phys.Status, so one can be converted to the other; it is
+// defined separately so that this package does not depend on phys, which
+// needs cgo to build with libpcap.
+type BridgeStatus struct {
+	Up              bool   `json:"up"`
+	Err             string `json:"err,omitempty"`
+	Framing         string `json:"framing"`
+	DetectedFraming string `json:"detected_framing,omitempty"`
+	RxFrames        uint64 `json:"rx_frames"`
+	TxFrames        uint64 `json:"tx_frames"`
+	NonIPXFrames    uint64 `json:"non_ipx_frames"`
+}
+
+type entry struct {
+	protocol    string
+	node        network.Node
+	remoteAddr  net.Addr
+	connectTime time.Time
+}
+
+func (e *entry) info() *ClientInfo {
+	result := &ClientInfo{
+		Protocol:    e.protocol,
+		RemoteAddr:  e.remoteAddr.String(),
+		ConnectTime: e.connectTime,
+	}
+	if addr := network.NodeAddress(e.node); addr != ipx.AddrNull {
+		result.IPXAddr = addr.String()
+	}
+	var s stats.Statistics
+	if e.node.GetProperty(&s) {
+		result.Stats = &s
+	}
+	var l network.Liveness
+	if e.node.GetProperty(&l) {
+		result.LastReceived = &l.LastReceived
+	}
+	var port ipxswitch.PortID
+	if e.node.GetProperty(&port) {
+		p := int(port)
+		result.SwitchPort = &p
+	}
+	return result
+}
+
+// Registry keeps track of the clients that are currently connected. All
+// methods can be safely called on a nil Registry, in which case nothing
+// is recorded.
+type Registry struct {
+	mu       sync.Mutex
+	entries  map[*entry]bool
+	lister   network.AddressLister
+	sw       *ipxswitch.Network
+	bridge   func() BridgeStatus
+	healthy  func() bool
+	draining func() bool
+}
+
+// SetBridge sets the function used to get the status of the link to the
+// physical network, which is reported by Bridge.
+func (r *Registry) SetBridge(status func() BridgeStatus) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bridge = status
+}
+
+// Bridge returns the status of the link to the physical network, or nil if
+// no physical network is bridged.
+func (r *Registry) Bridge() *BridgeStatus {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	bridge := r.bridge
+	r.mu.Unlock()
+	if bridge == nil {
+		return nil
+	}
+	status := bridge()
+	return &status
+}
+
+// SetHealthCheck sets the function used to decide whether the server is
+// healthy. Until it is set, the server is reported as unhealthy.
+func (r *Registry) SetHealthCheck(healthy func() bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.healthy = healthy
+}
+
+// Healthy returns true if the server is running and able to accept
+// clients.
+func (r *Registry) Healthy() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	healthy := r.healthy
+	r.mu.Unlock()
+	return healthy != nil && healthy()
+}
+
+// SetDrainCheck sets the function used to decide whether the server is
+// draining; see server.Server.Drain.
+func (r *Registry) SetDrainCheck(draining func() bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = draining
+}
+
+// Drain returns whether the server is draining, along with the number of
+// clients that are still connected.
+func (r *Registry) Drain() *DrainStatus {
+	if r == nil {
+		return &DrainStatus{}
+	}
+	r.mu.Lock()
+	draining := r.draining
+	result := &DrainStatus{Sessions: len(r.entries)}
+	r.mu.Unlock()
+	result.Draining = draining != nil && draining()
+	return result
+}
+
+// SetSwitch sets the switch whose routing table is reported by Routes.
+func (r *Registry) SetSwitch(sw *ipxswitch.Network) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sw = sw
+}
+
+// Routes returns the contents of the switch's routing table.
+func (r *Registry) Routes() []*RouteInfo {
+	result := []*RouteInfo{}
+	if r == nil {
+		return result
+	}
+	r.mu.Lock()
+	sw := r.sw
+	r.mu.Unlock()
+	if sw == nil {
+		return result
+	}
+	for _, route := range sw.RoutingTable().Routes {
+		result = append(result, &RouteInfo{
+			Network:  fmt.Sprintf("%x", route.Network),
+			Addr:     route.Addr.String(),
+			Port:     route.Port,
+			LastSeen: route.LastSeen,
+		})
+	}
+	return result
+}
+
+// SetAddressLister sets the network whose membership is reported by
+// Addresses.
+func (r *Registry) SetAddressLister(l network.AddressLister) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lister = l
+}
+
+// Addresses returns the IPX addresses of all machines that have been seen
+// on the network, including those that are not directly connected clients
+// (for example, machines on a bridged physical network).
+func (r *Registry) Addresses() []string {
+	result := []string{}
+	if r == nil {
+		return result
+	}
+	r.mu.Lock()
+	l := r.lister
+	r.mu.Unlock()
+	if l == nil {
+		return result
+	}
+	for _, addr := range l.Addresses() {
+		result = append(result, addr.String())
+	}
+	return result
+}
+
+// Add records that a client has connected from the given remote address
+// using the given protocol, and was assigned the given node. The returned
+// function must be called when the client disconnects.
+func (r *Registry) Add(protocol string, node network.Node, remoteAddr net.Addr) func() {
+	if r == nil {
+		return func() {}
+	}
+	e := &entry{
+		protocol:    protocol,
+		node:        node,
+		remoteAddr:  remoteAddr,
+		connectTime: time.Now(),
+	}
+	r.mu.Lock()
+	r.entries[e] = true
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		delete(r.entries, e)
+		r.mu.Unlock()
+	}
+}
+
+// Clients returns information about all connected clients, ordered by
+// connect time.
+func (r *Registry) Clients() []*ClientInfo {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	entries := []*entry{}
+	for e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+	result := []*ClientInfo{}
+	for _, e := range entries {
+		result = append(result, e.info())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ConnectTime.Before(result[j].ConnectTime)
+	})
+	return result
+}
+
+// Kick disconnects all clients matching the given address, which may be
+// either an IPX address or a remote address. The number of clients
+// disconnected is returned.
+func (r *Registry) Kick(addr string) int {
+	if r == nil {
+		return 0
+	}
+	var ipxAddr ipx.Addr
+	mac, err := net.ParseMAC(addr)
+	isIPX := err == nil && len(mac) == len(ipxAddr)
+	if isIPX {
+		copy(ipxAddr[:], mac)
+	}
+	r.mu.Lock()
+	matches := []*entry{}
+	for e := range r.entries {
+		if (isIPX && network.NodeAddress(e.node) == ipxAddr) || e.remoteAddr.String() == addr {
+			matches = append(matches, e)
+		}
+	}
+	r.mu.Unlock()
+	for _, e := range matches {
+		e.node.Close()
+	}
+	return len(matches)
+}
+
+// NewRegistry creates a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[*entry]bool),
+	}
+}
+
+// Handler returns an http.Handler that implements the admin API:
+//
+//	GET /clients           - JSON list of connected clients.
+//	GET /addresses         - JSON list of IPX addresses on the network.
+//	GET /routes            - JSON dump of the switch's routing table.
+//	GET /bridge            - JSON status of the physical network bridge.
+//	GET /healthz           - 200 if the server is healthy, otherwise 503.
+//	GET /drain             - JSON drain status and number of clients.
+//	POST /kick?addr=ADDR   - disconnect client with IPX or remote address.
+func Handler(r *Registry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Clients())
+	})
+	mux.HandleFunc("/addresses", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Addresses())
+	})
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Routes())
+	})
+	mux.HandleFunc("/bridge", func(w http.ResponseWriter, req *http.Request) {
+		status := r.Bridge()
+		if status == nil {
+			http.Error(w, "no physical network bridged", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		if !r.Healthy() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Drain())
+	})
+	mux.HandleFunc("/kick", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "kick must be a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		addr := req.FormValue("addr")
+		if addr == "" {
+			http.Error(w, "no address specified", http.StatusBadRequest)
+			return
+		}
+		n := r.Kick(addr)
+		if n == 0 {
+			http.Error(w, fmt.Sprintf("no client found with address %q", addr), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "disconnected %d client(s)\n", n)
+	})
+	return mux
+}
@@ -0,0 +1,211 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+)
+
+// testNode is a node with a fixed IPX address that records whether it has
+// been closed.
+type testNode struct {
+	addr   ipx.Addr
+	closed bool
+}
+
+func (n *testNode) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (n *testNode) WritePacket(packet *ipx.Packet) error {
+	return nil
+}
+
+func (n *testNode) Close() error {
+	n.closed = true
+	return nil
+}
+
+func (n *testNode) GetProperty(x interface{}) bool {
+	switch x.(type) {
+	case *ipx.Addr:
+		*x.(*ipx.Addr) = n.addr
+		return true
+	default:
+		return false
+	}
+}
+
+var _ = (network.Node)(&testNode{})
+
+func request(t *testing.T, r *Registry, method, url string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+	return rec
+}
+
+func addClient(r *Registry, addr ipx.Addr, remoteAddr string) *testNode {
+	node := &testNode{addr: addr}
+	udpAddr, _ := net.ResolveUDPAddr("udp", remoteAddr)
+	r.Add("dosbox", node, udpAddr)
+	return node
+}
+
+func TestClients(t *testing.T) {
+	r := NewRegistry()
+	addClient(r, ipx.Addr{0x02, 0, 0, 0, 0, 1}, "10.0.0.1:213")
+	remove := r.Add("uplink", &testNode{}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 10000})
+	addClient(r, ipx.Addr{0x02, 0, 0, 0, 0, 3}, "10.0.0.3:213")
+	remove()
+
+	rec := request(t, r, http.MethodGet, "/clients")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wrong status: want %d, got %d", http.StatusOK, rec.Code)
+	}
+	var clients []*ClientInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &clients); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	if len(clients) != 2 {
+		t.Fatalf("wrong number of clients: want 2, got %d", len(clients))
+	}
+	want := map[string]string{
+		"10.0.0.1:213": "02:00:00:00:00:01",
+		"10.0.0.3:213": "02:00:00:00:00:03",
+	}
+	for _, c := range clients {
+		if c.IPXAddr != want[c.RemoteAddr] {
+			t.Errorf("client %q: wrong IPX address: want %q, got %q", c.RemoteAddr, want[c.RemoteAddr], c.IPXAddr)
+		}
+		if c.Protocol != "dosbox" {
+			t.Errorf("client %q: wrong protocol: want dosbox, got %q", c.RemoteAddr, c.Protocol)
+		}
+	}
+}
+
+func TestKick(t *testing.T) {
+	r := NewRegistry()
+	node1 := addClient(r, ipx.Addr{0x02, 0, 0, 0, 0, 1}, "10.0.0.1:213")
+	node2 := addClient(r, ipx.Addr{0x02, 0, 0, 0, 0, 2}, "10.0.0.2:213")
+
+	if rec := request(t, r, http.MethodGet, "/kick?addr=02:00:00:00:00:01"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET request: want status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+	if rec := request(t, r, http.MethodPost, "/kick"); rec.Code != http.StatusBadRequest {
+		t.Errorf("no address: want status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if rec := request(t, r, http.MethodPost, "/kick?addr=02:00:00:00:00:99"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown address: want status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if node1.closed || node2.closed {
+		t.Fatalf("client disconnected by failed kick")
+	}
+
+	rec := request(t, r, http.MethodPost, "/kick?addr=02:00:00:00:00:01")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "disconnected 1 client") {
+		t.Errorf("kick by IPX address failed: status %d, %q", rec.Code, rec.Body.String())
+	}
+	if !node1.closed || node2.closed {
+		t.Errorf("wrong client disconnected by IPX address")
+	}
+
+	rec = request(t, r, http.MethodPost, "/kick?addr=10.0.0.2:213")
+	if rec.Code != http.StatusOK {
+		t.Errorf("kick by remote address failed: status %d, %q", rec.Code, rec.Body.String())
+	}
+	if !node2.closed {
+		t.Errorf("client not disconnected by remote address")
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	r.Add("dosbox", &testNode{}, &net.UDPAddr{})()
+	if rec := request(t, r, http.MethodGet, "/clients"); rec.Code != http.StatusOK {
+		t.Errorf("wrong status: want %d, got %d", http.StatusOK, rec.Code)
+	}
+	if n := r.Kick("10.0.0.1:213"); n != 0 {
+		t.Errorf("nil registry kicked %d clients", n)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	r := NewRegistry()
+	if rec := request(t, r, http.MethodGet, "/addresses"); strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("want empty list with no network set, got %q", rec.Body.String())
+	}
+
+	sw := ipxswitch.New(0)
+	r.SetAddressLister(sw)
+	r.SetSwitch(sw)
+	node1, node2 := sw.NewNode(), sw.NewNode()
+	for i, node := range []network.Node{node1, node2} {
+		node.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+				Src:  ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, byte(i + 1)}},
+			},
+			Payload: []byte{byte(i)},
+		})
+	}
+
+	rec := request(t, r, http.MethodGet, "/addresses")
+	var addrs []string
+	if err := json.Unmarshal(rec.Body.Bytes(), &addrs); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	want := []string{"02:00:00:00:00:01", "02:00:00:00:00:02"}
+	if strings.Join(addrs, ",") != strings.Join(want, ",") {
+		t.Errorf("wrong addresses: want %v, got %v", want, addrs)
+	}
+
+	rec = request(t, r, http.MethodGet, "/routes")
+	var routes []*RouteInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	if len(routes) != 2 || routes[0].Addr != want[0] || routes[1].Addr != want[1] {
+		t.Errorf("wrong routes: %+v", routes)
+	}
+
+	// Addresses are forgotten once the node they were seen on closes.
+	node1.Close()
+	rec = request(t, r, http.MethodGet, "/addresses")
+	if err := json.Unmarshal(rec.Body.Bytes(), &addrs); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	if len(addrs) != 1 || addrs[0] != want[1] {
+		t.Errorf("wrong addresses after close: want [%s], got %v", want[1], addrs)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	r := NewRegistry()
+	if rec := request(t, r, http.MethodGet, "/bridge"); rec.Code != http.StatusNotFound {
+		t.Errorf("want 404 with no bridge, got %d", rec.Code)
+	}
+	r.SetBridge(func() BridgeStatus {
+		return BridgeStatus{Up: true, Framing: "802.2", RxFrames: 12}
+	})
+	rec := request(t, r, http.MethodGet, "/bridge")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wrong status: want 200, got %d", rec.Code)
+	}
+	var got BridgeStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	if !got.Up || got.Framing != "802.2" || got.RxFrames != 12 {
+		t.Errorf("wrong bridge status: %+v", got)
+	}
+}
@@ -0,0 +1,91 @@
+// Package audit implements a log of client sessions, written when each
+// client disconnects. Unlike the normal log, which is intended for people to
+// read, the audit log contains one JSON record per line so that it can be
+// processed by other programs, eg. for accounting or investigating abuse.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/stats"
+)
+
+// Record describes a single client session.
+type Record struct {
+	Protocol       string            `json:"protocol"`
+	RemoteAddr     string            `json:"remote_addr"`
+	IPXAddr        string            `json:"ipx_addr,omitempty"`
+	ConnectTime    time.Time         `json:"connect_time"`
+	DisconnectTime time.Time         `json:"disconnect_time"`
+	Stats          *stats.Statistics `json:"stats,omitempty"`
+}
+
+// Log writes a Record to an io.Writer as each client session ends.
+type Log struct {
+	mu     sync.Mutex
+	w      io.Writer
+	logger *slog.Logger
+}
+
+// Start records that a client has connected from the given remote address
+// using the given protocol, and was assigned the given node. The returned
+// function must be called when the client disconnects, and writes the
+// session's record to the log.
+func (l *Log) Start(protocol string, node network.Node, remoteAddr net.Addr) func() {
+	if l == nil {
+		return func() {}
+	}
+	connectTime := time.Now()
+	return func() {
+		r := &Record{
+			Protocol:       protocol,
+			RemoteAddr:     remoteAddr.String(),
+			ConnectTime:    connectTime,
+			DisconnectTime: time.Now(),
+		}
+		if addr := network.NodeAddress(node); addr != ipx.AddrNull {
+			r.IPXAddr = addr.String()
+		}
+		var s stats.Statistics
+		if node.GetProperty(&s) {
+			r.Stats = &s
+		}
+		if err := l.write(r); err != nil && l.logger != nil {
+			l.logger.Log(context.Background(), slog.LevelError, "failed to write audit record",
+				"protocol", protocol,
+				"remote_addr", r.RemoteAddr,
+				"err", err)
+		}
+	}
+}
+
+func (l *Log) write(r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(data, '\n'))
+	return err
+}
+
+// New creates a Log that writes records to the given writer.
+func New(w io.Writer) *Log {
+	return NewWithLogger(w, nil)
+}
+
+// NewWithLogger is like New, but records that cannot be written are
+// reported to the given logger, so that gaps in the audit log do not go
+// unnoticed.
+func NewWithLogger(w io.Writer, logger *slog.Logger) *Log {
+	return &Log{w: w, logger: logger}
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/stats"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	n := stats.Wrap(addressable.Wrap(&ipxtesting.FakeNetwork{}))
+	remoteAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	for i := 0; i < 2; i++ {
+		node := n.NewNode()
+		end := l.Start("dosbox", node, remoteAddr)
+		node.WritePacket(&ipx.Packet{
+			Header:  ipx.Header{Src: ipx.HeaderAddr{Addr: network.NodeAddress(node)}},
+			Payload: []byte("hello"),
+		})
+		end()
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("want 2 records, got %d: %q", len(lines), buf.String())
+	}
+	var r struct {
+		Record
+		Stats map[string]interface{} `json:"stats"`
+	}
+	if err := json.Unmarshal(lines[0], &r); err != nil {
+		t.Fatalf("failed to decode record %q: %v", lines[0], err)
+	}
+	if r.Protocol != "dosbox" || r.RemoteAddr != remoteAddr.String() || r.IPXAddr == "" {
+		t.Errorf("wrong record: %+v", r)
+	}
+	if r.DisconnectTime.Before(r.ConnectTime) {
+		t.Errorf("disconnect time %v before connect time %v", r.DisconnectTime, r.ConnectTime)
+	}
+	if got := r.Stats["rx_bytes"]; got != float64(ipx.HeaderLength+5) {
+		t.Errorf("wrong byte count in record: want %d, got %v", ipx.HeaderLength+5, got)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Start("dosbox", nil, nil)()
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteError(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithLogger(failingWriter{}, slog.New(slog.NewTextHandler(&buf, nil)))
+	node := addressable.Wrap(&ipxtesting.FakeNetwork{}).NewNode()
+	l.Start("pptp", node, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1723})()
+	logged := buf.String()
+	if !strings.Contains(logged, "failed to write audit record") || !strings.Contains(logged, "disk full") {
+		t.Errorf("write error not logged: %q", logged)
+	}
+}
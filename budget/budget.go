@@ -0,0 +1,97 @@
+// Package budget implements a memory budget that can be shared between
+// multiple buffers holding partially-received data (eg. fragments awaiting
+// reassembly). Without a limit, a malicious client could exhaust memory by
+// sending many distinct partial frames that are never completed.
+package budget
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// DefaultLimit is the number of bytes that can be reserved from the
+	// Default budget.
+	DefaultLimit = 4 * 1024 * 1024
+)
+
+var (
+	// Default is the budget that is shared by all reassemblers unless
+	// configured otherwise.
+	Default = New(DefaultLimit)
+)
+
+// Stats contains counters describing memory pressure on a Budget.
+type Stats struct {
+	// InUse is the number of bytes currently reserved.
+	InUse int
+
+	// Limit is the maximum number of bytes that can be reserved.
+	Limit int
+
+	// Evictions counts the number of times that buffered data was
+	// discarded to free up space in the budget.
+	Evictions uint64
+
+	// Rejections counts the number of times that a reservation failed
+	// because the budget was exhausted.
+	Rejections uint64
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("%d/%d bytes in use, %d evictions, %d rejections",
+		s.InUse, s.Limit, s.Evictions, s.Rejections)
+}
+
+// Budget tracks the number of bytes reserved from a fixed limit.
+type Budget struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+// Reserve attempts to reserve the given number of bytes from the budget,
+// returning true if successful. Reserved bytes must later be returned by
+// calling Release.
+func (b *Budget) Reserve(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stats.InUse+n > b.stats.Limit {
+		b.stats.Rejections++
+		return false
+	}
+	b.stats.InUse += n
+	return true
+}
+
+// Release returns the given number of bytes to the budget.
+func (b *Budget) Release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.InUse -= n
+	if b.stats.InUse < 0 {
+		panic("budget: released more bytes than were reserved")
+	}
+}
+
+// Evicted is called by users of the budget when buffered data is discarded
+// to make space for new data. It updates the eviction counter.
+func (b *Budget) Evicted() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.Evictions++
+}
+
+// Stats returns a snapshot of the counters for the budget.
+func (b *Budget) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// New creates a new Budget that allows up to the given number of bytes to
+// be reserved at once.
+func New(limit int) *Budget {
+	return &Budget{
+		stats: Stats{Limit: limit},
+	}
+}
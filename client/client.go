@@ -24,26 +24,29 @@ type Client struct {
 }
 
 // Dial creates a new client for sending IPX frames to the server at the
-// given address.
+// given address. The address may be an IPv4 or IPv6 address, or a hostname
+// that resolves to either.
 func Dial(addr string) (*Client, error) {
-	resolvedAddr, err := net.ResolveUDPAddr("udp4", addr)
+	resolvedAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialUDP("udp4", nil, resolvedAddr)
+	conn, err := net.DialUDP("udp", nil, resolvedAddr)
 	if err != nil {
 		return nil, err
 	}
 	c := &Client{
 		conn:   conn,
-		rxpipe: pipe.New(),
+		rxpipe: pipe.New(pipe.DefaultBufferSize),
 	}
 	go c.recvLoop()
 	return c, nil
 }
 
 func (c *Client) recvLoop() {
-	var buf [1500]byte
+	// Allocate enough for the largest possible packet; it is up to the
+	// server to enforce its MTU.
+	var buf [ipx.MaxPacketLength]byte
 	defer c.rxpipe.Close()
 
 	for {
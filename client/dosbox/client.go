@@ -11,12 +11,21 @@ import (
 	"time"
 
 	udpclient "github.com/fragglet/ipxbox/client"
+	tcpclient "github.com/fragglet/ipxbox/client/tcp"
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/pipe"
 )
 
-const maxConnectAttempts = 5
+const (
+	// DefaultConnectAttempts is the number of registration packets that
+	// are sent by default before giving up on connecting.
+	DefaultConnectAttempts = 5
+
+	// DefaultRetryInterval is the default time to wait for a reply to a
+	// registration packet before sending another.
+	DefaultRetryInterval = time.Second
+)
 
 var (
 	_ = (network.Node)(&client{})
@@ -34,6 +43,36 @@ func (cf *connectFailure) Unwrap() error {
 	return os.ErrDeadlineExceeded
 }
 
+// Options contains optional settings for connecting to a server.
+type Options struct {
+	// If true, connect over a TCP stream rather than UDP, for networks
+	// where UDP is blocked.
+	TCP bool
+
+	// ConnectAttempts is the number of registration packets to send
+	// before giving up. If zero, DefaultConnectAttempts is used.
+	ConnectAttempts int
+
+	// RetryInterval is the time to wait for a reply to a registration
+	// packet before sending another. If zero, DefaultRetryInterval is
+	// used.
+	RetryInterval time.Duration
+}
+
+func (o *Options) connectAttempts() int {
+	if o.ConnectAttempts <= 0 {
+		return DefaultConnectAttempts
+	}
+	return o.ConnectAttempts
+}
+
+func (o *Options) retryInterval() time.Duration {
+	if o.RetryInterval <= 0 {
+		return DefaultRetryInterval
+	}
+	return o.RetryInterval
+}
+
 type client struct {
 	inner  ipx.ReadWriteCloser
 	rxpipe ipx.ReadWriteCloser
@@ -68,7 +107,7 @@ func (c *client) sendPingReply(addr *ipx.Addr) {
 		Header: ipx.Header{
 			Dest: ipx.HeaderAddr{
 				Addr:   *addr,
-				Socket: 2,
+				Socket: ipx.SocketRegistration,
 			},
 			Src: ipx.HeaderAddr{
 				Addr:   c.addr,
@@ -79,7 +118,7 @@ func (c *client) sendPingReply(addr *ipx.Addr) {
 }
 
 func isPing(hdr *ipx.Header) bool {
-	return hdr.Dest.Addr == ipx.AddrBroadcast && hdr.Dest.Socket == 2
+	return hdr.Dest.Addr == ipx.AddrBroadcast && hdr.Dest.Socket == ipx.SocketRegistration
 }
 
 func (c *client) recvLoop(ctx context.Context) {
@@ -110,35 +149,41 @@ func sendRegistrationPacket(c ipx.ReadWriteCloser) {
 		Header: ipx.Header{
 			Dest: ipx.HeaderAddr{
 				Addr:   ipx.AddrNull,
-				Socket: 2,
+				Socket: ipx.SocketRegistration,
 			},
 			Src: ipx.HeaderAddr{
 				Addr:   ipx.AddrNull,
-				Socket: 2,
+				Socket: ipx.SocketRegistration,
 			},
 		},
 	})
 }
 
 func isRegistrationResponse(hdr *ipx.Header) bool {
-	return hdr.Dest.Socket == 2 && hdr.Src.Socket == 2 && hdr.Dest.Addr != ipx.AddrBroadcast
+	return hdr.Dest.Socket == ipx.SocketRegistration && hdr.Src.Socket == ipx.SocketRegistration && hdr.Dest.Addr != ipx.AddrBroadcast
 }
 
-func handshakeConnect(ctx context.Context, c ipx.ReadWriteCloser, addr string) (ipx.Addr, error) {
+// handshakeConnect sends registration packets until the server replies, the
+// configured number of attempts have been made or the context expires.
+func handshakeConnect(ctx context.Context, c ipx.ReadWriteCloser, addr string, opts *Options) (ipx.Addr, error) {
 	nextSendTime := time.Now()
 	connectAttempts := 0
 	for {
+		if err := ctx.Err(); err != nil {
+			return ipx.AddrNull, err
+		}
 		now := time.Now()
 		if now.After(nextSendTime) {
-			if connectAttempts >= maxConnectAttempts {
+			if connectAttempts >= opts.connectAttempts() {
 				return ipx.AddrNull, &connectFailure{addr}
 			}
 			sendRegistrationPacket(c)
 			connectAttempts++
-			nextSendTime = now.Add(time.Second)
+			nextSendTime = now.Add(opts.retryInterval())
 		}
-		subctx, _ := context.WithDeadline(ctx, nextSendTime)
+		subctx, cancel := context.WithDeadline(ctx, nextSendTime)
 		packet, err := c.ReadPacket(subctx)
+		cancel()
 		if errors.Is(err, context.DeadlineExceeded) {
 			continue
 		}
@@ -151,19 +196,49 @@ func handshakeConnect(ctx context.Context, c ipx.ReadWriteCloser, addr string) (
 	}
 }
 
-func Dial(ctx context.Context, addr string) (network.Node, error) {
-	udp, err := udpclient.Dial(addr)
-	if err != nil {
-		return nil, err
-	}
+func connect(ctx context.Context, inner ipx.ReadWriteCloser, addr string, opts *Options) (network.Node, error) {
 	c := &client{
-		inner:  udp,
-		rxpipe: pipe.New(),
+		inner:  inner,
+		rxpipe: pipe.New(pipe.DefaultBufferSize),
 	}
-	if c.addr, err = handshakeConnect(ctx, udp, addr); err != nil {
-		udp.Close()
+	var err error
+	if c.addr, err = handshakeConnect(ctx, inner, addr, opts); err != nil {
+		inner.Close()
 		return nil, err
 	}
 	go c.recvLoop(context.Background())
 	return c, nil
 }
+
+// Dial connects to the server at the given address using the DOSbox
+// protocol. Registration packets are sent until the server replies, up to a
+// default number of attempts; the context can be used to put an overall
+// limit on the time taken to connect.
+func Dial(ctx context.Context, addr string) (network.Node, error) {
+	return DialWithOptions(ctx, addr, &Options{})
+}
+
+// DialTCP connects to a server using the DOSbox protocol, but over a TCP
+// stream rather than UDP, for networks where UDP is blocked.
+func DialTCP(ctx context.Context, addr string) (network.Node, error) {
+	return DialWithOptions(ctx, addr, &Options{TCP: true})
+}
+
+// DialWithOptions is like Dial, but allows optional settings to be given.
+// If opts is nil, the defaults are used.
+func DialWithOptions(ctx context.Context, addr string, opts *Options) (network.Node, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	var conn ipx.ReadWriteCloser
+	var err error
+	if opts.TCP {
+		conn, err = tcpclient.Dial(addr)
+	} else {
+		conn, err = udpclient.Dial(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return connect(ctx, conn, addr, opts)
+}
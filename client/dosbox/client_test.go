@@ -0,0 +1,112 @@
+package dosbox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+// countRegistrations counts the registration packets received by the
+// server end of a connection, without ever replying to them.
+func countRegistrations(server *ipxtesting.LoopbackEnd) <-chan int {
+	result := make(chan int, 1)
+	go func() {
+		n := 0
+		for {
+			packet, err := server.ReadPacket(context.Background())
+			if err != nil {
+				result <- n
+				return
+			}
+			if packet.Header.IsRegistrationPacket() {
+				n++
+			}
+		}
+	}()
+	return result
+}
+
+func TestConnect(t *testing.T) {
+	clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+	want := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	go func() {
+		serverEnd.ReadPacket(context.Background())
+		serverEnd.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: want, Socket: ipx.SocketRegistration},
+				Src:  ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: ipx.SocketRegistration},
+			},
+		})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := connect(ctx, clientEnd, "server", &Options{})
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer c.Close()
+	if got := network.NodeAddress(c); got != want {
+		t.Errorf("wrong address: want %v, got %v", want, got)
+	}
+}
+
+func TestConnectAttempts(t *testing.T) {
+	clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+	count := countRegistrations(serverEnd)
+	start := time.Now()
+	_, err := connect(context.Background(), clientEnd, "server", &Options{
+		ConnectAttempts: 3,
+		RetryInterval:   20 * time.Millisecond,
+	})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("want connect failure, got %v", err)
+	}
+	if d := time.Since(start); d < 60*time.Millisecond || d > time.Second {
+		t.Errorf("gave up after %v; want three retry intervals", d)
+	}
+	serverEnd.Close()
+	if n := <-count; n != 3 {
+		t.Errorf("wrong number of registration packets: want 3, got %d", n)
+	}
+}
+
+func TestConnectDeadline(t *testing.T) {
+	clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+	countRegistrations(serverEnd)
+	defer serverEnd.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := connect(ctx, clientEnd, "server", &Options{
+		ConnectAttempts: 1000,
+		RetryInterval:   10 * time.Millisecond,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want context deadline error, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("took %v to give up after context expired", d)
+	}
+}
+
+func TestDialNilOptions(t *testing.T) {
+	// Nothing ever replies, so dialing fails, but must not panic.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if c, err := DialWithOptions(ctx, conn.LocalAddr().String(), nil); err == nil {
+		c.Close()
+		t.Errorf("DialWithOptions succeeded with no server")
+	}
+}
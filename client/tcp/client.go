@@ -0,0 +1,168 @@
+// Package tcp implements a client for sending and receiving IPX frames
+// from a server over a TCP stream. Since TCP is a stream rather than a
+// datagram protocol, each IPX frame is preceded by its length as a 16-bit
+// big endian integer.
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/pipe"
+)
+
+// WriteTimeout is how long a write to the stream may block before the
+// connection is considered dead, so that a client that stops reading
+// cannot stall whatever is sending packets to it.
+const WriteTimeout = 10 * time.Second
+
+var (
+	_ = (ipx.ReadWriteCloser)(&Client{})
+)
+
+// MalformedHandler is called with the decoding error when a frame is
+// received that does not contain a valid IPX packet.
+type MalformedHandler func(err error)
+
+// Client is an implementation of the ipx.ReadWriteCloser interface that
+// sends and receives length-prefixed IPX frames over a TCP stream.
+type Client struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	rxpipe       ipx.ReadWriteCloser
+	malformed    MalformedHandler
+	writeTimeout time.Duration
+	mu           sync.Mutex // protects writes to conn
+}
+
+// Dial creates a new client for sending IPX frames to the server at the
+// given address.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// DialTLS is like Dial, but the stream to the server is encrypted with TLS
+// using the given configuration. The context can be used to cancel the
+// connection attempt and TLS handshake.
+func DialTLS(ctx context.Context, addr string, config *tls.Config) (*Client, error) {
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// New creates a new client that sends and receives IPX frames over an
+// existing stream connection. Malformed frames received from the stream
+// are logged and discarded.
+func New(conn net.Conn) *Client {
+	return NewWithHandler(conn, nil)
+}
+
+// NewWithHandler is like New, but malformed frames are passed to the given
+// handler instead of being logged. It is used by the server side to wrap
+// accepted connections, so that malformed frames can be reported.
+func NewWithHandler(conn net.Conn, malformed MalformedHandler) *Client {
+	c := &Client{
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		rxpipe:       pipe.New(pipe.DefaultBufferSize),
+		malformed:    malformed,
+		writeTimeout: WriteTimeout,
+	}
+	if c.malformed == nil {
+		c.malformed = func(err error) {
+			slog.Warn("malformed frame received",
+				"remote_addr", conn.RemoteAddr().String(), "err", err)
+		}
+	}
+	go c.recvLoop()
+	return c
+}
+
+// readFrame reads the next length-prefixed frame from the stream.
+func (c *Client) readFrame() ([]byte, error) {
+	var lenField [2]byte
+	if _, err := io.ReadFull(c.reader, lenField[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(lenField[:]))
+	if _, err := io.ReadFull(c.reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (c *Client) recvLoop() {
+	defer c.rxpipe.Close()
+
+	for {
+		frame, err := c.readFrame()
+		if err != nil {
+			// Unlike UDP, any read error means the stream is
+			// unusable and we cannot resynchronize.
+			c.conn.Close()
+			return
+		}
+
+		p := &ipx.Packet{}
+		if err := p.UnmarshalBinary(frame); err != nil {
+			c.malformed(err)
+			continue
+		}
+		if err := c.rxpipe.WritePacket(p); err != nil {
+			// TODO: Log error?
+		}
+	}
+}
+
+func (c *Client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return c.rxpipe.ReadPacket(ctx)
+}
+
+func (c *Client) WritePacket(packet *ipx.Packet) error {
+	packetBytes, err := packet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(packetBytes) > 0xffff {
+		return fmt.Errorf("packet too large to send over TCP: %d bytes", len(packetBytes))
+	}
+	frame := make([]byte, 2, len(packetBytes)+2)
+	binary.BigEndian.PutUint16(frame, uint16(len(packetBytes)))
+	frame = append(frame, packetBytes...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if _, err := c.conn.Write(frame); err != nil {
+		// A partial write leaves the stream out of sync, so the
+		// connection cannot be used any more.
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// RemoteAddr returns the address of the other end of the connection.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Client) Close() error {
+	c.rxpipe.Close()
+	return c.conn.Close()
+}
@@ -0,0 +1,175 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func writeFrame(t *testing.T, conn net.Conn, data []byte) {
+	t.Helper()
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	if _, err := conn.Write(append(frame, data...)); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+}
+
+func readPacket(t *testing.T, c *Client) *ipx.Packet {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	packet, err := c.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	return packet
+}
+
+func TestSendReceive(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	c1, c2 := New(conn1), New(conn2)
+	defer c1.Close()
+	defer c2.Close()
+
+	for _, packet := range ipxtesting.TestPackets {
+		go c1.WritePacket(packet)
+		got := readPacket(t, c2)
+		if got.String() != packet.String() || string(got.Payload) != string(packet.Payload) {
+			t.Errorf("wrong packet received: want %v, got %v", packet, got)
+		}
+	}
+}
+
+func TestMalformedFrame(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	errs := make(chan error, 1)
+	c := NewWithHandler(conn2, func(err error) {
+		errs <- err
+	})
+	defer c.Close()
+
+	writeFrame(t, conn1, []byte("too short"))
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("malformed frame was not reported")
+	}
+
+	// The stream is still usable after a malformed frame.
+	packet := ipxtesting.TestPackets[0]
+	data, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, conn1, data)
+	if got := readPacket(t, c); string(got.Payload) != string(packet.Payload) {
+		t.Errorf("wrong packet received: want %v, got %v", packet, got)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// Nothing ever reads from the other end of the pipe.
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	c := New(conn1)
+	defer c.Close()
+	c.writeTimeout = 50 * time.Millisecond
+
+	result := make(chan error, 1)
+	go func() {
+		result <- c.WritePacket(ipxtesting.TestPackets[0])
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("WritePacket succeeded with nothing reading")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WritePacket did not time out")
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	cert, certPEM, err := ipxtesting.MakeCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan *Client, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- New(conn)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := DialTLS(ctx, listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("DialTLS failed: %v", err)
+	}
+	defer c.Close()
+	packet := ipxtesting.TestPackets[0]
+	if err := c.WritePacket(packet); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	server := <-accepted
+	defer server.Close()
+	if got := readPacket(t, server); string(got.Payload) != string(packet.Payload) {
+		t.Errorf("wrong packet received: want %v, got %v", packet, got)
+	}
+
+	// The server's certificate is not trusted without the CA.
+	if c, err := DialTLS(ctx, listener.Addr().String(), &tls.Config{}); err == nil {
+		c.Close()
+		t.Errorf("DialTLS succeeded with untrusted certificate")
+	}
+}
+
+func TestDialTLSCancel(t *testing.T) {
+	// The server accepts the TCP connection but never completes the
+	// TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if c, err := DialTLS(ctx, listener.Addr().String(), &tls.Config{}); err == nil {
+		c.Close()
+		t.Fatalf("DialTLS succeeded without a handshake")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("DialTLS took %v to give up after context expired", d)
+	}
+}
@@ -1,32 +1,131 @@
 // Package uplink implements a client for connecting to an IPX uplink server
-// over UDP.
+// over UDP, or over TLS for links that cross untrusted networks.
 package uplink
 
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	udpclient "github.com/fragglet/ipxbox/client"
+	tcpclient "github.com/fragglet/ipxbox/client/tcp"
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/pipe"
 	"github.com/fragglet/ipxbox/server/uplink"
 )
 
-const maxConnectAttempts = 5
+const (
+	// DefaultConnectAttempts is the number of times that each handshake
+	// message is sent by default before giving up on connecting.
+	DefaultConnectAttempts = 5
+
+	// DefaultRetryInterval is the default time to wait for a reply to a
+	// handshake message before sending it again.
+	DefaultRetryInterval = time.Second
+
+	// DefaultReconnectTimeout is the default time to wait without
+	// receiving anything from the server before reconnecting. It allows
+	// for server keepalive times of up to 40 seconds; see
+	// Options.ReconnectTimeout.
+	DefaultReconnectTimeout = time.Minute
+
+	// rxBlockTimeout is how long to wait for the reader to drain the
+	// receive pipe when it is full. An uplink carries traffic for a whole
+	// network, so it is better to delay a burst than to drop it.
+	rxBlockTimeout = 100 * time.Millisecond
+
+	// minReconnectDelay and maxReconnectDelay bound the exponential
+	// backoff between reconnection attempts.
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
 
 var (
-	_ = (ipx.ReadWriteCloser)(&client{})
+	_ = (network.Node)(&client{})
 )
 
+// Options contains optional settings for connecting to an uplink server.
+type Options struct {
+	// If not nil, the connection is made over a TLS stream using this
+	// configuration, so that all traffic is encrypted and not only the
+	// handshake.
+	TLSConfig *tls.Config
+
+	// ChallengeLength is the length in bytes of the challenge sent to
+	// the server, and the minimum length of the challenge that the
+	// server must send. Values less than uplink.MinChallengeLength are
+	// raised to uplink.MinChallengeLength.
+	ChallengeLength int
+
+	// ConnectAttempts is the number of times to send each handshake
+	// message before giving up. If zero, DefaultConnectAttempts is
+	// used.
+	ConnectAttempts int
+
+	// RetryInterval is the time to wait for a reply to a handshake
+	// message before sending it again. If zero, DefaultRetryInterval
+	// is used.
+	RetryInterval time.Duration
+
+	// ReconnectTimeout is how long to wait without receiving anything
+	// from the server before assuming that the connection has been lost
+	// and reconnecting. An idle server only sends a keepalive once the
+	// link has been idle for its keepalive time, and checks for this at
+	// half that interval, so the gap between keepalives can be up to 1.5
+	// times the server's keepalive time; this must be longer than that.
+	// If zero, DefaultReconnectTimeout is used.
+	ReconnectTimeout time.Duration
+}
+
+func (o *Options) connectAttempts() int {
+	if o.ConnectAttempts <= 0 {
+		return DefaultConnectAttempts
+	}
+	return o.ConnectAttempts
+}
+
+func (o *Options) retryInterval() time.Duration {
+	if o.RetryInterval <= 0 {
+		return DefaultRetryInterval
+	}
+	return o.RetryInterval
+}
+
+func (o *Options) reconnectTimeout() time.Duration {
+	if o.ReconnectTimeout <= 0 {
+		return DefaultReconnectTimeout
+	}
+	return o.ReconnectTimeout
+}
+
+// client is an uplink connection that transparently reconnects to the
+// server if the connection is lost.
 type client struct {
-	inner  ipx.ReadWriteCloser
-	rxpipe ipx.ReadWriteCloser
+	dial               func(context.Context) (ipx.ReadWriteCloser, error)
+	clientID, password string
+	opts               *Options
+	rxpipe             ipx.ReadWriteCloser
+	stop               context.CancelFunc
+
+	mu    sync.Mutex
+	inner ipx.ReadWriteCloser
+	// connected is false while reconnecting; packets written during
+	// that time are dropped.
+	connected    bool
+	lastRecvTime time.Time
+}
+
+func (c *client) currentInner() ipx.ReadWriteCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inner
 }
 
 func (c *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
@@ -34,26 +133,110 @@ func (c *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 }
 
 func (c *client) WritePacket(packet *ipx.Packet) error {
-	return c.inner.WritePacket(packet)
+	c.mu.Lock()
+	inner, connected := c.inner, c.connected
+	c.mu.Unlock()
+	if !connected {
+		return nil
+	}
+	return inner.WritePacket(packet)
+}
+
+// GetProperty returns the health of the connection to the server as a
+// *network.Liveness.
+func (c *client) GetProperty(x interface{}) bool {
+	switch x := x.(type) {
+	case *network.Liveness:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		*x = network.Liveness{
+			Connected:    c.connected,
+			LastReceived: c.lastRecvTime,
+		}
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *client) Close() error {
+	c.stop()
 	c.sendUplinkMessage(&uplink.Message{
 		Type: uplink.MessageTypeClose,
 	})
 	c.rxpipe.Close()
-	return c.inner.Close()
+	return c.currentInner().Close()
+}
+
+// connect makes a new connection to the server and performs the handshake.
+func (c *client) connect(ctx context.Context) error {
+	inner, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.inner = inner
+	c.mu.Unlock()
+	if err := c.handshakeConnect(ctx, c.clientID, c.password); err != nil {
+		inner.Close()
+		return err
+	}
+	c.mu.Lock()
+	c.connected = true
+	c.lastRecvTime = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// reconnect closes the current connection and keeps trying to connect again,
+// with exponential backoff, until it succeeds or the context is cancelled.
+func (c *client) reconnect(ctx context.Context) bool {
+	c.mu.Lock()
+	c.connected = false
+	c.mu.Unlock()
+	c.currentInner().Close()
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		err := c.connect(ctx)
+		if ctx.Err() != nil {
+			// Closed while we were connecting.
+			c.currentInner().Close()
+			return false
+		} else if err == nil {
+			return true
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
 }
 
 func (c *client) recvLoop(ctx context.Context) {
 	for {
-		packet, err := c.inner.ReadPacket(ctx)
-		if errors.Is(err, io.ErrClosedPipe) {
-			break
-		} else if err != nil {
+		subctx, cancel := context.WithTimeout(ctx, c.opts.reconnectTimeout())
+		packet, err := c.currentInner().ReadPacket(subctx)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, io.ErrClosedPipe), errors.Is(err, context.DeadlineExceeded):
+			if !c.reconnect(ctx) {
+				return
+			}
+			continue
+		case err != nil:
 			// TODO: Log error?
 			continue
 		}
+		c.mu.Lock()
+		c.lastRecvTime = time.Now()
+		c.mu.Unlock()
 		if packet.Header.Dest.Addr == uplink.Address {
 			continue
 		}
@@ -67,7 +250,7 @@ func (c *client) sendUplinkMessage(msg *uplink.Message) error {
 	if err != nil {
 		return err
 	}
-	return c.inner.WritePacket(&ipx.Packet{
+	return c.currentInner().WritePacket(&ipx.Packet{
 		Header: ipx.Header{
 			Dest: ipx.HeaderAddr{
 				Addr: uplink.Address,
@@ -81,17 +264,21 @@ func (c *client) sendUntilResponse(ctx context.Context, msg *uplink.Message) (*u
 	nextSendTime := time.Now()
 	connectAttempts := 0
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		now := time.Now()
 		if now.After(nextSendTime) {
-			if connectAttempts >= maxConnectAttempts {
+			if connectAttempts >= c.opts.connectAttempts() {
 				return nil, fmt.Errorf("no response to %q message after %d attempts", msg.Type, connectAttempts)
 			}
 			c.sendUplinkMessage(msg)
 			connectAttempts++
-			nextSendTime = now.Add(time.Second)
+			nextSendTime = now.Add(c.opts.retryInterval())
 		}
-		subctx, _ := context.WithDeadline(ctx, nextSendTime)
-		packet, err := c.inner.ReadPacket(subctx)
+		subctx, cancel := context.WithDeadline(ctx, nextSendTime)
+		packet, err := c.currentInner().ReadPacket(subctx)
+		cancel()
 		switch {
 		case errors.Is(err, context.DeadlineExceeded):
 			continue
@@ -111,9 +298,9 @@ func (c *client) sendUntilResponse(ctx context.Context, msg *uplink.Message) (*u
 	}
 }
 
-func (c *client) handshakeConnect(ctx context.Context, password string) error {
-	clientChallenge := make([]byte, uplink.MinChallengeLength)
-	if _, err := rand.Read(clientChallenge); err != nil {
+func (c *client) handshakeConnect(ctx context.Context, clientID, password string) error {
+	clientChallenge, err := uplink.NewChallenge(c.opts.ChallengeLength)
+	if err != nil {
 		return err
 	}
 	clientSolution := uplink.SolveChallenge("server", password, clientChallenge)
@@ -126,13 +313,14 @@ func (c *client) handshakeConnect(ctx context.Context, password string) error {
 		return err
 	case response.Type != uplink.MessageTypeGetChallengeResponse:
 		return fmt.Errorf("wrong response to challenge request: want %q, got %q", uplink.MessageTypeGetChallengeResponse, response.Type)
-	case len(response.Challenge) < uplink.MinChallengeLength:
-		return fmt.Errorf("server challenge too short: want minimum %d bytes, got %d", uplink.MinChallengeLength, len(response.Challenge))
+	case len(response.Challenge) < len(clientChallenge):
+		return fmt.Errorf("server challenge too short: want minimum %d bytes, got %d", len(clientChallenge), len(response.Challenge))
 	}
 	response, err = c.sendUntilResponse(ctx, &uplink.Message{
 		Type:      uplink.MessageTypeSubmitSolution,
 		Challenge: clientChallenge,
 		Solution:  uplink.SolveChallenge("client", password, response.Challenge),
+		ClientID:  clientID,
 	})
 	switch {
 	case err != nil:
@@ -147,19 +335,58 @@ func (c *client) handshakeConnect(ctx context.Context, password string) error {
 	return nil
 }
 
-func Dial(ctx context.Context, addr, password string) (ipx.ReadWriteCloser, error) {
-	udp, err := udpclient.Dial(addr)
-	if err != nil {
-		return nil, err
+// Dial connects to the uplink server at the given address. The client ID
+// identifies which password is being used, and may be empty if the server
+// uses a single shared password. If the connection is later lost, the
+// client automatically reconnects; packets written while reconnecting are
+// dropped. The health of the connection can be queried through the
+// *network.Liveness property.
+func Dial(ctx context.Context, addr, clientID, password string) (network.Node, error) {
+	return DialWithOptions(ctx, addr, clientID, password, &Options{})
+}
+
+// DialTLS connects to the uplink server at the given address over a TLS
+// stream, so that all traffic is encrypted and not only the handshake. The
+// usual challenge-response authentication is still performed once the TLS
+// connection has been established.
+func DialTLS(ctx context.Context, addr, clientID, password string, config *tls.Config) (network.Node, error) {
+	return DialWithOptions(ctx, addr, clientID, password, &Options{
+		TLSConfig: config,
+	})
+}
+
+// DialWithOptions is like Dial, but allows optional settings to be given.
+// If opts is nil, the defaults are used.
+func DialWithOptions(ctx context.Context, addr, clientID, password string, opts *Options) (network.Node, error) {
+	if opts == nil {
+		opts = &Options{}
 	}
+	dialFunc := func(context.Context) (ipx.ReadWriteCloser, error) {
+		return udpclient.Dial(addr)
+	}
+	if opts.TLSConfig != nil {
+		dialFunc = func(ctx context.Context) (ipx.ReadWriteCloser, error) {
+			return tcpclient.DialTLS(ctx, addr, opts.TLSConfig)
+		}
+	}
+	return dial(ctx, dialFunc, clientID, password, opts)
+}
+
+// dial creates a client that uses the given function to connect to the
+// server, and makes the initial connection.
+func dial(ctx context.Context, dialFunc func(context.Context) (ipx.ReadWriteCloser, error), clientID, password string, opts *Options) (network.Node, error) {
 	c := &client{
-		inner:  udp,
-		rxpipe: pipe.New(),
+		dial:     dialFunc,
+		clientID: clientID,
+		password: password,
+		opts:     opts,
+		rxpipe:   pipe.NewBlocking(pipe.DefaultBufferSize, rxBlockTimeout),
 	}
-	if err := c.handshakeConnect(ctx, password); err != nil {
-		udp.Close()
+	if err := c.connect(ctx); err != nil {
 		return nil, err
 	}
-	go c.recvLoop(context.Background())
+	loopctx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+	go c.recvLoop(loopctx)
 	return c, nil
 }
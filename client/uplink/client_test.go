@@ -0,0 +1,207 @@
+package uplink
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/server/uplink"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	net := ipxswitch.New(0)
+	observer := net.NewNode()
+	p := &uplink.Protocol{
+		Network:       net,
+		Password:      "secret",
+		KeepaliveTime: time.Second,
+	}
+
+	var mu sync.Mutex
+	var conns []*ipxtesting.LoopbackEnd
+	dialFunc := func(context.Context) (ipx.ReadWriteCloser, error) {
+		clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+		go p.StartClient(ctx, serverEnd, ipxtesting.FakeAddress)
+		mu.Lock()
+		conns = append(conns, clientEnd)
+		mu.Unlock()
+		return clientEnd, nil
+	}
+	node, err := dial(ctx, dialFunc, "", "secret", &Options{})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer node.Close()
+	c := node.(*client)
+
+	// Simulate the connection being dropped.
+	conns[0].Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.mu.Lock()
+		connected := c.connected
+		c.mu.Unlock()
+		mu.Lock()
+		numConns := len(conns)
+		mu.Unlock()
+		if connected && numConns > 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client did not reconnect: %d connections made", numConns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var l network.Liveness
+	if !c.GetProperty(&l) || !l.Connected || time.Since(l.LastReceived) > 10*time.Second {
+		t.Errorf("wrong liveness after reconnect: %+v", l)
+	}
+
+	// Packets should now flow over the new connection.
+	want := ipxtesting.TestPackets[0]
+	if err := c.WritePacket(want); err != nil {
+		t.Fatalf("WritePacket failed after reconnect: %v", err)
+	}
+	subctx, subcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer subcancel()
+	got, err := observer.ReadPacket(subctx)
+	if err != nil {
+		t.Fatalf("packet not received after reconnect: %v", err)
+	}
+	if string(got.Payload) != string(want.Payload) {
+		t.Errorf("wrong packet received: want %+v, got %+v", want, got)
+	}
+}
+
+func TestChallengeLength(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &uplink.Protocol{
+		Network:         ipxswitch.New(0),
+		Password:        "secret",
+		ChallengeLength: 128,
+	}
+	dialFunc := func(context.Context) (ipx.ReadWriteCloser, error) {
+		clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+		go p.StartClient(ctx, serverEnd, ipxtesting.FakeAddress)
+		return clientEnd, nil
+	}
+
+	node, err := dial(ctx, dialFunc, "", "secret", &Options{ChallengeLength: 128})
+	if err != nil {
+		t.Fatalf("failed to connect with matching challenge length: %v", err)
+	}
+	node.Close()
+
+	// A server challenge shorter than our own is rejected.
+	p.ChallengeLength = 0
+	if _, err := dial(ctx, dialFunc, "", "secret", &Options{ChallengeLength: 128}); err == nil {
+		t.Errorf("connected to server with short challenge")
+	}
+}
+
+func TestConnectAttempts(t *testing.T) {
+	// The server never replies.
+	dialFunc := func(context.Context) (ipx.ReadWriteCloser, error) {
+		clientEnd, _ := ipxtesting.MakeLoopbackPair("client", "server")
+		return clientEnd, nil
+	}
+
+	start := time.Now()
+	_, err := dial(context.Background(), dialFunc, "", "secret", &Options{
+		ConnectAttempts: 2,
+		RetryInterval:   10 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatalf("connected to server that never replies")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want about 20ms", elapsed)
+	}
+
+	// The context deadline bounds the whole handshake.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = dial(ctx, dialFunc, "", "secret", &Options{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("want error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestDialNilOptions(t *testing.T) {
+	// Nothing ever replies, so dialing fails, but must not panic.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if c, err := DialWithOptions(ctx, conn.LocalAddr().String(), "", "secret", nil); err == nil {
+		c.Close()
+		t.Errorf("DialWithOptions succeeded with no server")
+	}
+}
+
+// TestIdleConnection checks that the server's keepalives stop an idle
+// connection from being dropped, as long as the reconnect timeout is long
+// enough.
+func TestIdleConnection(t *testing.T) {
+	for _, tc := range []struct {
+		reconnectTimeout time.Duration
+		wantReconnect    bool
+	}{
+		// Keepalives can be up to 1.5 times the keepalive time apart.
+		{reconnectTimeout: 300 * time.Millisecond, wantReconnect: false},
+		{reconnectTimeout: 50 * time.Millisecond, wantReconnect: true},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := &uplink.Protocol{
+			Network:       ipxswitch.New(0),
+			Password:      "secret",
+			KeepaliveTime: 100 * time.Millisecond,
+		}
+		var mu sync.Mutex
+		numConns := 0
+		dialFunc := func(context.Context) (ipx.ReadWriteCloser, error) {
+			clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+			go p.StartClient(ctx, serverEnd, ipxtesting.FakeAddress)
+			mu.Lock()
+			numConns++
+			mu.Unlock()
+			return clientEnd, nil
+		}
+		node, err := dial(ctx, dialFunc, "", "secret", &Options{
+			ReconnectTimeout: tc.reconnectTimeout,
+		})
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer node.Close()
+
+		// Nothing is sent in either direction, apart from keepalives.
+		// Reconnection waits for minReconnectDelay first.
+		time.Sleep(minReconnectDelay + 500*time.Millisecond)
+		mu.Lock()
+		reconnected := numConns > 1
+		mu.Unlock()
+		if reconnected != tc.wantReconnect {
+			t.Errorf("reconnect timeout %v: want reconnected=%v, got %v", tc.reconnectTimeout, tc.wantReconnect, reconnected)
+		}
+	}
+}
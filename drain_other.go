@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+)
+
+// There is no SIGUSR1 on these platforms, so draining is not supported.
+var drainSignals = []os.Signal{}
+
+// shutdownSignals are the signals that shut the server down immediately.
+var shutdownSignals = []os.Signal{os.Interrupt}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals are the signals that start draining clients.
+var drainSignals = []os.Signal{syscall.SIGUSR1}
+
+// shutdownSignals are the signals that shut the server down immediately.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
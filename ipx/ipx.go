@@ -9,6 +9,22 @@ import (
 	"net"
 )
 
+const (
+	// SocketRegistration is the socket used by the DOSbox protocol for
+	// registration packets, and for the ping packets used to keep
+	// connections alive.
+	SocketRegistration = 2
+
+	// DefaultMTU is the default maximum size in bytes of an IPX packet,
+	// including the header. This matches the payload size of a standard
+	// Ethernet frame.
+	DefaultMTU = 1500
+
+	// MaxPacketLength is the largest IPX packet that can be represented,
+	// since the header length field is 16 bits.
+	MaxPacketLength = 65535
+)
+
 // Addr represents an IPX address (MAC address).
 type Addr [6]byte
 
@@ -56,6 +72,13 @@ func (a Addr) String() string {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", a[0], a[1], a[2], a[3], a[4], a[5])
 }
 
+// String returns the address in the form network:node:socket, with the
+// network number and socket in hex, eg. "00000000:02:11:22:33:44:55:4000".
+// Each part is fixed width, so the output can be split back up easily.
+func (a HeaderAddr) String() string {
+	return fmt.Sprintf("%02x%02x%02x%02x:%s:%04x", a.Network[0], a.Network[1], a.Network[2], a.Network[3], a.Addr, a.Socket)
+}
+
 // UnmarshalBinary decodes an IPX header address from a slice of bytes.
 func (a *HeaderAddr) UnmarshalBinary(data []byte) error {
 	if len(data) < minHeaderAddressLength {
@@ -118,3 +141,10 @@ func (h *Header) MarshalBinary() ([]byte, error) {
 func (h *Header) IsBroadcast() bool {
 	return h.Dest.Addr == AddrBroadcast
 }
+
+// IsRegistrationPacket returns true if this is the header of a DOSbox
+// protocol registration packet, which a client sends to the null address
+// to request that the server assign it an address.
+func (h *Header) IsRegistrationPacket() bool {
+	return h.Dest.Socket == SocketRegistration && h.Dest.Network == ZeroNetwork && h.Dest.Addr == AddrNull
+}
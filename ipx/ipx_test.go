@@ -3,6 +3,7 @@ package ipx
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"reflect"
 	"testing"
@@ -145,6 +146,17 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+func TestMarshalTooLong(t *testing.T) {
+	pkt := &Packet{Payload: make([]byte, MaxPacketLength-HeaderLength)}
+	if _, err := pkt.MarshalBinary(); err != nil {
+		t.Errorf("maximum length packet: marshal failed: %v", err)
+	}
+	pkt.Payload = append(pkt.Payload, 0)
+	if _, err := pkt.MarshalBinary(); err != PacketTooLongError {
+		t.Errorf("over-length packet: want error %v, got %v", PacketTooLongError, err)
+	}
+}
+
 func TestShortPacket(t *testing.T) {
 	pktBytes := []byte{0x01, 0x02, 0x03, 0x04}
 	var pkt Packet
@@ -153,6 +165,109 @@ func TestShortPacket(t *testing.T) {
 	}
 }
 
+func TestUnmarshalStrict(t *testing.T) {
+	pktBytes := []byte{
+		0xff, 0xff, 0x00, 0x23, 0x00, 0x04, 0x00, 0x00,
+		0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x45, 0x67, 0x00, 0x00, 0x00, 0x00, 0x11, 0x22,
+		0x33, 0x44, 0x55, 0x66, 0x45, 0x67, 0x68, 0x65,
+		0x6c, 0x6c, 0x6f,
+	}
+	var pkt Packet
+	if err := pkt.UnmarshalBinaryStrict(pktBytes); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict failed: %v", err)
+	}
+	if string(pkt.Payload) != "hello" {
+		t.Errorf("wrong payload: want %q, got %q", "hello", pkt.Payload)
+	}
+
+	// Padding beyond the length in the header is discarded.
+	padded := append(append([]byte{}, pktBytes...), 0, 0, 0, 0, 0, 0)
+	if err := pkt.UnmarshalBinaryStrict(padded); err != nil {
+		t.Fatalf("UnmarshalBinaryStrict failed for padded packet: %v", err)
+	}
+	if string(pkt.Payload) != "hello" {
+		t.Errorf("padding not removed: want %q, got %q", "hello", pkt.Payload)
+	}
+
+	// Packets shorter than the header claims are rejected.
+	if err := pkt.UnmarshalBinaryStrict(pktBytes[:len(pktBytes)-1]); err == nil {
+		t.Errorf("want error for truncated packet, got none")
+	}
+
+	// A length smaller than the header itself is invalid.
+	tooSmall := append([]byte{}, pktBytes...)
+	tooSmall[2], tooSmall[3] = 0x00, 0x10
+	if err := pkt.UnmarshalBinaryStrict(tooSmall); err == nil {
+		t.Errorf("want error for length smaller than header, got none")
+	}
+}
+
+func TestIsRegistrationPacket(t *testing.T) {
+	hdr := &Header{
+		Dest: HeaderAddr{Addr: AddrNull, Socket: SocketRegistration},
+		Src:  HeaderAddr{Addr: AddrNull, Socket: SocketRegistration},
+	}
+	if !hdr.IsRegistrationPacket() {
+		t.Errorf("registration packet not recognized: %v > %v", hdr.Src, hdr.Dest)
+	}
+	hdr.Dest.Addr = AddrBroadcast
+	if hdr.IsRegistrationPacket() {
+		t.Errorf("broadcast packet recognized as registration: %v > %v", hdr.Src, hdr.Dest)
+	}
+}
+
+func TestHeaderAddrString(t *testing.T) {
+	addr := HeaderAddr{
+		Network: [4]byte{0x00, 0x00, 0xbe, 0xef},
+		Addr:    Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+		Socket:  SocketRegistration,
+	}
+	want := "0000beef:02:00:00:00:00:01:0002"
+	if got := addr.String(); got != want {
+		t.Errorf("wrong string for address: want %q, got %q", want, got)
+	}
+	if got := fmt.Sprintf("%v", addr); got != want {
+		t.Errorf("wrong formatting with %%v: want %q, got %q", want, got)
+	}
+}
+
+func TestPacketString(t *testing.T) {
+	packet := &Packet{
+		Header: Header{
+			PacketType: 4,
+			Dest:       HeaderAddr{Addr: AddrBroadcast, Socket: 0x452},
+			Src: HeaderAddr{
+				Network: [4]byte{0x12, 0x34, 0x56, 0x78},
+				Addr:    Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Socket:  0x4000,
+			},
+		},
+		Payload: make([]byte, 34),
+	}
+	want := "12345678:02:11:22:33:44:55:4000 > 00000000:ff:ff:ff:ff:ff:ff:0452: sap, type 4, length 64"
+	if got := packet.String(); got != want {
+		t.Errorf("wrong string for packet:\nwant %q\ngot  %q", want, got)
+	}
+	packet.Header.Dest.Socket = 0x4567
+	want = "12345678:02:11:22:33:44:55:4000 > 00000000:ff:ff:ff:ff:ff:ff:4567: type 4, length 64"
+	if got := packet.String(); got != want {
+		t.Errorf("wrong string for packet:\nwant %q\ngot  %q", want, got)
+	}
+}
+
+func TestSocketName(t *testing.T) {
+	for socket, want := range map[uint16]string{
+		SocketRegistration: "dosbox",
+		0x452:              "sap",
+		0x4567:             "",
+	} {
+		if got := SocketName(socket); got != want {
+			t.Errorf("SocketName(%#x): want %q, got %q", socket, want, got)
+		}
+	}
+}
+
 func TestCopyPackets(t *testing.T) {
 	t.Run("Copy until EOF", func(t *testing.T) {
 		var x, y TestingReadWriteCloser
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/sync/errgroup"
@@ -12,6 +13,10 @@ import (
 var (
 	_ = (encoding.BinaryMarshaler)(&Packet{})
 	_ = (encoding.BinaryUnmarshaler)(&Packet{})
+
+	// PacketTooLongError is returned when marshaling a packet whose total
+	// length cannot be represented in the 16-bit header length field.
+	PacketTooLongError = errors.New("IPX packet too long to marshal")
 )
 
 // Reader defines a common interface implemented by things from which
@@ -58,7 +63,60 @@ type Packet struct {
 	Payload []byte
 }
 
+// socketNames maps well-known socket numbers to the names of the protocols
+// that use them.
+var socketNames = map[uint16]string{
+	SocketRegistration: "dosbox",
+	0x451:              "ncp",
+	0x452:              "sap",
+	0x453:              "rip",
+	0x455:              "netbios",
+	0x456:              "diagnostics",
+	0x551:              "nwlink-smb-name",
+	0x552:              "nwlink-smb-redir",
+	0x553:              "nwlink-datagram",
+	0x6181:             "ipxpkt",
+	0x869c:             "doom",
+	0x900f:             "snmp",
+	0x9010:             "snmp-trap",
+	26000:              "quake",
+	26001:              "quake",
+	26900:              "hexen2",
+	26901:              "hexen2",
+}
+
+// SocketName returns the name of the protocol that normally uses the given
+// socket number, or an empty string if it is not a well-known socket.
+func SocketName(socket uint16) string {
+	return socketNames[socket]
+}
+
+// protocol returns a guess at the protocol of the packet, based on its
+// socket numbers.
+func (p *Packet) protocol() string {
+	if name := SocketName(p.Header.Dest.Socket); name != "" {
+		return name
+	}
+	return SocketName(p.Header.Src.Socket)
+}
+
+// String returns a one-line human-readable description of the packet,
+// similar to the output of tcpdump -n.
+func (p *Packet) String() string {
+	result := fmt.Sprintf("%s > %s:", p.Header.Src, p.Header.Dest)
+	if proto := p.protocol(); proto != "" {
+		result += " " + proto + ","
+	}
+	return result + fmt.Sprintf(" type %d, length %d", p.Header.PacketType, HeaderLength+len(p.Payload))
+}
+
+// MarshalBinary populates a slice of bytes from an IPX packet. An error is
+// returned if the packet is longer than MaxPacketLength, since the length
+// field in the header would otherwise silently wrap around.
 func (p *Packet) MarshalBinary() ([]byte, error) {
+	if HeaderLength+len(p.Payload) > MaxPacketLength {
+		return nil, PacketTooLongError
+	}
 	result, err := p.Header.MarshalBinary()
 	if err != nil {
 		return nil, err
@@ -75,6 +133,26 @@ func (p *Packet) UnmarshalBinary(packet []byte) error {
 	return nil
 }
 
+// UnmarshalBinaryStrict is like UnmarshalBinary, but checks that the length
+// field in the header is consistent with the data. An error is returned if
+// the packet is shorter than the header claims, and any bytes beyond the
+// claimed length are discarded; real IPX stacks may pad packets to the
+// minimum Ethernet frame size.
+func (p *Packet) UnmarshalBinaryStrict(packet []byte) error {
+	if err := p.Header.UnmarshalBinary(packet); err != nil {
+		return err
+	}
+	length := int(p.Header.Length)
+	switch {
+	case length < HeaderLength:
+		return fmt.Errorf("IPX header length field too small: %d < %d", length, HeaderLength)
+	case length > len(packet):
+		return fmt.Errorf("IPX packet shorter than header length field: %d < %d", len(packet), length)
+	}
+	p.Payload = append([]byte{}, packet[HeaderLength:length]...)
+	return nil
+}
+
 // CopyPackets copies packets from in to out until an error occurs whil
 // reading or the context is cancelled. If the input returns EOF then
 // CopyPackets returns nil to indicate copying completed successfully.
@@ -3,19 +3,36 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	stdnet "net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/fragglet/ipxbox/admin"
+	"github.com/fragglet/ipxbox/audit"
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/ipxpkt"
+	"github.com/fragglet/ipxbox/monitor"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/dejitter"
+	"github.com/fragglet/ipxbox/network/echo"
 	"github.com/fragglet/ipxbox/network/filter"
 	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/network/sap"
+	"github.com/fragglet/ipxbox/network/service"
+	"github.com/fragglet/ipxbox/network/splithorizon"
 	"github.com/fragglet/ipxbox/network/stats"
 	"github.com/fragglet/ipxbox/network/tappable"
 	"github.com/fragglet/ipxbox/phys"
@@ -23,49 +40,362 @@ import (
 	"github.com/fragglet/ipxbox/qproxy"
 	"github.com/fragglet/ipxbox/server"
 	"github.com/fragglet/ipxbox/server/dosbox"
+	tcpserver "github.com/fragglet/ipxbox/server/tcp"
 	"github.com/fragglet/ipxbox/server/uplink"
 	"github.com/fragglet/ipxbox/syslog"
-
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 )
 
 var (
-	dumpPackets    = flag.String("dump_packets", "", "Write packets to a .pcap file with the given name.")
-	port           = flag.Int("port", 10000, "UDP port to listen on.")
-	clientTimeout  = flag.Duration("client_timeout", 10*time.Minute, "Time of inactivity before disconnecting clients.")
-	allowNetBIOS   = flag.Bool("allow_netbios", false, "If true, allow packets to be forwarded that may contain Windows file sharing (NetBIOS) packets.")
-	enableIpxpkt   = flag.Bool("enable_ipxpkt", false, "If true, route encapsulated packets from the IPXPKT.COM driver to the physical network (requires --enable_tap or --pcap_device)")
-	enableSyslog   = flag.Bool("enable_syslog", false, "If true, client connects/disconnects are logged to syslog")
-	quakeServers   = flag.String("quake_servers", "", "Proxy to the given list of Quake UDP servers in a way that makes them accessible over IPX.")
-	enablePPTP     = flag.Bool("enable_pptp", false, "If true, run PPTP VPN server on TCP port 1723.")
-	uplinkPassword = flag.String("uplink_password", "", "Password to permit uplink clients to connect. If empty, uplink is not supported.")
+	dumpPackets       = flag.String("dump_packets", "", "Write packets to a .pcap file with the given name.")
+	dumpRotateSize    = flag.Int64("dump_rotate_size", 0, "If non-zero, start a new --dump_packets file when the current one reaches this many megabytes.")
+	dumpRotateTime    = flag.Duration("dump_rotate_time", 0, "If non-zero, start a new --dump_packets file after this amount of time.")
+	dumpMaxFiles      = flag.Int("dump_max_files", 0, "If non-zero, only keep this many --dump_packets files in total, including all per-client files, deleting the oldest.")
+	dumpPerClient     = flag.Bool("dump_per_client", false, "If true, write a separate --dump_packets file for each IPX node address, containing the packets it sent and received.")
+	printPackets      = flag.Bool("print_packets", false, "If true, print a line to stdout describing each packet that crosses the network, similar to tcpdump -n.")
+	replayPackets     = flag.String("replay_packets", "", "Replay the IPX packets in the given .pcap file into the network at startup, eg. to reproduce a problem captured with --dump_packets.")
+	replayRealTime    = flag.Bool("replay_realtime", false, "If true, --replay_packets replays packets with the same timing with which they were captured, rather than as fast as possible.")
+	port              = flag.Int("port", 10000, "UDP port to listen on.")
+	bindAddress       = flag.String("bind", "", `If not empty, only listen for clients on the given local IP address or hostname, rather than on all addresses. IPv6 link-local addresses must include the interface name, eg. "fe80::1%eth0".`)
+	tcpPort           = flag.Int("tcp_port", 0, "If non-zero, also accept clients over TCP on this port, for networks where UDP is blocked.")
+	tlsPort           = flag.Int("tls_port", 0, "If non-zero, also accept clients over TLS-encrypted TCP on this port. Requires --tls_cert and --tls_key. Useful for uplinks that cross the public internet.")
+	tlsCertFile       = flag.String("tls_cert", "", "File containing the PEM-encoded certificate chain to use for --tls_port.")
+	tlsKeyFile        = flag.String("tls_key", "", "File containing the PEM-encoded private key to use for --tls_port.")
+	udpNetwork        = flag.String("udp_network", "udp", `Network type for the UDP socket. Valid values are "udp" (IPv4 and IPv6), "udp4" and "udp6".`)
+	mtu               = flag.Int("mtu", ipx.DefaultMTU, "Maximum size in bytes of IPX packets received from and sent to UDP clients. Larger packets are discarded and logged rather than truncated.")
+	addressPool       = flag.String("address_pool", "", `If not empty, assign client addresses from the given range rather than randomly, specified as a base address and mask, eg. "02:00:00:00:01:00/ff:ff:ff:ff:ff:00". Clients are refused once every address in the range is in use.`)
+	sequentialAddrs   = flag.Bool("sequential_addrs", false, "If true, assign --address_pool addresses in order rather than choosing them randomly from the range.")
+	dejitterDepth     = flag.Int("dejitter_depth", 0, "If non-zero, smooth out bursts of packets from DOSBox clients by holding up to this many packets per client and releasing them at the client's usual rate. May help games that handle bursty delivery badly, at the cost of some latency.")
+	dejitterMaxHold   = flag.Duration("dejitter_max_hold", dejitter.DefaultMaxHold, "Maximum time that --dejitter_depth holds a packet.")
+	migrateClients    = flag.Bool("migrate_clients", false, "If true, when a DOSBox client's UDP source port changes mid-session, as can happen behind some NATs, move its session to the new port rather than treating it as a new client. The client must still be at the same IP address.")
+	clientTimeout     = flag.Duration("client_timeout", 10*time.Minute, "Time of inactivity before disconnecting clients.")
+	bufferPackets     = flag.Int("buffer_packets", pipe.DefaultBufferSize, "Number of packets to queue for each client before dropping packets. Larger values avoid drops during bursts, such as in peer-to-peer games with many players, but increase memory use and latency for slow clients.")
+	dropTimeout       = flag.Duration("drop_timeout", 0, "If non-zero, disconnect clients whose queue (see --buffer_packets) has stayed full for this long, so that every packet sent to them was dropped. A queue that never drains usually means a client that has stopped responding.")
+	splitHorizon      = flag.Bool("split_horizon", false, "Discard packets that loop back to the server, for example when it is connected to the same physical network through both --enable_tap or --pcap_device and an uplink.")
+	lowPriority       = flag.String("low_priority_sockets", "", `If set, packets to or from this comma-separated list of IPX sockets are queued separately and only delivered to clients when no other packets are waiting, so that bulk transfers do not delay game packets. Accepts the same groups as --blocked_ports, eg. "ipxpkt,ncp".`)
+	broadcastLimit    = flag.Int("broadcast_limit", 0, "If non-zero, the maximum number of broadcast packets per second that each client may send; further broadcasts are dropped.")
+	keepaliveTime     = flag.Duration("keepalive_time", 5*time.Second, "If nothing has been sent to a client for this long, send a keepalive packet. Must be shorter than --client_timeout. Uplink clients reconnect after their --reconnect_timeout (default 1m) without hearing from the server, which must be more than 1.5 times this.")
+	allowNetBIOS      = flag.Bool("allow_netbios", false, "If true, allow packets to be forwarded that may contain Windows file sharing (NetBIOS) packets.")
+	blockedPorts      = flag.String("blocked_ports", "default", `Comma-separated list of IPX sockets to block unless --allow_netbios is set. Entries can be socket numbers or the groups "default", "ncp", "sap", "rip", "netbios", "nwlink", "snmp" and "ipxpkt"; prefix an entry with "-" to unblock it, eg. "default,-nwlink".`)
+	logFiltered       = flag.Bool("log_filtered", false, "If true, log when packets are dropped because of --blocked_ports. To avoid flooding the log, at most one message is logged every 10 seconds.")
+	filterDirection   = flag.String("filter_direction", "both", `Which direction to block packets for --blocked_ports: "ingress" to block only packets sent by clients, "egress" to block only packets delivered to clients, or "both".`)
+	enableIpxpkt      = flag.Bool("enable_ipxpkt", false, "If true, route encapsulated packets from the IPXPKT.COM driver to the physical network (requires --enable_tap or --pcap_device)")
+	ipxpktFraming     = flag.String("ipxpkt_framing", "auto", `Variant of the IPXPKT.COM protocol to use with --enable_ipxpkt: "trailer" for versions that send 32 bytes of padding before each fragment, "notrailer" for versions that do not, or "auto" to detect per client.`)
+	ipxpktFragSize    = flag.Int("ipxpkt_fragment_size", ipxpkt.DefaultFragmentSize, "Maximum size of the Ethernet frame fragments sent to --enable_ipxpkt clients. Larger values reduce overhead but may not work with all versions of IPXPKT.COM.")
+	enableSyslog      = flag.Bool("enable_syslog", false, "If true, client connects/disconnects are logged to syslog")
+	quakeServers      = flag.String("quake_servers", "", "Proxy to the given list of Quake UDP servers in a way that makes them accessible over IPX.")
+	quakeIdleTimeout  = flag.Duration("quake_idle_timeout", 10*time.Minute, "Time of inactivity before closing a connection to a --quake_servers server. Increase this if games with long lobby waits are dropped.")
+	quakeSOCKS5Proxy  = flag.String("quake_socks5_proxy", "", "If not empty, address of a SOCKS5 proxy through which to send packets to --quake_servers.")
+	quakeBind         = flag.String("quake_bind", "", `If not empty, send packets to --quake_servers from the given local IP address or hostname, to control which interface they leave from on hosts with more than one. Cannot be used with --quake_socks5_proxy.`)
+	quakeGame         = flag.String("quake_game", "quake", `Game spoken by the servers given by --quake_servers: "quake" or "hexen2".`)
+	enablePPTP        = flag.Bool("enable_pptp", false, "If true, run PPTP VPN server on TCP port 1723.")
+	pptpDiscardTime   = flag.Duration("pptp_discard_time", 0, "If non-zero, send an LCP Discard-Request to --enable_pptp clients at this interval, a lightweight probe that the client silently discards.")
+	uplinkPassword    = flag.String("uplink_password", "", "Password to permit uplink clients to connect. If empty, uplink is not supported.")
+	enableSAP         = flag.Bool("enable_sap", false, "If true, respond to IPX SAP and RIP queries, advertising the services listed in --sap_services. This also removes the SAP and RIP sockets from --blocked_ports so that clients can reach the responder.")
+	sapServices       = flag.String("sap_services", "", `Comma-separated list of services to advertise with SAP when --enable_sap is set, each in the form "name/type/address/socket", eg. "FILESERVER/0x4/02:11:22:33:44:55/0x451".`)
+	uplinkPort        = flag.Int("uplink_port", 0, "If non-zero, accept uplink clients on this UDP port instead of on --port and --tcp_port, so that the uplink protocol can be firewalled separately from the public DOSBox port. --tls_port still accepts both.")
+	uplinkCredentials = flag.String("uplink_credentials", "", `File containing per-client uplink passwords, one "client-id:password" per line. Overrides --uplink_password. The file is reread on every connection attempt.`)
+	challengeLength   = flag.Int("challenge_length", uplink.MinChallengeLength, "Length in bytes of the challenge sent to uplink clients during authentication, and the minimum length accepted from them. Cannot be less than the default.")
+	enableMonitor     = flag.Bool("enable_monitor", false, "If true, log clients that show signs of abuse such as address spoofing, broadcast floods, malformed packets or repeated authentication failures.")
+	monitorThresholds = flag.String("monitor_thresholds", "", `Comma-separated list of per-minute thresholds for --enable_monitor, eg. "spoof=10,broadcast=1000,malformed=20,auth=3". Unlisted types keep their default thresholds.`)
+	monitorBlockTime  = flag.Duration("monitor_block_time", 0, "If non-zero, clients exceeding a --enable_monitor threshold are blocked for this long, rather than only logged.")
+	enableEcho        = flag.Bool("enable_echo", false, "If true, run an echo service that sends back any packets sent to IPX socket 0x3000, for testing connectivity.")
+	echoTimestamps    = flag.Bool("echo_timestamps", false, "If true, the echo service appends the time each packet was received, as nanoseconds since the Unix epoch.")
+	auditLog          = flag.String("audit_log", "", "If not empty, append a JSON record of each client session to the given file when the client disconnects, including its remote address, IPX address, connect and disconnect times and the number of bytes transferred.")
+	drainTimeout      = flag.Duration("drain_timeout", 0, "If non-zero, when draining after SIGUSR1, shut down after this long even if clients are still connected.")
+	adminAddress      = flag.String("admin_address", "", `If not empty, run an admin HTTP server on the given address (eg. "localhost:8080") that allows connected clients to be listed and disconnected.`)
 )
 
-func addQuakeProxies(ctx context.Context, net network.Network) {
+// newNode checks that a node created at startup for one of the server's
+// own services is usable. It can fail if --address_pool is too small.
+func newNode(node network.Node, what string) network.Node {
+	if err := network.NodeError(node); err != nil {
+		log.Fatalf("failed to create node for %s: %v", what, err)
+	}
+	return node
+}
+
+func addQuakeProxies(ctx context.Context, net network.Network, logger *slog.Logger) {
 	if *quakeServers == "" {
 		return
 	}
+	game, err := qproxy.LookupGame(*quakeGame)
+	if err != nil {
+		log.Fatalf("invalid --quake_game: %v", err)
+	}
+	var localAddr *stdnet.IPAddr
+	if *quakeBind != "" {
+		if *quakeSOCKS5Proxy != "" {
+			log.Fatalf("--quake_bind cannot be used with --quake_socks5_proxy")
+		}
+		localAddr, err = stdnet.ResolveIPAddr("ip", *quakeBind)
+		if err != nil {
+			log.Fatalf("invalid --quake_bind: %v", err)
+		}
+		// Check now that the address is one we can bind to, rather
+		// than when the first client connects.
+		conn, err := stdnet.ListenUDP("udp", &stdnet.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone})
+		if err != nil {
+			log.Fatalf("invalid --quake_bind: %v", err)
+		}
+		conn.Close()
+	}
 	for _, addr := range strings.Split(*quakeServers, ",") {
 		p := qproxy.New(&qproxy.Config{
-			Address:     addr,
-			IdleTimeout: *clientTimeout,
-		}, net.NewNode())
+			Address:      addr,
+			IdleTimeout:  *quakeIdleTimeout,
+			Game:         game,
+			SOCKS5Proxy:  *quakeSOCKS5Proxy,
+			LocalAddress: localAddr,
+			Logger:       logger,
+		}, newNode(service.NewNode(net, game.IPXSocket, game.ConnectedIPXSocket), "Quake proxy"))
 		go p.Run(ctx)
 	}
 }
 
-func makePcapWriter() *pcapgo.Writer {
-	f, err := os.Create(*dumpPackets)
+// startReplay replays the packets from the --replay_packets file into the
+// network. The result is written to the given logger, or to the default
+// logger if it is nil.
+func startReplay(ctx context.Context, net network.Network, logger *slog.Logger) {
+	if *replayPackets == "" {
+		return
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	f, err := os.Open(*replayPackets)
+	if err != nil {
+		log.Fatalf("failed to open --replay_packets file: %v", err)
+	}
+	node := net.NewNode()
+	go func() {
+		defer f.Close()
+		defer node.Close()
+		if err := phys.ReplayPcap(ctx, f, nil, node, *replayRealTime); err != nil {
+			logger.Error("failed to replay packets", "filename", *replayPackets, "err", err)
+			return
+		}
+		logger.Info("finished replaying packets", "filename", *replayPackets)
+	}()
+}
+
+// printTap prints a human-readable line for each packet read from the given
+// tap until the context is cancelled.
+func printTap(ctx context.Context, tap ipx.ReadCloser, w io.Writer) {
+	defer tap.Close()
+	for {
+		packet, err := tap.ReadPacket(ctx)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%s %s\n", time.Now().Format("15:04:05.000000"), packet)
+	}
+}
+
+func addSAPResponder(ctx context.Context, net network.Network) {
+	if !*enableSAP {
+		return
+	}
+	services, err := sap.ParseServices(*sapServices)
 	if err != nil {
-		log.Fatalf("failed to open pcap file for write: %v", err)
+		log.Fatalf("failed to parse --sap_services: %v", err)
+	}
+	r := sap.New(&sap.Config{
+		Services:  services,
+		Broadcast: true,
+	}, newNode(service.NewNode(net, sap.SAPSocket, sap.RIPSocket), "SAP responder"))
+	go r.Run(ctx)
+}
+
+func addEchoService(ctx context.Context, net network.Network) {
+	if !*enableEcho {
+		return
+	}
+	s := echo.New(&echo.Config{
+		Timestamp: *echoTimestamps,
+	}, newNode(service.NewNode(net, echo.DefaultSocket), "echo service"))
+	go s.Run(ctx)
+}
+
+func makeMonitor(ctx context.Context, logger *slog.Logger) *monitor.Monitor {
+	if !*enableMonitor {
+		return nil
+	}
+	thresholds, err := monitor.ParseThresholds(*monitorThresholds)
+	if err != nil {
+		log.Fatalf("failed to parse --monitor_thresholds: %v", err)
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	m := monitor.New(&monitor.Config{
+		Thresholds: thresholds,
+		Window:     time.Minute,
+		BlockTime:  *monitorBlockTime,
+		Logger:     logger,
+	})
+	go m.Run(ctx, 10*time.Minute)
+	return m
+}
+
+// logIpxpktStats periodically logs the reassembly statistics for the given
+// ipxpkt router, if they have changed, until the context is cancelled.
+func logIpxpktStats(ctx context.Context, r *ipxpkt.Router, logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	var last ipxpkt.ReassemblyStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Minute):
+		}
+		stats := r.ReassemblyStats()
+		if stats != last {
+			logger.Info("ipxpkt reassembly stats", "stats", stats.String())
+			last = stats
+		}
+	}
+}
+
+func makeAuditLog(logger *slog.Logger) *audit.Log {
+	if *auditLog == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("failed to open --audit_log: %v", err)
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return audit.NewWithLogger(f, logger)
+}
+
+func makeAdminServer(sw *ipxswitch.Network) *admin.Registry {
+	if *adminAddress == "" {
+		return nil
+	}
+	registry := admin.NewRegistry()
+	registry.SetAddressLister(sw)
+	registry.SetSwitch(sw)
+	listener, err := stdnet.Listen("tcp", *adminAddress)
+	if err != nil {
+		log.Fatalf("failed to start admin server: %v", err)
+	}
+	go http.Serve(listener, admin.Handler(registry))
+	return registry
+}
+
+// drainable is implemented by the servers that accept clients.
+type drainable interface {
+	io.Closer
+	Drain()
+	NumClients() int
+}
+
+// drainOnSignal waits for SIGUSR1 and then stops the given servers from
+// accepting new clients. Once all clients have disconnected, or
+// --drain_timeout has passed, the servers are shut down. Uplinks are not
+// waited for, since they never disconnect by themselves.
+func drainOnSignal(servers []drainable, logger *slog.Logger) {
+	if len(drainSignals) == 0 {
+		return
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, drainSignals...)
+	sig := <-sigs
+	logger.Info("draining clients before shutting down", "signal", sig.String())
+	for _, s := range servers {
+		s.Drain()
 	}
-	w := pcapgo.NewWriter(f)
-	w.WriteFileHeader(1500, layers.LinkTypeEthernet)
-	return w
+	var deadline time.Time
+	if *drainTimeout > 0 {
+		deadline = time.Now().Add(*drainTimeout)
+	}
+	for {
+		numClients := 0
+		for _, s := range servers {
+			numClients += s.NumClients()
+		}
+		if numClients == 0 {
+			logger.Info("all clients disconnected; shutting down")
+			break
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			logger.Warn("--drain_timeout reached; shutting down",
+				"clients", numClients)
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM and then shuts down
+// immediately, without waiting for clients to disconnect: the context is
+// cancelled and the given servers are closed.
+func shutdownOnSignal(cancel context.CancelFunc, servers []drainable, logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, shutdownSignals...)
+	sig := <-sigs
+	logger.Info("shutting down", "signal", sig.String())
+	cancel()
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
+func makePcapWriter(filename string, files *phys.FileList, keepExisting bool) (*phys.RotatingPcapWriter, error) {
+	return phys.NewRotatingPcapWriter(filename, &phys.RotateConfig{
+		MaxSize:      *dumpRotateSize * 1024 * 1024,
+		MaxAge:       *dumpRotateTime,
+		Files:        files,
+		KeepExisting: keepExisting,
+	})
+}
+
+// makePcapSink returns the sink to which all packets are written for
+// --dump_packets.
+func makePcapSink(logger *slog.Logger) ipx.WriteCloser {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	// The limit on the number of files applies to all the files
+	// written, not to each client's files separately.
+	files := phys.NewFileList(*dumpMaxFiles)
+	if !*dumpPerClient {
+		w, err := makePcapWriter(*dumpPackets, files, false)
+		if err != nil {
+			log.Fatalf("failed to open pcap file for write: %v", err)
+		}
+		return phys.NewPcapgoSink(w, phys.FramerEthernetII)
+	}
+	ext := filepath.Ext(*dumpPackets)
+	stem := strings.TrimSuffix(*dumpPackets, ext)
+	// A client that reconnects gets a new file rather than replacing
+	// the one from its earlier session.
+	return phys.NewSplitSink(func(addr ipx.Addr) (*phys.Sink, error) {
+		addrStr := strings.ReplaceAll(addr.String(), ":", "-")
+		w, err := makePcapWriter(fmt.Sprintf("%s-%s%s", stem, addrStr, ext), files, true)
+		if err != nil {
+			logger.Warn("failed to open pcap file",
+				"ipx_address", addr.String(), "err", err)
+			return nil, err
+		}
+		return phys.NewPcapgoSink(w, phys.FramerEthernetII), nil
+	}, *clientTimeout)
 }
 
-func makeNetwork(ctx context.Context) (network.Network, network.Network) {
+func makeNetwork(ctx context.Context, logger *slog.Logger) (network.Network, network.Network, *ipxswitch.Network) {
 	// We build the network up in layers, each layer adding an extra
 	// feature. This approach allows for modularity and separation of
 	// concerns, avoiding the complexity of a big monolithic system.
@@ -75,93 +405,288 @@ func makeNetwork(ctx context.Context) (network.Network, network.Network) {
 	//  3. Increment receive statistics (stats)
 	//  4. Drop packet if a NetBIOS packet (filter)
 	//  5. Fork incoming traffic to any network taps (tappable)
-	//  6. Forward to receive queue(s) of other clients (ipxswitch)
+	//  6. Drop packet if it has looped back from another segment (splithorizon)
+	//  7. Forward to receive queue(s) of other clients (ipxswitch)
 	// Then back out the other way (tx):
 	//  1. Read packet from receive queue (ipxswitch)
-	//  2. No-op (tappable)
-	//  3. Filter NetBIOS packets (filter)
-	//  4. Increment transmit statistics (stats)
-	//  5. Check dest address matches client address (addressable)
-	//  5. ReadPacket() by server, and transmit to client.
+	//  2. Drop packet if going back to its source segment (splithorizon)
+	//  3. No-op (tappable)
+	//  4. Filter NetBIOS packets (filter)
+	//  5. Increment transmit statistics (stats)
+	//  6. Check dest address matches client address (addressable)
+	//  7. ReadPacket() by server, and transmit to client.
 	var net network.Network
-	net = ipxswitch.New()
-	if *dumpPackets != "" {
+	sw := ipxswitch.New(*bufferPackets)
+	sw.SetBroadcastLimit(*broadcastLimit)
+	sw.SetDropTimeout(*dropTimeout)
+	if *lowPriority != "" {
+		sockets, err := filter.ParsePorts(*lowPriority)
+		if err != nil {
+			log.Fatalf("failed to parse --low_priority_sockets: %v", err)
+		}
+		sw.SetClassifier(pipe.SocketClassifier(sockets))
+	}
+	net = sw
+	if *splitHorizon {
+		net = splithorizon.Wrap(net, splithorizon.DefaultAgeTime)
+	}
+	if *dumpPackets != "" || *printPackets {
 		tappableLayer := tappable.Wrap(net)
-		w := makePcapWriter()
-		sink := phys.NewPcapgoSink(w, phys.FramerEthernetII)
-		go ipx.CopyPackets(ctx, tappableLayer.NewTap(), sink)
+		if *dumpPackets != "" {
+			go ipx.CopyPackets(ctx, tappableLayer.NewTap(), makePcapSink(logger))
+		}
+		if *printPackets {
+			go printTap(ctx, tappableLayer.NewTap(), os.Stdout)
+		}
 		net = tappableLayer
 	}
 	if !*allowNetBIOS {
-		net = filter.Wrap(net)
+		ports, err := filter.ParsePorts(*blockedPorts)
+		if err != nil {
+			log.Fatalf("failed to parse --blocked_ports: %v", err)
+		}
+		// SAP and RIP are normally filtered, but if we are
+		// responding to them ourselves then clients must be able
+		// to send queries and receive our responses.
+		if *enableSAP {
+			delete(ports, sap.SAPSocket)
+			delete(ports, sap.RIPSocket)
+		}
+		dir, err := filter.ParseDirection(*filterDirection)
+		if err != nil {
+			log.Fatalf("failed to parse --filter_direction: %v", err)
+		}
+		var filterLogger *slog.Logger
+		if *logFiltered {
+			filterLogger = logger
+			if filterLogger == nil {
+				filterLogger = slog.Default()
+			}
+		}
+		net = filter.WrapWithLogger(net, ports, dir, filterLogger)
 	}
 	uplinkable := net
-	net = addressable.Wrap(net)
+	if *addressPool != "" {
+		pool, err := addressable.ParsePool(*addressPool, !*sequentialAddrs)
+		if err != nil {
+			log.Fatalf("failed to parse --address_pool: %v", err)
+		}
+		net = addressable.WrapWithSource(net, pool)
+	} else {
+		net = addressable.Wrap(net)
+	}
 	net = stats.Wrap(net)
-	return net, stats.Wrap(uplinkable)
+	return net, stats.Wrap(uplinkable), sw
+}
+
+// listenAddress returns the address for the servers to listen on for the
+// given port, taking --bind into account.
+func listenAddress(port int) string {
+	// An empty host means to listen on all addresses.
+	return stdnet.JoinHostPort(*bindAddress, strconv.Itoa(port))
 }
 
 func main() {
 	physFlags := phys.RegisterFlags()
 	flag.Parse()
 
-	ctx := context.Background()
+	if *quakeIdleTimeout <= 0 {
+		log.Fatalf("--quake_idle_timeout (%s) must be positive", *quakeIdleTimeout)
+	}
+	if *mtu < ipx.HeaderLength || *mtu > ipx.MaxPacketLength {
+		log.Fatalf("--mtu (%d) must be between %d and %d", *mtu, ipx.HeaderLength, ipx.MaxPacketLength)
+	}
+	if *challengeLength < uplink.MinChallengeLength {
+		log.Fatalf("--challenge_length (%d) must be at least %d", *challengeLength, uplink.MinChallengeLength)
+	}
+	// A client that is connected but quiet is only kept alive by its
+	// replies to our keepalive pings, so they must be sent more often
+	// than the timeout.
+	if *keepaliveTime <= 0 || *keepaliveTime >= *clientTimeout {
+		log.Fatalf("--keepalive_time (%s) must be positive and shorter than --client_timeout (%s)", *keepaliveTime, *clientTimeout)
+	}
+	if *uplinkPort != 0 && *uplinkPassword == "" && *uplinkCredentials == "" {
+		log.Fatalf("--uplink_port requires --uplink_password or --uplink_credentials")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	var logger *log.Logger
+	var logger *slog.Logger
 	if *enableSyslog {
-		var err error
-		logger, err = syslog.NewLogger(
+		syslogger, err := syslog.NewLogger(
 			syslog.LOG_NOTICE|syslog.LOG_DAEMON, 0)
 		if err != nil {
 			log.Fatalf("failed to init syslog: %v", err)
 		}
+		logger = slog.New(slog.NewTextHandler(syslogger.Writer(), nil))
 	}
 
-	net, uplinkable := makeNetwork(ctx)
+	net, uplinkable, sw := makeNetwork(ctx, logger)
+	mon := makeMonitor(ctx, logger)
+	registry := makeAdminServer(sw)
+	auditor := makeAuditLog(logger)
 
-	physLink, err := physFlags.MakePhys(*enableIpxpkt)
+	physLink, err := physFlags.MakePhys(*enableIpxpkt, logger)
 	if err != nil {
 		log.Fatalf("failed to set up physical network: %v", err)
 	} else if physLink != nil {
+		link, err := physFlags.WrapNAT(physLink)
+		if err != nil {
+			log.Fatalf("invalid --nat_address: %v", err)
+		}
 		port := uplinkable.NewNode()
-		go physLink.Run()
-		go ipx.DuplexCopyPackets(ctx, physLink, port)
+		registry.SetBridge(func() admin.BridgeStatus {
+			return admin.BridgeStatus(physLink.Status())
+		})
+		go func() {
+			// Without this, a failed link would look just like
+			// a quiet network, so it is logged even without
+			// syslog.
+			if err := physLink.Run(); err != nil {
+				physLogger := logger
+				if physLogger == nil {
+					physLogger = slog.Default()
+				}
+				physLogger.Error("physical network link failed", "err", err)
+			}
+		}()
+		go ipx.DuplexCopyPackets(ctx, link, port)
 		if *enableIpxpkt {
-			r := ipxpkt.NewRouter(net.NewNode())
+			framing, err := ipxpkt.ParseFraming(*ipxpktFraming)
+			if err != nil {
+				log.Fatalf("failed to parse --ipxpkt_framing: %v", err)
+			}
+			r := ipxpkt.NewRouter(newNode(net.NewNode(), "ipxpkt router"), framing)
+			if err := r.SetFragmentSize(*ipxpktFragSize); err != nil {
+				log.Fatalf("invalid --ipxpkt_fragment_size: %v", err)
+			}
 			go phys.CopyFrames(r, physLink.NonIPX())
+			go logIpxpktStats(ctx, r, logger)
 		}
 	}
-	addQuakeProxies(ctx, net)
+	addQuakeProxies(ctx, net, logger)
+	addSAPResponder(ctx, net)
+	startReplay(ctx, uplinkable, logger)
+	addEchoService(ctx, net)
+	var servers []drainable
 	if *enablePPTP {
 		pptps, err := pptp.NewServer(net)
 		if err != nil {
 			log.Fatalf("failed to start PPTP server: %v", err)
 		}
+		pptps.SetDiscardInterval(*pptpDiscardTime)
+		pptps.SetLogger(logger)
+		pptps.SetAudit(auditor)
+		servers = append(servers, pptps)
 		go pptps.Run(ctx)
 	}
 
+	// Without syslog, connects and disconnects are not logged, but
+	// warnings about misbehaving clients still go to stderr since they
+	// are often the only clue when a client cannot connect.
+	dosboxLogger := logger
+	if dosboxLogger == nil {
+		dosboxLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: slog.LevelWarn,
+		}))
+	}
 	protocols := []server.Protocol{
 		&dosbox.Protocol{
-			Logger:        logger,
-			Network:       net,
-			KeepaliveTime: 5 * time.Second,
+			Logger:          dosboxLogger,
+			Network:         net,
+			KeepaliveTime:   *keepaliveTime,
+			Monitor:         mon,
+			Registry:        registry,
+			Audit:           auditor,
+			DejitterDepth:   *dejitterDepth,
+			DejitterMaxHold: *dejitterMaxHold,
 		},
 	}
-	if *uplinkPassword != "" {
-		protocols = append(protocols, &uplink.Protocol{
-			Logger:        logger,
-			Network:       uplinkable,
-			Password:      *uplinkPassword,
-			KeepaliveTime: 5 * time.Second,
+	var uplinkProtocols []server.Protocol
+	if *uplinkPassword != "" || *uplinkCredentials != "" {
+		p := &uplink.Protocol{
+			Logger:          logger,
+			Network:         uplinkable,
+			Password:        *uplinkPassword,
+			KeepaliveTime:   *keepaliveTime,
+			Monitor:         mon,
+			Registry:        registry,
+			Audit:           auditor,
+			ChallengeLength: *challengeLength,
+		}
+		if *uplinkCredentials != "" {
+			// Read errors are logged even without syslog, since
+			// every uplink is rejected until they are fixed.
+			credentialsLogger := logger
+			if credentialsLogger == nil {
+				credentialsLogger = slog.Default()
+			}
+			credentials, err := uplink.CredentialsFile(*uplinkCredentials, credentialsLogger)
+			if err != nil {
+				log.Fatalf("failed to read --uplink_credentials: %v", err)
+			}
+			p.Credentials = credentials
+		}
+		uplinkProtocols = append(uplinkProtocols, p)
+	}
+	config := &server.Config{
+		Protocols:      protocols,
+		ClientTimeout:  *clientTimeout,
+		Logger:         logger,
+		Network:        *udpNetwork,
+		Monitor:        mon,
+		MTU:            *mtu,
+		AllowMigration: *migrateClients,
+	}
+	// Each server has its own set of protocols, but they all share the
+	// same network. Unless uplinks have their own port, they are
+	// accepted on the same ports as DOSBox clients.
+	allConfig := *config
+	allConfig.Protocols = append(append([]server.Protocol{}, protocols...), uplinkProtocols...)
+	if *uplinkPort == 0 {
+		config = &allConfig
+	} else {
+		uplinkConfig := *config
+		uplinkConfig.Protocols = uplinkProtocols
+		us, err := server.New(listenAddress(*uplinkPort), &uplinkConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, us)
+		go us.Run(ctx)
+	}
+	if *tcpPort != 0 {
+		ts, err := tcpserver.New(listenAddress(*tcpPort), config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, ts)
+		go ts.Run(ctx)
+	}
+	if *tlsPort != 0 {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			log.Fatalf("failed to load --tls_cert/--tls_key: %v", err)
+		}
+		ts, err := tcpserver.NewTLS(listenAddress(*tlsPort), &allConfig, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
 		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, ts)
+		go ts.Run(ctx)
 	}
-	s, err := server.New(fmt.Sprintf(":%d", *port), &server.Config{
-		Protocols:     protocols,
-		ClientTimeout: *clientTimeout,
-		Logger:        logger,
-	})
+	s, err := server.New(listenAddress(*port), config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	servers = append(servers, s)
+	registry.SetHealthCheck(s.Healthy)
+	registry.SetDrainCheck(s.Draining)
+	go drainOnSignal(servers, logger)
+	go shutdownOnSignal(cancel, servers, logger)
 	s.Run(ctx)
 }
@@ -1,14 +1,22 @@
 package ipxpkt
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/fragglet/ipxbox/budget"
 	"github.com/fragglet/ipxbox/ipx"
 )
 
 const (
+	// DefaultFragmentSize is the default maximum fragment payload size.
 	// This should match the maximum used by ipxpkt.com:
-	maxFragmentPayload = 510
+	DefaultFragmentSize = 510
+
+	// maxIPXPacket is the largest IPX packet that can be carried over
+	// Ethernet or the DOSbox UDP protocol.
+	maxIPXPacket = 1500
 
 	// maxFrames is the maximum number of frames we store for reassembly
 	// at any given time.
@@ -17,8 +25,43 @@ const (
 	// maxAge is the maximum amount of time that we hold a frame for
 	// reassembly before giving up and flushing it.
 	maxAge = 10 * time.Second
+
+	// ipxHeaderLength is the same as ipx.HeaderLength, which is not a
+	// constant.
+	ipxHeaderLength = 30
+
+	// MaxFragmentSize is the largest fragment payload that can be sent
+	// while keeping packets within maxIPXPacket, allowing for the
+	// optional trailer.
+	MaxFragmentSize = maxIPXPacket - ipxHeaderLength - trailBytes - HeaderLength
 )
 
+// ReassemblyStats contains counters describing how well fragmented frames
+// are being reassembled.
+type ReassemblyStats struct {
+	// Completed counts the number of frames that were received in full.
+	Completed uint64
+
+	// Flushed counts the number of frames that were discarded before all
+	// of their fragments were received, either because they aged out or
+	// to make space for other frames.
+	Flushed uint64
+
+	// OutOfOrder counts the number of fragments that were received
+	// before an earlier fragment of the same frame.
+	OutOfOrder uint64
+
+	// Dropped counts the number of fragments that were discarded without
+	// being stored, because they were inconsistent with other fragments
+	// of the same frame or because there was no memory to hold them.
+	Dropped uint64
+}
+
+func (s *ReassemblyStats) String() string {
+	return fmt.Sprintf("%d frames completed, %d flushed incomplete, %d fragments out of order, %d fragments dropped",
+		s.Completed, s.Flushed, s.OutOfOrder, s.Dropped)
+}
+
 type frameKey struct {
 	src      ipx.HeaderAddr
 	packetID uint16
@@ -27,19 +70,50 @@ type frameKey struct {
 type frameData struct {
 	fragments [][]byte
 	lastRX    time.Time
+	// bytes is the number of bytes reserved from the budget for the
+	// fragments held in this frame.
+	bytes int
 }
 
 type frameReassembler struct {
 	frames map[frameKey]*frameData
+	budget *budget.Budget
+
+	// mu protects stats, which may be read from other goroutines.
+	mu    sync.Mutex
+	stats ReassemblyStats
 }
 
-func (fd *frameData) processFragment(hdr *Header, fragment []byte) ([]byte, bool) {
-	// Sanity check first:
-	if int(hdr.NumFragments) != len(fd.fragments) {
-		return nil, false
-	}
+// count increments a counter in the stats.
+func (fr *frameReassembler) count(counter *uint64) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	*counter++
+}
+
+// Stats returns a snapshot of the reassembly counters.
+func (fr *frameReassembler) Stats() ReassemblyStats {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.stats
+}
+
+// processFragment stores the given fragment in the frame. The caller must
+// already have reserved space in the budget for the fragment.
+func (fr *frameReassembler) processFragment(fd *frameData, hdr *Header, fragment []byte) ([]byte, bool) {
 	fd.lastRX = time.Now()
+	if old := fd.fragments[hdr.Fragment-1]; old != nil {
+		fr.budget.Release(len(old))
+		fd.bytes -= len(old)
+	}
+	for _, f := range fd.fragments[:hdr.Fragment-1] {
+		if f == nil {
+			fr.count(&fr.stats.OutOfOrder)
+			break
+		}
+	}
 	fd.fragments[hdr.Fragment-1] = append([]byte{}, fragment...)
+	fd.bytes += len(fragment)
 	for _, f := range fd.fragments {
 		if f == nil {
 			return nil, false
@@ -52,8 +126,33 @@ func (fd *frameData) processFragment(hdr *Header, fragment []byte) ([]byte, bool
 	return result, true
 }
 
-func (fr *frameReassembler) init() {
+func (fr *frameReassembler) init(b *budget.Budget) {
 	fr.frames = make(map[frameKey]*frameData)
+	fr.budget = b
+}
+
+// deleteFrame removes the given frame, returning its memory to the budget.
+func (fr *frameReassembler) deleteFrame(key frameKey) {
+	fd, ok := fr.frames[key]
+	if !ok {
+		return
+	}
+	fr.budget.Release(fd.bytes)
+	delete(fr.frames, key)
+}
+
+// reserve reserves the given number of bytes from the budget. If the budget
+// is exhausted, frames are evicted to free up space; if this reassembler
+// holds no more frames, false is returned and the caller should drop the
+// fragment.
+func (fr *frameReassembler) reserve(n int) bool {
+	for !fr.budget.Reserve(n) {
+		if len(fr.frames) == 0 {
+			return false
+		}
+		fr.flush()
+	}
+	return true
 }
 
 // flush empties out old frames from the queue that are older than maxAge. If
@@ -73,24 +172,41 @@ func (fr *frameReassembler) flush() {
 		}
 	}
 	for _, key := range flushKeys {
-		delete(fr.frames, key)
+		fr.deleteFrame(key)
+		fr.budget.Evicted()
+		fr.count(&fr.stats.Flushed)
 	}
 	// We always flush at least one frame from the queue to make space.
-	if len(flushKeys) == 0 {
-		delete(fr.frames, oldest)
+	if len(flushKeys) == 0 && len(fr.frames) > 0 {
+		fr.deleteFrame(oldest)
+		fr.budget.Evicted()
+		fr.count(&fr.stats.Flushed)
 	}
 }
 
 func (fr *frameReassembler) reassemble(ipxHeader *ipx.Header, hdr *Header, fragment []byte) ([]byte, bool) {
 	// Simplest optimization, no reassembly required:
 	if hdr.NumFragments == 1 {
+		fr.count(&fr.stats.Completed)
 		return fragment, true
 	}
 	key := frameKey{
 		src:      ipxHeader.Src,
 		packetID: hdr.PacketID,
 	}
+	// Space is reserved before looking up the frame, since reserving
+	// may evict frames (possibly including this one).
+	if !fr.reserve(len(fragment)) {
+		fr.count(&fr.stats.Dropped)
+		return nil, false
+	}
 	fd, ok := fr.frames[key]
+	// Sanity check first:
+	if ok && int(hdr.NumFragments) != len(fd.fragments) {
+		fr.budget.Release(len(fragment))
+		fr.count(&fr.stats.Dropped)
+		return nil, false
+	}
 	// First fragment of frame?
 	if !ok {
 		if len(fr.frames) >= maxFrames {
@@ -101,22 +217,23 @@ func (fr *frameReassembler) reassemble(ipxHeader *ipx.Header, hdr *Header, fragm
 		}
 		fr.frames[key] = fd
 	}
-	result, ok := fd.processFragment(hdr, fragment)
+	result, ok := fr.processFragment(fd, hdr, fragment)
 	if !ok {
 		return nil, false
 	}
-	delete(fr.frames, key)
+	fr.deleteFrame(key)
+	fr.count(&fr.stats.Completed)
 	return result, true
 }
 
 // fragmentFrame breaks the packet in the given slice into one or more smaller
-// slices, none of which is larger than maxFragmentPayload in length.
-func fragmentFrame(frame []byte) [][]byte {
-	numFragments := (len(frame) + maxFragmentPayload - 1) / maxFragmentPayload
+// slices, none of which is larger than fragmentSize in length.
+func fragmentFrame(frame []byte, fragmentSize int) [][]byte {
+	numFragments := (len(frame) + fragmentSize - 1) / fragmentSize
 	result := make([][]byte, numFragments)
 	offset := 0
 	for i := 0; i < numFragments; i++ {
-		nextOffset := offset + maxFragmentPayload
+		nextOffset := offset + fragmentSize
 		if nextOffset > len(frame) {
 			nextOffset = len(frame)
 		}
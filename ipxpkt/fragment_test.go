@@ -0,0 +1,125 @@
+package ipxpkt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fragglet/ipxbox/budget"
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func makeHeader(srcID int) *ipx.Header {
+	hdr := &ipx.Header{}
+	hdr.Src.Addr = ipx.Addr{0x02, 0, 0, 0, byte(srcID >> 8), byte(srcID)}
+	hdr.Src.Socket = ipxSocket
+	return hdr
+}
+
+func TestReassembly(t *testing.T) {
+	var fr frameReassembler
+	b := budget.New(budget.DefaultLimit)
+	fr.init(b)
+	frame := bytes.Repeat([]byte("abcdefghijk"), 200)
+	fragments := fragmentFrame(frame, DefaultFragmentSize)
+	var result []byte
+	for i, frag := range fragments {
+		hdr := &Header{
+			Fragment:     uint8(i + 1),
+			NumFragments: uint8(len(fragments)),
+			PacketID:     1234,
+		}
+		var complete bool
+		result, complete = fr.reassemble(makeHeader(1), hdr, frag)
+		if complete != (i == len(fragments)-1) {
+			t.Fatalf("fragment %d/%d: complete=%v", i+1, len(fragments), complete)
+		}
+	}
+	if !bytes.Equal(result, frame) {
+		t.Errorf("wrong reassembled frame: want %v, got %v", frame, result)
+	}
+	if stats := b.Stats(); stats.InUse != 0 {
+		t.Errorf("memory still reserved after reassembly: %s", stats.String())
+	}
+}
+
+func TestPartialFrameFlood(t *testing.T) {
+	const limit = 16 * 1024
+	b := budget.New(limit)
+	reassemblers := make([]frameReassembler, 4)
+	for i := range reassemblers {
+		reassemblers[i].init(b)
+	}
+	fragment := make([]byte, DefaultFragmentSize)
+	for i := 0; i < 10000; i++ {
+		fr := &reassemblers[i%len(reassemblers)]
+		hdr := &Header{
+			Fragment:     1,
+			NumFragments: 2,
+			PacketID:     uint16(i),
+		}
+		if _, complete := fr.reassemble(makeHeader(i), hdr, fragment); complete {
+			t.Fatalf("partial frame %d was reported as complete", i)
+		}
+		if stats := b.Stats(); stats.InUse > limit {
+			t.Fatalf("budget exceeded after %d partial frames: %s", i, stats.String())
+		}
+		if len(fr.frames) > maxFrames {
+			t.Fatalf("too many frames held after %d partial frames: %d > %d", i, len(fr.frames), maxFrames)
+		}
+	}
+	stats := b.Stats()
+	if stats.Evictions == 0 {
+		t.Errorf("want evictions when budget is exhausted, got %s", stats.String())
+	}
+	inUse := 0
+	for i := range reassemblers {
+		for _, fd := range reassemblers[i].frames {
+			inUse += fd.bytes
+		}
+	}
+	if inUse != stats.InUse {
+		t.Errorf("budget out of sync with buffered frames: %d bytes buffered, %s", inUse, stats.String())
+	}
+}
+
+func TestReassemblyStats(t *testing.T) {
+	var fr frameReassembler
+	fr.init(budget.New(budget.DefaultLimit))
+	frame := bytes.Repeat([]byte("abcdefghijk"), 200)
+	fragments := fragmentFrame(frame, DefaultFragmentSize)
+	// Deliver the fragments of one frame in reverse order.
+	for i := len(fragments) - 1; i >= 0; i-- {
+		hdr := &Header{
+			Fragment:     uint8(i + 1),
+			NumFragments: uint8(len(fragments)),
+			PacketID:     1,
+		}
+		fr.reassemble(makeHeader(1), hdr, fragments[i])
+	}
+	// Start more frames than can be held, which will never be completed.
+	for i := 0; i <= maxFrames; i++ {
+		hdr := &Header{
+			Fragment:     1,
+			NumFragments: 2,
+			PacketID:     uint16(100 + i),
+		}
+		fr.reassemble(makeHeader(1), hdr, fragments[0])
+	}
+	// A fragment inconsistent with the rest of its frame is dropped.
+	hdr := &Header{
+		Fragment:     1,
+		NumFragments: 3,
+		PacketID:     uint16(100 + maxFrames),
+	}
+	fr.reassemble(makeHeader(1), hdr, fragments[0])
+
+	want := ReassemblyStats{
+		Completed:  1,
+		Flushed:    1,
+		OutOfOrder: uint64(len(fragments) - 1),
+		Dropped:    1,
+	}
+	if got := fr.Stats(); got != want {
+		t.Errorf("wrong stats: want %s, got %s", want.String(), got.String())
+	}
+}
@@ -38,7 +38,7 @@ func (h *Header) UnmarshalBinary(packet []byte) error {
 	}
 	h.Fragment = packet[0]
 	h.NumFragments = packet[1]
-	h.PacketID = uint16(packet[2]) | uint16(packet[3]<<8)
+	h.PacketID = uint16(packet[2]) | uint16(packet[3])<<8
 	if h.Fragment < 1 || h.NumFragments < 1 || h.Fragment > h.NumFragments {
 		return fmt.Errorf("bad ipxpkt header violates invariants: %+v", h)
 	}
@@ -5,8 +5,10 @@ package ipxpkt
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/fragglet/ipxbox/budget"
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/phys"
@@ -23,6 +25,48 @@ var (
 	_ = (phys.DuplexEthernetStream)(&Router{})
 )
 
+// Framing specifies which variant of the ipxpkt protocol is used. Some
+// versions of IPXPKT.COM send 32 bytes of padding ("trailer") before the
+// fragment header of every packet, while others do not.
+type Framing int
+
+const (
+	// FramingAuto detects the variant used by each node from the
+	// packets that it sends. Packets are sent with the trailer to nodes
+	// that have not yet been detected, and to the broadcast address.
+	FramingAuto Framing = iota
+
+	// FramingTrailer always uses the variant with the trailer.
+	FramingTrailer
+
+	// FramingNoTrailer always uses the variant without the trailer.
+	FramingNoTrailer
+)
+
+func (f Framing) String() string {
+	switch f {
+	case FramingAuto:
+		return "auto"
+	case FramingTrailer:
+		return "trailer"
+	case FramingNoTrailer:
+		return "notrailer"
+	default:
+		return fmt.Sprintf("Framing(%d)", int(f))
+	}
+}
+
+// ParseFraming parses the name of an ipxpkt framing variant; valid names are
+// "auto", "trailer" and "notrailer".
+func ParseFraming(s string) (Framing, error) {
+	for _, f := range []Framing{FramingAuto, FramingTrailer, FramingNoTrailer} {
+		if s == f.String() {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ipxpkt framing %q: want \"auto\", \"trailer\" or \"notrailer\"", s)
+}
+
 // Router implements the ipxpkt protocol and implements the same
 // DuplexEthernetStream interface as a real physical Ethernet link;
 // it communicates by sending and receiving IPX packets.
@@ -30,22 +74,82 @@ type Router struct {
 	node          network.Node
 	packetCounter uint16
 	fr            frameReassembler
+	framing       Framing
+	table         *routingTable
+	fragmentSize  int
+
+	mu sync.Mutex
+	// detected is the framing variant detected for each node when using
+	// FramingAuto.
+	detected map[ipx.Addr]Framing
 }
 
 func (r *Router) Close() {
 	r.node.Close()
 }
 
+// validHeaderAt returns true if a valid fragment header can be decoded at the
+// given offset into the payload.
+func validHeaderAt(payload []byte, offset int) bool {
+	if len(payload) < offset+HeaderLength {
+		return false
+	}
+	var hdr Header
+	return hdr.UnmarshalBinary(payload[offset:]) == nil
+}
+
+// detectFraming returns the framing variant to use to decode the given
+// packet. In auto mode, the variant is determined by checking where a valid
+// header can be found; if this is ambiguous, the variant previously
+// detected for the source node is used.
+func (r *Router) detectFraming(packet *ipx.Packet) Framing {
+	if r.framing != FramingAuto {
+		return r.framing
+	}
+	withTrailer := validHeaderAt(packet.Payload, trailBytes)
+	withoutTrailer := validHeaderAt(packet.Payload, 0)
+	src := packet.Header.Src.Addr
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case withTrailer && !withoutTrailer:
+		r.detected[src] = FramingTrailer
+	case withoutTrailer && !withTrailer:
+		r.detected[src] = FramingNoTrailer
+	}
+	if f, ok := r.detected[src]; ok {
+		return f
+	}
+	return FramingTrailer
+}
+
+// framingFor returns the framing variant to use when sending to the given
+// node.
+func (r *Router) framingFor(dest ipx.Addr) Framing {
+	if r.framing != FramingAuto {
+		return r.framing
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.detected[dest]; ok {
+		return f
+	}
+	return FramingTrailer
+}
+
 func (r *Router) unwrapFrame(packet *ipx.Packet) ([]byte, error) {
 	if packet.Header.Dest.Socket != ipxSocket {
 		return nil, fmt.Errorf("not an ipxpkt fragment; destination socket %d != %d", packet.Header.Dest.Socket, ipxSocket)
 	}
 
-	// TODO: Support ipxpkt version without trail bytes
-	if len(packet.Payload) < trailBytes+HeaderLength {
-		return nil, fmt.Errorf("inner packet too short: %d < %d", len(packet.Payload), trailBytes+HeaderLength)
+	framing := r.detectFraming(packet)
+	payload := packet.Payload
+	if framing == FramingTrailer {
+		if len(payload) < trailBytes+HeaderLength {
+			return nil, fmt.Errorf("inner packet too short: %d < %d", len(payload), trailBytes+HeaderLength)
+		}
+		payload = payload[trailBytes:]
 	}
-	payload := packet.Payload[trailBytes:]
 
 	var hdr Header
 	if err := hdr.UnmarshalBinary(payload); err != nil {
@@ -55,9 +159,29 @@ func (r *Router) unwrapFrame(packet *ipx.Packet) ([]byte, error) {
 	if !complete {
 		return nil, fmt.Errorf("incomplete frame")
 	}
+	r.table.Record(frame, packet.Header.Src.Addr)
 	return frame, nil
 }
 
+// SetFragmentSize sets the maximum payload size of the fragments that
+// frames are broken into when they are sent. Larger fragments reduce
+// overhead, but not all versions of IPXPKT.COM may accept fragments larger
+// than DefaultFragmentSize. Fragments of any size are always accepted when
+// receiving.
+func (r *Router) SetFragmentSize(n int) error {
+	if n < 1 || n > MaxFragmentSize {
+		return fmt.Errorf("invalid fragment size %d: must be between 1 and %d", n, MaxFragmentSize)
+	}
+	r.fragmentSize = n
+	return nil
+}
+
+// ReassemblyStats returns a snapshot of the counters describing the
+// reassembly of fragmented frames received by the router.
+func (r *Router) ReassemblyStats() ReassemblyStats {
+	return r.fr.Stats()
+}
+
 // readFrame reads an Ethernet frame from the router; it will block until
 // a complete frame arrives from another node.
 func (r *Router) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
@@ -92,18 +216,21 @@ func (r *Router) WritePacketData(frame []byte) error {
 			Socket: ipxSocket,
 		},
 		Dest: ipx.HeaderAddr{
-			// Addr: - is set below
+			Addr:   r.table.LookupDest(frame),
 			Socket: ipxSocket,
 		},
 		Checksum: 0xffff,
 	}
-	// TODO: Hardware address from Ethernet frame may not match the IPX
-	// address to forward to. This needs a routing table implementation
-	// equivalent to what ipxpkt does.
-	copy(hdr1.Dest.Addr[:], frame[0:6])
 
 	r.packetCounter++
-	fragments := fragmentFrame(frame)
+	fragments := fragmentFrame(frame, r.fragmentSize)
+	if len(fragments) > 255 {
+		return fmt.Errorf("frame of %d bytes needs too many fragments (%d)", len(frame), len(fragments))
+	}
+	trailLen := 0
+	if r.framingFor(hdr1.Dest.Addr) == FramingTrailer {
+		trailLen = trailBytes
+	}
 
 	hdr2 := &Header{
 		NumFragments: uint8(len(fragments)),
@@ -111,10 +238,8 @@ func (r *Router) WritePacketData(frame []byte) error {
 	}
 
 	for fragIndex, frag := range fragments {
-		hdr1.Length = uint16(ipx.HeaderLength + HeaderLength + trailBytes + len(frag))
-		// TODO: Support non-trail version of ipxpkt
-		var trail [trailBytes]byte
-		data := append([]byte{}, trail[:]...)
+		hdr1.Length = uint16(ipx.HeaderLength + HeaderLength + trailLen + len(frag))
+		data := make([]byte, trailLen)
 
 		hdr2.Fragment = uint8(fragIndex + 1)
 		data2, err := hdr2.MarshalBinary()
@@ -138,10 +263,16 @@ func (r *Router) WritePacketData(frame []byte) error {
 	return nil
 }
 
-func NewRouter(node network.Node) *Router {
+// NewRouter creates a new Router that sends and receives packets using the
+// given node and the given variant of the ipxpkt protocol.
+func NewRouter(node network.Node, framing Framing) *Router {
 	r := &Router{
-		node: node,
+		node:         node,
+		framing:      framing,
+		detected:     make(map[ipx.Addr]Framing),
+		table:        makeRoutingTable(),
+		fragmentSize: DefaultFragmentSize,
 	}
-	r.fr.init()
+	r.fr.init(budget.Default)
 	return r
 }
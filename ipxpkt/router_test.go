@@ -0,0 +1,144 @@
+package ipxpkt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func makeFragmentPacket(srcID int, trailer bool, payload []byte) *ipx.Packet {
+	hdr := &Header{
+		Fragment:     1,
+		NumFragments: 1,
+		PacketID:     uint16(srcID),
+	}
+	data := []byte{}
+	if trailer {
+		data = make([]byte, trailBytes)
+	}
+	hdrBytes, _ := hdr.MarshalBinary()
+	data = append(data, hdrBytes...)
+	data = append(data, payload...)
+	packet := &ipx.Packet{
+		Header:  *makeHeader(srcID),
+		Payload: data,
+	}
+	packet.Header.Dest.Socket = ipxSocket
+	return packet
+}
+
+func TestFramingDetection(t *testing.T) {
+	frame := bytes.Repeat([]byte("ethernet frame "), 10)
+	for _, tc := range []struct {
+		framing Framing
+		trailer bool
+		want    Framing
+	}{
+		{FramingAuto, true, FramingTrailer},
+		{FramingAuto, false, FramingNoTrailer},
+		{FramingTrailer, true, FramingTrailer},
+		{FramingNoTrailer, false, FramingNoTrailer},
+	} {
+		r := NewRouter(nil, tc.framing)
+		packet := makeFragmentPacket(1, tc.trailer, frame)
+		result, err := r.unwrapFrame(packet)
+		if err != nil {
+			t.Errorf("framing=%s, trailer=%v: unwrapFrame failed: %v", tc.framing, tc.trailer, err)
+			continue
+		}
+		if !bytes.Equal(result, frame) {
+			t.Errorf("framing=%s, trailer=%v: wrong frame: want %v, got %v", tc.framing, tc.trailer, frame, result)
+		}
+		if got := r.framingFor(packet.Header.Src.Addr); got != tc.want {
+			t.Errorf("framing=%s, trailer=%v: want replies with %s, got %s", tc.framing, tc.trailer, tc.want, got)
+		}
+	}
+}
+
+func TestHeaderPacketID(t *testing.T) {
+	hdr := &Header{Fragment: 1, NumFragments: 2, PacketID: 0x1234}
+	data, _ := hdr.MarshalBinary()
+	var hdr2 Header
+	if err := hdr2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if hdr2 != *hdr {
+		t.Errorf("header did not round trip: want %+v, got %+v", hdr, hdr2)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	mac := []byte{0x02, 0xaa, 0xbb, 0xcc, 0xdd, 0xee}
+	frame := append([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, mac...)
+	frame = append(frame, []byte("payload")...)
+	r := NewRouter(nil, FramingAuto)
+	packet := makeFragmentPacket(1, true, frame)
+	if _, err := r.unwrapFrame(packet); err != nil {
+		t.Fatalf("unwrapFrame failed: %v", err)
+	}
+	reply := append(append([]byte{}, mac...), 0x02, 0, 0, 0, 0, 1)
+	if got, want := r.table.LookupDest(reply), packet.Header.Src.Addr; got != want {
+		t.Errorf("wrong destination for learned address: want %s, got %s", want, got)
+	}
+	unknown := []byte{0x02, 1, 2, 3, 4, 5, 0x02, 0, 0, 0, 0, 1}
+	if got := r.table.LookupDest(unknown); got != ipx.AddrBroadcast {
+		t.Errorf("want broadcast for unknown address, got %s", got)
+	}
+	if got := r.table.LookupDest(frame); got != ipx.AddrBroadcast {
+		t.Errorf("want broadcast for broadcast frame, got %s", got)
+	}
+}
+
+// captureNode is a network.Node that records the packets written to it.
+type captureNode struct {
+	packets []*ipx.Packet
+}
+
+func (n *captureNode) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (n *captureNode) WritePacket(packet *ipx.Packet) error {
+	n.packets = append(n.packets, packet)
+	return nil
+}
+
+func (n *captureNode) Close() error                   { return nil }
+func (n *captureNode) GetProperty(x interface{}) bool { return false }
+
+func TestFragmentSize(t *testing.T) {
+	const fragmentSize = 1000
+	frame := bytes.Repeat([]byte("large ethernet frame "), 72)
+	node := &captureNode{}
+	r := NewRouter(node, FramingNoTrailer)
+	if err := r.SetFragmentSize(MaxFragmentSize + 1); err == nil {
+		t.Errorf("fragment size larger than %d was accepted", MaxFragmentSize)
+	}
+	if err := r.SetFragmentSize(fragmentSize); err != nil {
+		t.Fatalf("SetFragmentSize failed: %v", err)
+	}
+	if err := r.WritePacketData(frame); err != nil {
+		t.Fatalf("WritePacketData failed: %v", err)
+	}
+	if len(node.packets) != 2 {
+		t.Fatalf("want frame split into 2 fragments, got %d", len(node.packets))
+	}
+	r2 := NewRouter(nil, FramingNoTrailer)
+	var result []byte
+	for i, packet := range node.packets {
+		if n := len(packet.Payload) - HeaderLength; n > fragmentSize {
+			t.Errorf("fragment %d too large: %d > %d", i+1, n, fragmentSize)
+		}
+		var err error
+		result, err = r2.unwrapFrame(packet)
+		if (err == nil) != (i == len(node.packets)-1) {
+			t.Fatalf("fragment %d: unwrapFrame returned %v", i+1, err)
+		}
+	}
+	if !bytes.Equal(result, frame) {
+		t.Errorf("wrong reassembled frame: want %v, got %v", frame, result)
+	}
+}
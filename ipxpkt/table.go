@@ -0,0 +1,92 @@
+package ipxpkt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	// maxTableEntries is the maximum number of Ethernet addresses that
+	// the routing table will remember.
+	maxTableEntries = 1024
+
+	// tableEntryTimeout is the time after which a table entry expires if
+	// no frames have been received from its Ethernet address.
+	tableEntryTimeout = 5 * time.Minute
+)
+
+type tableEntry struct {
+	node       ipx.Addr
+	lastRXTime time.Time
+}
+
+// routingTable stores the mapping from Ethernet hardware address to the IPX
+// node address of the ipxpkt client that owns it. The driver does not
+// necessarily use the same address for both, so we learn the mapping by
+// snooping on the source address of frames as they are received.
+type routingTable struct {
+	mu      sync.RWMutex
+	entries map[[6]byte]*tableEntry
+}
+
+// expire deletes entries that have not been refreshed recently. The write
+// lock must be held.
+func (t *routingTable) expire() {
+	now := time.Now()
+	for mac, e := range t.entries {
+		if now.Sub(e.lastRXTime) > tableEntryTimeout {
+			delete(t.entries, mac)
+		}
+	}
+}
+
+// Record saves the mapping from the source address of the given Ethernet
+// frame to the IPX node address that sent it.
+func (t *routingTable) Record(frame []byte, src ipx.Addr) {
+	if len(frame) < 12 || frame[6]&1 != 0 {
+		return
+	}
+	var mac [6]byte
+	copy(mac[:], frame[6:12])
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[mac]
+	if !ok {
+		if len(t.entries) >= maxTableEntries {
+			t.expire()
+			if len(t.entries) >= maxTableEntries {
+				return
+			}
+		}
+		e = &tableEntry{}
+		t.entries[mac] = e
+	}
+	e.node = src
+	e.lastRXTime = time.Now()
+}
+
+// LookupDest returns the IPX node address to which the given Ethernet frame
+// should be sent. Frames to broadcast or multicast addresses, and frames to
+// addresses that are not in the table, are broadcast to all nodes.
+func (t *routingTable) LookupDest(frame []byte) ipx.Addr {
+	if len(frame) < 6 || frame[0]&1 != 0 {
+		return ipx.AddrBroadcast
+	}
+	var mac [6]byte
+	copy(mac[:], frame[0:6])
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e, ok := t.entries[mac]
+	if !ok || time.Since(e.lastRXTime) > tableEntryTimeout {
+		return ipx.AddrBroadcast
+	}
+	return e.node
+}
+
+func makeRoutingTable() *routingTable {
+	return &routingTable{
+		entries: make(map[[6]byte]*tableEntry),
+	}
+}
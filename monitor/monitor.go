@@ -0,0 +1,336 @@
+// Package monitor implements a simple abuse monitor that aggregates signals
+// of suspicious activity detected by other parts of the server (spoofed
+// source addresses, broadcast floods, malformed packets and authentication
+// failures), logs sources that exceed configured thresholds and can
+// optionally block them.
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+)
+
+// EventType identifies a type of suspicious activity.
+type EventType int
+
+const (
+	// EventSpoofedAddress is reported when a client sends a packet with
+	// a source address other than the one assigned to it.
+	EventSpoofedAddress EventType = iota
+
+	// EventBroadcast is reported for every broadcast packet sent by a
+	// client; a large number in a short time indicates a flood.
+	EventBroadcast
+
+	// EventMalformedPacket is reported when a packet is received that
+	// cannot be decoded.
+	EventMalformedPacket
+
+	// EventAuthFailure is reported when a client fails to authenticate.
+	EventAuthFailure
+
+	numEventTypes
+)
+
+var (
+	_ = (network.Node)(&node{})
+
+	// BlockedError is returned when writing a packet from a source that
+	// has been blocked.
+	BlockedError = errors.New("source blocked by monitor")
+
+	eventNames = map[EventType]string{
+		EventSpoofedAddress:  "spoof",
+		EventBroadcast:       "broadcast",
+		EventMalformedPacket: "malformed",
+		EventAuthFailure:     "auth",
+	}
+
+	// DefaultThresholds are the thresholds used if none are configured.
+	DefaultThresholds = map[EventType]int{
+		EventSpoofedAddress:  20,
+		EventBroadcast:       3000,
+		EventMalformedPacket: 50,
+		EventAuthFailure:     5,
+	}
+)
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// ParseThresholds parses a comma-separated list of thresholds in the form
+// "type=count", eg. "spoof=10,auth=3". Valid types are "spoof", "broadcast",
+// "malformed" and "auth". Types that are not listed keep their default
+// threshold; a threshold of zero disables checking for that type.
+func ParseThresholds(s string) (map[EventType]int, error) {
+	result := make(map[EventType]int)
+	for t, n := range DefaultThresholds {
+		result[t] = n
+	}
+	if s == "" {
+		return result, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		fields := strings.SplitN(entry, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid threshold %q: want type=count", entry)
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %v", entry, err)
+		}
+		found := false
+		for t, name := range eventNames {
+			if name == fields[0] {
+				result[t] = n
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown event type %q", fields[0])
+		}
+	}
+	return result, nil
+}
+
+// Config contains configuration for a Monitor.
+type Config struct {
+	// Thresholds gives the number of events of each type that a source
+	// may trigger within Window before action is taken against it. A
+	// missing or zero threshold means the event type is never acted on.
+	Thresholds map[EventType]int
+
+	// Window is the length of the time window over which events are
+	// counted. If zero, one minute is used.
+	Window time.Duration
+
+	// If non-zero, sources that exceed a threshold are blocked for this
+	// amount of time. Otherwise, they are only logged.
+	BlockTime time.Duration
+
+	// If not nil, log entries are written when action is taken against
+	// a source.
+	Logger *slog.Logger
+}
+
+type sourceData struct {
+	windowStart  time.Time
+	counts       [numEventTypes]int
+	blockedUntil time.Time
+}
+
+// Monitor counts events for each source and takes action on sources that
+// exceed the configured thresholds. All methods may be called on a nil
+// Monitor, in which case they do nothing.
+type Monitor struct {
+	mu      sync.Mutex
+	config  Config
+	sources map[string]*sourceData
+	// flagged and blocked count actions taken since the last summary.
+	flagged, blocked [numEventTypes]int
+}
+
+func (m *Monitor) log(level slog.Level, msg string, args ...any) {
+	if m.config.Logger != nil {
+		m.config.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// sourceKey returns the key used to identify the given address. Only the
+// IP address is used, so that a client cannot evade the monitor simply by
+// changing port number.
+func sourceKey(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	return addr.String()
+}
+
+// Report records that an event of the given type was triggered by the given
+// source address.
+func (m *Monitor) Report(source net.Addr, t EventType) {
+	if m == nil {
+		return
+	}
+	key := sourceKey(source)
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sd, ok := m.sources[key]
+	if !ok {
+		sd = &sourceData{windowStart: now}
+		m.sources[key] = sd
+	} else if now.Sub(sd.windowStart) > m.config.Window {
+		sd.windowStart = now
+		sd.counts = [numEventTypes]int{}
+	}
+	sd.counts[t]++
+	threshold := m.config.Thresholds[t]
+	if threshold <= 0 || sd.counts[t] != threshold+1 {
+		return
+	}
+	if m.config.BlockTime > 0 {
+		sd.blockedUntil = now.Add(m.config.BlockTime)
+		m.blocked[t]++
+		m.log(slog.LevelWarn, "source blocked", "remote_addr", key,
+			"event", t.String(), "threshold", threshold,
+			"window", m.config.Window, "block_time", m.config.BlockTime)
+	} else {
+		m.flagged[t]++
+		m.log(slog.LevelWarn, "suspicious activity", "remote_addr", key,
+			"event", t.String(), "threshold", threshold,
+			"window", m.config.Window)
+	}
+}
+
+// Blocked returns true if the given source address is currently blocked.
+func (m *Monitor) Blocked(source net.Addr) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sd, ok := m.sources[sourceKey(source)]
+	return ok && time.Now().Before(sd.blockedUntil)
+}
+
+// expire deletes data for sources that have not reported any events
+// recently and are not blocked.
+func (m *Monitor) expire() {
+	now := time.Now()
+	for key, sd := range m.sources {
+		if now.Sub(sd.windowStart) > m.config.Window && now.After(sd.blockedUntil) {
+			delete(m.sources, key)
+		}
+	}
+}
+
+// Summary returns a description of the actions taken since the last call to
+// Summary, or an empty string if no action was taken.
+func (m *Monitor) Summary() string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	descs := []string{}
+	for t := EventType(0); t < numEventTypes; t++ {
+		if m.flagged[t] > 0 {
+			descs = append(descs, fmt.Sprintf("%d sources flagged for %s", m.flagged[t], t))
+		}
+		if m.blocked[t] > 0 {
+			descs = append(descs, fmt.Sprintf("%d sources blocked for %s", m.blocked[t], t))
+		}
+	}
+	m.flagged = [numEventTypes]int{}
+	m.blocked = [numEventTypes]int{}
+	if len(descs) == 0 {
+		return ""
+	}
+	blockedNow := []string{}
+	now := time.Now()
+	for key, sd := range m.sources {
+		if now.Before(sd.blockedUntil) {
+			blockedNow = append(blockedNow, key)
+		}
+	}
+	sort.Strings(blockedNow)
+	result := strings.Join(descs, ", ")
+	if len(blockedNow) > 0 {
+		result += fmt.Sprintf("; currently blocked: %s", strings.Join(blockedNow, ", "))
+	}
+	return result
+}
+
+// Run periodically logs a summary of actions taken, until the context is
+// cancelled.
+func (m *Monitor) Run(ctx context.Context, period time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+		}
+		if summary := m.Summary(); summary != "" {
+			m.log(slog.LevelInfo, "monitor summary", "summary", summary)
+		}
+	}
+}
+
+// Node wraps the given node, reporting events for suspicious packets that
+// are written to it by the given source. Packets from blocked sources are
+// discarded. If the Monitor is nil, the node is returned unchanged.
+func (m *Monitor) Node(inner network.Node, source net.Addr) network.Node {
+	if m == nil {
+		return inner
+	}
+	return &node{
+		inner:  inner,
+		m:      m,
+		source: source,
+	}
+}
+
+type node struct {
+	inner  network.Node
+	m      *Monitor
+	source net.Addr
+}
+
+func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return n.inner.ReadPacket(ctx)
+}
+
+func (n *node) WritePacket(packet *ipx.Packet) error {
+	if n.m.Blocked(n.source) {
+		return BlockedError
+	}
+	if packet.Header.IsBroadcast() {
+		n.m.Report(n.source, EventBroadcast)
+	}
+	err := n.inner.WritePacket(packet)
+	if errors.Is(err, addressable.WrongAddressError) {
+		n.m.Report(n.source, EventSpoofedAddress)
+	}
+	return err
+}
+
+func (n *node) Close() error {
+	return n.inner.Close()
+}
+
+func (n *node) GetProperty(x interface{}) bool {
+	return n.inner.GetProperty(x)
+}
+
+// New creates a new Monitor.
+func New(config *Config) *Monitor {
+	m := &Monitor{
+		config:  *config,
+		sources: make(map[string]*sourceData),
+	}
+	if m.config.Window == 0 {
+		m.config.Window = time.Minute
+	}
+	return m
+}
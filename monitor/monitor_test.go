@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockAfterThreshold(t *testing.T) {
+	m := New(&Config{
+		Thresholds: map[EventType]int{EventAuthFailure: 3},
+		BlockTime:  time.Minute,
+	})
+	addr1 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	addr2 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}
+	for i := 0; i < 3; i++ {
+		m.Report(addr1, EventAuthFailure)
+		m.Report(addr1, EventMalformedPacket)
+	}
+	if m.Blocked(addr1) {
+		t.Errorf("source blocked before exceeding threshold")
+	}
+	m.Report(addr1, EventAuthFailure)
+	if !m.Blocked(addr1) {
+		t.Errorf("source not blocked after exceeding threshold")
+	}
+	// Changing port number does not evade the block.
+	if !m.Blocked(&net.UDPAddr{IP: addr1.IP, Port: 5678}) {
+		t.Errorf("source not blocked after changing port")
+	}
+	if m.Blocked(addr2) {
+		t.Errorf("other source was blocked")
+	}
+	if summary := m.Summary(); summary == "" {
+		t.Errorf("want summary of actions taken, got empty string")
+	}
+	if summary := m.Summary(); summary != "" {
+		t.Errorf("want empty summary after previous summary, got %q", summary)
+	}
+}
+
+func TestNilMonitor(t *testing.T) {
+	var m *Monitor
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	m.Report(addr, EventAuthFailure)
+	if m.Blocked(addr) {
+		t.Errorf("nil monitor blocked source")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	m := New(&Config{
+		Thresholds: map[EventType]int{EventAuthFailure: 1},
+		BlockTime:  time.Minute,
+		Logger:     slog.New(slog.NewTextHandler(&buf, nil)),
+	})
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	m.Report(addr, EventAuthFailure)
+	m.Report(addr, EventAuthFailure)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m.Run(ctx, 10*time.Millisecond)
+
+	output := buf.String()
+	if !strings.Contains(output, `level=WARN msg="source blocked"`) {
+		t.Errorf("blocked source not logged as a warning: %q", output)
+	}
+	if !strings.Contains(output, `level=INFO msg="monitor summary"`) {
+		t.Errorf("summary not logged at info level: %q", output)
+	}
+}
@@ -16,20 +16,43 @@ import (
 var (
 	_ = (network.Network)(&addressableNetwork{})
 	_ = (network.Node)(&node{})
+	_ = (network.Node)(&failedNode{})
 
 	// WrongAddressError is returned when a packet is written with the
 	// wrong source IPX address.
 	WrongAddressError = errors.New("packet has wrong source address")
+
+	// AddressInUseError is returned when trying to change a node's
+	// address to one that is already in use by another node.
+	AddressInUseError = errors.New("address already in use")
+
+	// InvalidAddressError is returned when trying to change a node's
+	// address to one that is not a valid unicast address.
+	InvalidAddressError = errors.New("not a valid unicast address")
+
+	// AddressNotAllowedError is returned when trying to change a node's
+	// address to one that its address source would never assign.
+	AddressNotAllowedError = errors.New("address outside the range that can be assigned")
 )
 
-type addressableNetwork struct {
-	inner      network.Network
-	nodesByIPX map[ipx.Addr]*node
-	mu         sync.Mutex
+// AddressSource is a source of addresses to assign to new nodes.
+type AddressSource interface {
+	// NextAddr returns an address to assign to a new node. The inUse
+	// function reports whether an address is already assigned to
+	// another node, and the returned address must not be one of them.
+	// An error is returned if no address is available.
+	NextAddr(inUse func(ipx.Addr) bool) (ipx.Addr, error)
+
+	// Contains returns true if the given address is one that the source
+	// could assign. Nodes may only change their address to one of these.
+	Contains(addr ipx.Addr) bool
 }
 
-func (n *addressableNetwork) NewNode() network.Node {
-	result := &node{net: n}
+// randomSource is the default AddressSource, which generates random
+// addresses.
+type randomSource struct{}
+
+func (randomSource) NextAddr(inUse func(ipx.Addr) bool) (ipx.Addr, error) {
 	// Repeatedly generate a new IPX address until we generate one that
 	// is not already in use. A prefix of 02:... gives a Unicast address
 	// that is locally administered.
@@ -37,51 +60,129 @@ func (n *addressableNetwork) NewNode() network.Node {
 		var addr ipx.Addr
 		addr[0] = 0x02
 		rand.Read(addr[1:])
-		n.mu.Lock()
-		if _, ok := n.nodesByIPX[addr]; !ok {
-			result.addr = addr
-			n.nodesByIPX[addr] = result
-			n.mu.Unlock()
-			break
+		if !inUse(addr) {
+			return addr, nil
 		}
+	}
+}
+
+// Contains returns true for every address, since clients have always been
+// free to choose their own address when there is no pool.
+func (randomSource) Contains(addr ipx.Addr) bool {
+	return true
+}
+
+type addressableNetwork struct {
+	inner      network.Network
+	source     AddressSource
+	nodesByIPX map[ipx.Addr]*node
+	mu         sync.Mutex
+}
+
+// inUse returns true if the given address is assigned to a node. The
+// network's mutex must be held.
+func (n *addressableNetwork) inUse(addr ipx.Addr) bool {
+	_, ok := n.nodesByIPX[addr]
+	return ok
+}
+
+func (n *addressableNetwork) NewNode() network.Node {
+	result := &node{net: n}
+	n.mu.Lock()
+	addr, err := n.source.NextAddr(n.inUse)
+	if err != nil {
 		n.mu.Unlock()
+		return &failedNode{err: err}
 	}
+	result.addr = addr
+	n.nodesByIPX[addr] = result
+	n.mu.Unlock()
 	result.inner = n.inner.NewNode()
+	result.trustAddress(result.addr)
 	return result
 }
 
 type node struct {
 	net   *addressableNetwork
 	inner network.Node
+	mu    sync.RWMutex // protects addr
 	addr  ipx.Addr
 }
 
+// trustAddress tells lower layers that the given address is the node's only
+// valid source address, if they support it.
+func (n *node) trustAddress(addr ipx.Addr) {
+	var setTrusted network.TrustedSourceSetter
+	if n.inner.GetProperty(&setTrusted) {
+		setTrusted(addr)
+	}
+}
+
+func (n *node) address() ipx.Addr {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.addr
+}
+
+// changeAddress changes the node's address to the given address, if it is
+// one the address source allows and is not already in use by another node.
+func (n *node) changeAddress(addr ipx.Addr) error {
+	// Multicast bit must not be set.
+	if addr == ipx.AddrNull || addr[0]&0x01 != 0 {
+		return InvalidAddressError
+	}
+	if !n.net.source.Contains(addr) {
+		return AddressNotAllowedError
+	}
+	n.net.mu.Lock()
+	defer n.net.mu.Unlock()
+	if other, ok := n.net.nodesByIPX[addr]; ok {
+		if other == n {
+			return nil
+		}
+		return AddressInUseError
+	}
+	n.mu.Lock()
+	delete(n.net.nodesByIPX, n.addr)
+	n.addr = addr
+	n.net.nodesByIPX[addr] = n
+	n.mu.Unlock()
+	n.trustAddress(addr)
+	return nil
+}
+
+// isForNode returns true if a packet with the given destination should be
+// delivered to this node: either it is addressed to this node or it is a
+// broadcast.
+func (n *node) isForNode(dest *ipx.HeaderAddr) bool {
+	if dest.Network != ipx.ZeroNetwork {
+		return false
+	}
+	return dest.Addr == ipx.AddrBroadcast || dest.Addr == n.address()
+}
+
 func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
-	var packet *ipx.Packet
+	// Keep reading until we find a packet that's really destined for
+	// us. The inner network may have many packets queued that are not,
+	// so the context is checked on each iteration; otherwise we would
+	// never return if the context expired.
 	for {
-		var err error
-		packet, err = n.inner.ReadPacket(ctx)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		packet, err := n.inner.ReadPacket(ctx)
 		if err != nil {
 			return nil, err
 		}
-		dest := &packet.Header.Dest
-		if dest.Network == ipx.ZeroNetwork {
-			if dest.Addr == n.addr {
-				break
-			}
-			if dest.Addr == ipx.AddrBroadcast {
-				break
-			}
+		if n.isForNode(&packet.Header.Dest) {
+			return packet, nil
 		}
-		// Keep looping until we find a packet that's really
-		// destined for us.
 	}
-	return packet, nil
 }
 
 func (n *node) WritePacket(packet *ipx.Packet) error {
 	src := &packet.Header.Src
-	if src.Network != ipx.ZeroNetwork || src.Addr != n.addr {
+	if src.Network != ipx.ZeroNetwork || src.Addr != n.address() {
 		return WrongAddressError
 	}
 	return n.inner.WritePacket(packet)
@@ -89,7 +190,9 @@ func (n *node) WritePacket(packet *ipx.Packet) error {
 
 func (n *node) Close() error {
 	n.net.mu.Lock()
-	delete(n.net.nodesByIPX, n.addr)
+	if n.net.nodesByIPX[n.addr] == n {
+		delete(n.net.nodesByIPX, n.addr)
+	}
 	n.net.mu.Unlock()
 	return n.inner.Close()
 }
@@ -97,18 +200,56 @@ func (n *node) Close() error {
 func (n *node) GetProperty(x interface{}) bool {
 	switch x.(type) {
 	case *ipx.Addr:
-		*x.(*ipx.Addr) = n.addr
+		*x.(*ipx.Addr) = n.address()
+		return true
+	case *network.AddressChanger:
+		*x.(*network.AddressChanger) = n.changeAddress
 		return true
 	default:
 		return n.inner.GetProperty(x)
 	}
 }
 
+// failedNode is returned by NewNode when no address could be assigned. All
+// operations on it fail with the error from the address source.
+type failedNode struct {
+	err error
+}
+
+func (n *failedNode) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return nil, n.err
+}
+
+func (n *failedNode) WritePacket(packet *ipx.Packet) error {
+	return n.err
+}
+
+func (n *failedNode) Close() error {
+	return nil
+}
+
+func (n *failedNode) GetProperty(x interface{}) bool {
+	switch x.(type) {
+	case *network.NodeFailure:
+		*x.(*network.NodeFailure) = network.NodeFailure{Err: n.err}
+		return true
+	default:
+		return false
+	}
+}
+
 // Wrap creates a network that wraps the given network but assigns a unique
-// IPX address to each node.
+// random IPX address to each node.
 func Wrap(n network.Network) network.Network {
+	return WrapWithSource(n, randomSource{})
+}
+
+// WrapWithSource is like Wrap, but the addresses assigned to nodes are taken
+// from the given source. This allows tests to use predictable addresses.
+func WrapWithSource(n network.Network, source AddressSource) network.Network {
 	return &addressableNetwork{
 		inner:      n,
+		source:     source,
 		nodesByIPX: map[ipx.Addr]*node{},
 	}
 }
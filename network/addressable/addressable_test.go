@@ -0,0 +1,244 @@
+package addressable
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func makeNode(t *testing.T) (*node, *ipxtesting.CallbackDest) {
+	t.Helper()
+	dest := ipxtesting.MakeCallbackDest(func(*ipx.Packet) {})
+	n := Wrap(&ipxtesting.FakeNetwork{Inner: dest}).NewNode().(*node)
+	t.Cleanup(func() { n.Close() })
+	return n, dest
+}
+
+func packetTo(addr ipx.Addr, payload string) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: addr},
+		},
+		Payload: []byte(payload),
+	}
+}
+
+func TestReadPacketFiltering(t *testing.T) {
+	n, dest := makeNode(t)
+	other := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	otherNetwork := packetTo(n.address(), "other network")
+	otherNetwork.Header.Dest.Network = [4]byte{1, 2, 3, 4}
+
+	dest.SendPacket(packetTo(other, "other node"))
+	dest.SendPacket(otherNetwork)
+	dest.SendPacket(packetTo(ipx.AddrBroadcast, "broadcast"))
+	dest.SendPacket(packetTo(other, "other node"))
+	dest.SendPacket(packetTo(n.address(), "self"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, want := range []string{"broadcast", "self"} {
+		packet, err := n.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("ReadPacket failed waiting for %q packet: %v", want, err)
+		}
+		if got := string(packet.Payload); got != want {
+			t.Errorf("wrong packet received: want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestReadPacketContext(t *testing.T) {
+	n, dest := makeNode(t)
+	other := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	for i := 0; i < 10; i++ {
+		dest.SendPacket(packetTo(other, "other node"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := n.ReadPacket(ctx); err != context.Canceled {
+		t.Errorf("ReadPacket with cancelled context: want %v, got %v", context.Canceled, err)
+	}
+
+	// Once the queued packets have been discarded, ReadPacket must
+	// block until the context expires rather than spinning.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := n.ReadPacket(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ReadPacket with no matching packets: want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestAddressSource(t *testing.T) {
+	n := WrapWithSource(&ipxtesting.FakeNetwork{}, &ipxtesting.AddressSequence{})
+	node1 := n.NewNode()
+	want := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	if got := node1.(*node).address(); got != want {
+		t.Errorf("wrong address for first node: want %v, got %v", want, got)
+	}
+
+	// Addresses already in use are skipped.
+	if err := node1.(*node).changeAddress(ipx.Addr{0x02, 0, 0, 0, 0, 0x02}); err != nil {
+		t.Fatalf("changeAddress failed: %v", err)
+	}
+	node2 := n.NewNode()
+	want = ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+	if got := node2.(*node).address(); got != want {
+		t.Errorf("wrong address for second node: want %v, got %v", want, got)
+	}
+}
+
+func TestTrustedSource(t *testing.T) {
+	sw := ipxswitch.New(0)
+	n := Wrap(sw).NewNode().(*node)
+	defer n.Close()
+
+	// Addressable nodes reject spoofed packets themselves, so write
+	// directly to the inner node to check that the switch does too.
+	spoofed := &ipx.Packet{Header: ipx.Header{
+		Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+		Src:  ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}},
+	}}
+	if err := n.inner.WritePacket(spoofed); err != ipxswitch.SpoofedSourceError {
+		t.Errorf("want error %v, got %v", ipxswitch.SpoofedSourceError, err)
+	}
+
+	newAddr := ipx.Addr{0x02, 0x99, 0x88, 0x77, 0x66, 0x55}
+	if err := n.changeAddress(newAddr); err != nil {
+		t.Fatalf("changeAddress failed: %v", err)
+	}
+	packet := &ipx.Packet{Header: ipx.Header{
+		Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+		Src:  ipx.HeaderAddr{Addr: newAddr},
+	}}
+	if err := n.WritePacket(packet); err != nil {
+		t.Errorf("WritePacket from new address failed: %v", err)
+	}
+	if got := sw.Addresses(); len(got) != 1 || got[0] != newAddr {
+		t.Errorf("want only %v learned by switch, got %v", newAddr, got)
+	}
+}
+
+func newPool(t *testing.T, s string, random bool) *Pool {
+	t.Helper()
+	pool, err := ParsePool(s, random)
+	if err != nil {
+		t.Fatalf("ParsePool(%q) failed: %v", s, err)
+	}
+	return pool
+}
+
+func TestParsePool(t *testing.T) {
+	for _, s := range []string{
+		"02:00:00:00:01:00",
+		"02:00:00:00:01:00/",
+		"02:00:00:00:01:00/ff:ff",
+		"03:00:00:00:01:00/ff:ff:ff:ff:ff:00",
+		"02:00:00:00:01:00/fe:ff:ff:ff:ff:00",
+	} {
+		if _, err := ParsePool(s, false); err == nil {
+			t.Errorf("ParsePool(%q): want error, got none", s)
+		}
+	}
+	pool := newPool(t, "02:00:00:00:01:00/ff:ff:ff:ff:ff:00", false)
+	if got := pool.Size(); got != 256 {
+		t.Errorf("wrong pool size: want 256, got %d", got)
+	}
+}
+
+func TestPoolExhaustion(t *testing.T) {
+	for _, random := range []bool{false, true} {
+		pool := newPool(t, "02:00:00:00:01:00/ff:ff:ff:ff:ff:fc", random)
+		n := WrapWithSource(&ipxtesting.FakeNetwork{}, pool)
+		seen := map[ipx.Addr]network.Node{}
+		for i := 0; i < 4; i++ {
+			nd := n.NewNode()
+			if err := network.NodeError(nd); err != nil {
+				t.Fatalf("random=%v: node %d: NewNode failed: %v", random, i, err)
+			}
+			addr := nd.(*node).address()
+			if addr[5]&0xfc != 0 || addr != (ipx.Addr{0x02, 0, 0, 0, 0x01, addr[5]}) {
+				t.Errorf("random=%v: address %v not in pool", random, addr)
+			}
+			if _, ok := seen[addr]; ok {
+				t.Errorf("random=%v: address %v assigned twice", random, addr)
+			}
+			seen[addr] = nd
+		}
+
+		nd := n.NewNode()
+		if err := network.NodeError(nd); err != PoolExhaustedError {
+			t.Errorf("random=%v: want error %v, got %v", random, PoolExhaustedError, err)
+		}
+		if err := nd.WritePacket(&ipx.Packet{}); err != PoolExhaustedError {
+			t.Errorf("random=%v: WritePacket: want error %v, got %v", random, PoolExhaustedError, err)
+		}
+
+		// Once a node is closed, its address can be reused.
+		freed := ipx.Addr{0x02, 0, 0, 0, 0x01, 0x02}
+		seen[freed].Close()
+		nd = n.NewNode()
+		if err := network.NodeError(nd); err != nil {
+			t.Fatalf("random=%v: NewNode after close failed: %v", random, err)
+		}
+		if got := nd.(*node).address(); got != freed {
+			t.Errorf("random=%v: want freed address %v, got %v", random, freed, got)
+		}
+	}
+}
+
+func TestPoolCollision(t *testing.T) {
+	pool := newPool(t, "02:00:00:00:01:00/ff:ff:ff:ff:ff:00", false)
+	n := WrapWithSource(&ipxtesting.FakeNetwork{}, pool)
+	node1 := n.NewNode().(*node)
+
+	// A node that has changed its address to one in the pool causes
+	// that address to be skipped.
+	taken := ipx.Addr{0x02, 0, 0, 0, 0x01, 0x00}
+	node2 := n.NewNode().(*node)
+	if err := node2.changeAddress(ipx.Addr{0x02, 0, 0, 0, 0x01, 0x02}); err != nil {
+		t.Fatalf("changeAddress failed: %v", err)
+	}
+	if got := node1.address(); got != taken {
+		t.Errorf("wrong address for first node: want %v, got %v", taken, got)
+	}
+	node3 := n.NewNode().(*node)
+	want := ipx.Addr{0x02, 0, 0, 0, 0x01, 0x03}
+	if got := node3.address(); got != want {
+		t.Errorf("wrong address for third node: want %v, got %v", want, got)
+	}
+}
+
+func TestPoolChangeAddress(t *testing.T) {
+	pool := newPool(t, "02:00:00:00:01:00/ff:ff:ff:ff:ff:00", false)
+	n := WrapWithSource(&ipxtesting.FakeNetwork{}, pool)
+	nd := n.NewNode().(*node)
+	defer nd.Close()
+	orig := nd.address()
+
+	// Addresses outside the pool are rejected, even if they are free.
+	for _, addr := range []ipx.Addr{
+		{0x02, 0, 0, 0, 0x02, 0x05},
+		{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+	} {
+		if err := nd.changeAddress(addr); err != AddressNotAllowedError {
+			t.Errorf("changeAddress(%v): want error %v, got %v", addr, AddressNotAllowedError, err)
+		}
+	}
+	if got := nd.address(); got != orig {
+		t.Errorf("address changed after rejected request: want %v, got %v", orig, got)
+	}
+
+	want := ipx.Addr{0x02, 0, 0, 0, 0x01, 0x42}
+	if err := nd.changeAddress(want); err != nil {
+		t.Fatalf("changeAddress(%v) failed: %v", want, err)
+	}
+	if got := nd.address(); got != want {
+		t.Errorf("wrong address after change: want %v, got %v", want, got)
+	}
+}
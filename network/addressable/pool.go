@@ -0,0 +1,141 @@
+package addressable
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const addrBits = 48
+
+var (
+	_ = (AddressSource)(&Pool{})
+
+	// PoolExhaustedError is returned when a node cannot be created
+	// because every address in the pool is already in use.
+	PoolExhaustedError = errors.New("no free addresses left in pool")
+
+	// InvalidPoolError is returned when creating a pool that would
+	// contain multicast addresses.
+	InvalidPoolError = errors.New("address pool must only contain unicast addresses")
+)
+
+func addrToUint(addr ipx.Addr) uint64 {
+	var buf [8]byte
+	copy(buf[2:], addr[:])
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+func uintToAddr(x uint64) ipx.Addr {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	var addr ipx.Addr
+	copy(addr[:], buf[2:])
+	return addr
+}
+
+// Pool is an AddressSource that assigns addresses from an administratively
+// defined range: every address that matches a base address in the bits
+// that are set in a mask. For example, a base of 02:00:00:00:01:00 and a
+// mask of ff:ff:ff:ff:ff:00 gives the 256 addresses 02:00:00:00:01:xx.
+type Pool struct {
+	base, hostBits uint64
+	size           uint64
+	random         bool
+
+	mu   sync.Mutex
+	next uint64
+}
+
+// NewPool creates a pool with the given base address and mask. If random is
+// true, addresses are chosen randomly from the pool; otherwise they are
+// assigned in order.
+func NewPool(base, mask ipx.Addr, random bool) (*Pool, error) {
+	// Every address in the pool must have the multicast bit clear.
+	if base[0]&0x01 != 0 || mask[0]&0x01 == 0 {
+		return nil, InvalidPoolError
+	}
+	hostBits := ^addrToUint(mask) & (1<<addrBits - 1)
+	return &Pool{
+		base:     addrToUint(base) &^ hostBits,
+		hostBits: hostBits,
+		size:     1 << bits.OnesCount64(hostBits),
+		random:   random,
+	}, nil
+}
+
+// ParsePool parses a pool specified as a base address and mask separated by
+// a slash, eg. "02:00:00:00:01:00/ff:ff:ff:ff:ff:00", and creates a pool as
+// for NewPool.
+func ParsePool(s string, random bool) (*Pool, error) {
+	baseStr, maskStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("address pool %q not in the form base/mask", s)
+	}
+	var addrs [2]ipx.Addr
+	for i, str := range []string{baseStr, maskStr} {
+		mac, err := net.ParseMAC(str)
+		if err != nil {
+			return nil, err
+		}
+		if len(mac) != len(addrs[i]) {
+			return nil, fmt.Errorf("%q is not a 6-byte address", str)
+		}
+		copy(addrs[i][:], mac)
+	}
+	return NewPool(addrs[0], addrs[1], random)
+}
+
+// Size returns the number of addresses in the pool.
+func (p *Pool) Size() uint64 {
+	return p.size
+}
+
+// addrAt returns the address at the given index in the pool, by spreading
+// the bits of the index across the bits not covered by the mask.
+func (p *Pool) addrAt(index uint64) ipx.Addr {
+	result := p.base
+	for bit := uint64(1); bit < 1<<addrBits && index != 0; bit <<= 1 {
+		if p.hostBits&bit != 0 {
+			if index&1 != 0 {
+				result |= bit
+			}
+			index >>= 1
+		}
+	}
+	return uintToAddr(result)
+}
+
+// Contains returns true if the given address is in the pool.
+func (p *Pool) Contains(addr ipx.Addr) bool {
+	return addr != ipx.AddrNull && addrToUint(addr)&^p.hostBits == p.base
+}
+
+func (p *Pool) NextAddr(inUse func(ipx.Addr) bool) (ipx.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := p.next
+	if p.random {
+		var buf [8]byte
+		rand.Read(buf[:])
+		start = binary.BigEndian.Uint64(buf[:]) % p.size
+	}
+	// Scan from the starting index until we find an address that is
+	// free, so that we know for certain when the pool is exhausted.
+	for i := uint64(0); i < p.size; i++ {
+		index := (start + i) % p.size
+		addr := p.addrAt(index)
+		if addr != ipx.AddrNull && !inUse(addr) {
+			p.next = (index + 1) % p.size
+			return addr, nil
+		}
+	}
+	return ipx.AddrNull, PoolExhaustedError
+}
@@ -0,0 +1,270 @@
+// Package dejitter implements a Network that wraps another Network and
+// smooths out bursty delivery of the packets written to each node.
+//
+// UDP can delay and reorder packets, and when a path stalls it often
+// delivers a whole burst of packets at once, which some games handle
+// badly. IPX packets have no sequence numbers or timestamps, so there is
+// no way to put reordered packets back in order. Instead, each node keeps
+// track of the average interval between the packets written to it, and
+// packets that arrive in a burst are held and released at that interval,
+// as long as no packet is held for longer than a maximum hold time.
+package dejitter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/pipe"
+)
+
+const (
+	// DefaultDepth is the default number of packets that can be held
+	// for each node.
+	DefaultDepth = 16
+
+	// DefaultMaxHold is the default maximum time that a packet is held.
+	DefaultMaxHold = 50 * time.Millisecond
+
+	// Intervals between packets longer than this are assumed to be
+	// pauses in traffic rather than jitter, and are not measured.
+	idleGap = time.Second
+)
+
+var (
+	_ = (network.Network)(&dejitterNetwork{})
+	_ = (network.Node)(&node{})
+)
+
+// Statistics can be fetched using GetProperty from nodes, to measure the
+// effect of the dejitter buffer.
+type Statistics struct {
+	// Packets is the number of packets written to the node.
+	Packets uint64 `json:"packets"`
+
+	// Held is the number of packets that were held rather than being
+	// released immediately, and TotalHold is the total time for which
+	// they were held.
+	Held      uint64        `json:"held"`
+	TotalHold time.Duration `json:"total_hold"`
+
+	// Dropped is the number of packets discarded because the buffer
+	// was full.
+	Dropped uint64 `json:"dropped"`
+
+	// InputJitter and OutputJitter are estimates of the variation in
+	// the interval between packets, as they were written to the node
+	// and as they were released, respectively.
+	InputJitter  time.Duration `json:"input_jitter"`
+	OutputJitter time.Duration `json:"output_jitter"`
+}
+
+func (s *Statistics) String() string {
+	var avgHold time.Duration
+	if s.Held > 0 {
+		avgHold = s.TotalHold / time.Duration(s.Held)
+	}
+	return fmt.Sprintf("held %d of %d packets (average %s), dropped %d; jitter %s in, %s out",
+		s.Held, s.Packets, avgHold, s.Dropped, s.InputJitter, s.OutputJitter)
+}
+
+// jitterMeter estimates jitter as a running average of the change in the
+// interval between consecutive packets, in a similar way to RFC 3550.
+type jitterMeter struct {
+	last    time.Time
+	lastGap time.Duration
+	jitter  time.Duration
+}
+
+// update records that a packet was seen at the given time, returning the
+// interval since the previous packet if it is short enough to measure.
+func (m *jitterMeter) update(now time.Time) (time.Duration, bool) {
+	gap := now.Sub(m.last)
+	hadLast := !m.last.IsZero()
+	m.last = now
+	if !hadLast || gap >= idleGap {
+		m.lastGap = 0
+		return 0, false
+	}
+	if m.lastGap != 0 {
+		d := gap - m.lastGap
+		if d < 0 {
+			d = -d
+		}
+		m.jitter += (d - m.jitter) / 16
+	}
+	m.lastGap = gap
+	return gap, true
+}
+
+type heldPacket struct {
+	packet  *ipx.Packet
+	release time.Time
+}
+
+type dejitterNetwork struct {
+	inner   network.Network
+	depth   int
+	maxHold time.Duration
+}
+
+func (n *dejitterNetwork) NewNode() network.Node {
+	return WrapNode(n.inner.NewNode(), n.depth, n.maxHold)
+}
+
+func newNode(inner network.Node, depth int, maxHold time.Duration) *node {
+	if depth <= 0 {
+		depth = DefaultDepth
+	}
+	if maxHold <= 0 {
+		maxHold = DefaultMaxHold
+	}
+	return &node{
+		inner:   inner,
+		maxHold: maxHold,
+		queue:   make(chan heldPacket, depth),
+		closed:  make(chan struct{}),
+	}
+}
+
+// WrapNode wraps a single node so that bursts of packets written to it are
+// smoothed out, as for the nodes of a network created by Wrap. Packets are
+// written to the inner node later, from another goroutine, so any error
+// from the inner node is not returned by WritePacket. Anything that needs
+// to see those errors, such as a monitor.Monitor, must be wrapped by the
+// returned node rather than wrapping it.
+func WrapNode(inner network.Node, depth int, maxHold time.Duration) network.Node {
+	result := newNode(inner, depth, maxHold)
+	go result.run()
+	return result
+}
+
+type node struct {
+	inner     network.Node
+	maxHold   time.Duration
+	queue     chan heldPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu          sync.Mutex
+	avgGap      time.Duration
+	lastRelease time.Time
+	in, out     jitterMeter
+	stats       Statistics
+}
+
+// run releases held packets to the inner node once their release time is
+// reached.
+func (n *node) run() {
+	for {
+		select {
+		case <-n.closed:
+			return
+		case h := <-n.queue:
+			if d := time.Until(h.release); d > 0 {
+				select {
+				case <-n.closed:
+					return
+				case <-time.After(d):
+				}
+			}
+			n.mu.Lock()
+			n.out.update(time.Now())
+			n.mu.Unlock()
+			n.inner.WritePacket(h.packet)
+		}
+	}
+}
+
+func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return n.inner.ReadPacket(ctx)
+}
+
+// WritePacket queues the packet to be written to the inner node. Packets
+// are always released in the order they were written; a packet is held if
+// it arrived sooner after the previous one than the average interval.
+func (n *node) WritePacket(packet *ipx.Packet) error {
+	return n.write(packet, time.Now())
+}
+
+// write queues a packet that was written at the given time.
+func (n *node) write(packet *ipx.Packet, now time.Time) error {
+	select {
+	case <-n.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if gap, ok := n.in.update(now); ok {
+		n.avgGap += (gap - n.avgGap) / 8
+	}
+	release := n.lastRelease.Add(n.avgGap)
+	if release.Before(now) {
+		release = now
+	}
+	if limit := now.Add(n.maxHold); release.After(limit) {
+		release = limit
+	}
+	n.stats.Packets++
+	select {
+	case n.queue <- heldPacket{packet: packet, release: release}:
+	default:
+		n.stats.Dropped++
+		return pipe.PipeFullError
+	}
+	n.lastRelease = release
+	if hold := release.Sub(now); hold > 0 {
+		n.stats.Held++
+		n.stats.TotalHold += hold
+	}
+	return nil
+}
+
+func (n *node) Close() error {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+	})
+	return n.inner.Close()
+}
+
+func (n *node) GetProperty(x interface{}) bool {
+	switch x.(type) {
+	case *Statistics:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		s := n.stats
+		s.InputJitter = n.in.jitter
+		s.OutputJitter = n.out.jitter
+		*x.(*Statistics) = s
+		return true
+	default:
+		return n.inner.GetProperty(x)
+	}
+}
+
+// Wrap creates a network that wraps the given network but smooths out
+// bursts of packets written to its nodes. Up to depth packets are held for
+// each node, for no longer than maxHold. If depth or maxHold are not
+// positive, DefaultDepth and DefaultMaxHold are used.
+func Wrap(n network.Network, depth int, maxHold time.Duration) network.Network {
+	return &dejitterNetwork{
+		inner:   n,
+		depth:   depth,
+		maxHold: maxHold,
+	}
+}
+
+// Summary returns a string describing dejitter statistics for the given
+// Node, if any can be fetched. Otherwise an empty string is returned.
+func Summary(node network.Node) string {
+	var s Statistics
+	if !node.GetProperty(&s) {
+		return ""
+	}
+	return s.String()
+}
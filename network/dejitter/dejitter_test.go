@@ -0,0 +1,133 @@
+package dejitter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func makeNode(depth int, maxHold time.Duration) (network.Node, chan *ipx.Packet) {
+	released := make(chan *ipx.Packet, 100)
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		released <- pkt
+	})
+	n := Wrap(&ipxtesting.FakeNetwork{Inner: dest}, depth, maxHold).NewNode()
+	return n, released
+}
+
+func getStats(t *testing.T, n network.Node) Statistics {
+	t.Helper()
+	var s Statistics
+	if !n.GetProperty(&s) {
+		t.Fatalf("failed to get statistics")
+	}
+	return s
+}
+
+// TestBurstSmoothed sends a steady stream of packets followed by a burst,
+// as happens when a network path stalls, and checks that the burst is
+// spread out again without reordering or excessive delay. The packets are
+// written with made up timestamps and the release times they are given are
+// checked, so that the test does not depend on real timing.
+func TestBurstSmoothed(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	n := newNode(&ipxtesting.FakeNetwork{}, DefaultDepth, DefaultMaxHold)
+	defer n.Close()
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var sent []*ipx.Packet
+	var writeTimes, releaseTimes []time.Time
+	send := func() {
+		packet := &ipx.Packet{Payload: []byte(fmt.Sprintf("packet %d", len(sent)))}
+		sent = append(sent, packet)
+		writeTimes = append(writeTimes, now)
+		if err := n.write(packet, now); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+		// Nothing is running to release packets, so take them from
+		// the queue ourselves.
+		h := <-n.queue
+		if h.packet != packet {
+			t.Fatalf("packet %d released out of order: got %q", len(sent)-1, h.packet.Payload)
+		}
+		releaseTimes = append(releaseTimes, h.release)
+	}
+	for i := 0; i < 20; i++ {
+		send()
+		now = now.Add(interval)
+	}
+	now = now.Add(3 * interval)
+	for i := 0; i < 5; i++ {
+		send()
+	}
+
+	var out jitterMeter
+	for i, release := range releaseTimes {
+		if i > 0 && release.Before(releaseTimes[i-1]) {
+			t.Errorf("packet %d released before packet %d", i, i-1)
+		}
+		if hold := release.Sub(writeTimes[i]); hold < 0 || hold > DefaultMaxHold {
+			t.Errorf("packet %d held for %s; want between 0 and %s", i, hold, DefaultMaxHold)
+		}
+		out.update(release)
+	}
+	burst := releaseTimes[len(releaseTimes)-5:]
+	if spread := burst[4].Sub(burst[0]); spread < 2*interval {
+		t.Errorf("burst released over %s; want it spread out", spread)
+	}
+	s := getStats(t, n)
+	if s.Packets != uint64(len(sent)) || s.Held == 0 || s.Dropped != 0 {
+		t.Errorf("wrong statistics: %s", s.String())
+	}
+	if out.jitter >= s.InputJitter {
+		t.Errorf("jitter not reduced: %s in, %s out", s.InputJitter, out.jitter)
+	}
+}
+
+func TestReleased(t *testing.T) {
+	n, released := makeNode(DefaultDepth, DefaultMaxHold)
+	defer n.Close()
+	for i := 0; i < 3; i++ {
+		packet := &ipx.Packet{Payload: []byte(fmt.Sprintf("packet %d", i))}
+		if err := n.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+		select {
+		case got := <-released:
+			if got != packet {
+				t.Errorf("wrong packet released: want %q, got %q", packet.Payload, got.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("packet %d not released", i)
+		}
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	n, released := makeNode(2, time.Second)
+	defer n.Close()
+
+	// Establish a long interval so that following packets are held.
+	n.WritePacket(&ipx.Packet{})
+	time.Sleep(200 * time.Millisecond)
+	n.WritePacket(&ipx.Packet{})
+	<-released
+	<-released
+
+	var dropped int
+	for i := 0; i < 5; i++ {
+		if err := n.WritePacket(&ipx.Packet{}); err != nil {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Errorf("want some packets dropped when buffer is full")
+	}
+	if s := getStats(t, n); s.Dropped != uint64(dropped) {
+		t.Errorf("wrong dropped count: want %d, got %d", dropped, s.Dropped)
+	}
+}
@@ -0,0 +1,109 @@
+// Package echo implements an IPX echo service that can be used to test
+// connectivity to the server. Any packet sent to the echo socket is sent
+// back to its source address, optionally with a timestamp appended, so that
+// clients can confirm that packets flow in both directions and measure the
+// round-trip time.
+package echo
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+const (
+	// DefaultSocket is the IPX socket used by the echo service unless
+	// configured otherwise. The XNS echo socket (2) can't be used since
+	// DOSBox clients send their registration packets to it, so this is
+	// instead a socket that no well-known protocol uses, below the
+	// range that clients allocate dynamic sockets from.
+	DefaultSocket = 0x3000
+
+	// TimestampLength is the number of bytes appended to each echoed
+	// packet when timestamps are enabled.
+	TimestampLength = 8
+)
+
+// Config contains configuration for an echo service.
+type Config struct {
+	// Socket is the IPX socket to listen on. If zero, DefaultSocket is
+	// used.
+	Socket uint16
+
+	// If true, the time that the packet was received by the server is
+	// appended to the payload of each reply, as a 64-bit big endian
+	// count of nanoseconds since the Unix epoch.
+	Timestamp bool
+}
+
+// Service echoes packets back to their sender.
+type Service struct {
+	config Config
+	node   network.Node
+}
+
+func (s *Service) reply(packet *ipx.Packet, received time.Time) error {
+	hdr := &packet.Header
+	payload := append([]byte{}, packet.Payload...)
+	if s.config.Timestamp {
+		var ts [TimestampLength]byte
+		binary.BigEndian.PutUint64(ts[:], uint64(received.UnixNano()))
+		payload = append(payload, ts[:]...)
+	}
+	return s.node.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Checksum:   0xffff,
+			Length:     uint16(ipx.HeaderLength + len(payload)),
+			PacketType: hdr.PacketType,
+			Dest:       hdr.Src,
+			Src: ipx.HeaderAddr{
+				Network: hdr.Dest.Network,
+				Addr:    network.NodeAddress(s.node),
+				Socket:  s.config.Socket,
+			},
+		},
+		Payload: payload,
+	})
+}
+
+// Run reads packets from the network and echoes back any sent to the echo
+// socket, blocking until the context is cancelled or the node is closed.
+func (s *Service) Run(ctx context.Context) {
+	for {
+		packet, err := s.node.ReadPacket(ctx)
+		switch {
+		case err == io.ErrClosedPipe || err == context.Canceled:
+			return
+		case err != nil:
+			slog.Error("unexpected error reading from node", "err", err)
+			return
+		}
+		received := time.Now()
+		hdr := &packet.Header
+		if hdr.Dest.Socket != s.config.Socket || hdr.Src.Addr == ipx.AddrBroadcast {
+			continue
+		}
+		if err := s.reply(packet, received); err != nil {
+			slog.Warn("error sending echo reply",
+				"ipx_address", hdr.Src.Addr.String(), "err", err)
+		}
+	}
+}
+
+// New creates a new Service that sends and receives packets using the given
+// node.
+func New(config *Config, node network.Node) *Service {
+	s := &Service{
+		config: *config,
+		node:   node,
+	}
+	if s.config.Socket == 0 {
+		s.config.Socket = DefaultSocket
+	}
+	return s
+}
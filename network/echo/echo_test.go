@@ -0,0 +1,125 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var (
+	serviceAddr = ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	clientAddr  = ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+)
+
+// startService runs an echo service, returning a function to send packets
+// to it and a channel receiving its replies.
+func startService(t *testing.T, config *Config) (func(*ipx.Packet), chan *ipx.Packet) {
+	t.Helper()
+	replies := make(chan *ipx.Packet, 10)
+	dest := ipxtesting.MakeCallbackDest(func(packet *ipx.Packet) {
+		replies <- packet
+	})
+	s := New(config, &ipxtesting.FakeNetwork{Inner: dest, Address: serviceAddr})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Run(ctx)
+	return func(packet *ipx.Packet) { dest.SendPacket(packet) }, replies
+}
+
+func request(socket uint16, payload string) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			PacketType: 4,
+			Dest:       ipx.HeaderAddr{Addr: serviceAddr, Socket: socket},
+			Src:        ipx.HeaderAddr{Addr: clientAddr, Socket: 0x4000},
+		},
+		Payload: []byte(payload),
+	}
+}
+
+func expectReply(t *testing.T, replies chan *ipx.Packet) *ipx.Packet {
+	t.Helper()
+	select {
+	case packet := <-replies:
+		want := ipx.HeaderAddr{Addr: clientAddr, Socket: 0x4000}
+		if packet.Header.Dest != want {
+			t.Errorf("reply sent to wrong address: want %v, got %v", want, packet.Header.Dest)
+		}
+		return packet
+	case <-time.After(time.Second):
+		t.Fatalf("no reply received")
+		return nil
+	}
+}
+
+func expectNoReply(t *testing.T, replies chan *ipx.Packet) {
+	t.Helper()
+	select {
+	case packet := <-replies:
+		t.Errorf("unexpected reply: %v", packet)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDefaultSocket(t *testing.T) {
+	if DefaultSocket == ipx.SocketRegistration {
+		t.Errorf("echo socket collides with DOSBox registration socket")
+	}
+	send, replies := startService(t, &Config{})
+	send(request(ipx.SocketRegistration, "hello"))
+	expectNoReply(t, replies)
+	send(request(DefaultSocket, "hello"))
+	reply := expectReply(t, replies)
+	want := ipx.HeaderAddr{Addr: serviceAddr, Socket: DefaultSocket}
+	if reply.Header.Src != want {
+		t.Errorf("reply has wrong source: want %v, got %v", want, reply.Header.Src)
+	}
+	if string(reply.Payload) != "hello" {
+		t.Errorf("wrong payload echoed: want %q, got %q", "hello", reply.Payload)
+	}
+	if reply.Header.PacketType != 4 {
+		t.Errorf("wrong packet type: want 4, got %d", reply.Header.PacketType)
+	}
+}
+
+func TestConfiguredSocket(t *testing.T) {
+	send, replies := startService(t, &Config{Socket: 0x5678})
+	send(request(DefaultSocket, "hello"))
+	expectNoReply(t, replies)
+	send(request(0x5678, "hello"))
+	reply := expectReply(t, replies)
+	if reply.Header.Src.Socket != 0x5678 {
+		t.Errorf("reply has wrong source socket: want 0x5678, got %#x", reply.Header.Src.Socket)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	send, replies := startService(t, &Config{Timestamp: true})
+	before := time.Now()
+	send(request(DefaultSocket, "hello"))
+	reply := expectReply(t, replies)
+	after := time.Now()
+	if len(reply.Payload) != len("hello")+TimestampLength {
+		t.Fatalf("wrong reply length: want %d, got %d", len("hello")+TimestampLength, len(reply.Payload))
+	}
+	if !bytes.HasPrefix(reply.Payload, []byte("hello")) {
+		t.Errorf("payload not echoed: %q", reply.Payload)
+	}
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(reply.Payload[len("hello"):])))
+	if ts.Before(before) || ts.After(after) {
+		t.Errorf("timestamp %v not between %v and %v", ts, before, after)
+	}
+}
+
+func TestIgnoreBroadcastSource(t *testing.T) {
+	send, replies := startService(t, &Config{})
+	packet := request(DefaultSocket, "hello")
+	packet.Header.Src.Addr = ipx.AddrBroadcast
+	send(packet)
+	expectNoReply(t, replies)
+}
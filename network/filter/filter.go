@@ -5,6 +5,12 @@ package filter
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
@@ -27,17 +33,149 @@ var (
 		0x9010: true, // SNMP over IPX, RFC 1298
 	}
 
+	// portGroups are names that can be used with ParsePorts to refer
+	// to groups of related ports.
+	portGroups = map[string][]uint16{
+		"ncp":     {0x451},
+		"sap":     {0x452},
+		"rip":     {0x453},
+		"netbios": {0x455},
+		"nwlink":  {0x551, 0x552, 0x553},
+		"snmp":    {0x900F, 0x9010},
+		"ipxpkt":  {0x6181},
+	}
+
 	// FilteredPacketError is returned when the virtual network is
 	// configured to filter packets of this type.
 	FilteredPacketError = errors.New("packet filtered")
 )
 
+// DefaultPorts returns the set of well-known ports that are filtered by
+// default; these are the ports used for NetBIOS/SMB and related protocols.
+func DefaultPorts() map[uint16]bool {
+	result := make(map[uint16]bool)
+	for port := range netbiosPorts {
+		result[port] = true
+	}
+	return result
+}
+
+// ParsePorts parses a comma-separated list of ports to filter. Each entry
+// can be a port number, a group name ("ncp", "sap", "rip", "netbios",
+// "nwlink", "snmp", "ipxpkt") or "default" for all of the ports in
+// DefaultPorts. An entry prefixed with '-' removes ports from the set; for example
+// "default,-nwlink" filters all of the default ports except NWLink.
+func ParsePorts(s string) (map[uint16]bool, error) {
+	result := make(map[uint16]bool)
+	if s == "" {
+		return result, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		remove := strings.HasPrefix(entry, "-")
+		entry = strings.TrimPrefix(entry, "-")
+		var ports []uint16
+		if group, ok := portGroups[entry]; ok {
+			ports = group
+		} else if entry == "default" {
+			for port := range netbiosPorts {
+				ports = append(ports, port)
+			}
+		} else {
+			port, err := strconv.ParseUint(entry, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q: want port number or one of \"default\", \"ncp\", \"sap\", \"rip\", \"netbios\", \"nwlink\", \"snmp\", \"ipxpkt\"", entry)
+			}
+			ports = []uint16{uint16(port)}
+		}
+		for _, port := range ports {
+			if remove {
+				delete(result, port)
+			} else {
+				result[port] = true
+			}
+		}
+	}
+	return result, nil
+}
+
+const (
+	// logInterval is the minimum time between log messages about
+	// filtered packets; packets filtered in between are only counted.
+	logInterval = 10 * time.Second
+)
+
+// dropLogger logs packets that have been filtered, rate limited so that
+// a flood of filtered packets does not flood the log. A nil dropLogger
+// logs nothing.
+type dropLogger struct {
+	logger     *slog.Logger
+	mu         sync.Mutex
+	lastLog    time.Time
+	suppressed int
+}
+
+func (l *dropLogger) logDrop(hdr *ipx.Header, dir string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastLog) < logInterval {
+		l.suppressed++
+		return
+	}
+	l.logger.Info("filtered packet",
+		"direction", dir,
+		"src_addr", hdr.Src.Addr.String(),
+		"src_socket", fmt.Sprintf("0x%04x", hdr.Src.Socket),
+		"dest_addr", hdr.Dest.Addr.String(),
+		"dest_socket", fmt.Sprintf("0x%04x", hdr.Dest.Socket),
+		"suppressed", l.suppressed)
+	l.lastLog = now
+	l.suppressed = 0
+}
+
+// Direction specifies which direction packets are filtered in.
+type Direction int
+
+const (
+	// Ingress filters packets written into the network by nodes; that is,
+	// it stops clients from sending packets to the blocked ports.
+	Ingress Direction = 1 << iota
+
+	// Egress filters packets read from the network by nodes; that is, it
+	// stops clients from receiving packets to or from the blocked ports.
+	Egress
+
+	// Both filters packets in both directions.
+	Both = Ingress | Egress
+)
+
+// ParseDirection parses the name of a filtering direction, which may be
+// "both", "ingress" or "egress".
+func ParseDirection(s string) (Direction, error) {
+	switch s {
+	case "both":
+		return Both, nil
+	case "ingress":
+		return Ingress, nil
+	case "egress":
+		return Egress, nil
+	}
+	return 0, fmt.Errorf("invalid filter direction %q: want \"both\", \"ingress\" or \"egress\"", s)
+}
+
 type filter struct {
 	inner ipx.ReadWriteCloser
+	ports map[uint16]bool
+	dir   Direction
+	log   *dropLogger
 }
 
-func shouldFilter(hdr *ipx.Header) bool {
-	return netbiosPorts[hdr.Dest.Socket] || netbiosPorts[hdr.Src.Socket]
+func (f *filter) shouldFilter(hdr *ipx.Header) bool {
+	return f.ports[hdr.Dest.Socket] || f.ports[hdr.Src.Socket]
 }
 
 func (f *filter) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
@@ -46,14 +184,16 @@ func (f *filter) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 		if err != nil {
 			return nil, err
 		}
-		if !shouldFilter(&packet.Header) {
+		if f.dir&Egress == 0 || !f.shouldFilter(&packet.Header) {
 			return packet, nil
 		}
+		f.log.logDrop(&packet.Header, "egress")
 	}
 }
 
 func (f *filter) WritePacket(packet *ipx.Packet) error {
-	if shouldFilter(&packet.Header) {
+	if f.dir&Ingress != 0 && f.shouldFilter(&packet.Header) {
+		f.log.logDrop(&packet.Header, "ingress")
 		return FilteredPacketError
 	}
 	return f.inner.WritePacket(packet)
@@ -72,20 +212,50 @@ func (f *filter) GetProperty(x interface{}) bool {
 
 type filteringNetwork struct {
 	inner network.Network
+	ports map[uint16]bool
+	dir   Direction
+	log   *dropLogger
 }
 
 func (n *filteringNetwork) NewNode() network.Node {
-	return &filter{inner: n.inner.NewNode()}
+	return &filter{
+		inner: n.inner.NewNode(),
+		ports: n.ports,
+		dir:   n.dir,
+		log:   n.log,
+	}
 }
 
 // Wrap creates a network that wraps the given network but rejects packets
-// using certain well-known port numbers which could present a security risk.
-func Wrap(n network.Network) network.Network {
-	return &filteringNetwork{inner: n}
+// to or from any of the given ports, which could present a security risk.
+// DefaultPorts returns a suitable default set of ports. The dir argument
+// controls whether packets are filtered when written by nodes (Ingress),
+// when read by nodes (Egress) or both.
+func Wrap(n network.Network, ports map[uint16]bool, dir Direction) network.Network {
+	return WrapWithLogger(n, ports, dir, nil)
+}
+
+// WrapWithLogger is like Wrap, but if the given logger is not nil, a
+// message is logged when packets are filtered. To avoid flooding the log,
+// at most one message is logged every few seconds.
+func WrapWithLogger(n network.Network, ports map[uint16]bool, dir Direction, logger *slog.Logger) network.Network {
+	result := &filteringNetwork{
+		inner: n,
+		ports: ports,
+		dir:   dir,
+	}
+	if logger != nil {
+		result.log = &dropLogger{logger: logger}
+	}
+	return result
 }
 
 // New creates a new ReadWriteCloser that wraps the given ReadWriteCloser
-// but discards packets using well-known port numbers.
-func New(inner ipx.ReadWriteCloser) ipx.ReadWriteCloser {
-	return &filter{inner: inner}
+// but discards packets to or from any of the given ports.
+func New(inner ipx.ReadWriteCloser, ports map[uint16]bool) ipx.ReadWriteCloser {
+	return &filter{
+		inner: inner,
+		ports: ports,
+		dir:   Both,
+	}
 }
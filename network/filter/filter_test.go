@@ -1,7 +1,12 @@
 package filter
 
 import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
 	ipxtesting "github.com/fragglet/ipxbox/testing"
@@ -36,7 +41,7 @@ func TestFilteredWrites(t *testing.T) {
 	})
 	defer dest.Close()
 
-	filter := New(dest)
+	filter := New(dest, DefaultPorts())
 
 	t.Run("bad dest socket", func(t *testing.T) {
 		testPacket := makeTestPacket(goodSocket, badSocket)
@@ -71,3 +76,131 @@ func TestFilteredWrites(t *testing.T) {
 		}
 	})
 }
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts("default,-nwlink,0x1234")
+	if err != nil {
+		t.Fatalf("failed ParsePorts: %v", err)
+	}
+	for _, port := range []uint16{0x451, 0x455, 0x900F, 0x1234} {
+		if !ports[port] {
+			t.Errorf("want port %#x in set, got %v", port, ports)
+		}
+	}
+	for _, port := range []uint16{0x551, 0x552, 0x553, goodSocket} {
+		if ports[port] {
+			t.Errorf("port %#x should not be in set, got %v", port, ports)
+		}
+	}
+	if _, err := ParsePorts("netbios,bogus"); err == nil {
+		t.Errorf("want error parsing bad port name, got nil")
+	}
+}
+
+func TestSelectivelyAllowedPort(t *testing.T) {
+	const allowedSocket = 0x553 // NWLink datagram
+	ports, err := ParsePorts("default,-0x553")
+	if err != nil {
+		t.Fatalf("failed ParsePorts: %v", err)
+	}
+	gotPackets := 0
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		gotPackets++
+	})
+	defer dest.Close()
+
+	filter := New(dest, ports)
+
+	t.Run("write allowed port", func(t *testing.T) {
+		testPacket := makeTestPacket(goodSocket, allowedSocket)
+		if err := filter.WritePacket(testPacket); err != nil {
+			t.Errorf("error on WritePacket: %v", err)
+		}
+		if gotPackets != 1 {
+			t.Errorf("want gotPackets=1, got=%d", gotPackets)
+		}
+	})
+	t.Run("write blocked port", func(t *testing.T) {
+		testPacket := makeTestPacket(goodSocket, badSocket)
+		if err := filter.WritePacket(testPacket); err != FilteredPacketError {
+			t.Errorf("want error %v, got %v", FilteredPacketError, err)
+		}
+		if gotPackets != 1 {
+			t.Errorf("packet passed through filter: want gotPackets=1, got=%d", gotPackets)
+		}
+	})
+	t.Run("read", func(t *testing.T) {
+		blockedPacket := makeTestPacket(badSocket, goodSocket)
+		allowedPacket := makeTestPacket(allowedSocket, goodSocket)
+		dest.SendPacket(blockedPacket)
+		dest.SendPacket(allowedPacket)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		pkt, err := filter.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("error on ReadPacket: %v", err)
+		}
+		if pkt != allowedPacket {
+			t.Errorf("wrong packet read through filter: want %+v, got %+v", allowedPacket, pkt)
+		}
+	})
+}
+
+func TestDirection(t *testing.T) {
+	for _, tc := range []struct {
+		dir                        Direction
+		wantWrite, wantReadBlocked bool
+	}{
+		{Both, false, false},
+		{Ingress, false, true},
+		{Egress, true, false},
+	} {
+		gotPackets := 0
+		dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+			gotPackets++
+		})
+		defer dest.Close()
+		f := &filter{inner: dest, ports: DefaultPorts(), dir: tc.dir}
+
+		err := f.WritePacket(makeTestPacket(goodSocket, badSocket))
+		if gotWrite := err == nil && gotPackets == 1; gotWrite != tc.wantWrite {
+			t.Errorf("dir=%d: want write passed=%v, got err=%v, gotPackets=%d", tc.dir, tc.wantWrite, err, gotPackets)
+		}
+
+		blockedPacket := makeTestPacket(badSocket, goodSocket)
+		allowedPacket := makeTestPacket(goodSocket, goodSocket)
+		dest.SendPacket(blockedPacket)
+		dest.SendPacket(allowedPacket)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		pkt, err := f.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("dir=%d: error on ReadPacket: %v", tc.dir, err)
+		}
+		if gotBlocked := pkt == blockedPacket; gotBlocked != tc.wantReadBlocked {
+			t.Errorf("dir=%d: want blocked packet read=%v, got %+v", tc.dir, tc.wantReadBlocked, pkt)
+		}
+	}
+}
+
+func TestLogFiltered(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	n := WrapWithLogger(&ipxtesting.FakeNetwork{}, DefaultPorts(), Both, logger)
+	node := n.NewNode()
+	for i := 0; i < 5; i++ {
+		node.WritePacket(makeTestPacket(goodSocket, badSocket))
+	}
+	node.WritePacket(makeTestPacket(goodSocket, goodSocket))
+
+	// Only one message is logged for the burst of filtered packets.
+	logged := buf.String()
+	if n := strings.Count(logged, "filtered packet"); n != 1 {
+		t.Fatalf("want 1 message logged, got %d: %q", n, logged)
+	}
+	for _, want := range []string{"direction=ingress", "dest_socket=0x0455", "src_socket=0x270f"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("log message %q does not contain %q", logged, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package ipxswitch
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	// loopWindow is how long we remember broadcast packets for loop
+	// detection. If the same broadcast arrives from a different port
+	// within this time, it has probably looped back to us through a
+	// bridge or uplink.
+	loopWindow = 2 * time.Second
+)
+
+var (
+	// BroadcastLimitError is returned when a broadcast packet is dropped
+	// because the sending node exceeded its broadcast rate limit.
+	BroadcastLimitError = errors.New("broadcast rate limit exceeded")
+
+	// BroadcastLoopError is returned when a broadcast packet is dropped
+	// because it was already received from another node.
+	BroadcastLoopError = errors.New("broadcast loop detected")
+)
+
+type seenBroadcast struct {
+	nodeID int
+	time   time.Time
+}
+
+// bucket is a token bucket used for rate limiting broadcasts from a node.
+type bucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+// broadcastFilter protects the network from broadcast storms, both from
+// broadcast loops (eg. where the network is bridged to itself through both
+// an uplink and a physical network) and from individual nodes that send
+// too many broadcasts.
+type broadcastFilter struct {
+	mu        sync.Mutex
+	seen      map[uint64]*seenBroadcast
+	lastSweep time.Time
+	// rateLimit is the number of broadcasts per second allowed from each
+	// node, or zero for no limit.
+	rateLimit int
+	buckets   map[int]*bucket
+}
+
+// signature returns a hash identifying the given packet. The transport
+// control field is not included, since routers increment it as the packet
+// is forwarded.
+func signature(packet *ipx.Packet) uint64 {
+	h := fnv.New64a()
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], packet.Header.Dest.Socket)
+	h.Write(buf[:])
+	src, _ := packet.Header.Src.MarshalBinary()
+	h.Write(src)
+	h.Write([]byte{packet.Header.PacketType})
+	h.Write(packet.Payload)
+	return h.Sum64()
+}
+
+// sweep discards remembered broadcasts that are older than loopWindow.
+func (f *broadcastFilter) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < loopWindow {
+		return
+	}
+	for sig, s := range f.seen {
+		if now.Sub(s.time) > loopWindow {
+			delete(f.seen, sig)
+		}
+	}
+	f.lastSweep = now
+}
+
+// allowRate updates the token bucket for the given node and returns true
+// if it is allowed to send another broadcast.
+func (f *broadcastFilter) allowRate(nodeID int, now time.Time) bool {
+	if f.rateLimit <= 0 {
+		return true
+	}
+	b, ok := f.buckets[nodeID]
+	if !ok {
+		b = &bucket{tokens: float64(f.rateLimit), lastUpdate: now}
+		f.buckets[nodeID] = b
+	}
+	b.tokens += now.Sub(b.lastUpdate).Seconds() * float64(f.rateLimit)
+	if b.tokens > float64(f.rateLimit) {
+		b.tokens = float64(f.rateLimit)
+	}
+	b.lastUpdate = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// check returns nil if the given broadcast packet received from the given
+// node should be forwarded, or an error explaining why it was dropped.
+func (f *broadcastFilter) check(packet *ipx.Packet, nodeID int) error {
+	now := time.Now()
+	sig := signature(packet)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sweep(now)
+	if s, ok := f.seen[sig]; ok && s.nodeID != nodeID && now.Sub(s.time) <= loopWindow {
+		return BroadcastLoopError
+	}
+	if !f.allowRate(nodeID, now) {
+		return BroadcastLimitError
+	}
+	f.seen[sig] = &seenBroadcast{nodeID: nodeID, time: now}
+	return nil
+}
+
+// deleteNode discards rate limiting state for the given node.
+func (f *broadcastFilter) deleteNode(nodeID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.buckets, nodeID)
+}
+
+func makeBroadcastFilter() *broadcastFilter {
+	return &broadcastFilter{
+		seen:    map[uint64]*seenBroadcast{},
+		buckets: map[int]*bucket{},
+	}
+}
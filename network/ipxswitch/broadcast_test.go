@@ -0,0 +1,66 @@
+package ipxswitch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func makeBroadcast(payload string) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{
+				Addr:   ipx.AddrBroadcast,
+				Socket: 0x4567,
+			},
+			Src: ipx.HeaderAddr{
+				Addr:   ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Socket: 0x4567,
+			},
+		},
+		Payload: []byte(payload),
+	}
+}
+
+func TestBroadcastLoop(t *testing.T) {
+	n := New(0)
+	client, bridge, other := n.NewNode(), n.NewNode(), n.NewNode()
+	packet := makeBroadcast("hello")
+	if err := client.WritePacket(packet); err != nil {
+		t.Fatalf("first broadcast failed: %v", err)
+	}
+	// The same packet arriving back through the bridge is a loop.
+	looped := *packet
+	looped.Header.TransControl++
+	if err := bridge.WritePacket(&looped); err != BroadcastLoopError {
+		t.Errorf("want error %v for looped broadcast, got %v", BroadcastLoopError, err)
+	}
+	// Repeating the broadcast from the same node is fine.
+	if err := client.WritePacket(packet); err != nil {
+		t.Errorf("repeated broadcast failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if _, err := other.ReadPacket(ctx); err != nil {
+			t.Fatalf("broadcast %d not received: %v", i+1, err)
+		}
+	}
+}
+
+func TestBroadcastLimit(t *testing.T) {
+	n := New(0)
+	n.SetBroadcastLimit(5)
+	client := n.NewNode()
+	n.NewNode()
+	for i := 0; i < 5; i++ {
+		if err := client.WritePacket(makeBroadcast(string(rune('a' + i)))); err != nil {
+			t.Fatalf("broadcast %d failed: %v", i+1, err)
+		}
+	}
+	if err := client.WritePacket(makeBroadcast("too many")); err != BroadcastLimitError {
+		t.Errorf("want error %v, got %v", BroadcastLimitError, err)
+	}
+}
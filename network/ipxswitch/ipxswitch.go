@@ -4,9 +4,12 @@ package ipxswitch
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
@@ -18,17 +21,42 @@ type Network struct {
 	nodesByID  map[int]*node
 	nextNodeID int
 	table      *routingTable
+	bufferSize int
+	classifier pipe.Classifier
+	broadcasts *broadcastFilter
+	// dropTimeout is the time for which a node can continuously drop
+	// packets before it is closed, or zero for no limit.
+	dropTimeout time.Duration
 }
 
 type node struct {
 	net    *Network
 	nodeID int
 	rxpipe ipx.ReadWriteCloser
+	// dropped is the number of packets dropped because rxpipe was full.
+	dropped atomic.Uint64
+
+	mu sync.RWMutex // protects trusted, sockets and droppingSince
+	// trusted is the only source address accepted from the node, or
+	// nil if any address is accepted (eg. for bridges and uplinks).
+	trusted *ipx.HeaderAddr
+	// sockets is the set of destination sockets of the packets that
+	// are delivered to the node, or nil if all packets are delivered.
+	sockets map[uint16]bool
+	// droppingSince is the time of the first of the packets that have
+	// been dropped since a packet was last delivered, or zero if the
+	// last packet was delivered.
+	droppingSince time.Time
 }
 
 var (
 	_ = (network.Network)(&Network{})
 	_ = (network.Node)(&node{})
+	_ = (network.AddressLister)(&Network{})
+
+	// SpoofedSourceError is returned when a packet is written to a node
+	// with a source address other than the node's trusted address.
+	SpoofedSourceError = errors.New("packet source does not match trusted address")
 )
 
 // Close removes the node from its parent network; future calls to ReadPacket()
@@ -38,6 +66,7 @@ func (n *node) Close() error {
 	n.net.table.DeletePort(n.nodeID)
 	delete(n.net.nodesByID, n.nodeID)
 	n.net.mu.Unlock()
+	n.net.broadcasts.deleteNode(n.nodeID)
 	return n.rxpipe.Close()
 }
 
@@ -46,23 +75,112 @@ func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	return n.rxpipe.ReadPacket(ctx)
 }
 
+// setTrustedSource restricts the node to only sending packets from the given
+// address. Any addresses previously learned from the node are forgotten.
+func (n *node) setTrustedSource(addr ipx.Addr) {
+	n.mu.Lock()
+	n.trusted = &ipx.HeaderAddr{Network: ipx.ZeroNetwork, Addr: addr}
+	n.mu.Unlock()
+	n.net.table.ClearPort(n.nodeID)
+}
+
+// trustsSource returns true if the given source address is acceptable for
+// packets written to the node.
+func (n *node) trustsSource(src *ipx.HeaderAddr) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.trusted == nil || (src.Network == n.trusted.Network && src.Addr == n.trusted.Addr)
+}
+
+// setSocketFilter restricts the node to only receiving packets sent to the
+// given sockets.
+func (n *node) setSocketFilter(sockets []uint16) {
+	filter := map[uint16]bool{}
+	for _, socket := range sockets {
+		filter[socket] = true
+	}
+	n.mu.Lock()
+	n.sockets = filter
+	n.mu.Unlock()
+}
+
+// deliver writes a packet into the node's receive pipe, keeping count of
+// packets that are dropped because the pipe is full. If the node has been
+// dropping every packet for longer than the network's drop timeout, its
+// reader has probably stopped and the node is closed. Packets for sockets
+// that the node does not want are discarded without being queued.
+func (n *node) deliver(packet *ipx.Packet) error {
+	n.mu.RLock()
+	wanted := n.sockets == nil || n.sockets[packet.Header.Dest.Socket]
+	n.mu.RUnlock()
+	if !wanted {
+		return nil
+	}
+	err := n.rxpipe.WritePacket(packet)
+	now := time.Now()
+	n.mu.Lock()
+	if err != pipe.PipeFullError {
+		n.droppingSince = time.Time{}
+		n.mu.Unlock()
+		return err
+	}
+	n.dropped.Add(1)
+	if n.droppingSince.IsZero() {
+		n.droppingSince = now
+	}
+	stalled := now.Sub(n.droppingSince)
+	n.mu.Unlock()
+	n.net.mu.RLock()
+	timeout := n.net.dropTimeout
+	n.net.mu.RUnlock()
+	if timeout > 0 && stalled >= timeout {
+		n.Close()
+	}
+	return err
+}
+
 // WritePacket writes a packet into the network from the given node.
 func (n *node) WritePacket(packet *ipx.Packet) error {
+	// Learning a spoofed address would let a node hijack traffic for
+	// another machine.
+	if !n.trustsSource(&packet.Header.Src) {
+		return SpoofedSourceError
+	}
 	n.net.table.Record(n.nodeID, &packet.Header.Src)
 	return n.net.forwardPacket(packet, n)
 }
 
 func (n *node) GetProperty(x interface{}) bool {
-	return false
+	switch x.(type) {
+	case *PortID:
+		*x.(*PortID) = PortID(n.nodeID)
+		return true
+	case *RoutingTableSnapshot:
+		*x.(*RoutingTableSnapshot) = n.net.RoutingTable()
+		return true
+	case *network.TrustedSourceSetter:
+		*x.(*network.TrustedSourceSetter) = n.setTrustedSource
+		return true
+	case *network.SocketFilterSetter:
+		*x.(*network.SocketFilterSetter) = n.setSocketFilter
+		return true
+	case *network.DroppedPackets:
+		*x.(*network.DroppedPackets) = network.DroppedPackets{Count: n.dropped.Load()}
+		return true
+	default:
+		return false
+	}
 }
 
 // NewNode creates a new node on the network.
 func (n *Network) NewNode() network.Node {
-	node := &node{
-		net:    n,
-		rxpipe: pipe.New(),
-	}
+	node := &node{net: n}
 	n.mu.Lock()
+	if n.classifier != nil {
+		node.rxpipe = pipe.NewPriority(n.bufferSize, n.classifier)
+	} else {
+		node.rxpipe = pipe.New(n.bufferSize)
+	}
 	node.nodeID = n.nextNodeID
 	n.nextNodeID++
 	n.nodesByID[node.nodeID] = node
@@ -71,7 +189,55 @@ func (n *Network) NewNode() network.Node {
 	return node
 }
 
+// SetBroadcastLimit sets the maximum number of broadcast packets per second
+// that each node may send; broadcasts beyond the limit are dropped. If zero,
+// there is no limit. Regardless of the limit, broadcasts that loop back
+// into the network through another node are always dropped.
+func (n *Network) SetBroadcastLimit(perSecond int) {
+	n.broadcasts.mu.Lock()
+	defer n.broadcasts.mu.Unlock()
+	n.broadcasts.rateLimit = perSecond
+}
+
+// SetClassifier sets a classifier used to prioritize packets forwarded to
+// nodes. If set, nodes created afterwards queue high priority packets
+// separately and deliver them ahead of any queued low priority packets.
+func (n *Network) SetClassifier(c pipe.Classifier) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.classifier = c
+}
+
+// SetDropTimeout sets the time for which a node can drop every packet
+// forwarded to it, because its receive buffer is full, before the node is
+// closed. A buffer that stays full usually means that the node's reader has
+// stopped, and closing the node frees it. If zero, nodes are never closed.
+func (n *Network) SetDropTimeout(timeout time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropTimeout = timeout
+}
+
+// Addresses returns the addresses of the machines that have sent packets on
+// the network, as learned from their source addresses. Addresses are only
+// forgotten when the node they were seen on is closed, so an address seen
+// through a bridge remains listed for as long as the bridge is connected.
+func (n *Network) Addresses() []ipx.Addr {
+	return n.table.Addresses()
+}
+
+// RoutingTable returns a snapshot of the routing table, showing which port
+// each address has been seen on.
+func (n *Network) RoutingTable() RoutingTableSnapshot {
+	return n.table.Snapshot()
+}
+
 func (n *Network) broadcastPacket(packet *ipx.Packet, src ipx.Writer) error {
+	if srcNode, ok := src.(*node); ok {
+		if err := n.broadcasts.check(packet, srcNode.nodeID); err != nil {
+			return err
+		}
+	}
 	nodes := []*node{}
 	n.mu.RLock()
 	for _, node := range n.nodesByID {
@@ -85,7 +251,7 @@ func (n *Network) broadcastPacket(packet *ipx.Packet, src ipx.Writer) error {
 		// Packet is written into the delivery pipe for the node; the
 		// owner of the node will receive it by calling ReadPacket()
 		// from the other end of the pipe.
-		if err := node.rxpipe.WritePacket(packet); err != nil {
+		if err := node.deliver(packet); err != nil {
 			errs = append(errs, err.Error())
 		}
 	}
@@ -107,13 +273,18 @@ func (n *Network) forwardPacket(packet *ipx.Packet, src ipx.Writer) error {
 	if !ok || node == src {
 		return nil
 	}
-	return node.rxpipe.WritePacket(packet)
+	return node.deliver(packet)
 }
 
-// New creates a new Network.
-func New() *Network {
+// New creates a new Network. Each node buffers up to the given number of
+// packets that have been forwarded to it but not yet read; once the buffer is
+// full, further packets are dropped. If bufferSize is not positive,
+// pipe.DefaultBufferSize is used.
+func New(bufferSize int) *Network {
 	return &Network{
-		nodesByID: map[int]*node{},
-		table:     makeRoutingTable(),
+		nodesByID:  map[int]*node{},
+		table:      makeRoutingTable(),
+		bufferSize: bufferSize,
+		broadcasts: makeBroadcastFilter(),
 	}
 }
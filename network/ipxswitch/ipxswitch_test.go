@@ -0,0 +1,315 @@
+package ipxswitch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+func makePacket(src, dest ipx.Addr) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: dest, Socket: 0x4567},
+			Src:  ipx.HeaderAddr{Addr: src, Socket: 0x4567},
+		},
+		Payload: []byte("hello"),
+	}
+}
+
+func expectPacket(t *testing.T, n network.Node, want bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := n.ReadPacket(ctx)
+	if got := err == nil; got != want {
+		t.Errorf("want packet received=%v, got err=%v", want, err)
+	}
+}
+
+// TestBridgeUnicast checks that packets for machines behind a bridge port
+// (eg. a physical network) are only sent to that port once the machines'
+// addresses have been learned, rather than being broadcast to every node.
+func TestBridgeUnicast(t *testing.T) {
+	n := New(0)
+	bridge, client, other := n.NewNode(), n.NewNode(), n.NewNode()
+	physAddr1 := ipx.Addr{0x00, 0x11, 0x22, 0x33, 0x44, 0x01}
+	physAddr2 := ipx.Addr{0x00, 0x11, 0x22, 0x33, 0x44, 0x02}
+	clientAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+	// Several machines on the physical network send packets through
+	// the bridge. All are learned as being behind the bridge port.
+	for _, addr := range []ipx.Addr{physAddr1, physAddr2} {
+		bridge.WritePacket(makePacket(addr, ipx.AddrBroadcast))
+		expectPacket(t, client, true)
+		expectPacket(t, other, true)
+	}
+
+	for _, addr := range []ipx.Addr{physAddr1, physAddr2} {
+		if err := client.WritePacket(makePacket(clientAddr, addr)); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+		expectPacket(t, bridge, true)
+		expectPacket(t, other, false)
+	}
+}
+
+// TestAddressMove checks that when an address moves to another port, it is
+// no longer associated with the old port.
+func portID(t *testing.T, n network.Node) int {
+	t.Helper()
+	var id PortID
+	if !n.GetProperty(&id) {
+		t.Fatalf("node has no PortID property")
+	}
+	return int(id)
+}
+
+func TestAddressMove(t *testing.T) {
+	n := New(0)
+	port1, port2, sender, other := n.NewNode(), n.NewNode(), n.NewNode(), n.NewNode()
+	addr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	key := ipx.HeaderAddr{Addr: addr}
+	port1.WritePacket(makePacket(addr, ipx.AddrBroadcast))
+	// The payload differs, or this would look like a broadcast loop.
+	packet := makePacket(addr, ipx.AddrBroadcast)
+	packet.Payload = []byte("moved")
+	port2.WritePacket(packet)
+	// Drain the broadcasts.
+	expectPacket(t, port1, true)
+	expectPacket(t, port2, true)
+	for i := 0; i < 2; i++ {
+		expectPacket(t, sender, true)
+		expectPacket(t, other, true)
+	}
+
+	// The address is now only associated with the new port.
+	id1, id2 := portID(t, port1), portID(t, port2)
+	n.table.mu.RLock()
+	onPort1, onPort2 := n.table.ports[id1].addrs[key], n.table.ports[id2].addrs[key]
+	n.table.mu.RUnlock()
+	if onPort1 || !onPort2 {
+		t.Errorf("address not moved between ports: on port 1=%v, on port 2=%v", onPort1, onPort2)
+	}
+
+	// Closing the old port must not forget the address's new location,
+	// and the old port is removed from the table.
+	port1.Close()
+	sender.WritePacket(makePacket(ipx.Addr{0x02, 0, 0, 0, 0, 2}, addr))
+	expectPacket(t, port2, true)
+	expectPacket(t, other, false)
+	n.table.mu.RLock()
+	_, ok := n.table.ports[id1]
+	n.table.mu.RUnlock()
+	if ok {
+		t.Errorf("closed port still in routing table")
+	}
+	routes := n.RoutingTable().Routes
+	found := false
+	for _, r := range routes {
+		if r.Addr == addr {
+			found = true
+			if r.Port != id2 {
+				t.Errorf("wrong port for moved address: want %d, got %d", id2, r.Port)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("moved address missing from routing table: %v", routes)
+	}
+}
+
+func TestReadCancelled(t *testing.T) {
+	n := New(0)
+	node := n.NewNode()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := node.ReadPacket(ctx); err != context.Canceled {
+		t.Errorf("want error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	n := New(0)
+	node1, node2 := n.NewNode(), n.NewNode()
+	addr1 := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	addr2 := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	node1.WritePacket(makePacket(addr1, addr2))
+	node2.WritePacket(makePacket(addr2, addr1))
+	// Sending from another socket does not add a duplicate.
+	packet := makePacket(addr2, addr1)
+	packet.Header.Src.Socket = 0x1234
+	node2.WritePacket(packet)
+
+	got := n.Addresses()
+	want := []ipx.Addr{addr2, addr1}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("want addresses %v, got %v", want, got)
+	}
+
+	node1.Close()
+	got = n.Addresses()
+	if len(got) != 1 || got[0] != addr2 {
+		t.Errorf("want only %v after close, got %v", addr2, got)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	n := New(0)
+	node1, node2 := n.NewNode(), n.NewNode()
+	addr1 := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	addr2 := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	node1.WritePacket(makePacket(addr1, addr2))
+	node2.WritePacket(makePacket(addr2, addr1))
+
+	var port1, port2 PortID
+	if !node1.GetProperty(&port1) || !node2.GetProperty(&port2) {
+		t.Fatalf("failed to get port IDs")
+	}
+	var snapshot RoutingTableSnapshot
+	if !node1.GetProperty(&snapshot) {
+		t.Fatalf("failed to get routing table")
+	}
+	want := []Route{
+		{Addr: addr2, Port: int(port2)},
+		{Addr: addr1, Port: int(port1)},
+	}
+	if len(snapshot.Routes) != len(want) {
+		t.Fatalf("want %d routes, got %+v", len(want), snapshot.Routes)
+	}
+	for i, route := range snapshot.Routes {
+		if route.Addr != want[i].Addr || route.Port != want[i].Port {
+			t.Errorf("route %d: want %v on port %d, got %v on port %d",
+				i, want[i].Addr, want[i].Port, route.Addr, route.Port)
+		}
+		if route.LastSeen.IsZero() || route.LastSeen.After(snapshot.Time) {
+			t.Errorf("route %d: bad last seen time %v", i, route.LastSeen)
+		}
+	}
+}
+
+func TestTrustedSource(t *testing.T) {
+	n := New(0)
+	client, other := n.NewNode(), n.NewNode()
+	clientAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	otherAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	var setTrusted network.TrustedSourceSetter
+	if !client.GetProperty(&setTrusted) {
+		t.Fatalf("failed to get TrustedSourceSetter")
+	}
+	setTrusted(clientAddr)
+
+	// The other node's address cannot be hijacked by the client.
+	other.WritePacket(makePacket(otherAddr, ipx.AddrBroadcast))
+	expectPacket(t, client, true)
+	if err := client.WritePacket(makePacket(otherAddr, ipx.AddrBroadcast)); err != SpoofedSourceError {
+		t.Errorf("want error %v, got %v", SpoofedSourceError, err)
+	}
+	expectPacket(t, other, false)
+	packet := makePacket(clientAddr, ipx.AddrBroadcast)
+	packet.Header.Src.Network = [4]byte{1, 2, 3, 4}
+	if err := client.WritePacket(packet); err != SpoofedSourceError {
+		t.Errorf("want error %v, got %v", SpoofedSourceError, err)
+	}
+	expectPacket(t, other, false)
+	client.WritePacket(makePacket(clientAddr, otherAddr))
+	expectPacket(t, other, true)
+
+	got := n.Addresses()
+	want := []ipx.Addr{clientAddr, otherAddr}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("want addresses %v, got %v", want, got)
+	}
+
+	// Changing the trusted address forgets the old one.
+	newAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+	setTrusted(newAddr)
+	if got := n.Addresses(); len(got) != 1 || got[0] != otherAddr {
+		t.Errorf("want only %v after changing address, got %v", otherAddr, got)
+	}
+}
+
+func dropped(t *testing.T, n network.Node) uint64 {
+	t.Helper()
+	var d network.DroppedPackets
+	if !n.GetProperty(&d) {
+		t.Fatalf("failed to get dropped packet count")
+	}
+	return d.Count
+}
+
+// TestDropTimeout checks that packets dropped because a node's buffer is
+// full are counted, and that the node is closed once it has been dropping
+// packets for too long.
+func TestDropTimeout(t *testing.T) {
+	n := New(2)
+	n.SetDropTimeout(50 * time.Millisecond)
+	sender, stalled := n.NewNode(), n.NewNode()
+	senderAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+	for i := 0; i < 5; i++ {
+		sender.WritePacket(makePacket(senderAddr, ipx.AddrBroadcast))
+	}
+	if got := dropped(t, stalled); got != 3 {
+		t.Errorf("wrong dropped packet count: want 3, got %d", got)
+	}
+
+	// Reading a packet makes space, so the next one is delivered and
+	// the node is no longer considered stalled.
+	expectPacket(t, stalled, true)
+	time.Sleep(100 * time.Millisecond)
+	sender.WritePacket(makePacket(senderAddr, ipx.AddrBroadcast))
+	sender.WritePacket(makePacket(senderAddr, ipx.AddrBroadcast))
+	if _, err := stalled.ReadPacket(context.Background()); err != nil {
+		t.Fatalf("node closed too early: %v", err)
+	}
+
+	sender.WritePacket(makePacket(senderAddr, ipx.AddrBroadcast))
+	sender.WritePacket(makePacket(senderAddr, ipx.AddrBroadcast))
+	time.Sleep(100 * time.Millisecond)
+	sender.WritePacket(makePacket(senderAddr, ipx.AddrBroadcast))
+	if got := dropped(t, stalled); got != 6 {
+		t.Errorf("wrong dropped packet count: want 6, got %d", got)
+	}
+	if _, err := stalled.ReadPacket(context.Background()); err == nil {
+		t.Errorf("node not closed after dropping packets for too long")
+	}
+}
+
+// TestSocketFilter checks that packets for sockets that a node does not
+// want are discarded without filling its buffer.
+func TestSocketFilter(t *testing.T) {
+	n := New(2)
+	sender, svc := n.NewNode(), n.NewNode()
+	senderAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	var setFilter network.SocketFilterSetter
+	if !svc.GetProperty(&setFilter) {
+		t.Fatalf("failed to get SocketFilterSetter")
+	}
+	setFilter([]uint16{0x452})
+
+	for i := 0; i < 5; i++ {
+		sender.WritePacket(makePacket(senderAddr, ipx.AddrBroadcast))
+	}
+	packet := makePacket(senderAddr, ipx.AddrBroadcast)
+	packet.Header.Dest.Socket = 0x452
+	sender.WritePacket(packet)
+	if got := dropped(t, svc); got != 0 {
+		t.Errorf("wrong dropped packet count: want 0, got %d", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	got, err := svc.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("packet for bound socket not received: %v", err)
+	}
+	if got.Header.Dest.Socket != 0x452 {
+		t.Errorf("wrong packet received: want socket %#x, got %#x", 0x452, got.Header.Dest.Socket)
+	}
+	expectPacket(t, svc, false)
+}
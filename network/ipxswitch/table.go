@@ -1,6 +1,8 @@
 package ipxswitch
 
 import (
+	"bytes"
+	"sort"
 	"sync"
 	"time"
 
@@ -20,6 +22,31 @@ type portData struct {
 	addrs map[ipx.HeaderAddr]bool
 }
 
+// Route describes an entry in the routing table: the port that packets for
+// an address are forwarded to.
+type Route struct {
+	Network [4]byte
+	Addr    ipx.Addr
+	// Port identifies the node that packets for the address are sent
+	// to; it can be matched against the PortID property of nodes.
+	Port int
+	// LastSeen is the time that a packet was last received from the
+	// address.
+	LastSeen time.Time
+}
+
+// RoutingTableSnapshot is a copy of the contents of the routing table at a
+// particular time. It can also be fetched from nodes as a property using
+// GetProperty.
+type RoutingTableSnapshot struct {
+	Time   time.Time
+	Routes []Route
+}
+
+// PortID is a property that can be fetched from nodes using GetProperty,
+// identifying the node's port in the routing table.
+type PortID int
+
 // routingTable stores the mapping table from IPX address to port number.
 // We identify which addresses are on which ports by snooping on the source
 // address of packets as they are sent.
@@ -83,11 +110,12 @@ func (t *routingTable) Record(sourcePort int, src *ipx.HeaderAddr) {
 		// Another port was marked as the source for this address.
 		// Deassociate from other port, and reassign to new port.
 		// This can happen if an uplink client disconnects and then
-		// reconnects.
-		ad.portID = sourcePort
+		// reconnects, or if a machine moves between the physical
+		// network and a virtual client.
 		if otherPD, ok := t.ports[ad.portID]; ok {
 			delete(otherPD.addrs, *key)
 		}
+		ad.portID = sourcePort
 		pd.addrs[*key] = true
 	}
 	// TODO: Garbage collection goroutine for stale addresses
@@ -110,6 +138,52 @@ func (t *routingTable) LookupDest(dest *ipx.HeaderAddr) int {
 	return ad.portID
 }
 
+// Addresses returns the node addresses of all machines that have been seen
+// on the network, sorted into order.
+func (t *routingTable) Addresses() []ipx.Addr {
+	t.mu.RLock()
+	seen := map[ipx.Addr]bool{}
+	for key := range t.addrs {
+		seen[key.Addr] = true
+	}
+	t.mu.RUnlock()
+	result := []ipx.Addr{}
+	for addr := range seen {
+		result = append(result, addr)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i][:], result[j][:]) < 0
+	})
+	return result
+}
+
+// Snapshot returns a copy of the current contents of the routing table,
+// sorted by address.
+func (t *routingTable) Snapshot() RoutingTableSnapshot {
+	result := RoutingTableSnapshot{
+		Time:   time.Now(),
+		Routes: []Route{},
+	}
+	t.mu.RLock()
+	for key, ad := range t.addrs {
+		result.Routes = append(result.Routes, Route{
+			Network:  key.Network,
+			Addr:     key.Addr,
+			Port:     ad.portID,
+			LastSeen: ad.lastRXTime,
+		})
+	}
+	t.mu.RUnlock()
+	sort.Slice(result.Routes, func(i, j int) bool {
+		ri, rj := &result.Routes[i], &result.Routes[j]
+		if c := bytes.Compare(ri.Network[:], rj.Network[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(ri.Addr[:], rj.Addr[:]) < 0
+	})
+	return result
+}
+
 func (t *routingTable) AddPort(portID int) {
 	pd := &portData{
 		addrs: make(map[ipx.HeaderAddr]bool),
@@ -122,6 +196,18 @@ func (t *routingTable) AddPort(portID int) {
 func (t *routingTable) DeletePort(portID int) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.clearPort(portID)
+	delete(t.ports, portID)
+}
+
+// ClearPort forgets all addresses that have been learned on the given port.
+func (t *routingTable) ClearPort(portID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clearPort(portID)
+}
+
+func (t *routingTable) clearPort(portID int) {
 	pd, ok := t.ports[portID]
 	if !ok {
 		return
@@ -130,6 +216,7 @@ func (t *routingTable) DeletePort(portID int) {
 		if ad, ok := t.addrs[key]; ok && ad.portID == portID {
 			delete(t.addrs, key)
 		}
+		delete(pd.addrs, key)
 	}
 }
 
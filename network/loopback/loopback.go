@@ -0,0 +1,55 @@
+// Package loopback provides in-process endpoints on a network, for testing
+// games or tools on a single machine without running a UDP server. For
+// example, two endpoints can be attached to an ipxswitch.Network to connect
+// two instances of a program that speak IPX through network.Node:
+//
+//	a, b := loopback.NewPair(ipxswitch.New(0))
+//
+// This is a development convenience; real clients should connect through
+// one of the server protocols instead.
+package loopback
+
+import (
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+)
+
+var (
+	_ = (network.Node)(&endpoint{})
+)
+
+// endpoint wraps an addressable node and fills in the source address of
+// packets written to it, so callers do not need to know their address.
+type endpoint struct {
+	network.Node
+}
+
+func (e *endpoint) WritePacket(packet *ipx.Packet) error {
+	if packet.Header.Src.Addr == ipx.AddrNull {
+		p := *packet
+		p.Header.Src.Addr = network.NodeAddress(e.Node)
+		packet = &p
+	}
+	return e.Node.WritePacket(packet)
+}
+
+// New returns the given number of endpoints attached to the given network.
+// Each endpoint is assigned a unique random IPX address that can be read
+// with network.NodeAddress. Packets written with a null source address are
+// sent from the endpoint's address.
+func New(n network.Network, count int) []network.Node {
+	an := addressable.Wrap(n)
+	result := []network.Node{}
+	for i := 0; i < count; i++ {
+		result = append(result, &endpoint{an.NewNode()})
+	}
+	return result
+}
+
+// NewPair is a convenience function that returns two endpoints attached to
+// the given network.
+func NewPair(n network.Network) (network.Node, network.Node) {
+	nodes := New(n, 2)
+	return nodes[0], nodes[1]
+}
@@ -0,0 +1,43 @@
+package loopback
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+)
+
+func TestPair(t *testing.T) {
+	a, b := NewPair(ipxswitch.New(0))
+	defer a.Close()
+	defer b.Close()
+
+	addrA, addrB := network.NodeAddress(a), network.NodeAddress(b)
+	if addrA == ipx.AddrNull || addrA == addrB {
+		t.Fatalf("endpoints do not have unique addresses: %v, %v", addrA, addrB)
+	}
+
+	// The source address is filled in for us.
+	err := a.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: addrB, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Socket: 0x869c},
+		},
+		Payload: []byte("hello"),
+	})
+	if err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	packet, err := b.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if packet.Header.Src.Addr != addrA || string(packet.Payload) != "hello" {
+		t.Errorf("wrong packet received: %v", packet)
+	}
+}
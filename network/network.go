@@ -2,6 +2,9 @@
 package network
 
 import (
+	"net"
+	"time"
+
 	"github.com/fragglet/ipxbox/ipx"
 )
 
@@ -11,6 +14,15 @@ type Network interface {
 	NewNode() Node
 }
 
+// AddressLister is an optional interface implemented by networks that can
+// enumerate the addresses of the machines that have been seen on them.
+type AddressLister interface {
+	// Addresses returns a snapshot of the addresses that have been seen
+	// on the network. Addresses may remain listed after the machine
+	// using them has gone away.
+	Addresses() []ipx.Addr
+}
+
 // Node represents a node attached to an IPX network.
 type Node interface {
 	ipx.ReadWriteCloser
@@ -22,6 +34,92 @@ type Node interface {
 	GetProperty(value interface{}) bool
 }
 
+// Liveness is a property that can be fetched using GetProperty from nodes
+// that track the health of an underlying connection, such as uplinks.
+type Liveness struct {
+	// Connected is true if the connection is currently established.
+	Connected bool
+
+	// LastReceived is the time that a packet (including keepalives) was
+	// last received from the other end of the connection.
+	LastReceived time.Time
+}
+
+// DroppedPackets is a property that can be fetched using GetProperty from
+// nodes that discard packets forwarded to them when their receive buffer is
+// full, such as switch ports. Count is the number of packets dropped.
+type DroppedPackets struct {
+	Count uint64
+}
+
+// AddressChanger is a property that can be fetched using GetProperty from
+// nodes whose IPX address can be changed, such as those created by the
+// addressable network. Calling it requests that the node's address be
+// changed to the given address; an error is returned if the address is not
+// acceptable, for example because it is already in use.
+type AddressChanger func(addr ipx.Addr) error
+
+// TrustedSourceSetter is a property that can be fetched using GetProperty
+// from nodes that learn the addresses of machines from the packets written
+// to them, such as switch ports. Calling it tells the node that the given
+// address is the only legitimate source address for packets written to it,
+// so that packets with any other source address are rejected rather than
+// learned. Layers that assign addresses to nodes, such as the addressable
+// network, use it to protect lower layers from spoofed addresses.
+type TrustedSourceSetter func(addr ipx.Addr)
+
+// SocketFilterSetter is a property that can be fetched using GetProperty
+// from nodes that queue the packets forwarded to them, such as switch
+// ports. Calling it tells the node that its reader only wants packets sent
+// to the given sockets, so that other packets are discarded before they are
+// queued rather than after they are read. Service nodes use it so that
+// unrelated traffic cannot fill their receive buffers.
+type SocketFilterSetter func(sockets []uint16)
+
+// RemoteAddr is a property that can be fetched using GetProperty from
+// nodes that represent a client connected over another network, such as a
+// UDP or TCP client of the server. Addr is the client's address on that
+// network.
+type RemoteAddr struct {
+	Addr net.Addr
+}
+
+// NodeRemoteAddr returns the address of the remote client that the given
+// node represents, or nil if it is not known.
+func NodeRemoteAddr(n Node) net.Addr {
+	var result RemoteAddr
+	if !n.GetProperty(&result) {
+		return nil
+	}
+	return result.Addr
+}
+
+// remoteAddrNode wraps a node so that it has a RemoteAddr property.
+type remoteAddrNode struct {
+	Node
+	addr net.Addr
+}
+
+// GetProperty implements the Node interface. The address can be fetched
+// as a RemoteAddr property; all other properties come from the wrapped node.
+func (n *remoteAddrNode) GetProperty(x interface{}) bool {
+	switch x.(type) {
+	case *RemoteAddr:
+		*x.(*RemoteAddr) = RemoteAddr{Addr: n.addr}
+		return true
+	default:
+		return n.Node.GetProperty(x)
+	}
+}
+
+// WithRemoteAddr wraps the given node so that the given address can be
+// fetched from it as a RemoteAddr property. Protocols use it on the nodes
+// they create for clients, so that anything that is handed the node can
+// find where the client is connecting from.
+func WithRemoteAddr(n Node, addr net.Addr) Node {
+	return &remoteAddrNode{Node: n, addr: addr}
+}
+
 // NodeAddress returns the IPX address assigned too the given node, or it
 // returns ipx.AddrNull if there is no assigned address.
 func NodeAddress(n Node) ipx.Addr {
@@ -31,3 +129,22 @@ func NodeAddress(n Node) ipx.Addr {
 	}
 	return result
 }
+
+// NodeFailure is a property that can be fetched using GetProperty from
+// nodes that could not be created. A network that cannot create a node, for
+// example because it has run out of addresses to assign, instead returns
+// one that fails every operation; Err is the reason.
+type NodeFailure struct {
+	Err error
+}
+
+// NodeError returns the error that prevented the given node from being
+// created, or nil if the node is usable. Every caller of NewNode on a
+// network that may fail should check it before using the node.
+func NodeError(n Node) error {
+	var result NodeFailure
+	if !n.GetProperty(&result) {
+		return nil
+	}
+	return result.Err
+}
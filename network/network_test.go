@@ -0,0 +1,30 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestWithRemoteAddr(t *testing.T) {
+	inner := addressable.Wrap(ipxswitch.New(0)).NewNode()
+	if addr := network.NodeRemoteAddr(inner); addr != nil {
+		t.Fatalf("want no remote address for unwrapped node, got %v", addr)
+	}
+	node := network.WithRemoteAddr(inner, ipxtesting.FakeAddress)
+	defer node.Close()
+	if got := network.NodeRemoteAddr(node); got != ipxtesting.FakeAddress {
+		t.Errorf("wrong remote address: want %v, got %v", ipxtesting.FakeAddress, got)
+	}
+	// Properties of the wrapped node are still visible.
+	if got, want := network.NodeAddress(node), network.NodeAddress(inner); got != want {
+		t.Errorf("wrong IPX address: want %v, got %v", want, got)
+	}
+	var port ipxswitch.PortID
+	if !node.GetProperty(&port) {
+		t.Errorf("switch port property hidden by wrapper")
+	}
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+var (
+	_ = (Network)(Null{})
+	_ = (Node)(&nullNode{})
+)
+
+// Null is an implementation of Network where packets written to nodes are
+// discarded and nothing is ever received. It is useful for benchmarking and
+// testing other layers in isolation.
+type Null struct{}
+
+// NewNode creates a new node that discards all packets written to it.
+func (Null) NewNode() Node {
+	return &nullNode{
+		closed: make(chan struct{}),
+	}
+}
+
+type nullNode struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ReadPacket blocks until the node is closed or the context expires.
+func (n *nullNode) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// WritePacket discards the given packet.
+func (n *nullNode) WritePacket(packet *ipx.Packet) error {
+	select {
+	case <-n.closed:
+		return io.ErrClosedPipe
+	default:
+		return nil
+	}
+}
+
+func (n *nullNode) Close() error {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+	})
+	return nil
+}
+
+func (n *nullNode) GetProperty(value interface{}) bool {
+	return false
+}
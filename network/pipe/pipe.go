@@ -6,6 +6,12 @@
 // that have been written but not yet read from the pipe. The size of the
 // buffer is configurable. Once the buffer is full, WritePacket() will
 // return errors until the reader drains the pipe.
+//
+// Pipes created with NewBlocking() instead wait for a bounded amount of
+// time for the reader to make space when the buffer is full. This avoids
+// losing packets during short bursts, but should only be used where a slow
+// reader cannot hold up delivery to other readers, for example not in the
+// broadcast fan-out of a switch.
 package pipe
 
 import (
@@ -13,19 +19,23 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
 )
 
 const (
-	// maxBufferedPackets is the number of packets to buffer in a pipe
-	// before we start to drop packets. The rationale for this number
-	// is as follows: in a peer-to-peer game (Doom, Duke3D...) it is
-	// common to send a burst of packets, one to every other node in
-	// the game. Therefore we should be able to cope with such bursts
-	// up to the maximum number of players we might plausibly see in
-	// an IPX game. This seems like a reasonable upper bound.
-	maxBufferedPackets = 16
+	// DefaultBufferSize is the number of packets that is usually
+	// buffered in a pipe before we start to drop packets. The rationale
+	// for this number is as follows: in a peer-to-peer game (Doom,
+	// Duke3D...) it is common to send a burst of packets, one to every
+	// other node in the game. Therefore we should be able to cope with
+	// such bursts up to the maximum number of players we might
+	// plausibly see in an IPX game. This seems like a reasonable upper
+	// bound. A larger buffer means fewer dropped packets when a reader
+	// falls behind, at the cost of more memory per pipe and more
+	// latency for packets queued behind a burst.
+	DefaultBufferSize = 16
 )
 
 var (
@@ -35,36 +45,55 @@ var (
 )
 
 type pipe struct {
-	ch     chan *ipx.Packet
-	closed bool
-	mu     sync.Mutex
+	ch chan *ipx.Packet
+	// closed is closed when the pipe is closed. The data channel is
+	// never closed, since a blocked writer may still be sending to it.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// writeTimeout is the maximum time to wait for space in the buffer,
+	// or zero if writes never block.
+	writeTimeout time.Duration
 }
 
 func (p *pipe) Close() error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if !p.closed {
-		p.closed = true
-		close(p.ch)
-	}
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
 	return nil
 }
 
-// WritePacket sends a packet to the channel. This function never blocks. If
-// the pipe can hold no more data (eg. the reader has stopped reading) then
-// PipeFullError may be returned.
+func (p *pipe) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// WritePacket sends a packet to the channel. Unless the pipe was created by
+// NewBlocking, this function never blocks. If the pipe can hold no more data
+// (eg. the reader has stopped reading) then PipeFullError may be returned.
 func (p *pipe) WritePacket(pkt *ipx.Packet) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	// Sending to a closed channel will result in a runtime panic.
-	// Instead, if the pipe has been closed, return an error.
-	if p.closed {
+	if p.isClosed() {
 		return io.ErrClosedPipe
 	}
 	select {
 	case p.ch <- pkt:
 		return nil
 	default:
+	}
+	if p.writeTimeout == 0 {
+		return PipeFullError
+	}
+	timer := time.NewTimer(p.writeTimeout)
+	defer timer.Stop()
+	select {
+	case p.ch <- pkt:
+		return nil
+	case <-p.closed:
+		return io.ErrClosedPipe
+	case <-timer.C:
 		return PipeFullError
 	}
 }
@@ -72,28 +101,38 @@ func (p *pipe) WritePacket(pkt *ipx.Packet) error {
 // ReadPacket blocks until a packet is received, the pipe is closed or the
 // context expires.
 func (p *pipe) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
-	p.mu.Lock()
-	closed := p.closed
-	p.mu.Unlock()
-	if closed {
+	if p.isClosed() {
 		return nil, io.ErrClosedPipe
 	}
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case pkt, ok := <-p.ch:
-		if !ok {
-			return nil, io.ErrClosedPipe
-		}
+	case <-p.closed:
+		return nil, io.ErrClosedPipe
+	case pkt := <-p.ch:
 		return pkt, nil
 	}
 }
 
-// New returns a new pipe that buffers a number of writes internally.
-// This is conceptually similar to io.Pipe(), but for IPX packets.
-func New() *pipe {
+// New returns a new pipe that buffers up to the given number of writes
+// internally; if size is not positive, DefaultBufferSize is used. This is
+// conceptually similar to io.Pipe(), but for IPX packets.
+func New(size int) *pipe {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
 	p := &pipe{
-		ch: make(chan *ipx.Packet, maxBufferedPackets),
+		ch:     make(chan *ipx.Packet, size),
+		closed: make(chan struct{}),
 	}
 	return p
 }
+
+// NewBlocking returns a new pipe like New, except that once the buffer is
+// full, WritePacket blocks for up to the given timeout waiting for the
+// reader to make space before giving up and returning PipeFullError.
+func NewBlocking(size int, timeout time.Duration) *pipe {
+	p := New(size)
+	p.writeTimeout = timeout
+	return p
+}
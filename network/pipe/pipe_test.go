@@ -45,7 +45,7 @@ func makeTestPackets(count int) []*ipx.Packet {
 }
 
 func TestWriteThenRead(t *testing.T) {
-	p := New()
+	p := New(DefaultBufferSize)
 	wantPackets := makeTestPackets(10)
 	for _, pkt := range wantPackets {
 		if err := p.WritePacket(pkt); err != nil {
@@ -69,7 +69,7 @@ func TestWriteThenRead(t *testing.T) {
 }
 
 func TestNeverBlocks(t *testing.T) {
-	p := New()
+	p := New(DefaultBufferSize)
 	for i := 0; i < 1000; i++ {
 		err := p.WritePacket(testPacket)
 		if err != nil && err != PipeFullError {
@@ -80,7 +80,7 @@ func TestNeverBlocks(t *testing.T) {
 }
 
 func TestExpiredContext(t *testing.T) {
-	p := New()
+	p := New(DefaultBufferSize)
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	_, err := p.ReadPacket(ctx)
 	if err != context.DeadlineExceeded {
@@ -91,7 +91,7 @@ func TestExpiredContext(t *testing.T) {
 
 func TestClosingSocket(t *testing.T) {
 	ctx := context.Background()
-	p := New()
+	p := New(DefaultBufferSize)
 	go func() {
 		time.Sleep(1 * time.Second)
 		p.Close()
@@ -102,3 +102,90 @@ func TestClosingSocket(t *testing.T) {
 		t.Errorf("want error %v, got %v", io.ErrClosedPipe, err)
 	}
 }
+
+func TestBlockingWrite(t *testing.T) {
+	p := NewBlocking(DefaultBufferSize, 5*time.Second)
+	packets := makeTestPackets(DefaultBufferSize * 2)
+	go func() {
+		for _, pkt := range packets {
+			if err := p.WritePacket(pkt); err != nil {
+				t.Errorf("failed WritePacket: %v", err)
+				return
+			}
+		}
+	}()
+	ctx := context.Background()
+	for i, want := range packets {
+		// Read slowly, so that the writer must wait for space.
+		time.Sleep(time.Millisecond)
+		got, err := p.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("failed ReadPacket: %v", err)
+		}
+		if got != want {
+			t.Fatalf("packet %d: want %+v, got %+v", i, want, got)
+		}
+	}
+}
+
+func TestBlockingWriteTimeout(t *testing.T) {
+	p := NewBlocking(DefaultBufferSize, 10*time.Millisecond)
+	for i := 0; i < DefaultBufferSize; i++ {
+		if err := p.WritePacket(testPacket); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+	if err := p.WritePacket(testPacket); err != PipeFullError {
+		t.Errorf("want error %v, got %v", PipeFullError, err)
+	}
+}
+
+func TestCloseUnblocksWriter(t *testing.T) {
+	p := NewBlocking(DefaultBufferSize, time.Minute)
+	for i := 0; i < DefaultBufferSize; i++ {
+		p.WritePacket(testPacket)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Close()
+	}()
+	if err := p.WritePacket(testPacket); err != io.ErrClosedPipe {
+		t.Errorf("want error %v, got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	const bulkSocket = 0x6181
+	p := NewPriority(DefaultBufferSize, SocketClassifier(map[uint16]bool{bulkSocket: true}))
+	bulk := makeTestPackets(DefaultBufferSize)
+	for _, pkt := range bulk {
+		pkt.Header.Dest.Socket = bulkSocket
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+	// The low priority buffer is full, but high priority packets can
+	// still be queued.
+	if err := p.WritePacket(bulk[0]); err != PipeFullError {
+		t.Errorf("want error %v, got %v", PipeFullError, err)
+	}
+	game := makeTestPackets(2)
+	for _, pkt := range game {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+
+	// High priority packets are read first, then the rest in order.
+	want := append(game, bulk...)
+	ctx := context.Background()
+	for i, wantPkt := range want {
+		got, err := p.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("failed ReadPacket: %v", err)
+		}
+		if got != wantPkt {
+			t.Fatalf("packet %d: want %+v, got %+v", i, wantPkt, got)
+		}
+	}
+}
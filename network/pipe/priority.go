@@ -0,0 +1,111 @@
+package pipe
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+var (
+	_ = (ipx.ReadWriteCloser)(&priorityPipe{})
+)
+
+// Classifier decides whether a packet written to a priority pipe is high
+// priority (true) or low priority (false).
+type Classifier func(*ipx.Packet) bool
+
+// SocketClassifier returns a Classifier that treats packets to or from any
+// of the given sockets as low priority, and all other packets as high
+// priority. This is useful for sockets used for bulk transfers, such as
+// file sharing, which can otherwise delay game packets.
+func SocketClassifier(lowPriority map[uint16]bool) Classifier {
+	return func(pkt *ipx.Packet) bool {
+		return !lowPriority[pkt.Header.Dest.Socket] && !lowPriority[pkt.Header.Src.Socket]
+	}
+}
+
+// priorityPipe is like a pipe, but has separate buffers for high and low
+// priority packets. Readers always receive any queued high priority packets
+// before low priority ones.
+type priorityPipe struct {
+	classifier Classifier
+	high, low  chan *ipx.Packet
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func (p *priorityPipe) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+func (p *priorityPipe) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// WritePacket queues a packet in the buffer for its priority. It never
+// blocks; if the buffer is full then PipeFullError is returned. A burst of
+// low priority packets therefore cannot cause high priority packets to be
+// dropped.
+func (p *priorityPipe) WritePacket(pkt *ipx.Packet) error {
+	if p.isClosed() {
+		return io.ErrClosedPipe
+	}
+	ch := p.low
+	if p.classifier(pkt) {
+		ch = p.high
+	}
+	select {
+	case ch <- pkt:
+		return nil
+	default:
+		return PipeFullError
+	}
+}
+
+// ReadPacket blocks until a packet is received, the pipe is closed or the
+// context expires. High priority packets are returned first.
+func (p *priorityPipe) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	if p.isClosed() {
+		return nil, io.ErrClosedPipe
+	}
+	select {
+	case pkt := <-p.high:
+		return pkt, nil
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.closed:
+		return nil, io.ErrClosedPipe
+	case pkt := <-p.high:
+		return pkt, nil
+	case pkt := <-p.low:
+		return pkt, nil
+	}
+}
+
+// NewPriority returns a new pipe that uses the given classifier to sort
+// packets into high and low priority. Each priority has its own buffer of
+// the given size; if size is not positive, DefaultBufferSize is used.
+func NewPriority(size int, classifier Classifier) *priorityPipe {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &priorityPipe{
+		classifier: classifier,
+		high:       make(chan *ipx.Packet, size),
+		low:        make(chan *ipx.Packet, size),
+		closed:     make(chan struct{}),
+	}
+}
@@ -0,0 +1,274 @@
+// Package sap implements a responder for the IPX Service Advertising Protocol
+// (SAP) and Routing Information Protocol (RIP). Real IPX networks use these
+// protocols so that clients can discover servers and routes; some older
+// software will not work unless it sees SAP responses. The responder answers
+// SAP queries with a static list of configured services, and answers RIP
+// requests for the local network.
+package sap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+const (
+	// SAPSocket is the well-known IPX socket number used for SAP.
+	SAPSocket = 0x452
+
+	// RIPSocket is the well-known IPX socket number used for RIP.
+	RIPSocket = 0x453
+
+	sapPacketType = 4
+	ripPacketType = 1
+
+	sapGeneralQuery    = 1
+	sapGeneralResponse = 2
+	sapNearestQuery    = 3
+	sapNearestResponse = 4
+
+	ripRequest  = 1
+	ripResponse = 2
+
+	// Each entry in a SAP response is 64 bytes long and a single
+	// response packet can hold at most seven entries.
+	sapEntryLength     = 64
+	sapEntriesPerReply = 7
+	sapNameLength      = 48
+
+	ripEntryLength = 8
+
+	// AllServiceTypes is the wildcard service type that matches any
+	// type of service in a SAP query.
+	AllServiceTypes = 0xffff
+
+	broadcastPeriod = 60 * time.Second
+)
+
+var (
+	allNetworks = [4]byte{0xff, 0xff, 0xff, 0xff}
+)
+
+// Service describes a service that is advertised to SAP queries.
+type Service struct {
+	// Type is the SAP service type, eg. 0x0004 for a file server.
+	Type uint16
+
+	// Name of the service, which is truncated to 47 characters.
+	Name string
+
+	// Address is the IPX address where the service can be reached.
+	Address ipx.HeaderAddr
+}
+
+func (s *Service) marshal() []byte {
+	result := make([]byte, sapEntryLength)
+	binary.BigEndian.PutUint16(result[0:2], s.Type)
+	copy(result[2:2+sapNameLength-1], []byte(s.Name))
+	addr, _ := s.Address.MarshalBinary()
+	copy(result[50:62], addr)
+	// Number of intermediate networks; the service is local.
+	binary.BigEndian.PutUint16(result[62:64], 1)
+	return result
+}
+
+// ParseServices parses a comma-separated list of service descriptions, each
+// of the form "name/type/address/socket", eg.
+// "FILESERVER/0x4/02:11:22:33:44:55/0x451".
+func ParseServices(s string) ([]Service, error) {
+	result := []Service{}
+	if s == "" {
+		return result, nil
+	}
+	for _, desc := range strings.Split(s, ",") {
+		fields := strings.Split(desc, "/")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid service %q: want name/type/address/socket", desc)
+		}
+		svcType, err := strconv.ParseUint(fields[1], 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type for service %q: %v", desc, err)
+		}
+		mac, err := net.ParseMAC(fields[2])
+		if err != nil || len(mac) != len(ipx.Addr{}) {
+			return nil, fmt.Errorf("invalid address for service %q", desc)
+		}
+		socket, err := strconv.ParseUint(fields[3], 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket for service %q: %v", desc, err)
+		}
+		svc := Service{
+			Type: uint16(svcType),
+			Name: fields[0],
+		}
+		copy(svc.Address.Addr[:], mac)
+		svc.Address.Socket = uint16(socket)
+		result = append(result, svc)
+	}
+	return result, nil
+}
+
+// Config contains configuration for a SAP/RIP responder.
+type Config struct {
+	// Services is the list of services advertised in SAP responses.
+	Services []Service
+
+	// If true, the list of services is broadcast to the network every
+	// 60 seconds, as real IPX servers do.
+	Broadcast bool
+}
+
+// Responder answers SAP and RIP requests on an IPX network.
+type Responder struct {
+	config Config
+	node   network.Node
+}
+
+func (r *Responder) sendPacket(dest *ipx.HeaderAddr, socket uint16, packetType byte, payload []byte) error {
+	return r.node.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Checksum:   0xffff,
+			Length:     uint16(ipx.HeaderLength + len(payload)),
+			PacketType: packetType,
+			Dest:       *dest,
+			Src: ipx.HeaderAddr{
+				Addr:   network.NodeAddress(r.node),
+				Socket: socket,
+			},
+		},
+		Payload: payload,
+	})
+}
+
+// matchingServices returns the configured services matching the given type.
+func (r *Responder) matchingServices(svcType uint16) []Service {
+	result := []Service{}
+	for _, svc := range r.config.Services {
+		if svcType == AllServiceTypes || svc.Type == svcType {
+			result = append(result, svc)
+		}
+	}
+	return result
+}
+
+// sendServices sends SAP responses of the given type listing the given
+// services, split across multiple packets if necessary.
+func (r *Responder) sendServices(dest *ipx.HeaderAddr, responseType uint16, services []Service) error {
+	for len(services) > 0 {
+		n := len(services)
+		if n > sapEntriesPerReply {
+			n = sapEntriesPerReply
+		}
+		payload := []byte{0, 0}
+		binary.BigEndian.PutUint16(payload[0:2], responseType)
+		for _, svc := range services[:n] {
+			payload = append(payload, svc.marshal()...)
+		}
+		if err := r.sendPacket(dest, SAPSocket, sapPacketType, payload); err != nil {
+			return err
+		}
+		services = services[n:]
+	}
+	return nil
+}
+
+func (r *Responder) handleSAP(packet *ipx.Packet) error {
+	if len(packet.Payload) < 4 {
+		return nil
+	}
+	queryType := binary.BigEndian.Uint16(packet.Payload[0:2])
+	svcType := binary.BigEndian.Uint16(packet.Payload[2:4])
+	services := r.matchingServices(svcType)
+	switch queryType {
+	case sapGeneralQuery:
+		return r.sendServices(&packet.Header.Src, sapGeneralResponse, services)
+	case sapNearestQuery:
+		if len(services) > 0 {
+			return r.sendServices(&packet.Header.Src, sapNearestResponse, services[:1])
+		}
+	}
+	return nil
+}
+
+func (r *Responder) handleRIP(packet *ipx.Packet) error {
+	if len(packet.Payload) < 2+ripEntryLength {
+		return nil
+	}
+	if binary.BigEndian.Uint16(packet.Payload[0:2]) != ripRequest {
+		return nil
+	}
+	var netNum [4]byte
+	copy(netNum[:], packet.Payload[2:6])
+	if netNum != ipx.ZeroNetwork && netNum != allNetworks {
+		return nil
+	}
+	// We only know about one network (network zero), and it is one
+	// hop and one tick away.
+	payload := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(payload[0:2], ripResponse)
+	binary.BigEndian.PutUint16(payload[6:8], 1)
+	binary.BigEndian.PutUint16(payload[8:10], 1)
+	return r.sendPacket(&packet.Header.Src, RIPSocket, ripPacketType, payload)
+}
+
+// sendBroadcasts runs as a background goroutine, periodically broadcasting
+// the list of services to the network.
+func (r *Responder) sendBroadcasts(ctx context.Context) {
+	dest := &ipx.HeaderAddr{
+		Addr:   ipx.AddrBroadcast,
+		Socket: SAPSocket,
+	}
+	for {
+		r.sendServices(dest, sapGeneralResponse, r.config.Services)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(broadcastPeriod):
+		}
+	}
+}
+
+// Run reads packets from the network and responds to any SAP and RIP
+// requests, blocking until the context is cancelled or the node is closed.
+func (r *Responder) Run(ctx context.Context) {
+	if r.config.Broadcast {
+		go r.sendBroadcasts(ctx)
+	}
+	for {
+		packet, err := r.node.ReadPacket(ctx)
+		switch {
+		case err == io.ErrClosedPipe || err == context.Canceled:
+			return
+		case err != nil:
+			slog.Error("unexpected error reading from node", "err", err)
+			return
+		}
+		switch packet.Header.Dest.Socket {
+		case SAPSocket:
+			err = r.handleSAP(packet)
+		case RIPSocket:
+			err = r.handleRIP(packet)
+		}
+		if err != nil {
+			slog.Warn("error sending SAP/RIP response", "err", err)
+		}
+	}
+}
+
+// New creates a new Responder that sends and receives packets using the
+// given node.
+func New(config *Config, node network.Node) *Responder {
+	return &Responder{
+		config: *config,
+		node:   node,
+	}
+}
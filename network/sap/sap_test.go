@@ -0,0 +1,161 @@
+package sap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var (
+	responderAddr = ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	clientAddr    = ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+)
+
+// startResponder runs a responder for the given services, returning a
+// function to send packets to it and a channel receiving its replies.
+func startResponder(t *testing.T, config *Config) (func(*ipx.Packet), chan *ipx.Packet) {
+	t.Helper()
+	replies := make(chan *ipx.Packet, 10)
+	dest := ipxtesting.MakeCallbackDest(func(packet *ipx.Packet) {
+		replies <- packet
+	})
+	r := New(config, &ipxtesting.FakeNetwork{Inner: dest, Address: responderAddr})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Run(ctx)
+	return func(packet *ipx.Packet) { dest.SendPacket(packet) }, replies
+}
+
+func query(socket uint16, payload ...uint16) *ipx.Packet {
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: socket},
+			Src:  ipx.HeaderAddr{Addr: clientAddr, Socket: 0x4000},
+		},
+	}
+	for _, x := range payload {
+		packet.Payload = binary.BigEndian.AppendUint16(packet.Payload, x)
+	}
+	return packet
+}
+
+func expectReply(t *testing.T, replies chan *ipx.Packet) *ipx.Packet {
+	t.Helper()
+	select {
+	case packet := <-replies:
+		if packet.Header.Dest.Addr != clientAddr || packet.Header.Src.Addr != responderAddr {
+			t.Errorf("reply has wrong addresses: %v", packet)
+		}
+		return packet
+	case <-time.After(time.Second):
+		t.Fatalf("no reply received")
+		return nil
+	}
+}
+
+func expectNoReply(t *testing.T, replies chan *ipx.Packet) {
+	t.Helper()
+	select {
+	case packet := <-replies:
+		t.Errorf("unexpected reply: %v", packet)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestParseServices(t *testing.T) {
+	services, err := ParseServices("FILESERVER/0x4/02:11:22:33:44:55/0x451,GAME/0x8000/02:00:00:00:00:02/0x869c")
+	if err != nil {
+		t.Fatalf("ParseServices failed: %v", err)
+	}
+	want := []Service{
+		{Type: 4, Name: "FILESERVER", Address: ipx.HeaderAddr{Addr: clientAddr, Socket: 0x451}},
+		{Type: 0x8000, Name: "GAME", Address: ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 0x02}, Socket: 0x869c}},
+	}
+	if fmt.Sprint(services) != fmt.Sprint(want) {
+		t.Errorf("wrong services parsed: want %v, got %v", want, services)
+	}
+	for _, s := range []string{
+		"FILESERVER/0x4/02:11:22:33:44:55",
+		"FILESERVER/xyz/02:11:22:33:44:55/0x451",
+		"FILESERVER/0x4/02:11:22:33/0x451",
+		"FILESERVER/0x4/02:11:22:33:44:55/0x10000",
+	} {
+		if _, err := ParseServices(s); err == nil {
+			t.Errorf("ParseServices(%q): want error, got none", s)
+		}
+	}
+}
+
+func TestSAPQueries(t *testing.T) {
+	var services []Service
+	for i := 0; i < 10; i++ {
+		services = append(services, Service{Type: 4, Name: fmt.Sprintf("SERVER%d", i)})
+	}
+	services = append(services, Service{Type: 0x8000, Name: "GAME"})
+	send, replies := startResponder(t, &Config{Services: services})
+
+	// A general query for all file servers needs two replies to fit
+	// them all.
+	send(query(SAPSocket, sapGeneralQuery, 4))
+	for _, want := range []int{7, 3} {
+		reply := expectReply(t, replies)
+		if got := (len(reply.Payload) - 2) / sapEntryLength; got != want {
+			t.Errorf("wrong number of entries in reply: want %d, got %d", want, got)
+		}
+		if got := binary.BigEndian.Uint16(reply.Payload[0:2]); got != sapGeneralResponse {
+			t.Errorf("wrong response type: want %d, got %d", sapGeneralResponse, got)
+		}
+	}
+
+	// A nearest query gets a single entry.
+	send(query(SAPSocket, sapNearestQuery, 0x8000))
+	reply := expectReply(t, replies)
+	if len(reply.Payload) != 2+sapEntryLength {
+		t.Fatalf("wrong length for nearest response: %d", len(reply.Payload))
+	}
+	if got := string(reply.Payload[4:8]); got != "GAME" {
+		t.Errorf("wrong service in nearest response: want %q, got %q", "GAME", got)
+	}
+
+	// No reply is sent for an unknown service type, or for a
+	// truncated query.
+	send(query(SAPSocket, sapNearestQuery, 0x1234))
+	send(query(SAPSocket, sapGeneralQuery))
+	expectNoReply(t, replies)
+}
+
+func TestRIPRequest(t *testing.T) {
+	send, replies := startResponder(t, &Config{})
+	// Requests for network zero are answered, others are not.
+	send(query(RIPSocket, ripRequest, 0x1234, 0x5678, 0xffff, 0xffff))
+	expectNoReply(t, replies)
+	send(query(RIPSocket, ripRequest, 0, 0, 0xffff, 0xffff))
+	reply := expectReply(t, replies)
+	if reply.Header.Src.Socket != RIPSocket || reply.Header.PacketType != ripPacketType {
+		t.Errorf("wrong RIP response header: %v", reply)
+	}
+	want := []byte{0, 2, 0, 0, 0, 0, 0, 1, 0, 1}
+	if string(reply.Payload) != string(want) {
+		t.Errorf("wrong RIP response: want %x, got %x", want, reply.Payload)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	_, replies := startResponder(t, &Config{
+		Services:  []Service{{Type: 4, Name: "SERVER"}},
+		Broadcast: true,
+	})
+	select {
+	case packet := <-replies:
+		if packet.Header.Dest.Addr != ipx.AddrBroadcast || packet.Header.Dest.Socket != SAPSocket {
+			t.Errorf("wrong destination for broadcast: %v", packet.Header.Dest)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no broadcast sent")
+	}
+}
@@ -0,0 +1,76 @@
+// Package service implements nodes for in-process services on the virtual
+// network, such as the echo service or SAP responder. A service node is
+// bound to one or more IPX sockets, and only packets sent to those sockets
+// are read from it; everything else is discarded before it reaches the
+// service. Where the underlying network supports it, such as the switch,
+// other packets are discarded before they are even queued for the node, so
+// that busy traffic on other sockets cannot crowd out the service's own.
+package service
+
+import (
+	"context"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+var (
+	_ = (network.Node)(&node{})
+)
+
+type node struct {
+	inner   network.Node
+	sockets map[uint16]bool
+}
+
+// ReadPacket blocks until a packet is received for one of the sockets the
+// node is bound to, or the context expires.
+func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		packet, err := n.inner.ReadPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if n.sockets[packet.Header.Dest.Socket] {
+			return packet, nil
+		}
+	}
+}
+
+func (n *node) WritePacket(packet *ipx.Packet) error {
+	return n.inner.WritePacket(packet)
+}
+
+func (n *node) Close() error {
+	return n.inner.Close()
+}
+
+func (n *node) GetProperty(x interface{}) bool {
+	return n.inner.GetProperty(x)
+}
+
+// Bind wraps the given node so that only packets sent to the given sockets
+// are read from it. Writes are passed through unchanged.
+func Bind(inner network.Node, sockets ...uint16) network.Node {
+	n := &node{
+		inner:   inner,
+		sockets: map[uint16]bool{},
+	}
+	for _, socket := range sockets {
+		n.sockets[socket] = true
+	}
+	var setFilter network.SocketFilterSetter
+	if inner.GetProperty(&setFilter) {
+		setFilter(sockets)
+	}
+	return n
+}
+
+// NewNode creates a new node on the given network for a service that
+// listens on the given sockets.
+func NewNode(n network.Network, sockets ...uint16) network.Node {
+	return Bind(n.NewNode(), sockets...)
+}
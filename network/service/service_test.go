@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+)
+
+func TestBoundSockets(t *testing.T) {
+	sw := ipxswitch.New(0)
+	client := sw.NewNode()
+	svc := NewNode(sw, 0x452, 0x453)
+	defer client.Close()
+	defer svc.Close()
+
+	for i, socket := range []uint16{0x869c, 0x452, 0x4000, 0x453} {
+		err := client.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: socket},
+				Src:  ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 0x01}},
+			},
+			Payload: []byte{byte(i)},
+		})
+		if err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, want := range []uint16{0x452, 0x453} {
+		packet, err := svc.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("ReadPacket failed waiting for socket %#x: %v", want, err)
+		}
+		if got := packet.Header.Dest.Socket; got != want {
+			t.Errorf("wrong packet received: want socket %#x, got %#x", want, got)
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := svc.ReadPacket(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ReadPacket with no matching packets: want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,159 @@
+// Package splithorizon implements a network that wraps another network
+// and prevents packets from looping between network segments. This can
+// happen when the server is connected to the same physical network more
+// than once, for example through both a bridge and an uplink to another
+// server that is bridged to the same network.
+//
+// Each address is "owned" by the node it was most recently seen sending
+// from. A packet is never forwarded back to the node that owns its source
+// address, and packets arriving on another node with a source address that
+// is already owned are assumed to have looped around and are discarded.
+// Ownership expires if nothing is seen from the address for a while, so
+// that machines can move between segments.
+package splithorizon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+const (
+	// DefaultAgeTime is the default time after which an address that
+	// has not been seen is no longer owned by its node.
+	DefaultAgeTime = 30 * time.Second
+)
+
+var (
+	_ = (network.Network)(&splitHorizonNetwork{})
+	_ = (network.Node)(&node{})
+
+	// LoopError is returned when a packet is written to a node but its
+	// source address is owned by another node, indicating that it has
+	// looped back to the network.
+	LoopError = errors.New("packet source address belongs to another segment")
+)
+
+type owner struct {
+	node     *node
+	lastSeen time.Time
+}
+
+type splitHorizonNetwork struct {
+	inner     network.Network
+	ageTime   time.Duration
+	mu        sync.Mutex
+	owners    map[ipx.Addr]*owner
+	lastSweep time.Time
+}
+
+// sweep discards ownership of addresses that have not been seen recently.
+func (n *splitHorizonNetwork) sweep(now time.Time) {
+	if now.Sub(n.lastSweep) < n.ageTime {
+		return
+	}
+	for addr, o := range n.owners {
+		if now.Sub(o.lastSeen) >= n.ageTime {
+			delete(n.owners, addr)
+		}
+	}
+	n.lastSweep = now
+}
+
+// learn records that a packet with the given source address was written
+// to the given node. LoopError is returned if the address is owned by
+// another node.
+func (n *splitHorizonNetwork) learn(addr ipx.Addr, nd *node) error {
+	if addr == ipx.AddrNull || addr == ipx.AddrBroadcast {
+		return nil
+	}
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sweep(now)
+	o, ok := n.owners[addr]
+	if ok && o.node != nd && now.Sub(o.lastSeen) < n.ageTime {
+		return LoopError
+	}
+	n.owners[addr] = &owner{node: nd, lastSeen: now}
+	return nil
+}
+
+// ownedBy returns true if the given address is owned by the given node.
+func (n *splitHorizonNetwork) ownedBy(addr ipx.Addr, nd *node) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	o, ok := n.owners[addr]
+	return ok && o.node == nd && time.Since(o.lastSeen) < n.ageTime
+}
+
+// forget discards ownership of all addresses owned by the given node.
+func (n *splitHorizonNetwork) forget(nd *node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for addr, o := range n.owners {
+		if o.node == nd {
+			delete(n.owners, addr)
+		}
+	}
+}
+
+func (n *splitHorizonNetwork) NewNode() network.Node {
+	return &node{
+		net:   n,
+		inner: n.inner.NewNode(),
+	}
+}
+
+type node struct {
+	net   *splitHorizonNetwork
+	inner network.Node
+}
+
+func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		packet, err := n.inner.ReadPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Never send a packet back toward the segment it came from.
+		if !n.net.ownedBy(packet.Header.Src.Addr, n) {
+			return packet, nil
+		}
+	}
+}
+
+func (n *node) WritePacket(packet *ipx.Packet) error {
+	if err := n.net.learn(packet.Header.Src.Addr, n); err != nil {
+		return err
+	}
+	return n.inner.WritePacket(packet)
+}
+
+func (n *node) Close() error {
+	n.net.forget(n)
+	return n.inner.Close()
+}
+
+func (n *node) GetProperty(x interface{}) bool {
+	return n.inner.GetProperty(x)
+}
+
+// Wrap creates a network that wraps the given network but discards packets
+// that loop back to it through another node. An address seen from one node
+// cannot be used from another node until nothing has been seen from it for
+// the given age time.
+func Wrap(n network.Network, ageTime time.Duration) network.Network {
+	return &splitHorizonNetwork{
+		inner:   n,
+		ageTime: ageTime,
+		owners:  map[ipx.Addr]*owner{},
+	}
+}
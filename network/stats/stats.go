@@ -4,6 +4,7 @@ package stats
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -20,26 +21,50 @@ type Statistics struct {
 	rxPackets, txPackets uint64
 	rxBytes, txBytes     uint64
 	connectTime          time.Time
+	// lastActivity is the time that a packet was last sent or received.
+	lastActivity time.Time
+	// droppedPackets is the number of packets that could not be sent
+	// because the node's receive buffer was full.
+	droppedPackets uint64
 }
 
 func (s *Statistics) String() string {
-	result := fmt.Sprintf("connected for %s; ", time.Since(s.connectTime))
+	result := fmt.Sprintf("connected for %s, ", time.Since(s.connectTime))
+	result += fmt.Sprintf("idle for %s; ", time.Since(s.lastActivity))
 	result += fmt.Sprintf("received %d packets (%d bytes), ",
 		s.rxPackets, s.rxBytes)
 	result += fmt.Sprintf("sent %d packets (%d bytes)",
 		s.txPackets, s.txBytes)
+	if s.droppedPackets > 0 {
+		result += fmt.Sprintf(", dropped %d packets", s.droppedPackets)
+	}
 	return result
 }
 
+// MarshalJSON implements the json.Marshaler interface.
+func (s *Statistics) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"connect_time":    s.connectTime,
+		"last_activity":   s.lastActivity,
+		"rx_packets":      s.rxPackets,
+		"rx_bytes":        s.rxBytes,
+		"tx_packets":      s.txPackets,
+		"tx_bytes":        s.txBytes,
+		"dropped_packets": s.droppedPackets,
+	})
+}
+
 type statsNetwork struct {
 	inner network.Network
 }
 
 func (n *statsNetwork) NewNode() network.Node {
+	now := time.Now()
 	return &node{
 		inner: n.inner.NewNode(),
 		stats: Statistics{
-			connectTime: time.Now(),
+			connectTime:  now,
+			lastActivity: now,
 		},
 	}
 }
@@ -59,6 +84,7 @@ func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	// we *write* a packet it's because we've received from them.
 	n.stats.txPackets++
 	n.stats.txBytes += uint64(len(packet.Payload) + ipx.HeaderLength)
+	n.stats.lastActivity = time.Now()
 	return packet, nil
 }
 
@@ -68,6 +94,7 @@ func (n *node) WritePacket(packet *ipx.Packet) error {
 	}
 	n.stats.rxPackets++
 	n.stats.rxBytes += uint64(len(packet.Payload) + ipx.HeaderLength)
+	n.stats.lastActivity = time.Now()
 	return nil
 }
 
@@ -78,7 +105,12 @@ func (n *node) Close() error {
 func (n *node) GetProperty(x interface{}) bool {
 	switch x.(type) {
 	case *Statistics:
-		*x.(*Statistics) = n.stats
+		stats := n.stats
+		var dropped network.DroppedPackets
+		if n.inner.GetProperty(&dropped) {
+			stats.droppedPackets = dropped.Count
+		}
+		*x.(*Statistics) = stats
 		return true
 	default:
 		return n.inner.GetProperty(x)
@@ -0,0 +1,37 @@
+package stats
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func getStats(t *testing.T, n interface{ GetProperty(interface{}) bool }) Statistics {
+	t.Helper()
+	var s Statistics
+	if !n.GetProperty(&s) {
+		t.Fatalf("failed to get statistics")
+	}
+	return s
+}
+
+func TestIdleTime(t *testing.T) {
+	n := Wrap(&ipxtesting.FakeNetwork{}).NewNode()
+	s := getStats(t, n)
+	if !s.lastActivity.Equal(s.connectTime) {
+		t.Errorf("want last activity %v to be connect time %v", s.lastActivity, s.connectTime)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	n.WritePacket(&ipx.Packet{Payload: []byte("hello")})
+	s = getStats(t, n)
+	if !s.lastActivity.After(s.connectTime) {
+		t.Errorf("last activity %v not updated after write", s.lastActivity)
+	}
+	if summary := Summary(n); !strings.Contains(summary, "idle for ") {
+		t.Errorf("summary does not include idle time: %q", summary)
+	}
+}
@@ -36,7 +36,7 @@ func (n *TappableNetwork) NewTap() ipx.ReadCloser {
 	defer n.mu.Unlock()
 	tap := &tap{
 		net:    n,
-		rxpipe: pipe.New(),
+		rxpipe: pipe.New(pipe.DefaultBufferSize),
 		tapID:  n.nextTapID,
 	}
 	n.nextTapID++
@@ -0,0 +1,129 @@
+package tappable
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+// makeTestNetwork returns a TappableNetwork wrapping a fake network, along
+// with a pointer to a slice that accumulates all packets that reach the
+// inner network.
+func makeTestNetwork() (*TappableNetwork, *[]*ipx.Packet) {
+	gotPackets := []*ipx.Packet{}
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		gotPackets = append(gotPackets, pkt)
+	})
+	return Wrap(&ipxtesting.FakeNetwork{Inner: dest}), &gotPackets
+}
+
+// readAll reads the given number of packets from the given tap.
+func readAll(t *testing.T, tap ipx.Reader, count int) []*ipx.Packet {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result := []*ipx.Packet{}
+	for i := 0; i < count; i++ {
+		pkt, err := tap.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("failed ReadPacket after %d packets: %v", i, err)
+		}
+		result = append(result, pkt)
+	}
+	return result
+}
+
+// assertEmpty checks that no more packets can be read from the given tap.
+func assertEmpty(t *testing.T, tap ipx.Reader) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pkt, err := tap.ReadPacket(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("want error %v, got packet %+v, error %v", context.DeadlineExceeded, pkt, err)
+	}
+}
+
+func TestTapsReceiveCopies(t *testing.T) {
+	n, gotPackets := makeTestNetwork()
+	tap1, tap2 := n.NewTap(), n.NewTap()
+	defer tap1.Close()
+	defer tap2.Close()
+
+	node := n.NewNode()
+	for _, pkt := range ipxtesting.TestPackets {
+		if err := node.WritePacket(pkt); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+	want := ipxtesting.TestPackets
+	if !reflect.DeepEqual(*gotPackets, want) {
+		t.Errorf("wrong packets written to inner network: want %+v, got %+v", want, *gotPackets)
+	}
+	for i, tap := range []ipx.ReadCloser{tap1, tap2} {
+		got := readAll(t, tap, len(want))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("tap %d received wrong packets: want %+v, got %+v", i+1, want, got)
+		}
+		assertEmpty(t, tap)
+	}
+}
+
+func TestClosedTap(t *testing.T) {
+	n, gotPackets := makeTestNetwork()
+	tap1, tap2 := n.NewTap(), n.NewTap()
+	defer tap2.Close()
+
+	node := n.NewNode()
+	tap1.Close()
+	for _, pkt := range ipxtesting.TestPackets {
+		if err := node.WritePacket(pkt); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+	want := ipxtesting.TestPackets
+	if !reflect.DeepEqual(*gotPackets, want) {
+		t.Errorf("wrong packets written to inner network: want %+v, got %+v", want, *gotPackets)
+	}
+	if _, err := tap1.ReadPacket(context.Background()); err != io.ErrClosedPipe {
+		t.Errorf("ReadPacket on closed tap: want error %v, got %v", io.ErrClosedPipe, err)
+	}
+	got := readAll(t, tap2, len(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("open tap received wrong packets: want %+v, got %+v", want, got)
+	}
+}
+
+func TestFullTapDoesNotBlock(t *testing.T) {
+	n, gotPackets := makeTestNetwork()
+	// This tap is never read from, so its buffer fills up.
+	tap := n.NewTap()
+	defer tap.Close()
+
+	node := n.NewNode()
+	numPackets := 1000
+	done := make(chan error)
+	go func() {
+		for i := 0; i < numPackets; i++ {
+			if err := node.WritePacket(ipxtesting.TestPackets[0]); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WritePacket blocked on full tap")
+	}
+	if len(*gotPackets) != numPackets {
+		t.Errorf("want %d packets written to inner network, got %d", numPackets, len(*gotPackets))
+	}
+}
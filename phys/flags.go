@@ -3,35 +3,106 @@ package phys
 import (
 	"flag"
 	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/fragglet/ipxbox/ipx"
 	"github.com/songgao/water"
 )
 
 type Flags struct {
 	PcapDevice      *string
 	EnableTap       *bool
+	TapFD           *int
 	EthernetFraming *string
+	EthernetVLAN    *uint
+	VXLANPeers      *string
+	VXLANPort       *int
+	VXLANVNI        *uint
+	NATAddress      *string
+	NetstackAddress *string
 }
 
 func RegisterFlags() *Flags {
 	f := &Flags{}
 	maybeAddPcapDeviceFlag(f)
+	maybeAddNetstackFlag(f)
 	f.EnableTap = flag.Bool("enable_tap", false, "Bridge the server to a tap device.")
+	f.TapFD = flag.Int("tap_fd", -1, "If not negative, bridge the server to an already-open tap device inherited as this file descriptor, instead of creating one.")
 	f.EthernetFraming = flag.String("ethernet_framing", "auto", `Framing to use when sending Ethernet packets. Valid values are "auto", "802.2", "802.3raw", "snap" and "eth-ii".`)
+	f.EthernetVLAN = flag.Uint("ethernet_vlan", 0, "If non-zero, send and receive Ethernet frames tagged with this 802.1Q VLAN ID.")
+	f.VXLANPeers = flag.String("vxlan_peers", "", "Bridge the server to a VXLAN segment shared with the given comma-separated list of peer addresses.")
+	f.VXLANPort = flag.Int("vxlan_port", VXLANPort, "UDP port to listen on for VXLAN packets.")
+	f.VXLANVNI = flag.Uint("vxlan_vni", 1, "VXLAN network identifier (VNI) of the segment to bridge to.")
+	f.NATAddress = flag.String("nat_address", "", "If not empty, hide the addresses of clients from the bridged physical network by rewriting the source address of packets sent to it to this address, translating socket numbers like a NAT router so that replies can be returned.")
 	return f
 }
 
+// pcapFilter returns the BPF filter expression that selects the IPX frames
+// captured from a pcap device. The "ipx" primitive only looks for the IPX
+// EtherType or LLC header at the untagged offset, so when a VLAN is in use
+// the tag must be matched first; otherwise every tagged frame is dropped.
+func (f *Flags) pcapFilter() string {
+	if *f.EthernetVLAN != 0 {
+		return fmt.Sprintf("vlan %d and ipx", *f.EthernetVLAN)
+	}
+	return "ipx"
+}
+
 func (f *Flags) EthernetStream(captureNonIPX bool) (DuplexEthernetStream, error) {
 	if *f.EnableTap {
 		return NewTap(water.Config{})
 	}
+	if *f.TapFD >= 0 {
+		return NewTapFromFD(*f.TapFD)
+	}
+	if *f.VXLANPeers != "" {
+		return NewVXLAN(*f.VXLANPort, *f.VXLANVNI, *f.VXLANPeers)
+	}
+	if stream, err := openNetstack(f); stream != nil || err != nil {
+		return stream, err
+	}
 	return openPcapHandle(f, captureNonIPX)
 }
 
-func (f *Flags) makeFramer() (Framer, error) {
+// WrapNAT wraps the given link to the physical network in a NAT if one was
+// requested with the flags. Otherwise the link is returned unchanged.
+func (f *Flags) WrapNAT(link ipx.ReadWriteCloser) (ipx.ReadWriteCloser, error) {
+	if *f.NATAddress == "" {
+		return link, nil
+	}
+	mac, err := net.ParseMAC(*f.NATAddress)
+	if err != nil {
+		return nil, err
+	}
+	var addr ipx.Addr
+	if len(mac) != len(addr) || mac[0]&0x01 != 0 {
+		return nil, fmt.Errorf("%q is not a unicast Ethernet address", *f.NATAddress)
+	}
+	copy(addr[:], mac)
+	return NewNAT(link, addr), nil
+}
+
+func (f *Flags) makeFramer(logger *slog.Logger) (Framer, error) {
+	framer, err := f.makeUntaggedFramer(logger)
+	if err != nil || *f.EthernetVLAN == 0 {
+		return framer, err
+	}
+	if *f.EthernetVLAN > maxVLANID {
+		return nil, fmt.Errorf("invalid VLAN ID %d", *f.EthernetVLAN)
+	}
+	return NewVLANFramer(framer, uint16(*f.EthernetVLAN))
+}
+
+func (f *Flags) makeUntaggedFramer(logger *slog.Logger) (Framer, error) {
 	framerName := *f.EthernetFraming
 	if framerName == "auto" {
+		if logger == nil {
+			logger = slog.Default()
+		}
 		return &automaticFramer{
 			fallback: Framer802_2,
+			logger:   logger,
 		}, nil
 	}
 	for _, framer := range allFramers {
@@ -42,12 +113,15 @@ func (f *Flags) makeFramer() (Framer, error) {
 	return nil, fmt.Errorf("unknown Ethernet framing %q", framerName)
 }
 
-func (f *Flags) MakePhys(captureNonIPX bool) (*Phys, error) {
+// MakePhys opens the physical network specified by the flags. If the Ethernet
+// framing is being autodetected, the detected framing is written to the given
+// logger, or to the default logger if it is nil.
+func (f *Flags) MakePhys(captureNonIPX bool, logger *slog.Logger) (*Phys, error) {
 	stream, err := f.EthernetStream(captureNonIPX)
 	if err != nil {
 		return nil, err
 	} else if stream != nil {
-		framer, err := f.makeFramer()
+		framer, err := f.makeFramer(logger)
 		if err != nil {
 			return nil, err
 		}
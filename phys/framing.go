@@ -1,6 +1,7 @@
 package phys
 
 import (
+	"log/slog"
 	"net"
 	"sync"
 
@@ -28,7 +29,9 @@ var (
 	FramerSNAP       = framerSNAP{}
 	FramerEthernetII = framerEthernetII{}
 
-	allFramers = []Framer{Framer802_2, Framer802_3Raw, FramerEthernetII, FramerSNAP}
+	// Raw 802.3 must be checked before 802.2 during autodetection,
+	// since both are 802.3 frames without an EtherType.
+	allFramers = []Framer{Framer802_3Raw, Framer802_2, FramerEthernetII, FramerSNAP}
 )
 
 // Unframe parses the layers in the given packet to locate and extract
@@ -98,6 +101,13 @@ func (framer802_2) Name() string { return "802.2" }
 type framer802_3Raw struct{}
 
 func (framer802_3Raw) Frame(dest net.HardwareAddr, packet *ipx.Packet) ([]gopacket.SerializableLayer, error) {
+	// Receivers identify raw frames by the checksum field, which must
+	// always be 0xffff.
+	packet = &ipx.Packet{
+		Header:  packet.Header,
+		Payload: packet.Payload,
+	}
+	packet.Header.Checksum = 0xffff
 	payload, err := packet.MarshalBinary()
 	if err != nil {
 		return nil, err
@@ -116,23 +126,17 @@ func (framer802_3Raw) Unframe(eth *layers.Ethernet, nextLayers []gopacket.Layer)
 	if eth.EthernetType != layers.EthernetTypeLLC {
 		return nil, false
 	}
-	if len(nextLayers) < 1 {
-		return nil, false
-	}
-	llc, ok := nextLayers[0].(*layers.LLC)
-	if !ok || llc.DSAP != lsapNovell || llc.SSAP != lsapNovell {
-		return nil, false
-	}
-	llcBytes := llc.LayerContents()
-	if llcBytes[0] != 0xff || llcBytes[1] != 0xff {
-		return nil, false
-	}
 	// Novell "raw" 802.3:
 	// https://en.wikipedia.org/wiki/Ethernet_frame#Novell_raw_IEEE_802.3
 	// "This does not conform to the IEEE 802.3 standard, but
 	// since IPX always has FF as the first two octets" it can be
-	// interpreted correctly.
-	return eth.LayerPayload(), true
+	// interpreted correctly. gopacket decodes these octets as an LLC
+	// header, so we look at the Ethernet payload directly instead.
+	payload := eth.LayerPayload()
+	if len(payload) < 2 || payload[0] != 0xff || payload[1] != 0xff {
+		return nil, false
+	}
+	return payload, true
 }
 
 func (framer802_3Raw) Name() string { return "802.3raw" }
@@ -211,15 +215,40 @@ func (framerEthernetII) Unframe(eth *layers.Ethernet, nextLayers []gopacket.Laye
 
 func (framerEthernetII) Name() string { return "eth-ii" }
 
+// maxLearnedFramings is the maximum number of machines for which
+// automaticFramer remembers the framing used.
+const maxLearnedFramings = 1024
+
 // automaticFramer picks a framer based on the first IPX packet it receives.
+// Since a physical network may have machines using different framings, it
+// also remembers the framing used by each machine it receives from, and
+// uses the same framing when sending to that machine.
 type automaticFramer struct {
 	framer, fallback Framer
 	mu               sync.RWMutex
+	logger           *slog.Logger
+	loopback         *loopbackDetector
+	learned          map[ipx.Addr]Framer
+}
+
+// findAutomaticFramer returns the automaticFramer used by the given framer,
+// or nil if it does not use one.
+func findAutomaticFramer(framer Framer) *automaticFramer {
+	if vf, ok := framer.(*vlanFramer); ok {
+		framer = vf.inner
+	}
+	af, _ := framer.(*automaticFramer)
+	return af
 }
 
 func (f *automaticFramer) Frame(dest net.HardwareAddr, packet *ipx.Packet) ([]gopacket.SerializableLayer, error) {
+	var addr ipx.Addr
+	copy(addr[:], dest)
 	f.mu.RLock()
-	framer := f.framer
+	framer, ok := f.learned[addr]
+	if !ok {
+		framer = f.framer
+	}
 	if framer == nil {
 		framer = f.fallback
 	}
@@ -227,6 +256,34 @@ func (f *automaticFramer) Frame(dest net.HardwareAddr, packet *ipx.Packet) ([]go
 	return framer.Frame(dest, packet)
 }
 
+// learnFraming records the framing used by the machine with the given MAC
+// address, given a payload that it sent.
+func (f *automaticFramer) learnFraming(src net.HardwareAddr, framer Framer, payload []byte) {
+	var addr ipx.Addr
+	if len(src) != len(addr) {
+		return
+	}
+	copy(addr[:], src)
+	f.mu.RLock()
+	current, ok := f.learned[addr]
+	full := len(f.learned) >= maxLearnedFramings
+	f.mu.RUnlock()
+	if current == framer || (!ok && full) {
+		return
+	}
+	// Packets we sent that are captured again use the framing that we
+	// chose, not necessarily what the machine expects.
+	if f.loopback != nil && f.loopback.isLoopback(payload) {
+		return
+	}
+	f.mu.Lock()
+	if f.learned == nil {
+		f.learned = make(map[ipx.Addr]Framer)
+	}
+	f.learned[addr] = framer
+	f.mu.Unlock()
+}
+
 func (f *automaticFramer) detectedFramer(detected Framer, payload []byte) {
 	f.mu.RLock()
 	framer := f.framer
@@ -240,24 +297,57 @@ func (f *automaticFramer) detectedFramer(detected Framer, payload []byte) {
 		if err := ipxpkt.UnmarshalBinary(payload); err != nil {
 			return
 		}
-		if ipxpkt.Header.TransControl != loopbackDetectValue {
-			// TODO: Write detected.Name() to log file
+		if f.loopback == nil || !f.loopback.isLoopback(payload) {
 			f.mu.Lock()
-			f.framer = detected
+			if f.framer == nil {
+				f.framer = detected
+				f.logger.Info("detected Ethernet framing",
+					"framing", detected.Name(),
+					"ipx_address", ipxpkt.Header.Src.Addr.String())
+			}
 			f.mu.Unlock()
 		}
 	}
 }
 
 func (f *automaticFramer) Unframe(eth *layers.Ethernet, nextLayers []gopacket.Layer) ([]byte, bool) {
+	framer, result, ok := f.unframe(eth, nextLayers)
+	if ok {
+		f.learnFraming(eth.SrcMAC, framer, result)
+	}
+	return result, ok
+}
+
+// unframe unframes the given packet, returning the framer that matched.
+func (f *automaticFramer) unframe(eth *layers.Ethernet, nextLayers []gopacket.Layer) (Framer, []byte, bool) {
+	// Fast path: once the framing has been detected, almost every packet
+	// will use it, so try it first before checking all the others.
+	if detected := f.Detected(); detected != nil {
+		if result, ok := detected.Unframe(eth, nextLayers); ok {
+			return detected, result, true
+		}
+	}
+	return f.unframeAll(eth, nextLayers)
+}
+
+// unframeAll tries all framers in turn until one matches.
+func (f *automaticFramer) unframeAll(eth *layers.Ethernet, nextLayers []gopacket.Layer) (Framer, []byte, bool) {
 	for _, framer := range allFramers {
 		result, ok := framer.Unframe(eth, nextLayers)
 		if ok {
 			f.detectedFramer(framer, result)
-			return result, true
+			return framer, result, true
 		}
 	}
-	return nil, false
+	return nil, nil, false
 }
 
 func (f *automaticFramer) Name() string { return "auto" }
+
+// Detected returns the framer that has been autodetected, or nil if no
+// packets have been received yet.
+func (f *automaticFramer) Detected() Framer {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.framer
+}
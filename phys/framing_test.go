@@ -0,0 +1,243 @@
+package phys
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var testPacket = &ipx.Packet{
+	Header: ipx.Header{
+		Checksum: 0xffff,
+		Length:   uint16(ipx.HeaderLength + 5),
+		Dest: ipx.HeaderAddr{
+			Addr:   ipx.AddrBroadcast,
+			Socket: 0x4000,
+		},
+		Src: ipx.HeaderAddr{
+			Addr:   ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+			Socket: 0x4000,
+		},
+	},
+	Payload: []byte("hello"),
+}
+
+// frameAndDecode frames the given packet using the given framer, and then
+// decodes the resulting frame as gopacket would when it is received.
+func frameAndDecode(t testing.TB, framer Framer, packet *ipx.Packet) gopacket.Packet {
+	dest := packet.Header.Dest.Addr[:]
+	ls, err := framer.Frame(dest, packet)
+	if err != nil {
+		t.Fatalf("%s: failed to frame packet: %v", framer.Name(), err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, ls...); err != nil {
+		t.Fatalf("%s: failed to serialize frame: %v", framer.Name(), err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func checkUnframed(t *testing.T, name string, payload []byte, packet *ipx.Packet) {
+	want, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Frames may be padded to the minimum Ethernet frame size.
+	if len(payload) < len(want) || !bytes.Equal(payload[:len(want)], want) {
+		t.Errorf("%s: wrong payload unframed: want %x, got %x", name, want, payload)
+	}
+}
+
+func TestVLANFraming(t *testing.T) {
+	for _, inner := range allFramers {
+		framer, err := NewVLANFramer(inner, 123)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt := frameAndDecode(t, framer, testPacket)
+		tag, ok := pkt.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+		if !ok {
+			t.Errorf("%s: frame does not have 802.1Q tag", framer.Name())
+			continue
+		}
+		if tag.VLANIdentifier != 123 {
+			t.Errorf("%s: wrong VLAN ID, want 123, got %d", framer.Name(), tag.VLANIdentifier)
+		}
+		payload, ok := Unframe(pkt, framer)
+		if !ok {
+			t.Errorf("%s: failed to unframe tagged frame", framer.Name())
+			continue
+		}
+		checkUnframed(t, framer.Name(), payload, testPacket)
+
+		otherVLAN, _ := NewVLANFramer(inner, 456)
+		if _, ok := Unframe(pkt, otherVLAN); ok {
+			t.Errorf("%s: frame for VLAN 123 unframed for VLAN 456", framer.Name())
+		}
+		untagged := frameAndDecode(t, inner, testPacket)
+		if _, ok := Unframe(untagged, framer); ok {
+			t.Errorf("%s: untagged frame was accepted", framer.Name())
+		}
+	}
+}
+
+func TestVLANAutomaticFraming(t *testing.T) {
+	af := &automaticFramer{fallback: Framer802_2, logger: slog.Default()}
+	framer, err := NewVLANFramer(af, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, _ := NewVLANFramer(FramerSNAP, 10)
+	pkt := frameAndDecode(t, sender, testPacket)
+	payload, ok := Unframe(pkt, framer)
+	if !ok {
+		t.Fatalf("failed to unframe tagged SNAP frame")
+	}
+	checkUnframed(t, "auto", payload, testPacket)
+}
+
+func TestFramingRoundTrip(t *testing.T) {
+	for _, framer := range allFramers {
+		pkt := frameAndDecode(t, framer, testPacket)
+		for _, other := range allFramers {
+			payload, ok := Unframe(pkt, other)
+			if other != framer {
+				if ok {
+					t.Errorf("%s frame was unframed as %s", framer.Name(), other.Name())
+				}
+				continue
+			}
+			if !ok {
+				t.Errorf("%s: failed to unframe", framer.Name())
+				continue
+			}
+			checkUnframed(t, framer.Name(), payload, testPacket)
+		}
+	}
+}
+
+func TestAutomaticFramingRaw(t *testing.T) {
+	// A genuine raw 802.3 frame as sent by an old Netware client. The
+	// length field is followed immediately by the IPX header, which
+	// always starts with a 0xffff checksum.
+	frame := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Destination MAC
+		0x02, 0x11, 0x22, 0x33, 0x44, 0x55, // Source MAC
+		0x00, 0x22, // Length
+		0xff, 0xff, // IPX checksum
+		0x00, 0x22, // IPX length
+		0x00,                   // Transport control
+		0x04,                   // Packet type
+		0x00, 0x00, 0x00, 0x00, // Destination network
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Destination node
+		0x04, 0x52, // Destination socket
+		0x00, 0x00, 0x00, 0x00, // Source network
+		0x02, 0x11, 0x22, 0x33, 0x44, 0x55, // Source node
+		0x40, 0x00, // Source socket
+		0x00, 0x01, 0x02, 0x03, // Payload
+	}
+	// Padding to minimum Ethernet frame size.
+	frame = append(frame, make([]byte, 60-len(frame))...)
+	pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	af := &automaticFramer{fallback: Framer802_2, logger: slog.Default()}
+	payload, ok := Unframe(pkt, af)
+	if !ok {
+		t.Fatalf("failed to unframe raw 802.3 frame")
+	}
+	if !bytes.Equal(payload[:len(frame)-14-14], frame[14:len(frame)-14]) {
+		t.Errorf("wrong payload unframed: %x", payload)
+	}
+	if detected := af.Detected(); detected != Framer802_3Raw {
+		t.Errorf("wrong framer detected: want 802.3raw, got %v", detected)
+	}
+}
+
+func TestAutomaticFramingFastPath(t *testing.T) {
+	af := &automaticFramer{fallback: Framer802_2, logger: slog.Default()}
+	for _, framer := range []Framer{FramerEthernetII, FramerEthernetII, FramerSNAP} {
+		pkt := frameAndDecode(t, framer, testPacket)
+		payload, ok := Unframe(pkt, af)
+		if !ok {
+			t.Fatalf("%s: failed to unframe", framer.Name())
+		}
+		checkUnframed(t, framer.Name(), payload, testPacket)
+	}
+	// Detected framing does not change once detected, even if other
+	// framings are then received.
+	if detected := af.Detected(); detected != FramerEthernetII {
+		t.Errorf("wrong framer detected: want eth-ii, got %v", detected)
+	}
+}
+
+func TestPerDestinationFraming(t *testing.T) {
+	af := &automaticFramer{fallback: Framer802_2, logger: slog.Default()}
+	rawAddr := ipx.Addr{0x00, 0x11, 0x22, 0x33, 0x44, 0x01}
+	ethIIAddr := ipx.Addr{0x00, 0x11, 0x22, 0x33, 0x44, 0x02}
+	otherAddr := ipx.Addr{0x00, 0x11, 0x22, 0x33, 0x44, 0x03}
+
+	// Two machines on the network use different framings.
+	for addr, framer := range map[ipx.Addr]Framer{
+		rawAddr:   Framer802_3Raw,
+		ethIIAddr: FramerEthernetII,
+	} {
+		packet := *testPacket
+		packet.Header.Src.Addr = addr
+		if _, ok := Unframe(frameAndDecode(t, framer, &packet), af); !ok {
+			t.Fatalf("%s: failed to unframe", framer.Name())
+		}
+	}
+	detected := af.Detected()
+
+	// Packets sent to each machine use the framing it uses, and other
+	// machines get the detected framing.
+	for addr, want := range map[ipx.Addr]Framer{
+		rawAddr:   Framer802_3Raw,
+		ethIIAddr: FramerEthernetII,
+		otherAddr: detected,
+	} {
+		packet := *testPacket
+		packet.Header.Dest.Addr = addr
+		pkt := frameAndDecode(t, af, &packet)
+		if _, ok := Unframe(pkt, want); !ok {
+			t.Errorf("packet to %v not sent with %s framing", addr, want.Name())
+		}
+	}
+}
+
+// unframeAllShim is a Framer that always tries every framer in turn, as
+// automaticFramer does before framing has been detected.
+type unframeAllShim struct {
+	*automaticFramer
+}
+
+func (s unframeAllShim) Unframe(eth *layers.Ethernet, nextLayers []gopacket.Layer) ([]byte, bool) {
+	_, result, ok := s.unframeAll(eth, nextLayers)
+	return result, ok
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func benchmarkUnframe(b *testing.B, framer Framer) {
+	pkt := frameAndDecode(b, FramerEthernetII, testPacket)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := Unframe(pkt, framer); !ok {
+			b.Fatalf("failed to unframe packet")
+		}
+	}
+}
+
+func BenchmarkUnframeTryAll(b *testing.B) {
+	af := &automaticFramer{fallback: Framer802_2, logger: discardLogger}
+	benchmarkUnframe(b, unframeAllShim{af})
+}
+
+func BenchmarkUnframeDetected(b *testing.B) {
+	af := &automaticFramer{fallback: Framer802_2, logger: discardLogger}
+	benchmarkUnframe(b, af)
+}
@@ -0,0 +1,51 @@
+package phys
+
+import (
+	"bytes"
+	"sync"
+)
+
+// loopbackHistory is the number of recently sent packets that are
+// remembered for loopback detection.
+const loopbackHistory = 64
+
+// loopbackDetector remembers the IPX packets most recently written to a
+// physical interface, so that they can be recognized and discarded if they
+// are captured again (bug #18). This was previously done by setting a magic
+// value in the TransControl field of packets we sent, but that caused
+// legitimate packets with the same value to be discarded.
+type loopbackDetector struct {
+	mu     sync.Mutex
+	recent [loopbackHistory][]byte
+	next   int
+}
+
+// sent records that the given marshaled IPX packet was written.
+func (d *loopbackDetector) sent(packet []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recent[d.next] = packet
+	d.next = (d.next + 1) % loopbackHistory
+}
+
+// isLoopback returns true if the given received IPX packet is one that was
+// recently sent. The received packet may have been padded with zeroes to
+// the minimum Ethernet frame size. The checksum field is ignored, since
+// some framers overwrite it.
+func (d *loopbackDetector) isLoopback(packet []byte) bool {
+	if len(packet) < 2 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, sent := range d.recent {
+		if len(sent) < 2 || !bytes.HasPrefix(packet[2:], sent[2:]) {
+			continue
+		}
+		padding := packet[len(sent):]
+		if len(bytes.Trim(padding, "\x00")) == 0 {
+			return true
+		}
+	}
+	return false
+}
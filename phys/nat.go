@@ -0,0 +1,166 @@
+package phys
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	// Sockets in this range are allocated dynamically by IPX stacks,
+	// so are used when a source socket cannot be preserved.
+	minDynamicSocket = 0x4000
+	maxDynamicSocket = 0x7fff
+
+	// natTimeout is the time after which an unused translation is
+	// discarded.
+	natTimeout = 5 * time.Minute
+)
+
+var (
+	_ = (ipx.ReadWriteCloser)(&NAT{})
+
+	// NATTableFullError is returned when a packet cannot be sent to the
+	// physical network because no socket is free to translate its
+	// source address to.
+	NATTableFullError = errors.New("no free sockets for address translation")
+)
+
+type natEntry struct {
+	internal ipx.HeaderAddr
+	socket   uint16
+	lastUsed time.Time
+}
+
+// NAT wraps the link to a physical network and translates addresses in the
+// same way as a NAT router, so that the physical network only sees a
+// single address. The source address of every packet sent to the physical
+// network is rewritten to the NAT's address, and its source socket to a
+// socket that identifies the original sender. The original socket number
+// is kept if no other sender is using it. Packets received that are
+// addressed to that socket have their destination translated back.
+// Broadcasts received from the physical network are passed through as
+// they are.
+type NAT struct {
+	inner     ipx.ReadWriteCloser
+	addr      ipx.Addr
+	mu        sync.Mutex
+	bySource  map[ipx.HeaderAddr]*natEntry
+	bySocket  map[uint16]*natEntry
+	next      uint16
+	lastSweep time.Time
+}
+
+// NewNAT creates a NAT that translates the addresses of packets passing
+// through the given link to the physical network, using the given address
+// as the only address seen on the physical network.
+func NewNAT(inner ipx.ReadWriteCloser, addr ipx.Addr) *NAT {
+	return &NAT{
+		inner:    inner,
+		addr:     addr,
+		bySource: map[ipx.HeaderAddr]*natEntry{},
+		bySocket: map[uint16]*natEntry{},
+		next:     minDynamicSocket,
+	}
+}
+
+// sweep discards translations that have not been used recently. The mutex
+// must be held.
+func (n *NAT) sweep(now time.Time) {
+	if now.Sub(n.lastSweep) < time.Minute {
+		return
+	}
+	for src, e := range n.bySource {
+		if now.Sub(e.lastUsed) >= natTimeout {
+			delete(n.bySource, src)
+			delete(n.bySocket, e.socket)
+		}
+	}
+	n.lastSweep = now
+}
+
+// allocSocket returns a free socket to use for translating the given
+// source socket. The mutex must be held.
+func (n *NAT) allocSocket(socket uint16) (uint16, bool) {
+	if _, ok := n.bySocket[socket]; !ok {
+		return socket, true
+	}
+	for i := 0; i <= maxDynamicSocket-minDynamicSocket; i++ {
+		candidate := n.next
+		n.next++
+		if n.next > maxDynamicSocket {
+			n.next = minDynamicSocket
+		}
+		if _, ok := n.bySocket[candidate]; !ok {
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+// translate returns the translation for the given source address, creating
+// a new one if necessary.
+func (n *NAT) translate(src ipx.HeaderAddr) (*natEntry, error) {
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.bySource[src]
+	if !ok {
+		n.sweep(now)
+		socket, ok := n.allocSocket(src.Socket)
+		if !ok {
+			return nil, NATTableFullError
+		}
+		e = &natEntry{internal: src, socket: socket}
+		n.bySource[src] = e
+		n.bySocket[socket] = e
+	}
+	e.lastUsed = now
+	return e, nil
+}
+
+// WritePacket sends the given packet to the physical network, with its
+// source address translated.
+func (n *NAT) WritePacket(packet *ipx.Packet) error {
+	e, err := n.translate(packet.Header.Src)
+	if err != nil {
+		return err
+	}
+	translated := *packet
+	translated.Header.Src.Addr = n.addr
+	translated.Header.Src.Socket = e.socket
+	return n.inner.WritePacket(&translated)
+}
+
+// ReadPacket returns the next packet received from the physical network.
+// Packets addressed to the NAT's address have their destination translated
+// back to the original sender; those that do not match a translation are
+// discarded.
+func (n *NAT) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	for {
+		packet, err := n.inner.ReadPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if packet.Header.Dest.Addr != n.addr {
+			return packet, nil
+		}
+		n.mu.Lock()
+		e, ok := n.bySocket[packet.Header.Dest.Socket]
+		if ok {
+			e.lastUsed = time.Now()
+			packet.Header.Dest = e.internal
+		}
+		n.mu.Unlock()
+		if ok {
+			return packet, nil
+		}
+	}
+}
+
+func (n *NAT) Close() error {
+	return n.inner.Close()
+}
@@ -0,0 +1,101 @@
+package phys
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var (
+	natAddr   = ipx.Addr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	realAddr  = ipx.Addr{0x00, 0x99, 0x88, 0x77, 0x66, 0x55}
+	client1   = ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	client2   = ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	gameSock  = uint16(0x869c)
+	otherSock = uint16(0x4567)
+)
+
+func natPacket(src ipx.Addr, srcSocket uint16, dest ipx.Addr, destSocket uint16) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Src:  ipx.HeaderAddr{Addr: src, Socket: srcSocket},
+			Dest: ipx.HeaderAddr{Addr: dest, Socket: destSocket},
+		},
+		Payload: []byte("hello"),
+	}
+}
+
+func TestNAT(t *testing.T) {
+	var sent []*ipx.Packet
+	physNet := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		sent = append(sent, pkt)
+	})
+	n := NewNAT(physNet, natAddr)
+	defer n.Close()
+
+	// Two clients send from the same socket; the first keeps its
+	// socket number and the second is given another.
+	n.WritePacket(natPacket(client1, gameSock, ipx.AddrBroadcast, gameSock))
+	n.WritePacket(natPacket(client2, gameSock, ipx.AddrBroadcast, gameSock))
+	n.WritePacket(natPacket(client1, gameSock, realAddr, gameSock))
+	if len(sent) != 3 {
+		t.Fatalf("want 3 packets sent, got %d", len(sent))
+	}
+	for i, pkt := range sent {
+		if pkt.Header.Src.Addr != natAddr {
+			t.Errorf("packet %d: source address not translated: %v", i, pkt.Header.Src)
+		}
+	}
+	if got := sent[0].Header.Src.Socket; got != gameSock {
+		t.Errorf("first client's socket not preserved: want %#x, got %#x", gameSock, got)
+	}
+	client2Sock := sent[1].Header.Src.Socket
+	if client2Sock == gameSock {
+		t.Errorf("second client was given the same socket as the first")
+	}
+	if got := sent[2].Header.Src.Socket; got != gameSock {
+		t.Errorf("translation not reused: want socket %#x, got %#x", gameSock, got)
+	}
+
+	// Replies are translated back to the right client; broadcasts and
+	// packets for unknown sockets are not.
+	physNet.SendPacket(natPacket(realAddr, gameSock, natAddr, otherSock))
+	physNet.SendPacket(natPacket(realAddr, gameSock, natAddr, client2Sock))
+	physNet.SendPacket(natPacket(realAddr, gameSock, ipx.AddrBroadcast, gameSock))
+	physNet.SendPacket(natPacket(realAddr, gameSock, natAddr, gameSock))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, want := range []ipx.HeaderAddr{
+		{Addr: client2, Socket: gameSock},
+		{Addr: ipx.AddrBroadcast, Socket: gameSock},
+		{Addr: client1, Socket: gameSock},
+	} {
+		pkt, err := n.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if pkt.Header.Dest != want {
+			t.Errorf("wrong destination: want %v, got %v", want, pkt.Header.Dest)
+		}
+	}
+}
+
+func TestNATTableFull(t *testing.T) {
+	n := NewNAT(ipxtesting.MakeCallbackDest(func(*ipx.Packet) {}), natAddr)
+	defer n.Close()
+	// The first sender keeps its socket, and the rest use up all the
+	// dynamic sockets.
+	for i := 0; i <= maxDynamicSocket-minDynamicSocket+1; i++ {
+		src := ipx.Addr{0x02, 0, 0, 0, byte(i >> 8), byte(i)}
+		if err := n.WritePacket(natPacket(src, gameSock, realAddr, gameSock)); err != nil {
+			t.Fatalf("packet %d: WritePacket failed: %v", i, err)
+		}
+	}
+	err := n.WritePacket(natPacket(ipx.Addr{0x02, 0xff, 0, 0, 0, 1}, gameSock, realAddr, gameSock))
+	if err != NATTableFullError {
+		t.Errorf("want error %v, got %v", NATTableFullError, err)
+	}
+}
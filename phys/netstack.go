@@ -0,0 +1,280 @@
+//go:build netstack
+// +build netstack
+
+package phys
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	netstackNIC       = 1
+	netstackQueueSize = 512
+
+	// netstackMaxInFlight is the maximum number of TCP connections that
+	// can be in the process of being established at once.
+	netstackMaxInFlight = 256
+
+	// netstackUDPTimeout is how long a UDP flow can be idle in both
+	// directions before it is forgotten.
+	netstackUDPTimeout = 2 * time.Minute
+)
+
+var (
+	_ = (DuplexEthernetStream)(&netstackStream{})
+)
+
+// netstackStream implements the DuplexEthernetStream interface using gVisor's
+// userspace TCP/IP stack. The stack appears on the Ethernet segment as a
+// router; TCP connections and UDP flows that clients send through it are
+// terminated inside the stack and relayed to their real destinations using
+// ordinary sockets, so that clients share the host's address like they would
+// behind a NAT router.
+type netstackStream struct {
+	stack  *stack.Stack
+	ep     *channel.Endpoint
+	ctx    context.Context
+	cancel context.CancelFunc
+	dialer net.Dialer
+}
+
+// netstackLinkAddress returns the Ethernet address used by the stack with the
+// given IPv4 address. Like libslirp, the address is derived from the IP
+// address so that it is stable across restarts.
+func netstackLinkAddress(addr tcpip.Address) tcpip.LinkAddress {
+	ip := addr.As4()
+	return tcpip.LinkAddress([]byte{0x52, 0x55, ip[0], ip[1], ip[2], ip[3]})
+}
+
+// newNetstackStream creates a stack with a single Ethernet interface that has
+// the given address and a route to the subnet that the address is on.
+func newNetstackStream(addr tcpip.AddressWithPrefix) (*netstackStream, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	ep := channel.New(netstackQueueSize, 1500+14, netstackLinkAddress(addr.Address))
+	if err := s.CreateNIC(netstackNIC, ethernet.New(ep)); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to create NIC: %v", err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: addr,
+	}
+	if err := s.AddProtocolAddress(netstackNIC, protocolAddr, stack.AddressProperties{}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to add address %v: %v", addr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: addr.Subnet(), NIC: netstackNIC},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	return &netstackStream{
+		stack:  s,
+		ep:     ep,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (s *netstackStream) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	pkt := s.ep.ReadContext(s.ctx)
+	if pkt.IsNil() {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	defer pkt.DecRef()
+	var frame []byte
+	for _, b := range pkt.AsSlices() {
+		frame = append(frame, b...)
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(frame),
+		Length:        len(frame),
+	}
+	return frame, ci, nil
+}
+
+func (s *netstackStream) WritePacketData(frame []byte) error {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(frame),
+	})
+	defer pkt.DecRef()
+	// The Ethernet header is parsed by the stack, which silently drops
+	// any frames (including IPX) for protocols that it does not speak.
+	s.ep.InjectInbound(0, pkt)
+	return nil
+}
+
+func (s *netstackStream) Close() {
+	s.cancel()
+	s.ep.Close()
+	s.stack.Close()
+}
+
+// dialAddress returns the address to dial on the real network to reach the
+// destination that a client was trying to reach.
+func dialAddress(id stack.TransportEndpointID) string {
+	return net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+}
+
+// closeWrite shuts down the sending side of the given connection, or the
+// whole connection if it does not support half-closing.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
+
+// spliceStreams copies data in both directions between the given two
+// connections until both directions are finished, then closes them.
+func spliceStreams(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		closeWrite(dst)
+		done <- struct{}{}
+	}
+	go relay(a, b)
+	go relay(b, a)
+	<-done
+	<-done
+}
+
+// spliceDatagrams copies datagrams in both directions between the given two
+// connections until nothing has been sent in either direction for
+// netstackUDPTimeout, then closes them.
+func spliceDatagrams(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	extendDeadline := func() {
+		deadline := time.Now().Add(netstackUDPTimeout)
+		a.SetReadDeadline(deadline)
+		b.SetReadDeadline(deadline)
+	}
+	extendDeadline()
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 65536)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+			extendDeadline()
+		}
+	}
+	go relay(a, b)
+	go relay(b, a)
+	// Once either direction fails, the deferred closes unblock the other.
+	<-done
+}
+
+func (s *netstackStream) forwardTCP(r *tcp.ForwarderRequest) {
+	outside, err := s.dialer.DialContext(s.ctx, "tcp", dialAddress(r.ID()))
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		outside.Close()
+		return
+	}
+	r.Complete(false)
+	go spliceStreams(gonet.NewTCPConn(&wq, ep), outside)
+}
+
+func (s *netstackStream) forwardUDP(r *udp.ForwarderRequest) {
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		return
+	}
+	inside := gonet.NewUDPConn(s.stack, &wq, ep)
+	outside, err := s.dialer.DialContext(s.ctx, "udp", dialAddress(r.ID()))
+	if err != nil {
+		inside.Close()
+		return
+	}
+	go spliceDatagrams(inside, outside)
+}
+
+// NewNetstack creates a DuplexEthernetStream that acts as a NAT router,
+// giving machines on the Ethernet segment access to the networks that the
+// host can reach without needing a TAP device or an external helper. The
+// router has the given IPv4 address and prefix length (for example
+// "10.0.2.2/24"); clients must be configured with an address on the same
+// subnet and use the router as their default gateway. Only TCP and UDP are
+// relayed.
+func NewNetstack(addr string) (*netstackStream, error) {
+	ip, ipnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 address", addr)
+	}
+	prefixLen, _ := ipnet.Mask.Size()
+	s, err := newNetstackStream(tcpip.AddressWithPrefix{
+		Address:   tcpip.AddrFrom4Slice(ip.To4()),
+		PrefixLen: prefixLen,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Promiscuous mode lets the stack accept packets addressed to any
+	// destination, and spoofing lets it reply from those addresses.
+	s.stack.SetPromiscuousMode(netstackNIC, true)
+	s.stack.SetSpoofing(netstackNIC, true)
+	tcpForwarder := tcp.NewForwarder(s.stack, 0, netstackMaxInFlight, s.forwardTCP)
+	s.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s.stack, s.forwardUDP)
+	s.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	return s, nil
+}
+
+func openNetstack(f *Flags) (DuplexEthernetStream, error) {
+	if *f.NetstackAddress == "" {
+		return nil, nil
+	}
+	s, err := NewNetstack(*f.NetstackAddress)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func maybeAddNetstackFlag(f *Flags) {
+	f.NetstackAddress = flag.String("netstack_address", "", `If not empty, bridge the server to a userspace NAT router with this IPv4 address and prefix length (for example "10.0.2.2/24"), which relays TCP connections and UDP flows from clients to the networks that the host can reach. Only useful with --enable_ipxpkt.`)
+}
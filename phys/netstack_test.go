@@ -0,0 +1,188 @@
+//go:build netstack
+// +build netstack
+
+package phys
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// hostAddress returns a non-loopback IPv4 address of this machine. The stack
+// does not accept packets for loopback addresses from the Ethernet segment,
+// so the tests need another address to connect to.
+func hostAddress(t *testing.T) net.IP {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+			return ipnet.IP.To4()
+		}
+	}
+	t.Skip("no non-loopback IPv4 address to test with")
+	return nil
+}
+
+// makeNetstackClient creates a NAT router and a client stack on the same
+// Ethernet segment, with the router as the client's default gateway.
+func makeNetstackClient(t *testing.T) *netstackStream {
+	t.Helper()
+	router, err := NewNetstack("10.0.2.2/24")
+	if err != nil {
+		t.Fatalf("NewNetstack failed: %v", err)
+	}
+	t.Cleanup(router.Close)
+	client, err := newNetstackStream(tcpip.AddressWithPrefix{
+		Address:   tcpip.AddrFrom4([4]byte{10, 0, 2, 15}),
+		PrefixLen: 24,
+	})
+	if err != nil {
+		t.Fatalf("newNetstackStream failed: %v", err)
+	}
+	t.Cleanup(client.Close)
+	client.stack.AddRoute(tcpip.Route{
+		Destination: header.IPv4EmptySubnet,
+		Gateway:     tcpip.AddrFrom4([4]byte{10, 0, 2, 2}),
+		NIC:         netstackNIC,
+	})
+	go CopyFrames(client, router)
+	return client
+}
+
+func fullAddress(addr net.Addr) tcpip.FullAddress {
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	return tcpip.FullAddress{
+		NIC:  netstackNIC,
+		Addr: tcpip.AddrFrom4Slice(ip.To4()),
+		Port: uint16(port),
+	}
+}
+
+func TestNetstackTCP(t *testing.T) {
+	host := hostAddress(t)
+	client := makeNetstackClient(t)
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The connection comes from the host, not the client.
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(host) {
+			t.Errorf("connection from %v, want %v", ip, host)
+		}
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := gonet.DialContextTCP(ctx, client.stack, fullAddress(l.Addr()), ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialContextTCP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	conn.CloseWrite()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("want %q echoed back, got %q", "hello", got)
+	}
+}
+
+func TestNetstackUDP(t *testing.T) {
+	host := hostAddress(t)
+	client := makeNetstackClient(t)
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	raddr := fullAddress(pc.LocalAddr())
+	conn, err := gonet.DialUDP(client.stack, nil, &raddr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	buf := make([]byte, 100)
+	n, from, err := pc.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("ReadFromUDP failed: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("want %q, got %q", "ping", buf[:n])
+	}
+	if !from.IP.Equal(host) {
+		t.Errorf("datagram from %v, want %v", from.IP, host)
+	}
+	if _, err := pc.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatalf("WriteToUDP failed: %v", err)
+	}
+	n, err = conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("want %q, got %q", "pong", buf[:n])
+	}
+}
+
+func TestNetstackIgnoresIPX(t *testing.T) {
+	router, err := NewNetstack("10.0.2.2/24")
+	if err != nil {
+		t.Fatalf("NewNetstack failed: %v", err)
+	}
+	defer router.Close()
+	frame := []byte("\xff\xff\xff\xff\xff\xff\x02\x00\x00\x00\x00\x01\x00\x1e\xff\xff")
+	if err := router.WritePacketData(frame); err != nil {
+		t.Errorf("WritePacketData failed: %v", err)
+	}
+	if n := router.ep.NumQueued(); n != 0 {
+		t.Errorf("want no frames sent in response to IPX frame, got %d", n)
+	}
+}
+
+func TestNewNetstackErrors(t *testing.T) {
+	for _, addr := range []string{"", "10.0.2.2", "fe80::1/64", "bogus/24"} {
+		if s, err := NewNetstack(addr); err == nil {
+			s.Close()
+			t.Errorf("NewNetstack(%q) succeeded, want error", addr)
+		}
+	}
+}
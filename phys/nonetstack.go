@@ -0,0 +1,11 @@
+//go:build !netstack
+// +build !netstack
+
+package phys
+
+func openNetstack(f *Flags) (DuplexEthernetStream, error) {
+	return nil, nil
+}
+
+func maybeAddNetstackFlag(f *Flags) {
+}
@@ -43,7 +43,7 @@ func openPcapHandle(f *Flags, captureNonIPX bool) (DuplexEthernetStream, error)
 	// because they're all we care about. However, when ipxpkt routing is
 	// enabled we want all Ethernet frames.
 	if !captureNonIPX {
-		if err := handle.SetBPFFilter("ipx"); err != nil {
+		if err := handle.SetBPFFilter(f.pcapFilter()); err != nil {
 			return nil, err
 		}
 	}
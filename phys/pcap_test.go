@@ -0,0 +1,55 @@
+//go:build !nopcap
+// +build !nopcap
+
+package phys
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// TestPcapFilter checks that the filter set on pcap devices passes IPX
+// frames in each framing, including when they are tagged with the
+// configured VLAN.
+func TestPcapFilter(t *testing.T) {
+	for _, vlanID := range []uint{0, 123} {
+		f := &Flags{EthernetVLAN: &vlanID}
+		bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 1500, f.pcapFilter())
+		if err != nil {
+			t.Fatalf("VLAN %d: failed to compile filter %q: %v", vlanID, f.pcapFilter(), err)
+		}
+		for _, inner := range allFramers {
+			framer := inner
+			if vlanID != 0 {
+				framer, err = NewVLANFramer(inner, uint16(vlanID))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			data := frameAndDecode(t, framer, testPacket).Data()
+			ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+			if !bpf.Matches(ci, data) {
+				t.Errorf("VLAN %d: %s frame rejected by filter %q", vlanID, framer.Name(), f.pcapFilter())
+			}
+			if vlanID == 0 {
+				continue
+			}
+			// Frames for other VLANs, or untagged frames, are
+			// not wanted.
+			other, _ := NewVLANFramer(inner, 456)
+			data = frameAndDecode(t, other, testPacket).Data()
+			ci = gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+			if bpf.Matches(ci, data) {
+				t.Errorf("VLAN %d: %s frame for VLAN 456 passed by filter", vlanID, framer.Name())
+			}
+			data = frameAndDecode(t, inner, testPacket).Data()
+			ci = gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+			if bpf.Matches(ci, data) {
+				t.Errorf("VLAN %d: untagged %s frame passed by filter", vlanID, inner.Name())
+			}
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
@@ -18,12 +19,6 @@ import (
 	"github.com/google/gopacket/pcapgo"
 )
 
-// loopbackDetectValue is a special magic value that the TransControl
-// field is set to when IPX packets are written to a physical interface.
-// We use this to detect packets if they have been looped back and
-// captured again due to bug #18, and discard them.
-const loopbackDetectValue = 127
-
 var (
 	_ = (ipx.WriteCloser)(&Sink{})
 	_ = (ipx.ReadWriteCloser)(&Phys{})
@@ -65,13 +60,19 @@ func (s *pcapgoSinkShim) WritePacketData(data []byte) error {
 	}, data)
 }
 
-func (s *pcapgoSinkShim) Close() {}
+func (s *pcapgoSinkShim) Close() {
+	if c, ok := s.pds.(io.Closer); ok {
+		c.Close()
+	}
+}
 
 // Sink is an implementation of ipx.WriteCloser that frames IPX packets and
 // writes them to a physical network interface.
 type Sink struct {
-	pds    PacketDataSink
-	framer Framer
+	pds      PacketDataSink
+	framer   Framer
+	loopback *loopbackDetector
+	txFrames atomic.Uint64
 }
 
 // WritePacket implements the ipx.Writer interface, and will write the
@@ -82,16 +83,25 @@ func (s *Sink) WritePacket(packet *ipx.Packet) error {
 	opts := gopacket.SerializeOptions{}
 	modifiedHeader := packet.Header
 	modifiedHeader.Checksum = 0
-	modifiedHeader.TransControl = loopbackDetectValue
-	layers, err := s.framer.Frame(dest, &ipx.Packet{
+	modifiedPacket := &ipx.Packet{
 		Header:  modifiedHeader,
 		Payload: packet.Payload,
-	})
+	}
+	layers, err := s.framer.Frame(dest, modifiedPacket)
 	if err != nil {
 		return err
 	}
+	packetBytes, err := modifiedPacket.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	s.loopback.sent(packetBytes)
 	gopacket.SerializeLayers(buf, opts, layers...)
-	return s.pds.WritePacketData(buf.Bytes())
+	if err := s.pds.WritePacketData(buf.Bytes()); err != nil {
+		return err
+	}
+	s.txFrames.Add(1)
+	return nil
 }
 
 func (s *Sink) Close() error {
@@ -103,8 +113,9 @@ func (s *Sink) Close() error {
 // to the given gopacket data sink.
 func NewSink(pds PacketDataSink, framer Framer) *Sink {
 	return &Sink{
-		pds:    pds,
-		framer: framer,
+		pds:      pds,
+		framer:   framer,
+		loopback: &loopbackDetector{},
 	}
 }
 
@@ -114,14 +125,41 @@ func NewPcapgoSink(pds PcapgoDataSink, framer Framer) *Sink {
 	return NewSink(&pcapgoSinkShim{pds}, framer)
 }
 
+// Status describes the state of the link to a physical network. It can be
+// fetched from a Phys using GetProperty.
+type Status struct {
+	// Up is true while frames are being read from the network. It is
+	// false before Run is called, and after Run has returned, in which
+	// case Err describes why.
+	Up  bool   `json:"up"`
+	Err string `json:"err,omitempty"`
+
+	// Framing is the name of the configured Ethernet framing, and
+	// DetectedFraming is the framing in use if it is being
+	// autodetected, or empty if none has been detected yet.
+	Framing         string `json:"framing"`
+	DetectedFraming string `json:"detected_framing,omitempty"`
+
+	// RxFrames and TxFrames count the IPX frames received from and
+	// sent to the network, and NonIPXFrames counts other frames that
+	// were received.
+	RxFrames     uint64 `json:"rx_frames"`
+	TxFrames     uint64 `json:"tx_frames"`
+	NonIPXFrames uint64 `json:"non_ipx_frames"`
+}
+
 // Phys is an implementation of ipx.ReadWriteCloser that reads and writes
 // IPX packets from a physical network interface.
 type Phys struct {
 	*Sink
-	ps     *gopacket.PacketSource
-	rxpipe ipx.ReadWriteCloser
-	nonIPX *nonIPX
-	mu     sync.Mutex
+	ps           *gopacket.PacketSource
+	rxpipe       ipx.ReadWriteCloser
+	nonIPX       *nonIPX
+	mu           sync.Mutex
+	up           bool
+	err          error
+	rxFrames     atomic.Uint64
+	nonIPXFrames atomic.Uint64
 }
 
 func (p *Phys) Close() error {
@@ -135,23 +173,36 @@ func (p *Phys) Close() error {
 	return nil
 }
 
+func (p *Phys) setUp(up bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.up, p.err = up, err
+}
+
 func (p *Phys) Run() error {
+	p.setUp(true, nil)
 	for {
 		pkt, err := p.ps.NextPacket()
 		if err != nil {
+			p.setUp(false, err)
 			return err
 		}
 		payload, ok := Unframe(pkt, p.Sink.framer)
 		if ok {
+			// Frames are often padded to the minimum Ethernet frame
+			// size, so the length field must be used to find the
+			// real end of the packet.
 			ipxpkt := &ipx.Packet{}
-			if err := ipxpkt.UnmarshalBinary(payload); err != nil {
-				return err
+			if err := ipxpkt.UnmarshalBinaryStrict(payload); err != nil {
+				continue
 			}
+			p.rxFrames.Add(1)
 			// We discard looped-back packets (bug #18):
-			if ipxpkt.Header.TransControl != loopbackDetectValue {
+			if !p.Sink.loopback.isLoopback(payload) {
 				p.rxpipe.WritePacket(ipxpkt)
 			}
 		} else {
+			p.nonIPXFrames.Add(1)
 			p.mu.Lock()
 			if p.nonIPX != nil {
 				p.nonIPX.frames <- pkt
@@ -161,6 +212,49 @@ func (p *Phys) Run() error {
 	}
 }
 
+// Framer returns the framer being used to send packets. If the framing is
+// being autodetected, the detected framer is returned, or nil if it has not
+// yet been detected.
+func (p *Phys) Framer() Framer {
+	if af := findAutomaticFramer(p.Sink.framer); af != nil {
+		return af.Detected()
+	}
+	if vf, ok := p.Sink.framer.(*vlanFramer); ok {
+		return vf.inner
+	}
+	return p.Sink.framer
+}
+
+// Status returns the current state of the link to the physical network.
+func (p *Phys) Status() Status {
+	p.mu.Lock()
+	result := Status{Up: p.up}
+	if p.err != nil {
+		result.Err = p.err.Error()
+	}
+	p.mu.Unlock()
+	result.Framing = p.Sink.framer.Name()
+	if f := p.Framer(); f != nil && findAutomaticFramer(p.Sink.framer) != nil {
+		result.DetectedFraming = f.Name()
+	}
+	result.RxFrames = p.rxFrames.Load()
+	result.TxFrames = p.Sink.txFrames.Load()
+	result.NonIPXFrames = p.nonIPXFrames.Load()
+	return result
+}
+
+// GetProperty populates the given value based on its type, in the same way
+// as network.Node. The link's Status can be fetched.
+func (p *Phys) GetProperty(x interface{}) bool {
+	switch x.(type) {
+	case *Status:
+		*x.(*Status) = p.Status()
+		return true
+	default:
+		return false
+	}
+}
+
 // ReadPacket implements the ipx.Reader interface, and will block until an
 // IPX packet is read from the physical interface.
 func (p *Phys) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
@@ -254,10 +348,14 @@ func (ni *nonIPX) Close() {
 }
 
 func NewPhys(stream DuplexEthernetStream, framer Framer) *Phys {
+	sink := NewSink(stream, framer)
+	if af := findAutomaticFramer(framer); af != nil {
+		af.loopback = sink.loopback
+	}
 	return &Phys{
-		Sink:   NewSink(stream, framer),
+		Sink:   sink,
 		ps:     gopacket.NewPacketSource(stream, layers.LinkTypeEthernet),
-		rxpipe: pipe.New(),
+		rxpipe: pipe.New(pipe.DefaultBufferSize),
 	}
 }
 
@@ -0,0 +1,132 @@
+package phys
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/google/gopacket"
+)
+
+// fakeStream is a DuplexEthernetStream where frames to be read are
+// supplied through a channel, and written frames are recorded.
+type fakeStream struct {
+	rx      chan []byte
+	written [][]byte
+}
+
+func (s *fakeStream) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	frame, ok := <-s.rx
+	if !ok {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	return frame, gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(frame),
+		Length:        len(frame),
+	}, nil
+}
+
+func (s *fakeStream) WritePacketData(frame []byte) error {
+	s.written = append(s.written, append([]byte{}, frame...))
+	return nil
+}
+
+func (s *fakeStream) Close() {}
+
+func serializeFrame(t *testing.T, framer Framer, packet *ipx.Packet) []byte {
+	ls, err := framer.Frame(packet.Header.Dest.Addr[:], packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoopbackDetection(t *testing.T) {
+	stream := &fakeStream{rx: make(chan []byte, 2)}
+	p := NewPhys(stream, FramerEthernetII)
+	go p.Run()
+	defer p.Close()
+
+	if err := p.WritePacket(testPacket); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.written) != 1 {
+		t.Fatalf("want one frame written, got %d", len(stream.written))
+	}
+	// The frame we sent is captured again and must be discarded, but a
+	// packet from elsewhere that happens to have TransControl=127 (the
+	// value that was once used to mark sent packets) must not be.
+	legitimate := *testPacket
+	legitimate.Header.TransControl = 127
+	legitimate.Header.Src.Addr = ipx.Addr{0x02, 0x66, 0x77, 0x88, 0x99, 0xaa}
+	stream.rx <- stream.written[0]
+	stream.rx <- serializeFrame(t, FramerEthernetII, &legitimate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	packet, err := p.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("legitimate packet was not received: %v", err)
+	}
+	if packet.Header.Src.Addr != legitimate.Header.Src.Addr {
+		t.Errorf("looped-back packet was not discarded: got packet from %s", packet.Header.Src.Addr)
+	}
+	if packet.Header.TransControl != 127 {
+		t.Errorf("wrong TransControl: want 127, got %d", packet.Header.TransControl)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	stream := &fakeStream{rx: make(chan []byte, 2)}
+	af := &automaticFramer{fallback: Framer802_2, logger: discardLogger}
+	p := NewPhys(stream, af)
+	defer p.Close()
+
+	var status Status
+	if !p.GetProperty(&status) {
+		t.Fatalf("failed to get status")
+	}
+	if status.Up || status.Framing != "auto" || status.DetectedFraming != "" {
+		t.Errorf("wrong status before Run: %+v", status)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+	stream.rx <- serializeFrame(t, FramerSNAP, testPacket)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.ReadPacket(ctx); err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if err := p.WritePacket(testPacket); err != nil {
+		t.Fatal(err)
+	}
+	status = p.Status()
+	want := Status{
+		Up:              true,
+		Framing:         "auto",
+		DetectedFraming: "snap",
+		RxFrames:        1,
+		TxFrames:        1,
+	}
+	if status != want {
+		t.Errorf("wrong status: want %+v, got %+v", want, status)
+	}
+
+	// When the stream fails, the link is reported as down.
+	close(stream.rx)
+	<-done
+	if status = p.Status(); status.Up || status.Err != io.EOF.Error() {
+		t.Errorf("wrong status after stream closed: %+v", status)
+	}
+}
@@ -0,0 +1,81 @@
+package phys
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// unframeAny extracts an IPX payload from the given packet using whichever
+// framer matches it.
+func unframeAny(pkt gopacket.Packet) ([]byte, bool) {
+	for _, framer := range allFramers {
+		if payload, ok := Unframe(pkt, framer); ok {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+// ReplayPcap reads Ethernet frames from the given pcap file and writes the
+// IPX packets they contain to the given writer; non-IPX frames are skipped.
+// If framer is nil, frames using any framing are accepted. If realTime is
+// true, packets are written with the same timing with which they were
+// captured; otherwise they are written as fast as possible.
+func ReplayPcap(ctx context.Context, r io.Reader, framer Framer, w ipx.Writer, realTime bool) error {
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		return err
+	}
+	if lt := pr.LinkType(); lt != layers.LinkTypeEthernet {
+		return fmt.Errorf("unsupported pcap link type %v; only Ethernet is supported", lt)
+	}
+	var firstCapture, start time.Time
+	for {
+		data, ci, err := pr.ReadPacketData()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		if realTime {
+			if firstCapture.IsZero() {
+				firstCapture, start = ci.Timestamp, time.Now()
+			}
+			delay := time.Until(start.Add(ci.Timestamp.Sub(firstCapture)))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		var payload []byte
+		var ok bool
+		if framer == nil {
+			payload, ok = unframeAny(pkt)
+		} else {
+			payload, ok = Unframe(pkt, framer)
+		}
+		if !ok {
+			continue
+		}
+		ipxpkt := &ipx.Packet{}
+		if err := ipxpkt.UnmarshalBinaryStrict(payload); err != nil {
+			continue
+		}
+		// Errors are ignored since individual packets may be
+		// rejected (eg. filtered) without stopping the replay.
+		w.WritePacket(ipxpkt)
+	}
+}
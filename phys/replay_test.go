@@ -0,0 +1,90 @@
+package phys
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// makeTestPcap returns a pcap file containing the given frames, captured
+// the given interval apart.
+func makeTestPcap(t *testing.T, interval time.Duration, frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1000000000, 0)
+	for _, frame := range frames {
+		err := w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ts,
+			CaptureLength: len(frame),
+			Length:        len(frame),
+		}, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(interval)
+	}
+	return buf.Bytes()
+}
+
+func TestReplayPcap(t *testing.T) {
+	// A non-IPX frame is included that should be skipped.
+	nonIPX := serializeFrame(t, FramerEthernetII, testPacket)
+	nonIPX[12], nonIPX[13] = 0x08, 0x00
+	pcap := makeTestPcap(t, 50*time.Millisecond,
+		serializeFrame(t, FramerEthernetII, testPacket),
+		nonIPX,
+		serializeFrame(t, Framer802_2, testPacket),
+	)
+	for _, realTime := range []bool{false, true} {
+		var got []*ipx.Packet
+		dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+			got = append(got, pkt)
+		})
+		start := time.Now()
+		err := ReplayPcap(context.Background(), bytes.NewReader(pcap), nil, dest, realTime)
+		if err != nil {
+			t.Fatalf("realTime=%v: ReplayPcap failed: %v", realTime, err)
+		}
+		elapsed := time.Since(start)
+		if len(got) != 2 {
+			t.Fatalf("realTime=%v: want 2 packets replayed, got %d", realTime, len(got))
+		}
+		for _, pkt := range got {
+			if pkt.Header != testPacket.Header || !bytes.Equal(pkt.Payload, testPacket.Payload) {
+				t.Errorf("realTime=%v: wrong packet replayed: %+v", realTime, pkt)
+			}
+		}
+		if realTime && elapsed < 100*time.Millisecond {
+			t.Errorf("real-time replay finished too quickly: %v", elapsed)
+		} else if !realTime && elapsed >= 100*time.Millisecond {
+			t.Errorf("replay took too long: %v", elapsed)
+		}
+	}
+}
+
+func TestReplayPcapFramer(t *testing.T) {
+	pcap := makeTestPcap(t, 0,
+		serializeFrame(t, FramerEthernetII, testPacket),
+		serializeFrame(t, Framer802_2, testPacket),
+	)
+	count := 0
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		count++
+	})
+	if err := ReplayPcap(context.Background(), bytes.NewReader(pcap), Framer802_2, dest, false); err != nil {
+		t.Fatalf("ReplayPcap failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("want only 802.2 packet replayed, got %d packets", count)
+	}
+}
@@ -0,0 +1,231 @@
+package phys
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const pcapSnapLen = 1500
+
+var (
+	_ = (PcapgoDataSink)(&RotatingPcapWriter{})
+)
+
+// RotateConfig specifies when a RotatingPcapWriter should start a new file.
+type RotateConfig struct {
+	// If non-zero, a new file is started once the current file reaches
+	// this many bytes.
+	MaxSize int64
+
+	// If non-zero, a new file is started once the current file has been
+	// open for this amount of time.
+	MaxAge time.Duration
+
+	// If non-zero, only this many files are kept; older files are
+	// deleted as new ones are started. Ignored if Files is not nil.
+	MaxFiles int
+
+	// If not nil, the files written are tracked in this list, which
+	// can be shared between multiple writers so that the number of
+	// files is limited across all of them.
+	Files *FileList
+
+	// If true, existing files are never overwritten, even if rotation
+	// is not enabled; see NewRotatingPcapWriter.
+	KeepExisting bool
+}
+
+// FileList keeps track of the files written by one or more
+// RotatingPcapWriters, deleting the oldest files once there are too many.
+// Files that are still being written are never deleted.
+type FileList struct {
+	mu       sync.Mutex
+	maxFiles int
+	files    []string
+	open     map[string]bool
+}
+
+// NewFileList creates a new FileList that keeps at most the given number
+// of files. If maxFiles is zero, files are never deleted.
+func NewFileList(maxFiles int) *FileList {
+	return &FileList{
+		maxFiles: maxFiles,
+		open:     make(map[string]bool),
+	}
+}
+
+// opened records that a new file has been started, deleting the oldest
+// files that are no longer open if there are now too many.
+func (l *FileList) opened(filename string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files = append(l.files, filename)
+	l.open[filename] = true
+	if l.maxFiles <= 0 {
+		return
+	}
+	excess := len(l.files) - l.maxFiles
+	kept := []string{}
+	for _, f := range l.files {
+		if excess > 0 && !l.open[f] {
+			os.Remove(f)
+			excess--
+			continue
+		}
+		kept = append(kept, f)
+	}
+	l.files = kept
+}
+
+// closed records that a file is no longer being written.
+func (l *FileList) closed(filename string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.open, filename)
+}
+
+func (c *RotateConfig) enabled() bool {
+	return c.MaxSize > 0 || c.MaxAge > 0
+}
+
+// RotatingPcapWriter is an implementation of PcapgoDataSink that writes
+// packets to a .pcap file, starting a new file when the current one grows
+// too large or too old. If rotation is enabled, the start time of each file
+// is included in its filename.
+type RotatingPcapWriter struct {
+	mu       sync.Mutex
+	filename string
+	config   RotateConfig
+	f        *os.File
+	w        *pcapgo.Writer
+	size     int64
+	openTime time.Time
+}
+
+// currentFilename returns the name for a new file opened now.
+func (w *RotatingPcapWriter) currentFilename(now time.Time) string {
+	if !w.config.enabled() {
+		return w.filename
+	}
+	ext := filepath.Ext(w.filename)
+	stem := strings.TrimSuffix(w.filename, ext)
+	return fmt.Sprintf("%s-%s%s", stem, now.Format("20060102-150405.000"), ext)
+}
+
+// createFile creates a new file with the given name. If a file with that
+// name already exists, a numeric suffix is added to the name rather than
+// overwriting it.
+func createFile(filename string) (*os.File, error) {
+	ext := filepath.Ext(filename)
+	stem := strings.TrimSuffix(filename, ext)
+	name := filename
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+		name = fmt.Sprintf("%s.%d%s", stem, i, ext)
+	}
+}
+
+func (w *RotatingPcapWriter) closeFile() error {
+	err := w.f.Close()
+	w.config.Files.closed(w.f.Name())
+	w.f = nil
+	return err
+}
+
+func (w *RotatingPcapWriter) openFile(now time.Time) error {
+	var f *os.File
+	var err error
+	if w.config.enabled() || w.config.KeepExisting {
+		f, err = createFile(w.currentFilename(now))
+	} else {
+		f, err = os.Create(w.filename)
+	}
+	if err != nil {
+		return err
+	}
+	pw := pcapgo.NewWriter(f)
+	if err := pw.WriteFileHeader(pcapSnapLen, layers.LinkTypeEthernet); err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.w = f, pw
+	w.size = 0
+	w.openTime = now
+	w.config.Files.opened(f.Name())
+	return nil
+}
+
+func (w *RotatingPcapWriter) needRotate(now time.Time) bool {
+	switch {
+	case w.config.MaxSize > 0 && w.size >= w.config.MaxSize:
+		return true
+	case w.config.MaxAge > 0 && now.Sub(w.openTime) >= w.config.MaxAge:
+		return true
+	default:
+		return false
+	}
+}
+
+// WritePacket implements the PcapgoDataSink interface, writing the given
+// packet to the current file.
+func (w *RotatingPcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if w.f != nil && w.needRotate(now) {
+		w.closeFile()
+	}
+	if w.f == nil {
+		if err := w.openFile(now); err != nil {
+			return err
+		}
+	}
+	if err := w.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+	// Each record has a 16 byte header before the packet data.
+	w.size += int64(16 + len(data))
+	return nil
+}
+
+// Close closes the current file. If more packets are written afterwards, a
+// new file is opened.
+func (w *RotatingPcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	return w.closeFile()
+}
+
+// NewRotatingPcapWriter creates a new RotatingPcapWriter that writes to files
+// based on the given filename. The first file is opened immediately so that
+// any error can be reported. If rotation is enabled or KeepExisting is set,
+// existing files are never overwritten; if a file already exists, a numeric
+// suffix is added to the new file's name. Otherwise, an existing file with
+// the given name is truncated.
+func NewRotatingPcapWriter(filename string, config *RotateConfig) (*RotatingPcapWriter, error) {
+	w := &RotatingPcapWriter{
+		filename: filename,
+		config:   *config,
+	}
+	if w.config.Files == nil {
+		w.config.Files = NewFileList(w.config.MaxFiles)
+	}
+	if err := w.openFile(time.Now()); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,139 @@
+package phys
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func writeCaptures(t *testing.T, w *RotatingPcapWriter, count int) {
+	t.Helper()
+	frame := make([]byte, 60)
+	for i := 0; i < count; i++ {
+		ci := gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)}
+		if err := w.WritePacket(ci, frame); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+}
+
+// countPackets returns the number of packets in each of the .pcap files in
+// the given directory.
+func countPackets(t *testing.T, dir string) map[string]int {
+	t.Helper()
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]int{}
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		for {
+			if _, _, err := r.ReadPacketData(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", filename, err)
+			}
+			result[filepath.Base(filename)]++
+		}
+		f.Close()
+	}
+	return result
+}
+
+func TestRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewRotatingPcapWriter(filepath.Join(dir, "capture.pcap"), &RotateConfig{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each record is 76 bytes long, so each file holds two.
+	writeCaptures(t, w, 5)
+	w.Close()
+	files := countPackets(t, dir)
+	if len(files) != 3 {
+		t.Errorf("want 3 files, got %v", files)
+	}
+	total := 0
+	for _, n := range files {
+		total += n
+	}
+	if total != 5 {
+		t.Errorf("want 5 packets written, got %d", total)
+	}
+}
+
+func TestRotateMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := NewFileList(3)
+	var writers []*RotatingPcapWriter
+	for _, name := range []string{"a.pcap", "b.pcap"} {
+		w, err := NewRotatingPcapWriter(filepath.Join(dir, name), &RotateConfig{
+			MaxSize: 1,
+			Files:   files,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writers = append(writers, w)
+	}
+	// The limit applies to both writers together.
+	for i := 0; i < 4; i++ {
+		for _, w := range writers {
+			writeCaptures(t, w, 1)
+		}
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+	if got := countPackets(t, dir); len(got) != 3 {
+		t.Errorf("want 3 files kept, got %v", got)
+	}
+}
+
+func TestNoOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "capture.pcap")
+	for i := 0; i < 2; i++ {
+		w, err := NewRotatingPcapWriter(filename, &RotateConfig{KeepExisting: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeCaptures(t, w, 1)
+		w.Close()
+	}
+	want := map[string]int{"capture.pcap": 1, "capture.1.pcap": 1}
+	got := countPackets(t, dir)
+	if len(got) != len(want) || got["capture.pcap"] != 1 || got["capture.1.pcap"] != 1 {
+		t.Errorf("want files %v, got %v", want, got)
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "capture.pcap")
+	for i := 1; i <= 2; i++ {
+		w, err := NewRotatingPcapWriter(filename, &RotateConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeCaptures(t, w, i)
+		w.Close()
+	}
+	// Without rotation, the file from the first run is replaced.
+	got := countPackets(t, dir)
+	if len(got) != 1 || got["capture.pcap"] != 2 {
+		t.Errorf("want only capture.pcap with 2 packets, got %v", got)
+	}
+}
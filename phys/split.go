@@ -0,0 +1,98 @@
+package phys
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+var (
+	_ = (ipx.WriteCloser)(&SplitSink{})
+)
+
+type splitSinkEntry struct {
+	sink      *Sink
+	lastWrite time.Time
+}
+
+// SplitSink is an implementation of ipx.WriteCloser that splits packets
+// between a separate Sink for each node address. Each packet is written to
+// the sink for its source address and, if it is not a broadcast, to the sink
+// for its destination address as well. Sinks are created on demand and are
+// closed once no packets have been written to them for a while.
+type SplitSink struct {
+	mu          sync.Mutex
+	newSink     func(addr ipx.Addr) (*Sink, error)
+	sinks       map[ipx.Addr]*splitSinkEntry
+	idleTimeout time.Duration
+	lastExpire  time.Time
+}
+
+func (s *SplitSink) writeToNode(addr ipx.Addr, packet *ipx.Packet, now time.Time) error {
+	if addr == ipx.AddrNull || addr == ipx.AddrBroadcast {
+		return nil
+	}
+	e, ok := s.sinks[addr]
+	if !ok {
+		sink, err := s.newSink(addr)
+		if err != nil {
+			return err
+		}
+		e = &splitSinkEntry{sink: sink}
+		s.sinks[addr] = e
+	}
+	e.lastWrite = now
+	return e.sink.WritePacket(packet)
+}
+
+// expire closes sinks that have not been written to recently.
+func (s *SplitSink) expire(now time.Time) {
+	if now.Sub(s.lastExpire) < s.idleTimeout {
+		return
+	}
+	s.lastExpire = now
+	for addr, e := range s.sinks {
+		if now.Sub(e.lastWrite) > s.idleTimeout {
+			e.sink.Close()
+			delete(s.sinks, addr)
+		}
+	}
+}
+
+// WritePacket implements the ipx.Writer interface.
+func (s *SplitSink) WritePacket(packet *ipx.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expire(now)
+	hdr := &packet.Header
+	if err := s.writeToNode(hdr.Src.Addr, packet, now); err != nil {
+		return err
+	}
+	if hdr.Dest.Addr != hdr.Src.Addr {
+		return s.writeToNode(hdr.Dest.Addr, packet, now)
+	}
+	return nil
+}
+
+func (s *SplitSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, e := range s.sinks {
+		e.sink.Close()
+		delete(s.sinks, addr)
+	}
+	return nil
+}
+
+// NewSplitSink creates a new SplitSink that invokes the given function to
+// create a new Sink the first time a packet is seen for each node address.
+// Sinks that are idle for longer than idleTimeout are closed.
+func NewSplitSink(newSink func(addr ipx.Addr) (*Sink, error), idleTimeout time.Duration) *SplitSink {
+	return &SplitSink{
+		newSink:     newSink,
+		sinks:       make(map[ipx.Addr]*splitSinkEntry),
+		idleTimeout: idleTimeout,
+	}
+}
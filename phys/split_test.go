@@ -0,0 +1,73 @@
+package phys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// countingSink is a PacketDataSink that counts the frames written to it.
+type countingSink struct {
+	frames int
+	closed bool
+}
+
+func (s *countingSink) WritePacketData([]byte) error {
+	s.frames++
+	return nil
+}
+
+func (s *countingSink) Close() {
+	s.closed = true
+}
+
+func TestSplitSink(t *testing.T) {
+	var sinks []*countingSink
+	byAddr := map[ipx.Addr]*countingSink{}
+	split := NewSplitSink(func(addr ipx.Addr) (*Sink, error) {
+		s := &countingSink{}
+		sinks = append(sinks, s)
+		byAddr[addr] = s
+		return NewSink(s, FramerEthernetII), nil
+	}, 50*time.Millisecond)
+
+	send := func(src, dest ipx.Addr) {
+		t.Helper()
+		err := split.WritePacket(&ipx.Packet{Header: ipx.Header{
+			Src:  ipx.HeaderAddr{Addr: src},
+			Dest: ipx.HeaderAddr{Addr: dest},
+		}})
+		if err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+
+	// Unicast packets go to both nodes' sinks, broadcasts only to the
+	// sender's.
+	send(client1, client2)
+	send(client1, ipx.AddrBroadcast)
+	if got := byAddr[client1].frames; got != 2 {
+		t.Errorf("wrong number of frames for %v: want 2, got %d", client1, got)
+	}
+	if got := byAddr[client2].frames; got != 1 {
+		t.Errorf("wrong number of frames for %v: want 1, got %d", client2, got)
+	}
+
+	// Idle sinks are closed, and a new sink is created if the node
+	// appears again.
+	time.Sleep(100 * time.Millisecond)
+	old := byAddr[client1]
+	send(client1, ipx.AddrBroadcast)
+	if !old.closed || !sinks[1].closed {
+		t.Errorf("idle sinks were not closed")
+	}
+	if byAddr[client1] == old || len(sinks) != 3 {
+		t.Errorf("new sink not created for %v after idle timeout", client1)
+	}
+
+	split.Close()
+	if !byAddr[client1].closed {
+		t.Errorf("sink not closed when split sink closed")
+	}
+}
@@ -3,6 +3,9 @@
 package phys
 
 import (
+	"fmt"
+	"io"
+	"os"
 	"time"
 
 	"github.com/google/gopacket"
@@ -15,9 +18,9 @@ var (
 )
 
 // tapWrapper implements the DuplexEthernetStream interface by wrapping a
-// water.Interface.
+// TAP device, where each read or write transfers a single Ethernet frame.
 type tapWrapper struct {
-	ifce *water.Interface
+	ifce io.ReadWriteCloser
 }
 
 func (w *tapWrapper) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
@@ -55,3 +58,18 @@ func NewTap(cfg water.Config) (*tapWrapper, error) {
 	}
 	return &tapWrapper{ifce}, nil
 }
+
+// NewTapFromFD creates a new physical IPX interface using a TAP device that
+// has already been opened, for example by a container orchestrator that sets
+// up the device on our behalf so that ipxbox can run without the privileges
+// needed to create it.
+func NewTapFromFD(fd int) (*tapWrapper, error) {
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd:%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	return &tapWrapper{f}, nil
+}
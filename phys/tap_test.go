@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package phys
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+)
+
+func TestTapFromFD(t *testing.T) {
+	// A SOCK_SEQPACKET socket pair preserves message boundaries in the
+	// same way that a TAP device returns one frame per read.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	tap, err := NewTapFromFD(fds[0])
+	if err != nil {
+		t.Fatalf("NewTapFromFD failed: %v", err)
+	}
+	defer tap.Close()
+	defer syscall.Close(fds[1])
+
+	frame := []byte("\xff\xff\xff\xff\xff\xff\x02\x00\x00\x00\x00\x01hello")
+	if _, err := syscall.Write(fds[1], frame); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	got, ci, err := tap.ReadPacketData()
+	if err != nil {
+		t.Fatalf("ReadPacketData failed: %v", err)
+	}
+	if !bytes.Equal(got, frame) || ci.Length != len(frame) {
+		t.Errorf("wrong frame read: want %x, got %x", frame, got)
+	}
+
+	if err := tap.WritePacketData([]byte("reply")); err != nil {
+		t.Fatalf("WritePacketData failed: %v", err)
+	}
+	buf := make([]byte, 100)
+	n, err := syscall.Read(fds[1], buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got := string(buf[:n]); got != "reply" {
+		t.Errorf("wrong frame written: want %q, got %q", "reply", got)
+	}
+
+	if _, err := NewTapFromFD(-1); err == nil {
+		t.Errorf("NewTapFromFD(-1): want error, got none")
+	}
+}
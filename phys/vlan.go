@@ -0,0 +1,90 @@
+package phys
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const maxVLANID = 0xffe
+
+// vlanFramer wraps another framer so that frames are sent and received
+// inside a particular IEEE 802.1Q VLAN. Frames that are not tagged with the
+// VLAN ID are ignored.
+type vlanFramer struct {
+	inner  Framer
+	vlanID uint16
+}
+
+// NewVLANFramer returns a Framer that frames packets with the given framer,
+// but adds an 802.1Q tag with the given VLAN ID.
+func NewVLANFramer(inner Framer, vlanID uint16) (Framer, error) {
+	if vlanID < 1 || vlanID > maxVLANID {
+		return nil, fmt.Errorf("invalid VLAN ID %d: must be in range 1-%d", vlanID, maxVLANID)
+	}
+	return &vlanFramer{
+		inner:  inner,
+		vlanID: vlanID,
+	}, nil
+}
+
+func (f *vlanFramer) Frame(dest net.HardwareAddr, packet *ipx.Packet) ([]gopacket.SerializableLayer, error) {
+	ls, err := f.inner.Frame(dest, packet)
+	if err != nil {
+		return nil, err
+	}
+	eth, ok := ls[0].(*layers.Ethernet)
+	if !ok {
+		return nil, fmt.Errorf("framer %q did not return an Ethernet frame", f.inner.Name())
+	}
+	// The 802.1Q tag goes where the EtherType would normally be, and
+	// the field after the tag contains the original EtherType, or for
+	// 802.3 frames, the length.
+	tag := &layers.Dot1Q{
+		VLANIdentifier: f.vlanID,
+		Type:           eth.EthernetType,
+	}
+	if eth.EthernetType == layers.EthernetTypeLLC {
+		tag.Type = layers.EthernetType(eth.Length)
+	}
+	taggedEth := *eth
+	taggedEth.EthernetType = layers.EthernetTypeDot1Q
+	taggedEth.Length = 0
+	result := []gopacket.SerializableLayer{&taggedEth, tag}
+	return append(result, ls[1:]...), nil
+}
+
+func (f *vlanFramer) Unframe(eth *layers.Ethernet, nextLayers []gopacket.Layer) ([]byte, bool) {
+	if eth.EthernetType != layers.EthernetTypeDot1Q || len(nextLayers) < 1 {
+		return nil, false
+	}
+	tag, ok := nextLayers[0].(*layers.Dot1Q)
+	if !ok || tag.VLANIdentifier != f.vlanID {
+		return nil, false
+	}
+	// Reconstruct the untagged frame for the inner framer. gopacket
+	// does not decode 802.3 frames inside a VLAN tag, so we must decode
+	// the LLC header ourselves in that case.
+	untaggedEth := *eth
+	untaggedEth.EthernetType = tag.Type
+	untaggedEth.Length = 0
+	untaggedEth.Payload = tag.LayerPayload()
+	innerLayers := nextLayers[1:]
+	if tag.Type < 0x0600 {
+		untaggedEth.EthernetType = layers.EthernetTypeLLC
+		untaggedEth.Length = uint16(tag.Type)
+		if int(untaggedEth.Length) < len(untaggedEth.Payload) {
+			untaggedEth.Payload = untaggedEth.Payload[:untaggedEth.Length]
+		}
+		pkt := gopacket.NewPacket(untaggedEth.Payload, layers.LayerTypeLLC, gopacket.Default)
+		innerLayers = pkt.Layers()
+	}
+	return f.inner.Unframe(&untaggedEth, innerLayers)
+}
+
+func (f *vlanFramer) Name() string {
+	return fmt.Sprintf("%s (VLAN %d)", f.inner.Name(), f.vlanID)
+}
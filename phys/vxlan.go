@@ -0,0 +1,133 @@
+package phys
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	// VXLANPort is the IANA-assigned UDP port number for VXLAN.
+	VXLANPort = 4789
+
+	vxlanHeaderLength = 8
+	vxlanFlagVNI      = 0x08
+	maxVNI            = 1<<24 - 1
+)
+
+var (
+	_ = (DuplexEthernetStream)(&vxlanStream{})
+)
+
+// vxlanStream implements the DuplexEthernetStream interface by sending and
+// receiving Ethernet frames encapsulated inside VXLAN (RFC 7348) packets.
+// There is no multicast support; instead, every frame is sent to every peer
+// in a static list ("head-end replication"). Encapsulation adds 50 bytes of
+// overhead to each frame (inner Ethernet, IPv4, UDP and VXLAN headers), so
+// the underlying network must have an MTU of at least 1550 bytes to carry
+// full-sized frames. IPX packets are usually much smaller than this, but
+// either the underlay MTU should be raised or clients configured not to
+// send IPX packets larger than 1450 bytes.
+type vxlanStream struct {
+	conn  *net.UDPConn
+	vni   uint32
+	peers []*net.UDPAddr
+}
+
+func (s *vxlanStream) isPeer(addr *net.UDPAddr) bool {
+	for _, peer := range s.peers {
+		if peer.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// decapsulate checks the VXLAN header of the given packet and returns the
+// inner Ethernet frame.
+func (s *vxlanStream) decapsulate(packet []byte) ([]byte, bool) {
+	if len(packet) < vxlanHeaderLength {
+		return nil, false
+	}
+	if packet[0]&vxlanFlagVNI == 0 {
+		return nil, false
+	}
+	vni := binary.BigEndian.Uint32(packet[4:8]) >> 8
+	if vni != s.vni {
+		return nil, false
+	}
+	return packet[vxlanHeaderLength:], true
+}
+
+func (s *vxlanStream) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	var buf [9000]byte
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		// Only frames from configured peers are accepted; anything
+		// else is silently dropped.
+		if !s.isPeer(addr) {
+			continue
+		}
+		frame, ok := s.decapsulate(buf[:n])
+		if !ok {
+			continue
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Now(),
+			CaptureLength: len(frame),
+			Length:        len(frame),
+		}
+		return append([]byte{}, frame...), ci, nil
+	}
+}
+
+func (s *vxlanStream) WritePacketData(frame []byte) error {
+	packet := make([]byte, vxlanHeaderLength, vxlanHeaderLength+len(frame))
+	packet[0] = vxlanFlagVNI
+	binary.BigEndian.PutUint32(packet[4:8], s.vni<<8)
+	packet = append(packet, frame...)
+	for _, peer := range s.peers {
+		if _, err := s.conn.WriteToUDP(packet, peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *vxlanStream) Close() {
+	s.conn.Close()
+}
+
+// NewVXLAN creates a DuplexEthernetStream that bridges to a VXLAN segment
+// with the given VXLAN network identifier (VNI). It listens on the given UDP
+// port and sends frames to every address in the comma-separated list of
+// peers; a peer address without a port number uses the standard VXLAN port.
+func NewVXLAN(port int, vni uint, peers string) (*vxlanStream, error) {
+	if vni > maxVNI {
+		return nil, fmt.Errorf("VXLAN VNI %d out of range; maximum is %d", vni, maxVNI)
+	}
+	s := &vxlanStream{vni: uint32(vni)}
+	for _, peer := range strings.Split(peers, ",") {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			peer = net.JoinHostPort(peer, fmt.Sprintf("%d", VXLANPort))
+		}
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, err
+		}
+		s.peers = append(s.peers, addr)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return s, nil
+}
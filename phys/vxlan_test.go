@@ -0,0 +1,74 @@
+package phys
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// makeVXLAN creates a VXLAN stream listening on a random port on the
+// loopback interface, with no peers.
+func makeVXLAN(t *testing.T, vni uint) *vxlanStream {
+	t.Helper()
+	s, err := NewVXLAN(0, vni, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewVXLAN failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+	s.peers = nil
+	return s
+}
+
+func vxlanAddr(s *vxlanStream) *net.UDPAddr {
+	port := s.conn.LocalAddr().(*net.UDPAddr).Port
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestVXLAN(t *testing.T) {
+	s1, s2, other := makeVXLAN(t, 42), makeVXLAN(t, 42), makeVXLAN(t, 43)
+	s1.peers = []*net.UDPAddr{vxlanAddr(s2)}
+	s2.peers = []*net.UDPAddr{vxlanAddr(s1)}
+	other.peers = []*net.UDPAddr{vxlanAddr(s2)}
+
+	// Frames for a different VNI are ignored.
+	if err := other.WritePacketData([]byte("wrong vni")); err != nil {
+		t.Fatalf("WritePacketData failed: %v", err)
+	}
+	frame := []byte("\xff\xff\xff\xff\xff\xff\x02\x00\x00\x00\x00\x01hello")
+	if err := s1.WritePacketData(frame); err != nil {
+		t.Fatalf("WritePacketData failed: %v", err)
+	}
+	got, ci, err := s2.ReadPacketData()
+	if err != nil {
+		t.Fatalf("ReadPacketData failed: %v", err)
+	}
+	if !bytes.Equal(got, frame) || ci.Length != len(frame) {
+		t.Errorf("wrong frame received: want %x, got %x", frame, got)
+	}
+}
+
+func TestVXLANDecapsulate(t *testing.T) {
+	s := &vxlanStream{vni: 42}
+	for _, tc := range []struct {
+		packet []byte
+		ok     bool
+	}{
+		{[]byte{0x08, 0, 0, 0, 0, 0, 42, 0, 'x'}, true},
+		{[]byte{0x08, 0, 0, 0, 0, 0, 43, 0, 'x'}, false},
+		{[]byte{0x00, 0, 0, 0, 0, 0, 42, 0, 'x'}, false},
+		{[]byte{0x08, 0, 0}, false},
+	} {
+		frame, ok := s.decapsulate(tc.packet)
+		if ok != tc.ok {
+			t.Errorf("decapsulate(%x): want ok=%v, got %v", tc.packet, tc.ok, ok)
+		} else if ok && string(frame) != "x" {
+			t.Errorf("decapsulate(%x): wrong frame %x", tc.packet, frame)
+		}
+	}
+}
+
+func TestVXLANInvalidVNI(t *testing.T) {
+	if _, err := NewVXLAN(0, maxVNI+1, "127.0.0.1"); err == nil {
+		t.Errorf("NewVXLAN with VNI %d: want error, got none", maxVNI+1)
+	}
+}
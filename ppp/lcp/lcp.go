@@ -132,7 +132,7 @@ func (d *EchoData) UnmarshalBinary(data []byte) error {
 
 func (d *EchoData) MarshalBinary() (data []byte, err error) {
 	result := []byte{0, 0, 0, 0}
-	binary.BigEndian.PutUint32(data[:], d.MagicNumber)
+	binary.BigEndian.PutUint32(result[:], d.MagicNumber)
 	result = append(result, d.Data...)
 	return result, nil
 }
@@ -159,6 +159,21 @@ func (d *ProtocolRejectData) MarshalBinary() ([]byte, error) {
 	return result, nil
 }
 
+// CodeRejectData contains data that is sent in Code-Reject messages: the
+// packet with the code that was not recognized.
+type CodeRejectData struct {
+	RejectedPacket []byte
+}
+
+func (d *CodeRejectData) UnmarshalBinary(data []byte) error {
+	d.RejectedPacket = data
+	return nil
+}
+
+func (d *CodeRejectData) MarshalBinary() ([]byte, error) {
+	return d.RejectedPacket, nil
+}
+
 // LCP is a gopacket layer for the Link Control Protocol and and other
 // dialects that reuse the same wire format.
 type LCP struct {
@@ -186,9 +201,10 @@ func (l *LCP) UnmarshalBinary(data []byte) error {
 		l.Data = &TerminateData{}
 	case EchoRequest, EchoReply, DiscardRequest:
 		l.Data = &EchoData{}
+	case CodeReject:
+		l.Data = &CodeRejectData{}
 	case ProtocolReject:
 		l.Data = &ProtocolRejectData{}
-		// TODO: Other message types.
 	}
 	if l.Data != nil {
 		if err := l.Data.UnmarshalBinary(data[4:]); err != nil {
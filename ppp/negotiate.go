@@ -227,6 +227,14 @@ func (n *negotiator) handleConfigureNak(l *lcp.LCP) {
 
 	values := make(map[lcp.OptionType][]byte)
 	for _, opt := range cd.Options {
+		// A Configure-Nak may suggest options that we did not
+		// request, eg. IPX header compression from old dial-up
+		// clients. We don't support these, and RFC 1661 allows us to
+		// decline them simply by leaving them out of the next
+		// Configure-Request.
+		if _, ok := n.localOptions[opt.Type]; !ok {
+			continue
+		}
 		values[opt.Type] = append([]byte{}, opt.Data...)
 	}
 
@@ -271,8 +279,10 @@ func (n *negotiator) maybeSendRequest() {
 }
 
 func (n *negotiator) StartNegotiation() {
+	n.mu.Lock()
 	n.requestSequence = 1
 	n.err = nil
+	n.mu.Unlock()
 	for {
 		n.mu.Lock()
 		done := n.localComplete || n.err != nil
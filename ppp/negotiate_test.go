@@ -0,0 +1,89 @@
+package ppp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ppp/lcp"
+)
+
+func TestNegotiationGivesUp(t *testing.T) {
+	requests := 0
+	n := &negotiator{
+		localOptions: map[lcp.OptionType]*option{
+			lcp.OptionMagicNumber: &option{
+				value:    []byte{1, 2, 3, 4},
+				validate: nonNegotiable,
+			},
+		},
+		remoteOptions: map[lcp.OptionType]*option{},
+		// Peer that never acks anything we send.
+		sendPPP: func(p []byte) error {
+			requests++
+			return nil
+		},
+	}
+	finished := make(chan struct{})
+	go func() {
+		n.StartNegotiation()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(requestTimeout * (maxConfigureRequests + 2)):
+		t.Fatalf("negotiation did not give up")
+	}
+	done, err := n.Done()
+	if !done || err == nil {
+		t.Errorf("want negotiation to fail, got done=%v, err=%v", done, err)
+	}
+	if requests != maxConfigureRequests {
+		t.Errorf("wrong number of Configure-Requests sent: want %d, got %d", maxConfigureRequests, requests)
+	}
+}
+
+func TestNakSuggestingCompression(t *testing.T) {
+	var sent []*lcp.LCP
+	n := &negotiator{
+		localOptions: map[lcp.OptionType]*option{
+			lcp.OptionIPXNode: &option{
+				value: []byte{0, 0, 0, 0, 0, 0},
+			},
+		},
+		remoteOptions: map[lcp.OptionType]*option{},
+		sendPPP: func(p []byte) error {
+			l := &lcp.LCP{}
+			if err := l.UnmarshalBinary(p); err != nil {
+				t.Fatal(err)
+			}
+			sent = append(sent, l)
+			return nil
+		},
+	}
+	n.handleConfigureNak(&lcp.LCP{
+		Type: lcp.ConfigureNak,
+		Data: &lcp.ConfigureData{
+			Options: []lcp.Option{
+				{
+					Type: lcp.OptionIPXNode,
+					Data: []byte{1, 2, 3, 4, 5, 6},
+				},
+				{
+					// Telebit compressed IPX
+					Type: lcp.OptionIPXCompressionProtocol,
+					Data: []byte{0x00, 0x02, 0x10, 0x00},
+				},
+			},
+		},
+	})
+	if n.err != nil {
+		t.Fatalf("negotiation failed: %v", n.err)
+	}
+	if len(sent) != 1 || sent[0].Type != lcp.ConfigureRequest {
+		t.Fatalf("want new Configure-Request to be sent, got %+v", sent)
+	}
+	opts := sent[0].Data.(*lcp.ConfigureData).Options
+	if len(opts) != 1 || opts[0].Type != lcp.OptionIPXNode {
+		t.Errorf("wrong options in new Configure-Request: %+v", opts)
+	}
+}
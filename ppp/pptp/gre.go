@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -14,14 +15,17 @@ import (
 const (
 	greProtocol   = 47
 	recvQueueSize = 16
+
+	// ackDelay is how long we wait for an outgoing data packet to
+	// carry an acknowledgement before we send a standalone ack.
+	ackDelay = 100 * time.Millisecond
 )
 
 var (
-	wrongLayers         = errors.New("layers not as expected: want IP->GRE")
-	wrongGREFields      = errors.New("GRE fields wrong: want version=1, ethernet type PPP")
-	unknownSession      = errors.New("packet for an unknown GRE session")
-	outOfSequencePacket = errors.New("out of sequence packet received")
-	recvQueueOverflow   = errors.New("session receive queue is full")
+	wrongLayers       = errors.New("layers not as expected: want IP->GRE")
+	wrongGREFields    = errors.New("GRE fields wrong: want version=1, ethernet type PPP")
+	unknownSession    = errors.New("packet for an unknown GRE session")
+	recvQueueOverflow = errors.New("session receive queue is full")
 )
 
 var _ = (io.ReadWriteCloser)(&greSession{})
@@ -29,58 +33,92 @@ var _ = (io.ReadWriteCloser)(&greSession{})
 // greSession is used to send and receive packets for a particular PPP-over-GRE
 // session.
 type greSession struct {
-	s                           *greServer
-	closed                      bool
-	recvQueue                   chan gopacket.Packet
-	addr                        net.IP
-	sendCallID, recvCallID      uint16
-	sentSeq, recvSeq, recvAcked uint32
+	s                      *greServer
+	closed                 bool
+	recvQueue              chan gopacket.Packet
+	reorder                *reorderBuffer
+	addr                   net.IP
+	sendCallID, recvCallID uint16
+
+	// mu protects the fields below, which are shared between the
+	// reading and writing sides of the session.
+	mu               sync.Mutex
+	sentSeq, recvSeq uint32
+	ackPending       bool
+	ackTimer         *time.Timer
+	acksStopped      bool
 }
 
-func (s *greSession) recvPacket(p []byte) (int, error) {
-	pkt, ok := <-s.recvQueue
-	if !ok {
-		return 0, io.EOF
-	}
+// receive processes a packet taken from the receive queue, adding it to
+// the reorder buffer.
+func (s *greSession) receive(pkt gopacket.Packet) {
 	ls := pkt.Layers()
 	greHeader := ls[1].(*layers.GRE)
-	// RFC 2637 mandates that "out of sequence packets between the PNS and
-	// PAC MUST be silently discarded [or reordered]" because PPP cannot
-	// handle out-of-order packets.
-	// TODO: Consider selectively breaking this requirement for some
-	// packets, ie. encapsulated IPX frames.
-	if greHeader.SeqPresent {
-		if greHeader.Seq < s.recvSeq {
-			return 0, outOfSequencePacket
-		}
-		// TODO: if we don't otherwise send a packet, send an empty ack packet
-		s.recvSeq = greHeader.Seq
+	// Packets without a sequence number are just acks and do not
+	// contain any payload.
+	if !greHeader.SeqPresent {
+		return
 	}
-	result := ls[1].LayerPayload()
-	copy(p[0:len(result)], result)
-	return len(result), nil
+	s.reorder.insert(greHeader.Seq, ls[1].LayerPayload())
 }
 
 func (s *greSession) Read(p []byte) (int, error) {
 	for {
-		cnt, err := s.recvPacket(p)
-		switch err {
-		case nil:
-			// We might have successfully received a packet, but if
-			// it was just an ack it might have been zero length,
-			// so try again.
-			if cnt > 0 {
-				return cnt, nil
+		// RFC 2637 mandates that "out of sequence packets between the
+		// PNS and PAC MUST be silently discarded [or reordered]"
+		// because PPP cannot handle out-of-order packets. We reorder
+		// them, but only wait a short time for missing packets.
+		if payload, seq, ok := s.reorder.pop(); ok {
+			s.received(seq)
+			if len(payload) > 0 {
+				return copy(p, payload), nil
+			}
+			continue
+		}
+		var timeout <-chan time.Time
+		if s.reorder.waiting() {
+			timeout = time.After(time.Until(s.reorder.deadline()))
+		}
+		select {
+		case pkt, ok := <-s.recvQueue:
+			if !ok {
+				return 0, io.EOF
 			}
-		case outOfSequencePacket:
-			// try again
-		default:
-			return 0, err
+			s.receive(pkt)
+		case <-timeout:
+			s.reorder.skip()
 		}
 	}
 }
 
+// received records that the packet with the given sequence number has been
+// received and needs to be acknowledged. If no outgoing packet carries the
+// ack within ackDelay, a standalone ack packet is sent instead, so that the
+// peer's send window does not fill up when traffic is one-directional.
+func (s *greSession) received(seq uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recvSeq = seq
+	s.ackPending = true
+	if s.ackTimer == nil && !s.acksStopped {
+		s.ackTimer = time.AfterFunc(ackDelay, s.sendAck)
+	}
+}
+
+func (s *greSession) sendAck() {
+	s.mu.Lock()
+	s.ackTimer = nil
+	// The timer may already have fired when the session was closed,
+	// in which case nothing more should be sent.
+	pending := s.ackPending && !s.acksStopped
+	s.mu.Unlock()
+	if pending {
+		s.sendPacket(nil)
+	}
+}
+
 func (s *greSession) sendPacket(frame []byte) (int, error) {
+	s.mu.Lock()
 	greHeader := &layers.GRE{
 		Protocol:   layers.EthernetTypePPP,
 		KeyPresent: true,
@@ -92,11 +130,12 @@ func (s *greSession) sendPacket(frame []byte) (int, error) {
 		greHeader.SeqPresent = true
 		s.sentSeq++
 	}
-	if s.recvAcked < s.recvSeq {
+	if s.ackPending {
 		greHeader.Ack = s.recvSeq
 		greHeader.AckPresent = true
-		s.recvAcked = s.recvSeq
+		s.ackPending = false
 	}
+	s.mu.Unlock()
 	buf := gopacket.NewSerializeBuffer()
 	var opts gopacket.SerializeOptions
 	gopacket.SerializeLayers(buf, opts,
@@ -121,9 +160,22 @@ func (s *greSession) Close() error {
 		close(s.recvQueue)
 		s.closed = true
 	}
+	s.stopAcks()
 	return nil
 }
 
+// stopAcks cancels any pending standalone ack and prevents any more from
+// being scheduled.
+func (s *greSession) stopAcks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acksStopped = true
+	if s.ackTimer != nil {
+		s.ackTimer.Stop()
+		s.ackTimer = nil
+	}
+}
+
 func (s *greSession) sessionKey() *sessionKey {
 	return &sessionKey{
 		IP:     s.addr.String(),
@@ -136,8 +188,15 @@ type sessionKey struct {
 	CallID uint16
 }
 
+// greConn is the subset of *net.IPConn used by greServer.
+type greConn interface {
+	Read(b []byte) (int, error)
+	WriteToIP(b []byte, addr *net.IPAddr) (int, error)
+	Close() error
+}
+
 type greServer struct {
-	conn     *net.IPConn
+	conn     greConn
 	sessions map[sessionKey]*greSession
 	mu       sync.Mutex
 }
@@ -158,6 +217,7 @@ func (s *greServer) startSession(remoteAddr net.IP, sendCallID, recvCallID uint1
 		s:          s,
 		addr:       remoteAddr,
 		recvQueue:  make(chan gopacket.Packet, recvQueueSize),
+		reorder:    makeReorderBuffer(),
 		sendCallID: sendCallID,
 		recvCallID: recvCallID,
 	}
@@ -220,6 +280,7 @@ func (s *greServer) Close() error {
 	for _, session := range s.sessions {
 		close(session.recvQueue)
 		session.closed = true
+		session.stopAcks()
 	}
 	s.mu.Unlock()
 	return s.conn.Close()
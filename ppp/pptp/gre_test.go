@@ -0,0 +1,85 @@
+package pptp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGREConn records the packets written to it.
+type fakeGREConn struct {
+	mu      sync.Mutex
+	written int
+}
+
+func (c *fakeGREConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *fakeGREConn) WriteToIP(b []byte, addr *net.IPAddr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written++
+	return len(b), nil
+}
+
+func (c *fakeGREConn) Close() error {
+	return nil
+}
+
+func (c *fakeGREConn) numWritten() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
+
+func startFakeSession(t *testing.T) (*greSession, *fakeGREConn) {
+	t.Helper()
+	conn := &fakeGREConn{}
+	s := &greServer{
+		conn:     conn,
+		sessions: make(map[sessionKey]*greSession),
+	}
+	session, err := s.startSession(net.IPv4(10, 0, 0, 1), 1, 2)
+	if err != nil {
+		t.Fatalf("startSession failed: %v", err)
+	}
+	return session, conn
+}
+
+func TestStandaloneAck(t *testing.T) {
+	session, conn := startFakeSession(t)
+	defer session.Close()
+	session.received(1)
+	time.Sleep(3 * ackDelay)
+	if n := conn.numWritten(); n != 1 {
+		t.Errorf("want one standalone ack to be sent, got %d packets", n)
+	}
+}
+
+func TestNoAckAfterClose(t *testing.T) {
+	session, conn := startFakeSession(t)
+	session.received(1)
+	session.Close()
+	// A packet may still be popped from the reorder buffer by a
+	// concurrent Read after the session has been closed.
+	session.received(2)
+	// Simulate the timer having fired just as the session was closed.
+	session.sendAck()
+	time.Sleep(3 * ackDelay)
+	if n := conn.numWritten(); n != 0 {
+		t.Errorf("want no acks sent after close, got %d packets", n)
+	}
+}
+
+func TestNoAckAfterServerClose(t *testing.T) {
+	session, conn := startFakeSession(t)
+	session.received(1)
+	session.s.Close()
+	time.Sleep(3 * ackDelay)
+	if n := conn.numWritten(); n != 0 {
+		t.Errorf("want no acks sent after server close, got %d packets", n)
+	}
+}
@@ -0,0 +1,100 @@
+package pptp
+
+import (
+	"time"
+)
+
+const (
+	// reorderWindow is the maximum number of out of sequence packets
+	// that are held while waiting for a missing packet.
+	reorderWindow = 16
+
+	// reorderTimeout is the maximum time that we wait for a missing
+	// packet to arrive before giving up and skipping past it.
+	reorderTimeout = 100 * time.Millisecond
+)
+
+// seqBefore returns true if sequence number a comes before b, allowing for
+// wraparound of the sequence number space.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// reorderBuffer holds GRE packets that arrive out of sequence so that they
+// can be released in order. RFC 2637 requires that out of sequence packets
+// are either discarded or reordered, since PPP cannot handle them; over real
+// internet paths, discarding them causes frequent frame loss.
+type reorderBuffer struct {
+	started bool
+	// next is the sequence number of the next packet to be released.
+	next    uint32
+	pending map[uint32][]byte
+	// gapSince is the time that we started waiting for the packet with
+	// sequence number next.
+	gapSince time.Time
+}
+
+// insert adds a received packet to the buffer. Packets that have already
+// been released or skipped past are discarded.
+func (b *reorderBuffer) insert(seq uint32, payload []byte) {
+	if !b.started {
+		b.started = true
+		b.next = seq
+	}
+	if seqBefore(seq, b.next) {
+		return
+	}
+	if _, ok := b.pending[seq]; ok {
+		return
+	}
+	if len(b.pending) == 0 {
+		b.gapSince = time.Now()
+	}
+	b.pending[seq] = payload
+	if len(b.pending) > reorderWindow {
+		b.skip()
+	}
+}
+
+// pop returns the next packet in sequence, if it has been received.
+func (b *reorderBuffer) pop() ([]byte, uint32, bool) {
+	payload, ok := b.pending[b.next]
+	if !ok {
+		return nil, 0, false
+	}
+	seq := b.next
+	delete(b.pending, seq)
+	b.next++
+	b.gapSince = time.Now()
+	return payload, seq, true
+}
+
+// waiting returns true if packets are being held because an earlier packet
+// is missing.
+func (b *reorderBuffer) waiting() bool {
+	return len(b.pending) > 0
+}
+
+// deadline returns the time at which we give up waiting for the missing
+// packet.
+func (b *reorderBuffer) deadline() time.Time {
+	return b.gapSince.Add(reorderTimeout)
+}
+
+// skip gives up waiting for the missing packet(s) and advances to the
+// earliest packet that is being held.
+func (b *reorderBuffer) skip() {
+	first := true
+	for seq := range b.pending {
+		if first || seqBefore(seq, b.next) {
+			b.next = seq
+			first = false
+		}
+	}
+}
+
+func makeReorderBuffer() *reorderBuffer {
+	return &reorderBuffer{
+		pending: make(map[uint32][]byte),
+	}
+}
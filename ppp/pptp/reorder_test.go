@@ -0,0 +1,69 @@
+package pptp
+
+import (
+	"testing"
+)
+
+func popAll(b *reorderBuffer) []uint32 {
+	result := []uint32{}
+	for {
+		_, seq, ok := b.pop()
+		if !ok {
+			return result
+		}
+		result = append(result, seq)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	b := makeReorderBuffer()
+	for _, seq := range []uint32{10, 12, 13, 11, 9, 14} {
+		b.insert(seq, []byte{byte(seq)})
+	}
+	got := popAll(b)
+	want := []uint32{10, 11, 12, 13, 14}
+	if len(got) != len(want) {
+		t.Fatalf("wrong packets released: want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("wrong packets released: want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestReorderSkip(t *testing.T) {
+	b := makeReorderBuffer()
+	b.insert(0xfffffffe, nil)
+	popAll(b)
+	// Missing packet 0xffffffff; sequence numbers wrap around.
+	b.insert(0, nil)
+	b.insert(1, nil)
+	if got := popAll(b); len(got) != 0 {
+		t.Fatalf("packets released before gap was filled: %v", got)
+	}
+	if !b.waiting() {
+		t.Fatalf("want waiting for missing packet")
+	}
+	b.skip()
+	if got := popAll(b); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("wrong packets released after skip: %v", got)
+	}
+	// Late arrival of the skipped packet is discarded.
+	b.insert(0xffffffff, nil)
+	if b.waiting() {
+		t.Errorf("late packet should have been discarded")
+	}
+}
+
+func TestReorderWindow(t *testing.T) {
+	b := makeReorderBuffer()
+	b.insert(0, nil)
+	popAll(b)
+	for seq := uint32(2); seq < 2+reorderWindow+1; seq++ {
+		b.insert(seq, nil)
+	}
+	if got := popAll(b); len(got) != reorderWindow+1 {
+		t.Errorf("want window overflow to skip missing packet, got %v", got)
+	}
+}
@@ -9,8 +9,13 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/fragglet/ipxbox/audit"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/ppp"
 )
@@ -38,6 +43,18 @@ const (
 	msgSetLinkInfo
 )
 
+// Result and error codes sent in Outgoing-Call-Reply messages.
+const (
+	resultConnected    = 1
+	resultGeneralError = 2
+
+	errorNone       = 0
+	errorNoResource = 4
+
+	// Length of the call statistics field in Call-Disconnect-Notify.
+	callStatisticsLength = 128
+)
+
 type Connection struct {
 	callID uint16
 	conn   net.Conn
@@ -93,6 +110,41 @@ func (c *Connection) handleEcho(msg []byte) {
 	c.sendMessage(reply)
 }
 
+func (c *Connection) handleStopControl(msg []byte) {
+	reply := []byte{
+		0x00, 0x01, // Message type
+		0x1a, 0x2b, 0x3c, 0x4d, // Magic cookie
+		0x00, 0x04, // Control message type
+		0x00, 0x00, // Reserved0
+		0x01,       // Result code
+		0x00,       // Error code
+		0x00, 0x00, // Reserved1
+	}
+	c.sendMessage(reply)
+}
+
+// sendCallDisconnectNotify tells the client that the call has been
+// disconnected because of the given error. The error message is included
+// in the call statistics field, which clients may show to the user.
+func (c *Connection) sendCallDisconnectNotify(err error) {
+	msg := []byte{
+		0x00, 0x01, // Message type
+		0x1a, 0x2b, 0x3c, 0x4d, // Magic cookie
+		0x00, 0x0d, // Control message type
+		0x00, 0x00, // Reserved0
+		0x00, 0x00, // Call ID
+		0x02,       // Result code (general error)
+		0x00,       // Error code
+		0x00, 0x00, // Cause code
+		0x00, 0x00, // Reserved1
+	}
+	binary.BigEndian.PutUint16(msg[10:12], c.callID)
+	var stats [callStatisticsLength]byte
+	copy(stats[:len(stats)-1], []byte(err.Error()))
+	msg = append(msg, stats[:]...)
+	c.sendMessage(msg)
+}
+
 func (c *Connection) Close() error {
 	err1 := c.conn.Close()
 	var err2 error
@@ -121,12 +173,29 @@ func (c *Connection) startPPPSession(ctx context.Context, sendCallID uint16) {
 		c.conn.Close()
 		return
 	}
-	node := c.s.n.NewNode()
+	node := network.WithRemoteAddr(c.s.n.NewNode(), addr)
+	if err := network.NodeError(node); err != nil {
+		// TODO: Send back error message? Log error?
+		node.Close()
+		gre.Close()
+		c.conn.Close()
+		return
+	}
 	c.ppp = ppp.NewSession(gre, node)
+	c.ppp.SetDiscardInterval(c.s.discardInterval)
+	if c.s.logger != nil {
+		c.ppp.SetLogger(c.s.logger.With(
+			"remote_addr", addr.String(),
+			"call_id", c.callID,
+			"peer_call_id", sendCallID))
+	}
+	endAudit := c.s.audit.Start("pptp", node, addr)
 	go func() {
-		err := c.ppp.Run(ctx)
-		if err != nil {
-			// TODO: log error?
+		defer endAudit()
+		// If the session failed, tell the client why before we
+		// close the connection.
+		if err := c.ppp.Run(ctx); err != nil {
+			c.sendCallDisconnectNotify(err)
 		}
 		// Once the PPP session terminates, close the PPTP control
 		// connection as well.
@@ -134,13 +203,9 @@ func (c *Connection) startPPPSession(ctx context.Context, sendCallID uint16) {
 	}()
 }
 
-func (c *Connection) handleOutgoingCall(ctx context.Context, msg []byte) {
-	if len(msg) < 22 {
-		return
-	}
-	// Start up GRE session if we have not already.
-	sendCallID := binary.BigEndian.Uint16(msg[10:12])
-	c.startPPPSession(ctx, sendCallID)
+// sendOutgoingCallReply sends an Outgoing-Call-Reply in response to the given
+// Outgoing-Call-Request, with the given result and error codes.
+func (c *Connection) sendOutgoingCallReply(msg []byte, resultCode, errorCode byte) {
 	reply := []byte{
 		0x00, 0x01, // Message type
 		0x1a, 0x2b, 0x3c, 0x4d, // Magic cookie
@@ -156,6 +221,8 @@ func (c *Connection) handleOutgoingCall(ctx context.Context, msg []byte) {
 		0x00, 0x00, // Processing delay
 		0x00, 0x00, 0x00, 0x00, // Physical channel ID
 	}
+	reply[14] = resultCode
+	reply[15] = errorCode
 	// Call ID.
 	binary.BigEndian.PutUint16(reply[10:12], c.callID)
 	// We deliberately set the receive window size to a large value (1024
@@ -170,9 +237,26 @@ func (c *Connection) handleOutgoingCall(ctx context.Context, msg []byte) {
 	c.sendMessage(reply)
 }
 
+func (c *Connection) handleOutgoingCall(ctx context.Context, msg []byte) {
+	if len(msg) < 22 {
+		return
+	}
+	// We advertise a maximum of one channel in our Start-Control-
+	// Connection-Reply, so any further calls are rejected.
+	if c.ppp != nil {
+		c.sendOutgoingCallReply(msg, resultGeneralError, errorNoResource)
+		return
+	}
+	sendCallID := binary.BigEndian.Uint16(msg[10:12])
+	c.startPPPSession(ctx, sendCallID)
+	c.sendOutgoingCallReply(msg, resultConnected, errorNone)
+}
+
 func (c *Connection) readNextMessage() ([]byte, error) {
+	// TCP is a stream protocol, so a message may be split across several
+	// reads; io.ReadFull is used to assemble the complete message.
 	var lenField [2]byte
-	if _, err := c.conn.Read(lenField[:]); err != nil {
+	if _, err := io.ReadFull(c.conn, lenField[:]); err != nil {
 		return nil, err
 	}
 	msglen := binary.BigEndian.Uint16(lenField[:])
@@ -183,7 +267,7 @@ func (c *Connection) readNextMessage() ([]byte, error) {
 		return nil, fmt.Errorf("message too long: len=%d", msglen)
 	}
 	result := make([]byte, msglen-2)
-	if _, err := c.conn.Read(result); err != nil {
+	if _, err := io.ReadFull(c.conn, result); err != nil {
 		return nil, err
 	}
 	gotMsgType := binary.BigEndian.Uint16(result[0:2])
@@ -215,6 +299,17 @@ messageLoop:
 			c.handleEcho(msg)
 		case msgOutgoingCallRequest:
 			c.handleOutgoingCall(ctx, msg)
+		case msgSetLinkInfo:
+			// Windows clients send this to tell us the async
+			// control character map (ACCM) negotiated by PPP.
+			// The ACCM only controls escaping on async serial
+			// links; our PPP frames are carried over GRE
+			// without escaping, so there is nothing to apply.
+			// RFC 2637 defines no reply, so the message is
+			// accepted and the call carries on.
+		case msgStopControlConnectionRequest:
+			c.handleStopControl(msg)
+			break messageLoop
 		case msgCallClearRequest:
 			break messageLoop
 		}
@@ -239,6 +334,38 @@ type Server struct {
 	nextCallID uint16
 	n          network.Network
 	greServer  *greServer
+	// discardInterval is passed to the PPP sessions of new connections.
+	discardInterval time.Duration
+	// logger is passed to the PPP sessions of new connections, or nil
+	// if nothing is logged.
+	logger *slog.Logger
+	// If not nil, a record of each PPP session is written to the audit
+	// log when it ends.
+	audit *audit.Log
+
+	mu          sync.Mutex // protects connections and draining
+	connections map[*Connection]bool
+	// draining is set once Drain is called; new connections are closed
+	// as soon as they are accepted.
+	draining bool
+}
+
+// addConnection records a newly accepted connection, returning false if the
+// server is draining and the connection should not be accepted.
+func (s *Server) addConnection(c *Connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.connections[c] = true
+	return true
+}
+
+func (s *Server) removeConnection(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.connections, c)
 }
 
 // Run listens for and accepts new connections to the server. It blocks until
@@ -252,17 +379,65 @@ func (s *Server) Run(ctx context.Context) {
 		}
 		// TODO: Subcontext per connection and cancel on close
 		c := newConnection(s, conn, s.nextCallID)
-		go c.run(ctx)
+		if !s.addConnection(c) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			c.run(ctx)
+			s.removeConnection(c)
+		}()
 		s.nextCallID = (s.nextCallID + 1) & 0xffff
 	}
 	s.listener.Close()
 }
 
+// Drain stops the server from accepting new connections. Clients that are
+// already connected can stay connected.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+}
+
+// NumClients returns the number of clients currently connected.
+func (s *Server) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.connections)
+}
+
+// Close closes the listener and all client connections to shut down the
+// server.
 func (s *Server) Close() error {
+	s.mu.Lock()
+	for c := range s.connections {
+		c.Close()
+	}
+	s.mu.Unlock()
 	s.greServer.Close()
 	return s.listener.Close()
 }
 
+// SetDiscardInterval sets the interval at which the PPP sessions of new
+// connections send LCP Discard-Requests to check that the link is still
+// working. If zero, none are sent.
+func (s *Server) SetDiscardInterval(interval time.Duration) {
+	s.discardInterval = interval
+}
+
+// SetLogger sets the logger used by the PPP sessions of new connections.
+// Each session's log entries identify the peer's address and call ID.
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+// SetAudit sets the audit log that a record of each PPP session is written
+// to when the session ends.
+func (s *Server) SetAudit(l *audit.Log) {
+	s.audit = l
+}
+
 func NewServer(n network.Network) (*Server, error) {
 	gs, err := startGREServer()
 	if err != nil {
@@ -276,9 +451,10 @@ func NewServer(n network.Network) (*Server, error) {
 		return nil, err
 	}
 	return &Server{
-		listener:   listener,
-		nextCallID: 384,
-		n:          n,
-		greServer:  gs,
+		listener:    listener,
+		nextCallID:  384,
+		n:           n,
+		greServer:   gs,
+		connections: map[*Connection]bool{},
 	}, nil
 }
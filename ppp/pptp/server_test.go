@@ -0,0 +1,233 @@
+package pptp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/ppp"
+)
+
+func TestReadSplitMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newConnection(nil, server, 0)
+
+	msg := make([]byte, 16)
+	binary.BigEndian.PutUint16(msg[0:2], uint16(len(msg)))
+	binary.BigEndian.PutUint16(msg[2:4], 1)
+	binary.BigEndian.PutUint32(msg[4:8], magicNumber)
+	binary.BigEndian.PutUint16(msg[8:10], msgEchoRequest)
+	go func() {
+		// Deliver the message in two chunks, split partway through
+		// the body.
+		client.Write(msg[:5])
+		time.Sleep(10 * time.Millisecond)
+		client.Write(msg[5:])
+	}()
+
+	got, err := c.readNextMessage()
+	if err != nil {
+		t.Fatalf("readNextMessage failed: %v", err)
+	}
+	if len(got) != len(msg)-2 {
+		t.Fatalf("wrong message length: want %d, got %d", len(msg)-2, len(got))
+	}
+	if msgtype := binary.BigEndian.Uint16(got[6:8]); msgtype != msgEchoRequest {
+		t.Errorf("wrong message type: want %d, got %d", msgEchoRequest, msgtype)
+	}
+}
+
+func TestStopControlConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConnection(nil, server, 0)
+	done := make(chan struct{})
+	go func() {
+		c.run(context.Background())
+		close(done)
+	}()
+
+	msg := make([]byte, 16)
+	binary.BigEndian.PutUint16(msg[0:2], uint16(len(msg)))
+	binary.BigEndian.PutUint16(msg[2:4], 1)
+	binary.BigEndian.PutUint32(msg[4:8], magicNumber)
+	binary.BigEndian.PutUint16(msg[8:10], msgStopControlConnectionRequest)
+	msg[12] = 1 // Reason: general request
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+
+	reply := make([]byte, 16)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if msgtype := binary.BigEndian.Uint16(reply[8:10]); msgtype != msgStopControlConnectionReply {
+		t.Errorf("wrong reply type: want %d, got %d", msgStopControlConnectionReply, msgtype)
+	}
+	if reply[12] != 1 {
+		t.Errorf("wrong result code: want 1, got %d", reply[12])
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("connection not closed after Stop-Control-Connection-Request")
+	}
+}
+
+func TestSecondCallRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newConnection(nil, server, 0x180)
+	// Simulate a call already being in progress.
+	channel, _ := net.Pipe()
+	defer channel.Close()
+	c.ppp = ppp.NewSession(channel, network.Null{}.NewNode())
+
+	msg := make([]byte, 22)
+	binary.BigEndian.PutUint16(msg[0:2], 1)
+	binary.BigEndian.PutUint32(msg[2:6], magicNumber)
+	binary.BigEndian.PutUint16(msg[6:8], msgOutgoingCallRequest)
+	binary.BigEndian.PutUint16(msg[10:12], 0x1234)
+	go c.handleOutgoingCall(context.Background(), msg)
+
+	reply := make([]byte, 32)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if msgtype := binary.BigEndian.Uint16(reply[8:10]); msgtype != msgOutgoingCallReply {
+		t.Errorf("wrong reply type: want %d, got %d", msgOutgoingCallReply, msgtype)
+	}
+	if peerCallID := binary.BigEndian.Uint16(reply[14:16]); peerCallID != 0x1234 {
+		t.Errorf("wrong peer call ID: want %#x, got %#x", 0x1234, peerCallID)
+	}
+	if reply[16] != resultGeneralError || reply[17] != errorNoResource {
+		t.Errorf("want call rejected, got result=%d, error=%d", reply[16], reply[17])
+	}
+}
+
+func TestCallDisconnectNotify(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newConnection(nil, server, 0x180)
+	go c.sendCallDisconnectNotify(errors.New("negotiation failed"))
+
+	msg := make([]byte, 148)
+	if _, err := io.ReadFull(client, msg); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if msglen := binary.BigEndian.Uint16(msg[0:2]); msglen != 148 {
+		t.Errorf("wrong message length: want 148, got %d", msglen)
+	}
+	if msgtype := binary.BigEndian.Uint16(msg[8:10]); msgtype != msgCallDisconnectNotify {
+		t.Errorf("wrong message type: want %d, got %d", msgCallDisconnectNotify, msgtype)
+	}
+	if callID := binary.BigEndian.Uint16(msg[12:14]); callID != 0x180 {
+		t.Errorf("wrong call ID: want %#x, got %#x", 0x180, callID)
+	}
+	if got := string(bytes.TrimRight(msg[20:], "\x00")); got != "negotiation failed" {
+		t.Errorf("wrong call statistics: want %q, got %q", "negotiation failed", got)
+	}
+}
+
+func TestSetLinkInfo(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConnection(nil, server, 0x180)
+	go c.run(context.Background())
+
+	// Set-Link-Info has no reply; it should be accepted without closing
+	// the connection, so that a following Echo-Request is answered.
+	setLinkInfo := make([]byte, 24)
+	binary.BigEndian.PutUint16(setLinkInfo[0:2], uint16(len(setLinkInfo)))
+	binary.BigEndian.PutUint16(setLinkInfo[2:4], 1)
+	binary.BigEndian.PutUint32(setLinkInfo[4:8], magicNumber)
+	binary.BigEndian.PutUint16(setLinkInfo[8:10], msgSetLinkInfo)
+	binary.BigEndian.PutUint16(setLinkInfo[12:14], 0x180)
+	binary.BigEndian.PutUint32(setLinkInfo[16:20], 0xffffffff)
+	binary.BigEndian.PutUint32(setLinkInfo[20:24], 0xffffffff)
+	echo := make([]byte, 16)
+	binary.BigEndian.PutUint16(echo[0:2], uint16(len(echo)))
+	binary.BigEndian.PutUint16(echo[2:4], 1)
+	binary.BigEndian.PutUint32(echo[4:8], magicNumber)
+	binary.BigEndian.PutUint16(echo[8:10], msgEchoRequest)
+	binary.BigEndian.PutUint32(echo[12:16], 0x12345678)
+	for _, msg := range [][]byte{setLinkInfo, echo} {
+		if _, err := client.Write(msg); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 20)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if msgtype := binary.BigEndian.Uint16(reply[8:10]); msgtype != msgEchoReply {
+		t.Errorf("wrong reply type: want %d, got %d", msgEchoReply, msgtype)
+	}
+	if id := binary.BigEndian.Uint32(reply[12:16]); id != 0x12345678 {
+		t.Errorf("wrong echo identifier: want %#x, got %#x", 0x12345678, id)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		listener: listener,
+		n:        network.Null{},
+		greServer: &greServer{
+			conn:     &fakeGREConn{},
+			sessions: make(map[sessionKey]*greSession),
+		},
+		connections: map[*Connection]bool{},
+	}
+	defer s.Close()
+	go s.Run(context.Background())
+
+	waitClients := func(want int) {
+		t.Helper()
+		for start := time.Now(); s.NumClients() != want; {
+			if time.Since(start) > time.Second {
+				t.Fatalf("wrong number of clients: want %d, got %d", want, s.NumClients())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	waitClients(1)
+
+	// New connections are closed straight away once draining.
+	s.Drain()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("new connection while draining: want %v, got %v", io.EOF, err)
+	}
+	if got := s.NumClients(); got != 1 {
+		t.Errorf("wrong number of clients while draining: want 1, got %d", got)
+	}
+
+	client.Close()
+	waitClients(0)
+}
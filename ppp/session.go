@@ -2,12 +2,13 @@ package ppp
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"golang.org/x/sync/errgroup"
 	"io"
-	"math/rand"
+	"log/slog"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,22 @@ import (
 
 const (
 	PPPTypeIPX layers.PPPType = 0x002b
+
+	// maxProtocolRejects is the number of frames with unsupported
+	// protocols that a peer may send before we give up on it.
+	maxProtocolRejects = 32
+
+	// defaultMRU is the Maximum-Receive-Unit that is used if none is
+	// negotiated (RFC 1661), and is also the largest we will receive.
+	defaultMRU = 1500
+
+	// minMRU is the smallest MRU we accept. Every IPX network must be
+	// able to carry packets of this size.
+	minMRU = 576
+
+	// pppHeaderLength is the length of the address, control and protocol
+	// fields that precede the information field of each frame.
+	pppHeaderLength = 4
 )
 
 var (
@@ -45,14 +62,36 @@ const (
 )
 
 type Session struct {
-	node               network.Node
+	// node is the session's node on the IPX network, and is read and
+	// written using the usual context-aware network.Node interface.
+	node network.Node
+	// channel carries raw PPP frames to and from the peer (eg. over a
+	// PPTP GRE tunnel), so it is a byte stream rather than a node.
 	channel            io.ReadWriteCloser
 	mu                 sync.Mutex // protects state
 	state              linkState
 	negotiators        map[layers.PPPType]*negotiator
 	numProtocolRejects uint8
+	numCodeRejects     uint8
+	numDiscards        uint8
 	magicNumber        uint32
 	terminateError     error
+	// peerMRU is the largest frame the peer will receive, as negotiated
+	// during LCP negotiation.
+	peerMRU int
+	// discardInterval is the interval at which Discard-Requests are
+	// sent to the peer, or zero if they are not sent.
+	discardInterval time.Duration
+	// logger is used to log events on the link, or nil if they are not
+	// logged.
+	logger *slog.Logger
+}
+
+func (s *Session) log(level slog.Level, msg string, args ...any) {
+	if s.logger != nil {
+		args = append(args, "ipx_address", network.NodeAddress(s.node).String())
+		s.logger.Log(context.Background(), level, msg, args...)
+	}
 }
 
 func (s *Session) Close() error {
@@ -94,6 +133,10 @@ func (s *Session) sendPackets(ctx context.Context) error {
 	for !s.Terminated() {
 		packet, err := s.node.ReadPacket(ctx)
 		if err != nil {
+			if s.Terminated() {
+				// Node was closed as part of shutdown.
+				return nil
+			}
 			return err
 		}
 		s.mu.Lock()
@@ -107,6 +150,14 @@ func (s *Session) sendPackets(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
+		s.mu.Lock()
+		mru := s.peerMRU
+		s.mu.Unlock()
+		if len(marshaled) > mru {
+			// IPX has no fragmentation, so a packet too large for
+			// the peer to receive can only be dropped.
+			continue
+		}
 		if err := s.sendPPP(marshaled, PPPTypeIPX); err != nil {
 			return err
 		}
@@ -114,10 +165,80 @@ func (s *Session) sendPackets(ctx context.Context) error {
 	return nil
 }
 
+// sendDiscards periodically sends a Discard-Request to the peer while the link
+// is open, until the done channel is closed. The peer silently discards
+// them, so they are a lightweight way of checking that frames can still be
+// sent over the link, without requiring the peer to reply.
+func (s *Session) sendDiscards(ctx context.Context, done <-chan struct{}) error {
+	ticker := time.NewTicker(s.discardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		ok := s.state == stateNetwork
+		id := s.numDiscards
+		s.numDiscards++
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		err := s.sendLCP(&lcp.LCP{
+			Type:       lcp.DiscardRequest,
+			Identifier: id,
+			Data: &lcp.EchoData{
+				MagicNumber: s.magicNumber,
+			},
+		})
+		if err != nil && !s.Terminated() {
+			return err
+		}
+	}
+}
+
+// sendCodeReject sends a Code-Reject in response to an LCP packet with a code
+// that we do not recognize.
+func (s *Session) sendCodeReject(l *lcp.LCP) {
+	rejected := l.Contents
+	s.mu.Lock()
+	// The rejected packet is truncated if necessary so that the
+	// Code-Reject fits within the peer's MRU.
+	if maxLen := s.peerMRU - 4; len(rejected) > maxLen {
+		rejected = rejected[:maxLen]
+	}
+	id := s.numCodeRejects
+	s.numCodeRejects++
+	s.mu.Unlock()
+	s.sendLCP(&lcp.LCP{
+		Type:       lcp.CodeReject,
+		Identifier: id,
+		Data: &lcp.CodeRejectData{
+			RejectedPacket: rejected,
+		},
+	})
+}
+
 func (s *Session) handleLCP(l *lcp.LCP) bool {
 	switch l.Type {
+	case lcp.ConfigureRequest, lcp.ConfigureAck, lcp.ConfigureNak, lcp.ConfigureReject:
+		// Handled by the negotiator.
+		return false
 	case lcp.TerminateRequest:
+		// The peer may include a human-readable reason for the
+		// disconnect; log it since it is often the only clue as to
+		// why a client dropped.
+		reason := ""
+		if td, ok := l.Data.(*lcp.TerminateData); ok {
+			reason = string(td.Data)
+		}
+		s.log(slog.LevelInfo, "peer terminated PPP link", "reason", reason)
 		// Send ack and then immediately shut down.
+		s.setState(stateTerminate)
 		s.sendLCP(&lcp.LCP{
 			Type:       lcp.TerminateAck,
 			Identifier: l.Identifier,
@@ -138,15 +259,18 @@ func (s *Session) handleLCP(l *lcp.LCP) bool {
 				MagicNumber: s.magicNumber,
 			},
 		})
+	case lcp.TerminateAck, lcp.CodeReject, lcp.EchoReply, lcp.DiscardRequest:
+		// Nothing to do.
 	default:
-		return false
+		// RFC 1661 requires that unknown codes are rejected.
+		s.sendCodeReject(l)
 	}
 	return true
 }
 
 // recvAndProcess waits until a PPP frame is received and processes it.
 func (s *Session) recvAndProcess() error {
-	var buf [1500]byte
+	var buf [defaultMRU + pppHeaderLength]byte
 	// TODO: Send Echo-Requests when link idle, and time out eventually
 	nbytes, err := s.channel.Read(buf[:])
 	if err != nil {
@@ -160,6 +284,10 @@ func (s *Session) recvAndProcess() error {
 	}
 	ppp := pppLayer.(*layers.PPP)
 	if !supportedProtocols[ppp.PPPType] {
+		if s.numProtocolRejects >= maxProtocolRejects {
+			s.Terminate(fmt.Errorf("too many frames received with unsupported protocols"))
+			return nil
+		}
 		s.sendLCP(&lcp.LCP{
 			Type:       lcp.ProtocolReject,
 			Identifier: s.numProtocolRejects,
@@ -198,22 +326,60 @@ func (s *Session) recvAndProcess() error {
 	return nil
 }
 
+// parseMRU decodes the value of an MRU option, returning the default if
+// no value was negotiated.
+func parseMRU(value []byte) int {
+	if len(value) != 2 {
+		return defaultMRU
+	}
+	return int(binary.BigEndian.Uint16(value))
+}
+
+// validateLocalMRU is a validator function for the MRU that we request. The
+// peer may ask us to use a smaller MRU, but we cannot receive frames larger
+// than the default.
+func validateLocalMRU(o *option, newValue []byte) bool {
+	mru := parseMRU(newValue)
+	return newValue == nil || (len(newValue) == 2 && mru >= minMRU && mru <= defaultMRU)
+}
+
+// validateRemoteMRU is a validator function for the MRU requested by the
+// peer, which limits the size of the frames we send to it.
+func validateRemoteMRU(o *option, newValue []byte) bool {
+	return newValue == nil || (len(newValue) == 2 && parseMRU(newValue) >= minMRU)
+}
+
 // negotiate runs the basic LCP negotiation phase of PPP link setup.
 func (s *Session) negotiate() error {
+	// The magic number is used to detect looped-back links, so it must
+	// be unpredictable even when many sessions start at once. Zero is
+	// not a valid magic number (RFC 1661 section 6.4).
 	magicNumber := []byte{0, 0, 0, 0}
-	rand.Seed(time.Now().Unix())
-	rand.Read(magicNumber)
+	for binary.BigEndian.Uint32(magicNumber) == 0 {
+		if _, err := rand.Read(magicNumber); err != nil {
+			return err
+		}
+	}
+	mru := binary.BigEndian.AppendUint16(nil, defaultMRU)
 	localOptions := map[lcp.OptionType]*option{
 		lcp.OptionMagicNumber: &option{
 			value:    magicNumber,
 			validate: nonNegotiable,
 		},
+		lcp.OptionMRU: &option{
+			value:    mru,
+			validate: validateLocalMRU,
+		},
 	}
 	remoteOptions := map[lcp.OptionType]*option{
 		lcp.OptionMagicNumber: &option{
 			value:    []byte{0, 0, 0, 0},
 			validate: requiredOption,
 		},
+		lcp.OptionMRU: &option{
+			value:    mru,
+			validate: validateRemoteMRU,
+		},
 	}
 
 	n := &negotiator{
@@ -243,9 +409,26 @@ func (s *Session) negotiate() error {
 	}
 	// Negotiation successful
 	s.magicNumber = binary.BigEndian.Uint32(magicNumber)
+	s.mu.Lock()
+	s.peerMRU = parseMRU(remoteOptions[lcp.OptionMRU].value)
+	s.mu.Unlock()
 	return nil
 }
 
+// validateNodeAddress is a validator function for the IPXCP node address
+// option. The client may request its own address (eg. to keep the same
+// address across reconnects); if the address is not available, we Nak with
+// the address assigned by the server.
+func (s *Session) validateNodeAddress(o *option, newValue []byte) bool {
+	var changeAddress network.AddressChanger
+	if len(newValue) != len(ipx.Addr{}) || !s.node.GetProperty(&changeAddress) {
+		return false
+	}
+	var addr ipx.Addr
+	copy(addr[:], newValue)
+	return changeAddress(addr) == nil
+}
+
 // negotiateIPX runs IPXCP negotiation phase of PPP link setup.
 func (s *Session) negotiateIPX() error {
 	localOptions := map[lcp.OptionType]*option{
@@ -256,13 +439,11 @@ func (s *Session) negotiateIPX() error {
 			value: []byte{0, 0, 0, 0, 0, 0},
 		},
 	}
-	// TODO: Make address negotiable so that client can supply a
-	// desired address?
 	addr := network.NodeAddress(s.node)
 	remoteOptions := map[lcp.OptionType]*option{
 		lcp.OptionIPXNode: &option{
 			value:    addr[:],
-			validate: nonNegotiable,
+			validate: s.validateNodeAddress,
 		},
 	}
 
@@ -355,7 +536,14 @@ func (s *Session) Run(ctx context.Context) error {
 	eg.Go(func() error {
 		return s.sendPackets(subctx)
 	})
+	done := make(chan struct{})
+	if s.discardInterval > 0 {
+		eg.Go(func() error {
+			return s.sendDiscards(subctx, done)
+		})
+	}
 	eg.Go(func() error {
+		defer close(done)
 		// Main session logic.
 		err := s.doRun()
 		// If the error is because the connection was closed or the
@@ -379,11 +567,26 @@ func (s *Session) Run(ctx context.Context) error {
 	return err
 }
 
+// SetDiscardInterval sets the interval at which Discard-Requests are sent to
+// the peer once the link is open; if zero, none are sent. It must be called
+// before Run.
+func (s *Session) SetDiscardInterval(interval time.Duration) {
+	s.discardInterval = interval
+}
+
+// SetLogger sets the logger used to log events on the link. It should
+// identify the peer, for example with the peer's address. It must be
+// called before Run.
+func (s *Session) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
 func NewSession(channel io.ReadWriteCloser, node network.Node) *Session {
 	return &Session{
 		state:       stateEstablish,
 		channel:     channel,
 		node:        node,
 		negotiators: make(map[layers.PPPType]*negotiator),
+		peerMRU:     defaultMRU,
 	}
 }
@@ -0,0 +1,459 @@
+package ppp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/ppp/lcp"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fakeChannel records the PPP frames written to it, and returns queued
+// frames when read.
+type fakeChannel struct {
+	toRead  [][]byte
+	written [][]byte
+	closed  bool
+}
+
+func (c *fakeChannel) Read(buf []byte) (int, error) {
+	if len(c.toRead) == 0 {
+		return 0, errors.New("no more frames")
+	}
+	n := copy(buf, c.toRead[0])
+	c.toRead = c.toRead[1:]
+	return n, nil
+}
+
+func (c *fakeChannel) Write(buf []byte) (int, error) {
+	c.written = append(c.written, append([]byte{}, buf...))
+	return len(buf), nil
+}
+
+func (c *fakeChannel) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeChannel) sentLCP(t *testing.T) []*lcp.LCP {
+	t.Helper()
+	result := []*lcp.LCP{}
+	for _, frame := range c.written {
+		pkt := gopacket.NewPacket(frame, layers.LayerTypePPP, gopacket.Default)
+		l := pkt.Layer(lcp.LayerTypeLCP)
+		if l == nil {
+			t.Fatalf("frame is not an LCP frame: %x", frame)
+		}
+		result = append(result, l.(*lcp.LCP))
+	}
+	return result
+}
+
+func TestTerminateRequest(t *testing.T) {
+	var buf bytes.Buffer
+	channel := &fakeChannel{}
+	s := NewSession(channel, network.Null{}.NewNode())
+	s.SetLogger(slog.New(slog.NewTextHandler(&buf, nil)).With("remote_addr", "10.0.0.1"))
+	s.handleLCP(&lcp.LCP{
+		Type:       lcp.TerminateRequest,
+		Identifier: 42,
+		Data:       &lcp.TerminateData{Data: []byte("authentication failed")},
+	})
+	sent := channel.sentLCP(t)
+	if len(sent) != 1 || sent[0].Type != lcp.TerminateAck || sent[0].Identifier != 42 {
+		t.Errorf("want Terminate-Ack with identifier 42, got %+v", sent)
+	}
+	if !channel.closed {
+		t.Errorf("channel not closed after Terminate-Request")
+	}
+	logged := buf.String()
+	if !strings.Contains(logged, `reason="authentication failed"`) {
+		t.Errorf("termination reason not logged: %q", logged)
+	}
+	if !strings.Contains(logged, "remote_addr=10.0.0.1") {
+		t.Errorf("peer not identified in log: %q", logged)
+	}
+}
+
+func TestProtocolReject(t *testing.T) {
+	channel := &fakeChannel{}
+	s := NewSession(channel, network.Null{}.NewNode())
+	s.handleLCP(&lcp.LCP{
+		Type: lcp.ProtocolReject,
+		Data: &lcp.ProtocolRejectData{
+			PPPType: PPPTypeIPX,
+		},
+	})
+	sent := channel.sentLCP(t)
+	if len(sent) != 1 || sent[0].Type != lcp.TerminateRequest {
+		t.Errorf("want Terminate-Request, got %+v", sent)
+	}
+	if !channel.closed || !s.Terminated() {
+		t.Errorf("session not terminated after Protocol-Reject")
+	}
+	if s.terminateError == nil {
+		t.Errorf("want terminate error after Protocol-Reject")
+	}
+}
+
+func TestCodeReject(t *testing.T) {
+	channel := &fakeChannel{}
+	s := NewSession(channel, network.Null{}.NewNode())
+	unknown := []byte{42, 7, 0, 6, 0xab, 0xcd}
+	l := &lcp.LCP{}
+	if err := l.UnmarshalBinary(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if !s.handleLCP(l) {
+		t.Fatalf("unknown code not handled")
+	}
+	// Codes that we recognize but have nothing to do with are
+	// silently discarded.
+	s.handleLCP(&lcp.LCP{Type: lcp.EchoReply, Data: &lcp.EchoData{}})
+
+	sent := channel.sentLCP(t)
+	if len(sent) != 1 || sent[0].Type != lcp.CodeReject {
+		t.Fatalf("want Code-Reject, got %+v", sent)
+	}
+	crd, ok := sent[0].Data.(*lcp.CodeRejectData)
+	if !ok || !bytes.Equal(crd.RejectedPacket, unknown) {
+		t.Errorf("Code-Reject does not contain rejected packet: %+v", sent[0].Data)
+	}
+	if s.Terminated() {
+		t.Errorf("session terminated after unknown code")
+	}
+}
+
+func TestDiscardRequest(t *testing.T) {
+	channel := &fakeChannel{}
+	s := NewSession(channel, network.Null{}.NewNode())
+	s.magicNumber = 0x12345678
+
+	// Discard-Requests from the peer are silently discarded.
+	received := &lcp.LCP{}
+	frame := []byte{byte(lcp.DiscardRequest), 1, 0, 10, 0, 0, 0, 0, 0xab, 0xcd}
+	if err := received.UnmarshalBinary(frame); err != nil {
+		t.Fatal(err)
+	}
+	if !s.handleLCP(received) {
+		t.Errorf("Discard-Request not handled")
+	}
+	if sent := channel.sentLCP(t); len(sent) != 0 {
+		t.Fatalf("want nothing sent in response to Discard-Request, got %+v", sent)
+	}
+
+	// Once the link is open we send our own.
+	s.SetDiscardInterval(10 * time.Millisecond)
+	s.setState(stateNetwork)
+	done := make(chan struct{})
+	result := make(chan error)
+	go func() {
+		result <- s.sendDiscards(context.Background(), done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	if err := <-result; err != nil {
+		t.Fatalf("sendDiscards failed: %v", err)
+	}
+	sent := channel.sentLCP(t)
+	if len(sent) == 0 {
+		t.Fatalf("no Discard-Requests sent")
+	}
+	for i, l := range sent {
+		ed, ok := l.Data.(*lcp.EchoData)
+		if l.Type != lcp.DiscardRequest || !ok || ed.MagicNumber != s.magicNumber {
+			t.Errorf("want Discard-Request with magic number %x, got %+v", s.magicNumber, l)
+		}
+		if l.Identifier != uint8(i) {
+			t.Errorf("wrong identifier: want %d, got %d", i, l.Identifier)
+		}
+	}
+}
+
+func TestTooManyProtocolRejects(t *testing.T) {
+	channel := &fakeChannel{}
+	s := NewSession(channel, network.Null{}.NewNode())
+	// PPTP header, followed by an unsupported protocol (IPv4).
+	frame := []byte{0xff, 0x03, 0x00, 0x21, 1, 2, 3, 4}
+	for i := 0; i < maxProtocolRejects+10; i++ {
+		channel.toRead = append(channel.toRead, frame)
+	}
+	for i := 0; i < maxProtocolRejects+10 && !s.Terminated(); i++ {
+		if err := s.recvAndProcess(); err != nil {
+			t.Fatalf("recvAndProcess failed: %v", err)
+		}
+	}
+	if !s.Terminated() {
+		t.Fatalf("session not terminated after %d unsupported frames", maxProtocolRejects+10)
+	}
+	sent := channel.sentLCP(t)
+	if len(sent) != maxProtocolRejects+1 {
+		t.Fatalf("want %d frames sent, got %d", maxProtocolRejects+1, len(sent))
+	}
+	if sent[0].Type != lcp.ProtocolReject || sent[len(sent)-1].Type != lcp.TerminateRequest {
+		t.Errorf("want Protocol-Rejects followed by Terminate-Request, got %v and %v", sent[0].Type, sent[len(sent)-1].Type)
+	}
+}
+
+func expectLCP(t *testing.T, ctx context.Context, c *ipxtesting.PPPChannel, pppType layers.PPPType, lcpType lcp.MessageType) *lcp.LCP {
+	t.Helper()
+	for {
+		l, err := c.RecvLCP(ctx, pppType)
+		if err != nil {
+			t.Fatalf("error waiting for %v message: %v", lcpType, err)
+		}
+		// Configure-Requests may be retransmitted while we wait.
+		if l.Type == lcpType {
+			return l
+		}
+	}
+}
+
+// negotiateAsPeer plays the part of the client in a negotiation phase,
+// acking the server's request and sending a request with the given options.
+func negotiateAsPeer(t *testing.T, ctx context.Context, c *ipxtesting.PPPChannel, pppType layers.PPPType, opts []lcp.Option) *lcp.LCP {
+	t.Helper()
+	req := expectLCP(t, ctx, c, pppType, lcp.ConfigureRequest)
+	c.SendLCP(pppType, &lcp.LCP{
+		Type:       lcp.ConfigureAck,
+		Identifier: req.Identifier,
+		Data:       req.Data,
+	})
+	c.SendLCP(pppType, &lcp.LCP{
+		Type:       lcp.ConfigureRequest,
+		Identifier: 1,
+		Data:       &lcp.ConfigureData{Options: opts},
+	})
+	expectLCP(t, ctx, c, pppType, lcp.ConfigureAck)
+	return req
+}
+
+// waitForNetwork waits until the session has finished negotiation and
+// entered the network phase, or has terminated.
+func waitForNetwork(s *Session) {
+	for !s.Terminated() {
+		s.mu.Lock()
+		state := s.state
+		s.mu.Unlock()
+		if state == stateNetwork {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionNegotiation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	channel, peer := ipxtesting.MakePPPChannelPair()
+	received := make(chan *ipx.Packet, 1)
+	node := &ipxtesting.FakeNetwork{
+		Inner: ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+			received <- pkt
+		}),
+		Address: ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+	s := NewSession(channel, node)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+
+	req := negotiateAsPeer(t, ctx, peer, lcp.PPPTypeLCP, []lcp.Option{
+		{Type: lcp.OptionMagicNumber, Data: []byte{9, 9, 9, 9}},
+	})
+	negotiateAsPeer(t, ctx, peer, lcp.PPPTypeIPXCP, []lcp.Option{
+		{Type: lcp.OptionIPXNode, Data: node.Address[:]},
+	})
+
+	// Once negotiation is complete, IPX packets can be sent.
+	waitForNetwork(s)
+	var magicNumber []byte
+	for _, opt := range req.Data.(*lcp.ConfigureData).Options {
+		if opt.Type == lcp.OptionMagicNumber {
+			magicNumber = opt.Data
+		}
+	}
+	if len(magicNumber) != 4 || binary.BigEndian.Uint32(magicNumber) != s.magicNumber {
+		t.Errorf("wrong magic number negotiated: sent %x, session has %x", magicNumber, s.magicNumber)
+	}
+	packetBytes, err := ipxtesting.TestPackets[0].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SendFrame(PPPTypeIPX, packetBytes)
+	select {
+	case pkt := <-received:
+		if pkt.Header.Src != ipxtesting.TestPackets[0].Header.Src {
+			t.Errorf("wrong packet received: %+v", pkt)
+		}
+	case <-ctx.Done():
+		t.Fatalf("IPX packet not received after negotiation")
+	}
+
+	peer.SendLCP(lcp.PPPTypeLCP, &lcp.LCP{
+		Type:       lcp.TerminateRequest,
+		Identifier: 5,
+		Data:       &lcp.TerminateData{},
+	})
+	if err := <-runErr; err != nil {
+		t.Errorf("session ended with error: %v", err)
+	}
+}
+
+// proposeIPXNode runs the IPXCP phase as a client that requests the given
+// node address, and returns the server's response to the request.
+func proposeIPXNode(t *testing.T, ctx context.Context, c *ipxtesting.PPPChannel, addr ipx.Addr) *lcp.LCP {
+	t.Helper()
+	req := expectLCP(t, ctx, c, lcp.PPPTypeIPXCP, lcp.ConfigureRequest)
+	c.SendLCP(lcp.PPPTypeIPXCP, &lcp.LCP{
+		Type:       lcp.ConfigureAck,
+		Identifier: req.Identifier,
+		Data:       req.Data,
+	})
+	c.SendLCP(lcp.PPPTypeIPXCP, &lcp.LCP{
+		Type:       lcp.ConfigureRequest,
+		Identifier: 1,
+		Data: &lcp.ConfigureData{Options: []lcp.Option{
+			{Type: lcp.OptionIPXNode, Data: addr[:]},
+		}},
+	})
+	for {
+		l, err := c.RecvLCP(ctx, lcp.PPPTypeIPXCP)
+		if err != nil {
+			t.Fatalf("error waiting for response: %v", err)
+		}
+		if l.Type == lcp.ConfigureAck || l.Type == lcp.ConfigureNak {
+			return l
+		}
+	}
+}
+
+func TestClientRequestedAddress(t *testing.T) {
+	net := addressable.Wrap(network.Null{})
+	otherNode := net.NewNode()
+	defer otherNode.Close()
+	wantAddr := ipx.Addr{0x02, 0x99, 0x88, 0x77, 0x66, 0x55}
+
+	for _, tc := range []struct {
+		name      string
+		requested ipx.Addr
+		wantAck   bool
+	}{
+		{"free address", wantAddr, true},
+		{"address in use", network.NodeAddress(otherNode), false},
+		{"broadcast address", ipx.AddrBroadcast, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			channel, peer := ipxtesting.MakePPPChannelPair()
+			defer peer.Close()
+			node := net.NewNode()
+			assigned := network.NodeAddress(node)
+			s := NewSession(channel, node)
+			go s.Run(ctx)
+
+			negotiateAsPeer(t, ctx, peer, lcp.PPPTypeLCP, []lcp.Option{
+				{Type: lcp.OptionMagicNumber, Data: []byte{9, 9, 9, 9}},
+			})
+			reply := proposeIPXNode(t, ctx, peer, tc.requested)
+			opts := reply.Data.(*lcp.ConfigureData).Options
+			if tc.wantAck {
+				if reply.Type != lcp.ConfigureAck {
+					t.Fatalf("want Configure-Ack, got %v", reply.Type)
+				}
+				if got := network.NodeAddress(node); got != tc.requested {
+					t.Errorf("node address not changed: want %v, got %v", tc.requested, got)
+				}
+				return
+			}
+			if reply.Type != lcp.ConfigureNak || len(opts) != 1 || string(opts[0].Data) != string(assigned[:]) {
+				t.Fatalf("want Configure-Nak suggesting %v, got %+v", assigned, reply)
+			}
+			if got := network.NodeAddress(node); got != assigned {
+				t.Errorf("node address changed: want %v, got %v", assigned, got)
+			}
+		})
+	}
+}
+
+func TestPeerMRU(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	channel, peer := ipxtesting.MakePPPChannelPair()
+	defer peer.Close()
+	dest := ipxtesting.MakeCallbackDest(func(*ipx.Packet) {})
+	node := &ipxtesting.FakeNetwork{
+		Inner:   dest,
+		Address: ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+	s := NewSession(channel, node)
+	go s.Run(ctx)
+
+	// A dial-up client that can only receive small frames.
+	negotiateAsPeer(t, ctx, peer, lcp.PPPTypeLCP, []lcp.Option{
+		{Type: lcp.OptionMagicNumber, Data: []byte{9, 9, 9, 9}},
+		{Type: lcp.OptionMRU, Data: []byte{0x02, 0x58}}, // 600
+	})
+	negotiateAsPeer(t, ctx, peer, lcp.PPPTypeIPXCP, []lcp.Option{
+		{Type: lcp.OptionIPXNode, Data: node.Address[:]},
+	})
+	waitForNetwork(s)
+
+	for _, size := range []int{1000, 600, 100} {
+		dest.SendPacket(&ipx.Packet{
+			Header:  ipx.Header{Dest: ipx.HeaderAddr{Addr: node.Address}},
+			Payload: make([]byte, size-ipx.HeaderLength),
+		})
+	}
+	// The packet larger than the MRU is dropped.
+	for _, want := range []int{600, 100} {
+		for {
+			_, ppp, err := peer.RecvFrame(ctx)
+			if err != nil {
+				t.Fatalf("error waiting for %d byte IPX frame: %v", want, err)
+			}
+			if ppp.PPPType != PPPTypeIPX {
+				continue
+			}
+			if got := len(ppp.LayerPayload()); got != want {
+				t.Errorf("wrong IPX frame received: want %d bytes, got %d", want, got)
+			}
+			break
+		}
+	}
+}
+
+func TestMRUValidation(t *testing.T) {
+	for _, tc := range []struct {
+		value         []byte
+		local, remote bool
+	}{
+		{nil, true, true},
+		{[]byte{0x05, 0xdc}, true, true}, // 1500
+		{[]byte{0x02, 0x40}, true, true}, // 576
+		{[]byte{0x02, 0x3f}, false, false},
+		{[]byte{0x10, 0x00}, false, true},
+		{[]byte{0x05}, false, false},
+	} {
+		if got := validateLocalMRU(nil, tc.value); got != tc.local {
+			t.Errorf("validateLocalMRU(%x): want %v, got %v", tc.value, tc.local, got)
+		}
+		if got := validateRemoteMRU(nil, tc.value); got != tc.remote {
+			t.Errorf("validateRemoteMRU(%x): want %v, got %v", tc.value, tc.remote, got)
+		}
+	}
+}
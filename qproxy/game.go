@@ -0,0 +1,89 @@
+package qproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Game describes the variant of the NetQuake protocol spoken by a server.
+// Games derived from Quake share the same connection protocol, but differ
+// in details such as the port numbers used.
+type Game struct {
+	// Name is the name used to select the game, eg. on the command line.
+	Name string
+
+	// IPXSocket is the socket number that the game listens on for new
+	// connections.
+	IPXSocket uint16
+
+	// ConnectedIPXSocket is the socket number used for packets once a
+	// connection has been accepted.
+	ConnectedIPXSocket uint16
+
+	// IPXHeaderLength is the length of the header that the game's IPX
+	// driver adds to the start of each IPX packet. It is not part of
+	// the packets sent over UDP.
+	IPXHeaderLength int
+
+	// HeaderLength is the length of the header at the start of each
+	// packet, which contains the flags and packet length.
+	HeaderLength int
+
+	// ControlFlag is the flag set in the header of control packets.
+	ControlFlag uint16
+
+	// AcceptOpcode is the opcode of the control packet sent by the server
+	// to accept a new connection (CCREP_ACCEPT).
+	AcceptOpcode byte
+}
+
+var (
+	Quake = &Game{
+		Name:               "quake",
+		IPXSocket:          26000,
+		ConnectedIPXSocket: 26001,
+		IPXHeaderLength:    4,
+		HeaderLength:       4,
+		ControlFlag:        flagCtl,
+		AcceptOpcode:       0x81,
+	}
+
+	// Hexen II is built on the Quake engine, and its network protocol
+	// is unchanged apart from the port numbers.
+	HexenII = Quake.withPorts("hexen2", 26900, 26901)
+
+	allGames = []*Game{Quake, HexenII}
+)
+
+// withPorts returns a copy of the game that uses different port numbers.
+func (g *Game) withPorts(name string, socket, connectedSocket uint16) *Game {
+	result := *g
+	result.Name = name
+	result.IPXSocket = socket
+	result.ConnectedIPXSocket = connectedSocket
+	return &result
+}
+
+// LookupGame returns the Game with the given name.
+func LookupGame(name string) (*Game, error) {
+	for _, g := range allGames {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown game %q", name)
+}
+
+// acceptPort checks if the given packet is a CCREP_ACCEPT packet and if so,
+// returns the offset within the packet of the connected port number.
+func (g *Game) acceptPort(packet []byte) (int, bool) {
+	// Header is followed by the opcode and a 32-bit port number.
+	if len(packet) < g.HeaderLength+5 {
+		return 0, false
+	}
+	flags := binary.BigEndian.Uint16(packet[0:2])
+	if flags&g.ControlFlag == 0 || packet[g.HeaderLength] != g.AcceptOpcode {
+		return 0, false
+	}
+	return g.HeaderLength + 1, true
+}
@@ -3,12 +3,19 @@ package qproxy
 import (
 	"encoding/binary"
 	"errors"
+	"sync"
+	"time"
 )
 
 const (
 	reliableHeaderLength = 8
 	vanillaQuakeMTU      = 1024
 
+	// If a fragment sent downstream is not acknowledged within this time,
+	// it is retransmitted, up to maxRetransmits times.
+	defaultRetransmitTimeout = time.Second
+	maxRetransmits           = 5
+
 	flagData       = uint16(0x0001)
 	flagAck        = uint16(0x0002)
 	flagNak        = uint16(0x0004)
@@ -73,12 +80,20 @@ func (m *reliableMessage) UnmarshalBinary(data []byte) error {
 // reliableSharder receives Quake reliable message fragments, reassembles them
 // into packets and retransmits them as fragments smaller than the MTU.
 type reliableSharder struct {
+	mu           sync.Mutex
 	state        state
 	rxseq, rxack uint32 // from upstream
 	txseq, txack uint32 // to downstream
 	txqueue      []byte
 	txUpstream   func([]byte) error
 	txDownstream func([]byte) error
+
+	// unacked is the last fragment sent downstream, if it has not yet
+	// been acknowledged. It is retransmitted when the timer fires.
+	unacked           []byte
+	retries           int
+	timer             *time.Timer
+	retransmitTimeout time.Duration
 }
 
 func (s *reliableSharder) stateTransition(from, to state) {
@@ -103,10 +118,51 @@ func (s *reliableSharder) sendDownstream(rm *reliableMessage) error {
 		return err
 	}
 	debug("send to downstream: seq=%d, len=%d", rm.Sequence, len(data))
-	// TODO: Save and retransmit after timeout
+	s.unacked = data
+	s.retries = 0
+	s.startTimer()
 	return s.txDownstream(data)
 }
 
+func (s *reliableSharder) startTimer() {
+	s.stopTimer()
+	s.timer = time.AfterFunc(s.retransmitTimeout, s.retransmit)
+}
+
+func (s *reliableSharder) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// retransmit is invoked by the timer to resend the last fragment if it still
+// has not been acknowledged by downstream.
+func (s *reliableSharder) retransmit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unacked == nil {
+		return
+	}
+	if s.retries >= maxRetransmits {
+		debug("giving up retransmitting seq=%d", s.txseq-1)
+		s.unacked = nil
+		return
+	}
+	s.retries++
+	debug("retransmit to downstream: seq=%d, attempt %d", s.txseq-1, s.retries)
+	s.timer = time.AfterFunc(s.retransmitTimeout, s.retransmit)
+	s.txDownstream(s.unacked)
+}
+
+// stop cancels any pending retransmission.
+func (s *reliableSharder) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unacked = nil
+	s.stopTimer()
+}
+
 func (s *reliableSharder) sendNext() error {
 	if s.txack != s.txseq {
 		// Still waiting on ack of last packet
@@ -154,6 +210,11 @@ func (s *reliableSharder) sendAck() error {
 // receiveFromUpstream processes a packet received from the upstream
 // Quake server and returns true, nil if the packet was handled.
 func (s *reliableSharder) receiveFromUpstream(msg []byte) (bool, error) {
+	if len(msg) < 2 {
+		return false, messageTooShort
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	flags := binary.BigEndian.Uint16(msg[0:2])
 	if (flags & flagUnreliable) != 0 {
 		return false, nil
@@ -194,6 +255,11 @@ func (s *reliableSharder) receiveFromUpstream(msg []byte) (bool, error) {
 // receiveFromDownstream processes a packet received from the downstream
 // Quake client and returns true, nil if the packet was handled.
 func (s *reliableSharder) receiveFromDownstream(msg []byte) (bool, error) {
+	if len(msg) < 2 {
+		return false, messageTooShort
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	flags := binary.BigEndian.Uint16(msg[0:2])
 	if (flags & flagUnreliable) != 0 {
 		return false, nil
@@ -211,6 +277,8 @@ func (s *reliableSharder) receiveFromDownstream(msg []byte) (bool, error) {
 	// We have received an ack from downstream.
 	if rm.Sequence == s.txack {
 		s.txack++
+		s.unacked = nil
+		s.stopTimer()
 		s.stateTransition(stateSentEOM, stateEOMAcked)
 		// Downstream acked EOM? We can ack upstream now
 		var err error
@@ -228,6 +296,11 @@ func (s *reliableSharder) receiveFromDownstream(msg []byte) (bool, error) {
 }
 
 func (s *reliableSharder) init(txUpstream, txDownstream func([]byte) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unacked = nil
+	s.stopTimer()
+	s.retransmitTimeout = defaultRetransmitTimeout
 	s.state = stateReceiving
 	s.txqueue = []byte{}
 	s.txUpstream = txUpstream
@@ -0,0 +1,123 @@
+package qproxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// capture records the messages sent in one direction by a reliableSharder.
+type capture struct {
+	mu   sync.Mutex
+	msgs []*reliableMessage
+}
+
+func (c *capture) send(data []byte) error {
+	var rm reliableMessage
+	if err := rm.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, &rm)
+	return nil
+}
+
+func (c *capture) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.msgs)
+}
+
+func (c *capture) last() *reliableMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.msgs[len(c.msgs)-1]
+}
+
+func marshal(t *testing.T, rm *reliableMessage) []byte {
+	t.Helper()
+	data, err := rm.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRetransmit(t *testing.T) {
+	var upstream, downstream capture
+	var s reliableSharder
+	s.init(upstream.send, downstream.send)
+	s.retransmitTimeout = 10 * time.Millisecond
+	defer s.stop()
+
+	payload := []byte("hello world")
+	s.receiveFromUpstream(marshal(t, &reliableMessage{
+		Flags:    flagData | flagEOM,
+		Sequence: 0,
+		Payload:  payload,
+	}))
+	if downstream.count() != 1 {
+		t.Fatalf("want fragment sent downstream, got %d messages", downstream.count())
+	}
+
+	// The fragment is "lost", so we wait for it to be retransmitted.
+	time.Sleep(50 * time.Millisecond)
+	n := downstream.count()
+	if n < 2 {
+		t.Fatalf("want fragment to be retransmitted, got %d messages", n)
+	}
+	rm := downstream.last()
+	if rm.Sequence != 0 || rm.Flags != flagData|flagEOM || string(rm.Payload) != string(payload) {
+		t.Errorf("wrong retransmitted fragment: %+v", rm)
+	}
+
+	// Once acked, the stream completes: upstream's EOM is acked and no
+	// more retransmissions occur.
+	s.receiveFromDownstream(marshal(t, &reliableMessage{
+		Flags:    flagAck,
+		Sequence: 0,
+	}))
+	if upstream.count() != 1 || upstream.last().Flags != flagAck {
+		t.Errorf("want ack sent upstream after EOM acked, got %d messages", upstream.count())
+	}
+	n = downstream.count()
+	time.Sleep(50 * time.Millisecond)
+	if downstream.count() != n {
+		t.Errorf("fragment retransmitted after ack: %d -> %d messages", n, downstream.count())
+	}
+}
+
+func TestRetransmitLimit(t *testing.T) {
+	var upstream, downstream capture
+	var s reliableSharder
+	s.init(upstream.send, downstream.send)
+	s.retransmitTimeout = time.Millisecond
+	defer s.stop()
+
+	s.receiveFromUpstream(marshal(t, &reliableMessage{
+		Flags:    flagData | flagEOM,
+		Sequence: 0,
+		Payload:  []byte("hello"),
+	}))
+	time.Sleep(100 * time.Millisecond)
+	if got, want := downstream.count(), maxRetransmits+1; got != want {
+		t.Errorf("want %d messages sent downstream, got %d", want, got)
+	}
+}
+
+func TestShortMessages(t *testing.T) {
+	var upstream, downstream capture
+	var s reliableSharder
+	s.init(upstream.send, downstream.send)
+	defer s.stop()
+
+	for _, msg := range [][]byte{{}, {0x00}} {
+		if _, err := s.receiveFromUpstream(msg); err != messageTooShort {
+			t.Errorf("receiveFromUpstream(%v): want error %v, got %v", msg, messageTooShort, err)
+		}
+		if _, err := s.receiveFromDownstream(msg); err != messageTooShort {
+			t.Errorf("receiveFromDownstream(%v): want error %v, got %v", msg, messageTooShort, err)
+		}
+	}
+}
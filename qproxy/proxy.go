@@ -1,28 +1,22 @@
 // Package qproxy implements a proxy client that makes Quake UDP servers
-// available on an IPX network.
+// available on an IPX network. It is built on the generic udpproxy package,
+// and implements the parts of the proxy specific to the NetQuake protocol.
 package qproxy
 
 import (
 	"context"
-	"io"
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
-	"sync"
 	"time"
 
-	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/udpproxy"
 )
 
-const (
-	garbageCollectPeriod = 10 * time.Second
-	quakeIPXSocket       = 26000
-	connectedIPXSocket   = 26001
-	quakeHeaderBytes     = 4
-	acceptHeaderMinLen   = 9
-
-	// Packet response from server when accepting connection
-	ccRepAccept = 0x81
+var (
+	_ = (udpproxy.Protocol)(&protocol{})
+	_ = (udpproxy.Session)(&session{})
 )
 
 type Config struct {
@@ -31,278 +25,190 @@ type Config struct {
 
 	// IdleTimeout is the amount of time after which a connection is deleted.
 	IdleTimeout time.Duration
+
+	// GarbageCollectPeriod is how often to check for idle connections.
+	// If zero, a default is used. It is always made shorter than
+	// IdleTimeout.
+	GarbageCollectPeriod time.Duration
+
+	// Game is the variant of the protocol spoken by the server. If nil,
+	// Quake is assumed.
+	Game *Game
+
+	// SOCKS5Proxy is the address of a SOCKS5 proxy server through which
+	// to send packets to the Quake server. If empty, packets are sent
+	// directly.
+	SOCKS5Proxy string
+
+	// LocalAddress is the local address to which the sockets used to
+	// send packets directly to the Quake server are bound, which
+	// controls the interface they leave from on hosts with more than
+	// one. If nil, the operating system chooses. It is not used when
+	// SOCKS5Proxy is set.
+	LocalAddress *net.IPAddr
+
+	// If not nil, log entries are written when connections are closed
+	// and when errors occur.
+	Logger *slog.Logger
+}
+
+// debug logs a trace of the protocol state at debug level. The message is
+// only formatted if debug logging is enabled, since it is called for every
+// packet.
+func debug(format string, args ...interface{}) {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+// protocol implements udpproxy.Protocol for the NetQuake protocol.
+type protocol struct {
+	game *Game
+}
+
+func (p *protocol) ListenSocket() uint16 {
+	return p.game.IPXSocket
 }
 
-func debug(fmt string, args ...interface{}) {
-	//log.Printf(fmt, args...)
+func (p *protocol) NewSession(c *udpproxy.Conn) udpproxy.Session {
+	s := &session{
+		game:          p.game,
+		conn:          c,
+		connectedPort: -1,
+		ipxSocket:     p.game.ConnectedIPXSocket,
+	}
+	s.rs.init(s.sendToUpstream, s.sendToDownstream)
+	return s
 }
 
-type connection struct {
-	p             *Proxy
+// session holds the state of a single client's connection to the server.
+type session struct {
+	game          *Game
+	conn          *udpproxy.Conn
 	rs            reliableSharder
-	ipxAddr       *ipx.HeaderAddr
-	conn          *net.UDPConn
-	lastRXTime    time.Time
 	connectedPort int
 	ipxSocket     uint16
-	closed        bool
 }
 
 // handleAccept checks if a packet received from the main server port is a
 // CCREP_ACCEPT packet, and if so, reads the connected port number from the
-// packet, then replaces it with connectedIPXSocket.
-func (c *connection) handleAccept(packet []byte, serverAddr *net.UDPAddr) {
-	if len(packet) < acceptHeaderMinLen {
-		return
-	}
-	if packet[4] != ccRepAccept {
+// packet, then replaces it with the game's connected IPX socket.
+func (s *session) handleAccept(packet []byte, serverAddr *net.UDPAddr) {
+	off, ok := s.game.acceptPort(packet)
+	if !ok {
 		return
 	}
-	c.rs.init(c.sendToUpstream, c.sendToDownstream)
+	s.rs.init(s.sendToUpstream, s.sendToDownstream)
 	// We have a legitimate looking CCREP_ACCEPT packet.
 	// The server has indicated the port number assigned for this
 	// connection as part of the packet.
-	c.connectedPort = (int(packet[6]) << 8) | int(packet[5])
+	s.connectedPort = (int(packet[off+1]) << 8) | int(packet[off])
 	// Some Quake source ports do not allocate a new port per connection.
 	// In this case we cannot distinguish between packets destined for
-	// quakeIPXSocket vs connectedIPXSocket. Therefore in this case we
+	// the main socket vs the connected socket. Therefore in this case we
 	// forward all traffic from the same IPX port.
-	if c.connectedPort == serverAddr.Port {
-		c.ipxSocket = quakeIPXSocket
+	if s.connectedPort == serverAddr.Port {
+		s.ipxSocket = s.game.IPXSocket
 	}
 	// Before forwarding onto the IPX network, we must replace the UDP
 	// socket number with the connected IPX port number.
-	packet[5] = byte(c.ipxSocket & 0xff)
-	packet[6] = byte((c.ipxSocket >> 8) & 0xff)
+	packet[off] = byte(s.ipxSocket & 0xff)
+	packet[off+1] = byte((s.ipxSocket >> 8) & 0xff)
 	// The server will try to send us packets from the new port, but we
 	// may be behind a firewall connecting outwards. So send a packet to
 	// this new port so that packets will get through.
-	if c.connectedPort != serverAddr.Port {
-		destAddress := &net.UDPAddr{
-			IP:   serverAddr.IP,
-			Port: c.connectedPort,
-		}
-		if _, err := c.conn.WriteToUDP([]byte{}, destAddress); err != nil {
-			log.Printf("error sending firewall traversal packet: %v", err)
+	if s.connectedPort != serverAddr.Port {
+		if err := s.conn.SendToServer([]byte{}, s.connectedPort); err != nil {
+			slog.Warn("error sending firewall traversal packet", "err", err)
 		}
 	}
 }
 
-func (c *connection) sendToDownstreamSocket(payload []byte, socket uint16) error {
-	zeroBytes := [quakeHeaderBytes]byte{}
-	pktBytes := append([]byte{}, zeroBytes[:]...)
+func (s *session) sendToDownstreamSocket(payload []byte, socket uint16) error {
+	pktBytes := make([]byte, s.game.IPXHeaderLength, s.game.IPXHeaderLength+len(payload))
 	pktBytes = append(pktBytes, payload...)
-	return c.p.node.WritePacket(&ipx.Packet{
-		Header: ipx.Header{
-			Length: uint16(ipx.HeaderLength + len(pktBytes)),
-			Dest:   *c.ipxAddr,
-			Src: ipx.HeaderAddr{
-				Addr:   network.NodeAddress(c.p.node),
-				Socket: socket,
-			},
-		},
-		Payload: pktBytes,
-	})
+	return s.conn.SendToClient(pktBytes, socket)
 }
 
 // sendToDownstream forwards the given packet to the client, sending to the
 // client's data socket.
-func (c *connection) sendToDownstream(payload []byte) error {
-	return c.sendToDownstreamSocket(payload, c.ipxSocket)
+func (s *session) sendToDownstream(payload []byte) error {
+	return s.sendToDownstreamSocket(payload, s.ipxSocket)
 }
 
 // sendToUpstream forwards the given packet to the UDP port of the server.
-func (c *connection) sendToUpstream(payload []byte) error {
-	if c.connectedPort < 0 {
+func (s *session) sendToUpstream(payload []byte) error {
+	if s.connectedPort < 0 {
 		return nil
 	}
-	_, err := c.conn.WriteToUDP(payload, &net.UDPAddr{
-		IP:   c.p.address.IP,
-		Port: c.connectedPort,
-	})
-	return err
-}
-
-func (c *connection) receivePackets() {
-	var buf [9000]byte
-	for {
-		n, addr, err := c.conn.ReadFromUDP(buf[:])
-		switch {
-		case c.closed:
-			return
-		case err != nil:
-			log.Printf("error receiving UDP packets for connection to %v: %v", c.conn.RemoteAddr(), err)
+	return s.conn.SendToServer(payload, s.connectedPort)
+}
+
+func (s *session) FromServer(port int, packet []byte) {
+	// Packet must come from either the server's main port or from
+	// the port assigned to this connection. Map this into the IPX
+	// socket number for the source address.
+	serverAddr := s.conn.ServerAddr()
+	var socket uint16
+	switch port {
+	case serverAddr.Port:
+		socket = s.game.IPXSocket
+		s.handleAccept(packet, &serverAddr)
+	case s.connectedPort:
+		socket = s.ipxSocket
+		eaten, err := s.rs.receiveFromUpstream(packet)
+		if err != nil || eaten {
+			// Processed by sharder.
 			return
 		}
-		// Sanity check: packet must come from server's IP address.
-		if !addr.IP.Equal(c.p.address.IP) {
-			continue
-		}
-		// Packet must come from either the server's main port or from
-		// the port assigned to this connection. Map this into the IPX
-		// socket number for the source address.
-		var socket uint16
-		switch addr.Port {
-		case c.p.address.Port:
-			socket = uint16(quakeIPXSocket)
-			c.handleAccept(buf[:n], &c.p.address)
-		case c.connectedPort:
-			socket = uint16(c.ipxSocket)
-			eaten, err := c.rs.receiveFromUpstream(buf[:n])
-			if err != nil || eaten {
-				// Processed by sharder.
-				continue
-			}
-		default:
-			continue
-		}
-		c.lastRXTime = time.Now()
-		if err := c.sendToDownstreamSocket(buf[:n], socket); err != nil {
-			// TODO: close connection?
-		}
-	}
-}
-
-type Proxy struct {
-	config  Config
-	node    network.Node
-	conns   map[ipx.HeaderAddr]*connection
-	mu      sync.Mutex
-	address net.UDPAddr
-}
-
-func (p *Proxy) newConnection(ipxAddr *ipx.HeaderAddr) (*connection, error) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
-	if err != nil {
-		return nil, err
-	}
-	c := &connection{
-		p:             p,
-		ipxAddr:       ipxAddr,
-		conn:          conn,
-		lastRXTime:    time.Now(),
-		connectedPort: -1,
-		ipxSocket:     connectedIPXSocket,
-	}
-	c.rs.init(c.sendToUpstream, c.sendToDownstream)
-	p.conns[*ipxAddr] = c
-	go c.receivePackets()
-	return c, nil
-}
-
-func (p *Proxy) closeConnection(addr *ipx.HeaderAddr) {
-	c, ok := p.conns[*addr]
-	if !ok {
-		return
-	}
-	c.closed = true
-	delete(p.conns, *addr)
-	c.conn.Close()
-}
-
-func (p *Proxy) resolveAddress() bool {
-	a, err := net.ResolveUDPAddr("udp", p.config.Address)
-	if err != nil {
-		log.Printf("failed to resolve server address: %v", err)
-		return false
-	}
-	p.address = *a
-	return true
-}
-
-func (p *Proxy) processPacket(packet *ipx.Packet) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	// First connection triggers the server address to be resolved. After
-	// all connections time out, we resolve again once a new connection is
-	// opened. This handles dynamic DNS addresses where the IP changes.
-	// But we don't block on DNS resolution while a game is in progress.
-	if len(p.conns) == 0 && !p.resolveAddress() {
+	default:
 		return
 	}
-	c, ok := p.conns[packet.Header.Src]
-	if !ok {
-		var err error
-		c, err = p.newConnection(&packet.Header.Src)
-		if err != nil {
-			log.Printf("failed to create new connection to %v: %v", p.address, err)
-			return
-		}
-	}
-	c.lastRXTime = time.Now()
-	if _, err := c.conn.WriteToUDP(packet.Payload[quakeHeaderBytes:], &p.address); err != nil {
-		log.Printf("failed to forward IPX packet to UDP server: %v", err)
-		p.closeConnection(&packet.Header.Src)
+	if err := s.sendToDownstreamSocket(packet, socket); err != nil {
+		// TODO: close connection?
 	}
 }
 
-func (p *Proxy) processConnectedPacket(packet *ipx.Packet) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	c, ok := p.conns[packet.Header.Src]
-	if !ok {
-		return
-	}
-	c.lastRXTime = time.Now()
-	msg := packet.Payload[quakeHeaderBytes:]
-	eaten, err := c.rs.receiveFromDownstream(msg)
-	if err != nil {
-		log.Printf("error processing packet from downstream: %v", err)
-		p.closeConnection(&packet.Header.Src)
-	}
-	if eaten {
-		// Handled by reliable sharder code.
-		return
-	}
-	if err := c.sendToUpstream(msg); err != nil {
-		log.Printf("failed to forward IPX packet to UDP server: %v", err)
-		p.closeConnection(&packet.Header.Src)
+func (s *session) FromClient(socket uint16, payload []byte) error {
+	if len(payload) < s.game.IPXHeaderLength {
+		return nil
 	}
-}
-
-func (p *Proxy) garbageCollect() {
-	for {
-		time.Sleep(garbageCollectPeriod)
-		p.mu.Lock()
-		now := time.Now()
-		expiredConns := []ipx.HeaderAddr{}
-		for addr, c := range p.conns {
-			if now.Sub(c.lastRXTime) > p.config.IdleTimeout {
-				debug("timeout for %s: idle %s", c.conn.RemoteAddr(), now.Sub(c.lastRXTime))
-				expiredConns = append(expiredConns, addr)
-			}
+	msg := payload[s.game.IPXHeaderLength:]
+	switch socket {
+	case s.game.IPXSocket:
+		return s.conn.SendToServer(msg, s.conn.ServerAddr().Port)
+	case s.game.ConnectedIPXSocket:
+		eaten, err := s.rs.receiveFromDownstream(msg)
+		if err != nil || eaten {
+			// Handled by reliable sharder code.
+			return err
 		}
-		for _, addr := range expiredConns {
-			p.closeConnection(&addr)
-		}
-		p.mu.Unlock()
+		return s.sendToUpstream(msg)
+	default:
+		return nil
 	}
 }
 
-func (p *Proxy) Run(ctx context.Context) {
-	go p.garbageCollect()
-	for {
-		packet, err := p.node.ReadPacket(ctx)
-		switch {
-		case err == io.ErrClosedPipe:
-			return
-		case err != nil:
-			log.Printf("unexpected error reading from node: %v", err)
-			return
-		}
-
-		if packet.Header.Dest.Socket == quakeIPXSocket {
-			p.processPacket(packet)
-		} else if packet.Header.Dest.Socket == connectedIPXSocket {
-			p.processConnectedPacket(packet)
-		}
-	}
+func (s *session) Close() {
+	s.rs.stop()
 }
 
-func New(config *Config, node network.Node) *Proxy {
-	return &Proxy{
-		config: *config,
-		node:   node,
-		conns:  make(map[ipx.HeaderAddr]*connection),
+// New creates a proxy that makes the Quake server described by the given
+// config available on the IPX network through the given node. The node
+// should be bound to the game's sockets (see the service package), since
+// the proxy only handles packets sent to them.
+func New(config *Config, node network.Node) *udpproxy.Proxy {
+	game := config.Game
+	if game == nil {
+		game = Quake
 	}
+	return udpproxy.New(&udpproxy.Config{
+		Address:              config.Address,
+		IdleTimeout:          config.IdleTimeout,
+		GarbageCollectPeriod: config.GarbageCollectPeriod,
+		Protocol:             &protocol{game: game},
+		SOCKS5Proxy:          config.SOCKS5Proxy,
+		LocalAddress:         config.LocalAddress,
+		Logger:               config.Logger,
+	}, node)
 }
@@ -0,0 +1,154 @@
+package qproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+)
+
+// makeAccept returns a CCREP_ACCEPT control packet for the given game,
+// giving the given port number.
+func makeAccept(g *Game, port int) []byte {
+	packet := make([]byte, g.HeaderLength+5)
+	binary.BigEndian.PutUint16(packet[0:2], g.ControlFlag)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[g.HeaderLength] = g.AcceptOpcode
+	binary.LittleEndian.PutUint32(packet[g.HeaderLength+1:], uint32(port))
+	return packet
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readUDP returns the next non-empty packet received on the given socket,
+// skipping the empty packets sent for firewall traversal.
+func readUDP(t *testing.T, conn *net.UDPConn) ([]byte, *net.UDPAddr) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var buf [1500]byte
+		n, addr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			t.Fatalf("packet not received by server: %v", err)
+		}
+		if n > 0 {
+			return buf[:n], addr
+		}
+	}
+}
+
+func TestAcceptPort(t *testing.T) {
+	for _, g := range allGames {
+		t.Run(g.Name, func(t *testing.T) {
+			packet := makeAccept(g, 1234)
+			off, ok := g.acceptPort(packet)
+			if !ok || off != g.HeaderLength+1 {
+				t.Errorf("accept packet not recognized: offset=%d, ok=%v", off, ok)
+			}
+			if _, ok := g.acceptPort(packet[:len(packet)-1]); ok {
+				t.Errorf("truncated accept packet recognized")
+			}
+			packet[g.HeaderLength]++
+			if _, ok := g.acceptPort(packet); ok {
+				t.Errorf("packet with wrong opcode recognized")
+			}
+			packet = makeAccept(g, 1234)
+			binary.BigEndian.PutUint16(packet[0:2], flagData)
+			if _, ok := g.acceptPort(packet); ok {
+				t.Errorf("data packet recognized as accept packet")
+			}
+		})
+	}
+}
+
+func TestLookupGame(t *testing.T) {
+	for _, g := range allGames {
+		if got, err := LookupGame(g.Name); err != nil || got != g {
+			t.Errorf("LookupGame(%q) = %v, %v", g.Name, got, err)
+		}
+	}
+	if _, err := LookupGame("doom"); err == nil {
+		t.Errorf("want error for unknown game")
+	}
+	if HexenII.IPXSocket == Quake.IPXSocket || HexenII.ConnectedIPXSocket == Quake.ConnectedIPXSocket {
+		t.Errorf("Hexen II uses the same sockets as Quake")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	for _, g := range allGames {
+		t.Run(g.Name, func(t *testing.T) {
+			server, connected := listenUDP(t), listenUDP(t)
+			sw := ipxswitch.New(0)
+			client := sw.NewNode()
+			p := New(&Config{
+				Address:     server.LocalAddr().String(),
+				IdleTimeout: time.Minute,
+				Game:        g,
+			}, sw.NewNode())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go p.Run(ctx)
+
+			clientAddr := ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 0x01}, Socket: 0x4000}
+			send := func(socket uint16, payload []byte) {
+				ipxHeader := make([]byte, g.IPXHeaderLength)
+				client.WritePacket(&ipx.Packet{
+					Header: ipx.Header{
+						Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: socket},
+						Src:  clientAddr,
+					},
+					Payload: append(ipxHeader, payload...),
+				})
+			}
+
+			// The connection request reaches the server without
+			// the IPX driver's header.
+			request := []byte("connect request")
+			send(g.IPXSocket, request)
+			got, addr := readUDP(t, server)
+			if !bytes.Equal(got, request) {
+				t.Errorf("wrong request received by server: want %q, got %q", request, got)
+			}
+
+			// The port in the server's accept packet is replaced by
+			// the connected IPX socket.
+			connectedPort := connected.LocalAddr().(*net.UDPAddr).Port
+			server.WriteToUDP(makeAccept(g, connectedPort), addr)
+			packet, err := client.ReadPacket(ctx)
+			if err != nil {
+				t.Fatalf("accept packet not received by client: %v", err)
+			}
+			if packet.Header.Src.Socket != g.IPXSocket {
+				t.Errorf("accept packet from wrong socket: want %d, got %d", g.IPXSocket, packet.Header.Src.Socket)
+			}
+			want := append(make([]byte, g.IPXHeaderLength), makeAccept(g, int(g.ConnectedIPXSocket))...)
+			if !bytes.Equal(packet.Payload, want) {
+				t.Errorf("wrong accept packet: want %x, got %x", want, packet.Payload)
+			}
+
+			// Packets sent to the connected socket go to the port
+			// that the server gave.
+			data := make([]byte, 8)
+			binary.BigEndian.PutUint16(data[0:2], flagUnreliable)
+			binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+			send(g.ConnectedIPXSocket, data)
+			if got, _ := readUDP(t, connected); !bytes.Equal(got, data) {
+				t.Errorf("wrong packet received on connected port: want %x, got %x", data, got)
+			}
+		})
+	}
+}
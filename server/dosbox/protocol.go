@@ -3,19 +3,40 @@ package dosbox
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/fragglet/ipxbox/admin"
+	"github.com/fragglet/ipxbox/audit"
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/monitor"
 	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/dejitter"
 	"github.com/fragglet/ipxbox/network/stats"
 	"github.com/fragglet/ipxbox/server"
 )
 
+const (
+	// minRegistrationReplyInterval is the minimum time between
+	// registration replies sent to a client. A client that keeps
+	// re-registering does not get a flood of replies.
+	minRegistrationReplyInterval = 500 * time.Millisecond
+
+	// maxRegistrations is the number of registration packets that a
+	// client can send before we log that it is behaving abnormally.
+	maxRegistrations = 20
+
+	// unconfirmedRegistrations is the number of registration packets
+	// that a client can send, without sending anything else, before we
+	// log that our replies are probably not reaching it.
+	unconfirmedRegistrations = 3
+)
+
 var (
 	_ = (server.Protocol)(&Protocol{})
+	_ = (server.Migratable)(&Protocol{})
 	_ = (ipx.ReadWriteCloser)(&client{})
 
 	// Server-initiated pings come from this address.
@@ -38,24 +59,67 @@ type Protocol struct {
 
 	// If not nil, log entries are written as clients connect and
 	// disconnect.
-	Logger *log.Logger
+	Logger *slog.Logger
+
+	// If not nil, packets sent by clients are checked for suspicious
+	// activity such as address spoofing and broadcast floods.
+	Monitor *monitor.Monitor
+
+	// If not nil, connected clients are recorded in the registry so
+	// that they can be listed and disconnected through the admin API.
+	Registry *admin.Registry
+
+	// If not nil, a record of each client session is written to the
+	// audit log when the client disconnects.
+	Audit *audit.Log
+
+	// If non-zero, bursts of packets from each client are smoothed out
+	// by holding up to this many packets and releasing them at the
+	// client's usual rate, for no longer than DejitterMaxHold. See the
+	// dejitter package.
+	DejitterDepth   int
+	DejitterMaxHold time.Duration
 }
 
-func (p *Protocol) log(format string, args ...interface{}) {
+func (p *Protocol) log(level slog.Level, msg string, args ...any) {
 	if p.Logger != nil {
-		p.Logger.Printf(format, args...)
+		args = append([]any{"protocol", "dosbox"}, args...)
+		p.Logger.Log(context.Background(), level, msg, args...)
 	}
 }
 
-func isRegistrationPacket(packet *ipx.Packet) bool {
-	h := &packet.Header
-	return h.Dest.Socket == 2 && h.Dest.Network == ipx.ZeroNetwork && h.Dest.Addr == ipx.AddrNull
-}
-
 // IsRegistrationPacket returns true if the given packet is a DOSbox protocol
 // registration packet.
 func (p *Protocol) IsRegistrationPacket(packet *ipx.Packet) bool {
-	return isRegistrationPacket(packet)
+	return packet.Header.IsRegistrationPacket()
+}
+
+// ClientAddress returns the IPX address that the client sending the given
+// packet was assigned, which it uses as the source address of every packet
+// it sends after registering.
+func (p *Protocol) ClientAddress(packet *ipx.Packet) (ipx.Addr, bool) {
+	addr := packet.Header.Src.Addr
+	if addr == ipx.AddrNull || addr[0]&0x01 != 0 {
+		return ipx.AddrNull, false
+	}
+	return addr, true
+}
+
+// MigrationChallenge returns a ping packet sent from an address made from
+// the given nonce. The DOSbox client sends its reply to whatever source
+// address a ping has, so the reply carries the nonce back to us.
+func (p *Protocol) MigrationChallenge(nonce server.MigrationNonce) *ipx.Packet {
+	return makePing(ipx.Addr(nonce))
+}
+
+// ChallengeResponse returns the nonce from a client's reply to a ping sent
+// by MigrationChallenge.
+func (p *Protocol) ChallengeResponse(packet *ipx.Packet) (server.MigrationNonce, bool) {
+	hdr := &packet.Header
+	if hdr.Dest.Socket != ipx.SocketRegistration || hdr.Src.Socket != ipx.SocketRegistration || hdr.Dest.Addr == ipx.AddrNull {
+		return server.MigrationNonce{}, false
+	}
+	return server.MigrationNonce(hdr.Dest.Addr), true
 }
 
 // StartClient is invoked as a new goroutine when a new client connects.
@@ -64,24 +128,49 @@ func (p *Protocol) StartClient(ctx context.Context, inner ipx.ReadWriteCloser, r
 	if err != nil {
 		return err
 	}
-	if !isRegistrationPacket(packet) {
+	if !packet.Header.IsRegistrationPacket() {
 		return nil
 	}
-	node := p.Network.NewNode()
+	node := network.WithRemoteAddr(p.Network.NewNode(), remoteAddr)
+	if err := network.NodeError(node); err != nil {
+		node.Close()
+		return err
+	}
 	nodeAddr := network.NodeAddress(node)
+	// The monitor must see the result of every write to the node, so
+	// the dejitter buffer, which writes later from its own goroutine,
+	// goes outside it.
+	clientNode := p.Monitor.Node(node, remoteAddr)
+	if p.DejitterDepth > 0 {
+		clientNode = dejitter.WrapNode(clientNode, p.DejitterDepth, p.DejitterMaxHold)
+	}
 	defer func() {
-		node.Close()
+		clientNode.Close()
 		statsString := stats.Summary(node)
 		if statsString != "" {
-			p.log("%s (IPX address %s): final statistics: %s",
-				remoteAddr.String(), nodeAddr.String(), statsString)
+			p.log(slog.LevelInfo, "final statistics",
+				"remote_addr", remoteAddr.String(),
+				"ipx_address", nodeAddr.String(),
+				"stats", statsString)
+		}
+		if dejitterString := dejitter.Summary(clientNode); dejitterString != "" {
+			p.log(slog.LevelInfo, "dejitter statistics",
+				"remote_addr", remoteAddr.String(),
+				"ipx_address", nodeAddr.String(),
+				"stats", dejitterString)
 		}
 	}()
 
-	p.log("%s: new connection, assigned IPX address %s",
-		remoteAddr.String(), network.NodeAddress(node))
+	defer p.Registry.Add("dosbox", node, remoteAddr)()
+	defer p.Audit.Start("dosbox", node, remoteAddr)()
+
+	p.log(slog.LevelInfo, "client connected",
+		"remote_addr", remoteAddr.String(),
+		"ipx_address", nodeAddr.String())
 	c := &client{
+		p:            p,
 		inner:        inner,
+		remoteAddr:   remoteAddr,
 		nodeAddr:     &nodeAddr,
 		lastRecvTime: time.Now(),
 	}
@@ -92,16 +181,25 @@ func (p *Protocol) StartClient(ctx context.Context, inner ipx.ReadWriteCloser, r
 		go c.sendKeepalives(ctx, p.KeepaliveTime)
 	}
 
-	return ipx.DuplexCopyPackets(ctx, c, node)
+	return ipx.DuplexCopyPackets(ctx, c, clientNode)
 }
 
 // client implements the dosbox protocol as a wrapper around an
 // inner ReadWriteCloser that is used to send and receive IPX frames.
 type client struct {
+	p            *Protocol
 	inner        ipx.ReadWriteCloser
+	remoteAddr   net.Addr
 	nodeAddr     *ipx.Addr
 	mu           sync.Mutex
 	lastRecvTime time.Time
+
+	// Only accessed from ReadPacket:
+	registrations         int
+	lastRegistrationReply time.Time
+	// confirmed is true once the client has sent a packet other than
+	// a registration packet, which shows that it received our reply.
+	confirmed bool
 }
 
 func (p *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
@@ -113,10 +211,11 @@ func (p *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 		p.mu.Lock()
 		p.lastRecvTime = time.Now()
 		p.mu.Unlock()
-		if isRegistrationPacket(packet) {
-			p.sendRegistrationReply()
+		if packet.Header.IsRegistrationPacket() {
+			p.handleRegistration()
 			continue
 		}
+		p.confirmed = true
 		return packet, nil
 	}
 }
@@ -129,10 +228,41 @@ func (p *client) Close() error {
 	return p.inner.Close()
 }
 
+// handleRegistration is invoked when a client sends another registration
+// packet after it has connected, which usually means that our reply was lost.
+// Replies are rate limited so that a misbehaving client stuck in a loop
+// cannot use us to generate a flood.
+func (p *client) handleRegistration() {
+	p.registrations++
+	if p.registrations == maxRegistrations {
+		p.p.log(slog.LevelWarn, "abnormal number of registration packets received",
+			"remote_addr", p.remoteAddr.String(),
+			"ipx_address", p.nodeAddr.String(),
+			"registrations", p.registrations)
+	}
+	// A client that keeps registering but never sends anything else
+	// can reach us, but is not receiving our replies. This is usually
+	// because of a NAT or firewall between us and the client, and is
+	// otherwise hard to tell apart from a client that never reached
+	// the server at all.
+	if !p.confirmed && p.registrations == unconfirmedRegistrations {
+		p.p.log(slog.LevelWarn, "client keeps registering; replies may not be reaching it",
+			"remote_addr", p.remoteAddr.String(),
+			"ipx_address", p.nodeAddr.String(),
+			"registrations", p.registrations)
+	}
+	now := time.Now()
+	if now.Before(p.lastRegistrationReply.Add(minRegistrationReplyInterval)) {
+		return
+	}
+	p.sendRegistrationReply()
+}
+
 // sendRegistrationReply sends a response to the client when a registration
 // packet is received. This usually happens only once on first connect,
 // unless the reply is lost in transit.
 func (p *client) sendRegistrationReply() {
+	p.lastRegistrationReply = time.Now()
 	p.inner.WritePacket(&ipx.Packet{
 		Header: ipx.Header{
 			Checksum:     0xffff,
@@ -141,12 +271,12 @@ func (p *client) sendRegistrationReply() {
 			Dest: ipx.HeaderAddr{
 				Network: [4]byte{0, 0, 0, 0},
 				Addr:    *p.nodeAddr,
-				Socket:  2,
+				Socket:  ipx.SocketRegistration,
 			},
 			Src: ipx.HeaderAddr{
 				Network: [4]byte{0, 0, 0, 1},
 				Addr:    ipx.AddrBroadcast,
-				Socket:  2,
+				Socket:  ipx.SocketRegistration,
 			},
 		},
 	})
@@ -156,21 +286,26 @@ func (p *client) sendRegistrationReply() {
 // code recognizes broadcast packets sent to socket=2 and will send a reply to
 // the source address that we provide.
 func (p *client) sendPing() {
-	p.inner.WritePacket(&ipx.Packet{
+	// We send pings from an imaginary "ping reply" address because if
+	// we used ipx.AddrNull the reply would be indistinguishable from a
+	// registration packet.
+	p.inner.WritePacket(makePing(addrPingReply))
+}
+
+// makePing returns a ping packet; the client replies to the given address.
+func makePing(replyAddr ipx.Addr) *ipx.Packet {
+	return &ipx.Packet{
 		Header: ipx.Header{
 			Dest: ipx.HeaderAddr{
 				Addr:   ipx.AddrBroadcast,
-				Socket: 2,
+				Socket: ipx.SocketRegistration,
 			},
-			// We send pings from an imaginary "ping reply" address
-			// because if we used ipx.AddrNull the reply would be
-			// indistinguishable from a registration packet.
 			Src: ipx.HeaderAddr{
-				Addr:   addrPingReply,
+				Addr:   replyAddr,
 				Socket: 0,
 			},
 		},
-	})
+	}
 }
 
 // sendKeepalives runs as a background goroutine while a client is connected,
@@ -0,0 +1,191 @@
+package dosbox
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/monitor"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/server"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var registrationPacket = &ipx.Packet{
+	Header: ipx.Header{
+		Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: ipx.SocketRegistration},
+		Src:  ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: ipx.SocketRegistration},
+	},
+}
+
+// startClient starts a client of the given protocol, returning the client
+// end of its connection. The registration packet has already been sent.
+func startClient(t *testing.T, p *Protocol) *ipxtesting.LoopbackEnd {
+	t.Helper()
+	if p.Network == nil {
+		p.Network = addressable.Wrap(ipxswitch.New(0))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+	clientEnd.WritePacket(registrationPacket)
+	go p.StartClient(ctx, serverEnd, ipxtesting.FakeAddress)
+	return clientEnd
+}
+
+// countReplies counts the registration replies received within the given
+// time.
+func countReplies(t *testing.T, c *ipxtesting.LoopbackEnd, d time.Duration) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	result := 0
+	for {
+		packet, err := c.ReadPacket(ctx)
+		if err != nil {
+			return result
+		}
+		if packet.Header.Src.Socket == ipx.SocketRegistration && packet.Header.Src.Addr == ipx.AddrBroadcast {
+			result++
+		}
+	}
+}
+
+func TestRegistrationRateLimit(t *testing.T) {
+	c := startClient(t, &Protocol{})
+	if n := countReplies(t, c, 100*time.Millisecond); n != 1 {
+		t.Fatalf("want one reply to first registration, got %d", n)
+	}
+
+	// Repeated registrations in quick succession only get one reply.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.WritePacket(registrationPacket)
+	}
+	n := countReplies(t, c, 100*time.Millisecond)
+	if time.Since(start) < minRegistrationReplyInterval && n != 0 {
+		t.Errorf("want no replies within rate limit interval, got %d", n)
+	}
+
+	// After the interval has passed, the client gets another reply.
+	time.Sleep(minRegistrationReplyInterval)
+	c.WritePacket(registrationPacket)
+	if n := countReplies(t, c, 100*time.Millisecond); n != 1 {
+		t.Errorf("want one reply after rate limit interval, got %d", n)
+	}
+}
+
+func TestMigrationChallenge(t *testing.T) {
+	p := &Protocol{}
+	nonce := server.MigrationNonce{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}
+	ping := p.MigrationChallenge(nonce)
+	if ping.Header.Dest.Addr != ipx.AddrBroadcast || ping.Header.Dest.Socket != ipx.SocketRegistration {
+		t.Fatalf("challenge is not a ping: %v", ping)
+	}
+
+	// DOSBox replies to a ping by sending a packet to its source
+	// address, from its own address.
+	clientAddr := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	reply := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ping.Header.Src.Addr, Socket: ipx.SocketRegistration},
+			Src:  ipx.HeaderAddr{Addr: clientAddr, Socket: ipx.SocketRegistration},
+		},
+	}
+	if got, ok := p.ChallengeResponse(reply); !ok || got != nonce {
+		t.Errorf("wrong nonce from reply: want %x, got %x (ok=%v)", nonce, got, ok)
+	}
+	if got, ok := p.ClientAddress(reply); !ok || got != clientAddr {
+		t.Errorf("wrong client address from reply: want %v, got %v", clientAddr, got)
+	}
+	if _, ok := p.ChallengeResponse(registrationPacket); ok {
+		t.Errorf("registration packet treated as challenge response")
+	}
+}
+
+func TestDejitterSpoofReported(t *testing.T) {
+	m := monitor.New(&monitor.Config{
+		Thresholds: map[monitor.EventType]int{
+			monitor.EventSpoofedAddress: 1,
+		},
+		BlockTime: time.Minute,
+	})
+	c := startClient(t, &Protocol{
+		Monitor:       m,
+		DejitterDepth: 4,
+	})
+	if n := countReplies(t, c, 100*time.Millisecond); n != 1 {
+		t.Fatalf("want one registration reply, got %d", n)
+	}
+	// Packets from the wrong source address are only written to the
+	// network once the dejitter buffer releases them, but the monitor
+	// must still see them being rejected.
+	for i := 0; i < 2; i++ {
+		c.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x4000},
+				Src:  ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0xde, 0xad, 0xbe, 0xef, 0x00}, Socket: 0x4000},
+			},
+		})
+	}
+	for start := time.Now(); !m.Blocked(ipxtesting.FakeAddress); {
+		if time.Since(start) > time.Second {
+			t.Fatalf("client not blocked after sending spoofed packets")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written to by a logger in one
+// goroutine while being read in another.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestUnconfirmedRegistrations(t *testing.T) {
+	const warning = "client keeps registering"
+	for _, confirmed := range []bool{false, true} {
+		var buf syncBuffer
+		c := startClient(t, &Protocol{
+			Logger: slog.New(slog.NewTextHandler(&buf, nil)),
+		})
+		if confirmed {
+			// Any packet other than a registration shows that the
+			// client received our reply.
+			c.WritePacket(&ipx.Packet{
+				Header: ipx.Header{
+					Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x4000},
+					Src:  ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 1}, Socket: 0x4000},
+				},
+			})
+		}
+		// The first registration packet, sent by startClient, is not
+		// counted since the client has not had a reply yet.
+		for i := 0; i < unconfirmedRegistrations; i++ {
+			c.WritePacket(registrationPacket)
+		}
+		countReplies(t, c, 100*time.Millisecond)
+		if got := strings.Contains(buf.String(), warning); got == confirmed {
+			t.Errorf("confirmed=%v: want warning logged = %v, got log %q", confirmed, !confirmed, buf.String())
+		}
+	}
+}
@@ -4,20 +4,32 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/monitor"
+	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/pipe"
 )
 
+// minChallengeInterval is the minimum time between migration challenges
+// sent for the same client.
+const minChallengeInterval = time.Second
+
 var (
-	_ = (ipx.ReadWriteCloser)(&client{})
+	_ = (network.Node)(&client{})
 	_ = (io.Closer)(&Server{})
+
+	// PacketTooLargeError is returned when trying to send a packet that
+	// is larger than the configured MTU.
+	PacketTooLargeError = errors.New("packet exceeds MTU")
 )
 
 // Config contains configuration parameters for an IPX server.
@@ -29,9 +41,43 @@ type Config struct {
 	// Clients time out if nothing is received for this amount of time.
 	ClientTimeout time.Duration
 
+	// Network is the network type used when creating the UDP socket;
+	// valid values are "udp", "udp4" and "udp6". If empty, "udp" is
+	// used, which listens on both IPv4 and IPv6 where the platform
+	// supports dual-stack sockets.
+	Network string
+
 	// If not nil, log entries are written as clients connect and
 	// disconnect.
-	Logger *log.Logger
+	Logger *slog.Logger
+
+	// If not nil, malformed packets are reported to the monitor, and
+	// packets from sources it has blocked are discarded.
+	Monitor *monitor.Monitor
+
+	// MTU is the maximum size in bytes of an IPX packet, including the
+	// header. Larger packets are discarded rather than truncated. If
+	// zero, ipx.DefaultMTU is used.
+	MTU int
+
+	// If true, a client of a Migratable protocol whose UDP source port
+	// changes keeps its session, rather than the packets from the new
+	// port being treated as coming from a new client. Only the port
+	// may change; packets from a different IP address are never
+	// treated as coming from an existing client. The client is only
+	// moved once it has answered a challenge sent to the new port.
+	AllowMigration bool
+}
+
+func (c *Config) mtu() int {
+	switch {
+	case c.MTU <= 0:
+		return ipx.DefaultMTU
+	case c.MTU > ipx.MaxPacketLength:
+		return ipx.MaxPacketLength
+	default:
+		return c.MTU
+	}
 }
 
 // Protocol implements the inner protocol logic of the server.
@@ -49,13 +95,93 @@ type Protocol interface {
 	IsRegistrationPacket(*ipx.Packet) bool
 }
 
+// LongLived is an optional interface that can be implemented by a Protocol
+// whose clients stay connected indefinitely rather than for the length of a
+// game, such as uplinks from other servers, which are kept open by
+// keepalives. Draining a server does not wait for these clients, since
+// they never disconnect by themselves; see Server.NumClients.
+type LongLived interface {
+	// LongLived returns true if the protocol's clients stay connected
+	// indefinitely.
+	LongLived() bool
+}
+
+// IsLongLived returns true if the given protocol implements LongLived and
+// its clients stay connected indefinitely.
+func IsLongLived(p Protocol) bool {
+	l, ok := p.(LongLived)
+	return ok && l.LongLived()
+}
+
+// MigrationNonce is a random value that the server sends to a client's new
+// address before migrating the client there, and which must be sent back.
+// It is the size of an IPX node address so that protocols can carry it in
+// one.
+type MigrationNonce [6]byte
+
+// Migratable is an optional interface that can be implemented by a Protocol
+// whose clients can be recognized by the IPX address they send packets
+// from. It allows a client's session to continue when its UDP source port
+// changes, as happens when some NATs rebind their port mappings; see
+// Config.AllowMigration.
+//
+// A client's IPX address is seen by every other client on the network, so
+// it is not enough on its own to show that packets from a new port really
+// come from the client. Before migrating, the server sends a challenge
+// containing a random nonce to the new port, and the client is only moved
+// once the nonce comes back.
+type Migratable interface {
+	// ClientAddress returns the IPX address identifying the client that
+	// sent the given packet. If the packet does not identify the client
+	// (eg. a registration packet), false is returned.
+	ClientAddress(*ipx.Packet) (ipx.Addr, bool)
+
+	// MigrationChallenge returns a packet containing the given nonce,
+	// which a client that receives it will reply to.
+	MigrationChallenge(MigrationNonce) *ipx.Packet
+
+	// ChallengeResponse returns the nonce contained in the given packet,
+	// if it is a reply to a packet from MigrationChallenge.
+	ChallengeResponse(*ipx.Packet) (MigrationNonce, bool)
+}
+
+// migrationChallenge is a challenge that has been sent to a new address
+// for a client, which must be answered before the client is moved there.
+type migrationChallenge struct {
+	nonce MigrationNonce
+	addr  string
+	sent  time.Time
+}
+
 // client represents a client that is connected to an IPX server.
 type client struct {
 	s               *Server
+	protocol        Protocol
 	closed          bool
 	rxpipe          ipx.ReadWriteCloser
-	addr            *net.UDPAddr
 	lastReceiveTime time.Time
+
+	mu   sync.Mutex // protects addr
+	addr *net.UDPAddr
+
+	// ipxAddr is the IPX address that identifies the client, if known,
+	// which is used to recognize it if its UDP address changes. It and
+	// challenge are protected by the server's mutex.
+	ipxAddr    ipx.Addr
+	hasIPXAddr bool
+	challenge  *migrationChallenge
+}
+
+func (c *client) remoteAddr() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+func (c *client) setRemoteAddr(addr *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addr = addr
 }
 
 func (c *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
@@ -67,15 +193,33 @@ func (c *client) WritePacket(packet *ipx.Packet) error {
 	if err != nil {
 		return err
 	}
-	_, err = c.s.socket.WriteToUDP(packetBytes, c.addr)
+	if len(packetBytes) > c.s.mtu {
+		return fmt.Errorf("%w: %d > %d", PacketTooLargeError, len(packetBytes), c.s.mtu)
+	}
+	_, err = c.s.socket.WriteToUDP(packetBytes, c.remoteAddr())
 	return err
 }
 
+// GetProperty implements the network.Node interface. The client's UDP
+// address can be fetched as a network.RemoteAddr property.
+func (c *client) GetProperty(x interface{}) bool {
+	switch x.(type) {
+	case *network.RemoteAddr:
+		*x.(*network.RemoteAddr) = network.RemoteAddr{Addr: c.remoteAddr()}
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *client) Close() error {
 	c.s.mu.Lock()
 	defer c.s.mu.Unlock()
 	if !c.closed {
-		delete(c.s.clients, c.addr.String())
+		delete(c.s.clients, c.remoteAddr().String())
+		if c.hasIPXAddr && c.s.clientsByIPX[c.ipxAddr] == c {
+			delete(c.s.clientsByIPX, c.ipxAddr)
+		}
 		c.closed = true
 	}
 	return c.rxpipe.Close()
@@ -88,16 +232,27 @@ type Server struct {
 	config           *Config
 	socket           *net.UDPConn
 	clients          map[string]*client
+	clientsByIPX     map[ipx.Addr]*client
 	timeoutCheckTime time.Time
+	mtu              int
+	stopped          bool
+	draining         bool
+	// buf is used to receive packets. It is one byte larger than the
+	// MTU so that oversized packets can be detected.
+	buf []byte
 }
 
 // New creates a new Server, listening on the given address.
 func New(addr string, c *Config) (*Server, error) {
-	udp4Addr, err := net.ResolveUDPAddr("udp4", addr)
+	network := c.Network
+	if network == "" {
+		network = "udp"
+	}
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	socket, err := net.ListenUDP("udp", udp4Addr)
+	socket, err := net.ListenUDP(network, udpAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -105,13 +260,16 @@ func New(addr string, c *Config) (*Server, error) {
 		config:           c,
 		socket:           socket,
 		clients:          map[string]*client{},
+		clientsByIPX:     map[ipx.Addr]*client{},
 		timeoutCheckTime: time.Now().Add(10 * time.Second),
+		mtu:              c.mtu(),
+		buf:              make([]byte, c.mtu()+1),
 	}, nil
 }
 
-func (s *Server) log(format string, args ...interface{}) {
+func (s *Server) log(level slog.Level, msg string, args ...any) {
 	if s.config.Logger != nil {
-		s.config.Logger.Printf(format, args...)
+		s.config.Logger.Log(context.Background(), level, msg, args...)
 	}
 }
 
@@ -135,7 +293,8 @@ func (s *Server) newClient(ctx context.Context, protocol Protocol, addr *net.UDP
 	now := time.Now()
 	c := &client{
 		s:               s,
-		rxpipe:          pipe.New(),
+		protocol:        protocol,
+		rxpipe:          pipe.New(pipe.DefaultBufferSize),
 		addr:            addr,
 		lastReceiveTime: now,
 	}
@@ -150,7 +309,8 @@ func (s *Server) newClient(ctx context.Context, protocol Protocol, addr *net.UDP
 			err = nil
 		}
 		if err != nil {
-			s.log("client %s terminated abnormally: %v", addrStr, err)
+			s.log(slog.LevelWarn, "client terminated abnormally",
+				"remote_addr", addrStr, "err", err)
 		}
 		cancel()
 		c.Close()
@@ -158,11 +318,107 @@ func (s *Server) newClient(ctx context.Context, protocol Protocol, addr *net.UDP
 	return c
 }
 
+// learnClientAddress records the IPX address that identifies the given
+// client, if its protocol supports migration. Only the first address seen
+// is recorded, and never one that already identifies another client. The
+// server's mutex must be held.
+func (s *Server) learnClientAddress(c *client, packet *ipx.Packet) {
+	m, ok := c.protocol.(Migratable)
+	if !ok || !s.config.AllowMigration || c.hasIPXAddr || c.closed {
+		return
+	}
+	ipxAddr, ok := m.ClientAddress(packet)
+	if !ok {
+		return
+	}
+	if _, ok := s.clientsByIPX[ipxAddr]; ok {
+		return
+	}
+	c.ipxAddr, c.hasIPXAddr = ipxAddr, true
+	s.clientsByIPX[ipxAddr] = c
+}
+
+// migrateClient is invoked when a packet is received from an address that
+// does not match any client. If the packet identifies an existing client at
+// the same IP address, a challenge is sent to the new address, and once the
+// reply comes back the client is moved there. True is returned if the
+// packet was handled this way. The server's mutex must be held.
+func (s *Server) migrateClient(packet *ipx.Packet, addr *net.UDPAddr) bool {
+	if !s.config.AllowMigration {
+		return false
+	}
+	for _, proto := range s.config.Protocols {
+		m, ok := proto.(Migratable)
+		if !ok {
+			continue
+		}
+		ipxAddr, ok := m.ClientAddress(packet)
+		if !ok {
+			continue
+		}
+		c, ok := s.clientsByIPX[ipxAddr]
+		if !ok || c.protocol != proto || !c.remoteAddr().IP.Equal(addr.IP) {
+			continue
+		}
+		addrStr := addr.String()
+		nonce, ok := m.ChallengeResponse(packet)
+		if ch := c.challenge; !ok || ch == nil || ch.addr != addrStr || ch.nonce != nonce {
+			s.sendChallenge(c, m, addr)
+			return true
+		}
+		oldAddrStr := c.remoteAddr().String()
+		delete(s.clients, oldAddrStr)
+		c.setRemoteAddr(addr)
+		c.challenge = nil
+		s.clients[addrStr] = c
+		s.log(slog.LevelInfo, "client migrated to new address",
+			"remote_addr", addrStr,
+			"old_remote_addr", oldAddrStr,
+			"ipx_address", ipxAddr.String())
+		return true
+	}
+	return false
+}
+
+// sendChallenge sends a migration challenge for the given client to the
+// given address. Challenges are rate limited, so that one sent to a
+// different address cannot be repeatedly replaced before it is answered.
+// The server's mutex must be held.
+func (s *Server) sendChallenge(c *client, m Migratable, addr *net.UDPAddr) {
+	if ch := c.challenge; ch != nil && time.Since(ch.sent) < minChallengeInterval {
+		return
+	}
+	var nonce MigrationNonce
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return
+	}
+	packetBytes, err := m.MigrationChallenge(nonce).MarshalBinary()
+	if err != nil {
+		return
+	}
+	c.challenge = &migrationChallenge{
+		nonce: nonce,
+		addr:  addr.String(),
+		sent:  time.Now(),
+	}
+	s.socket.WriteToUDP(packetBytes, addr)
+}
+
 // processPacket decodes a received UDP packet, delivering it to the appropriate
 // client based on address. A new client is started if none matches the address.
 func (s *Server) processPacket(ctx context.Context, packetBytes []byte, addr *net.UDPAddr) {
+	if s.config.Monitor.Blocked(addr) {
+		s.mu.Lock()
+		c, ok := s.clients[addr.String()]
+		s.mu.Unlock()
+		if ok {
+			c.Close()
+		}
+		return
+	}
 	packet := &ipx.Packet{}
 	if err := packet.UnmarshalBinary(packetBytes); err != nil {
+		s.config.Monitor.Report(addr, monitor.EventMalformedPacket)
 		return
 	}
 
@@ -170,16 +426,21 @@ func (s *Server) processPacket(ctx context.Context, packetBytes []byte, addr *ne
 	// If we don't find a client matching this address, start a new one.
 	s.mu.Lock()
 	srcClient, ok := s.clients[addr.String()]
+	if !ok && s.migrateClient(packet, addr) {
+		s.mu.Unlock()
+		return
+	}
 	if !ok {
 		// Is this a supported protocol?
 		protocol, ok := s.findProtocol(packet)
-		if !ok {
+		if !ok || s.draining {
 			s.mu.Unlock()
 			return
 		}
 
 		srcClient = s.newClient(ctx, protocol, addr)
 	}
+	s.learnClientAddress(srcClient, packet)
 	s.mu.Unlock()
 
 	srcClient.lastReceiveTime = time.Now()
@@ -211,9 +472,9 @@ func (s *Server) checkClientTimeouts() time.Time {
 		// Nothing received in a long time? Time out the connection.
 		timeoutTime := c.lastReceiveTime.Add(s.config.ClientTimeout)
 		if now.After(timeoutTime) {
-			s.log(("client %s timed out: nothing received " +
-				"since %s."),
-				c.addr.String(), c.lastReceiveTime)
+			s.log(slog.LevelInfo, "client timed out",
+				"remote_addr", c.remoteAddr().String(),
+				"last_receive_time", c.lastReceiveTime)
 			c.Close()
 		}
 
@@ -228,13 +489,16 @@ func (s *Server) checkClientTimeouts() time.Time {
 // poll listens for new packets, blocking until one is received, or until
 // a timeout is reached.
 func (s *Server) poll(ctx context.Context) error {
-	var buf [1500]byte
-
 	s.socket.SetReadDeadline(s.timeoutCheckTime)
-	packetLen, addr, err := s.socket.ReadFromUDP(buf[:])
-
-	if err == nil {
-		s.processPacket(ctx, buf[0:packetLen], addr)
+	packetLen, addr, err := s.socket.ReadFromUDP(s.buf)
+
+	if err == nil && packetLen > s.mtu {
+		// The packet filled the buffer, so it may have been truncated.
+		s.log(slog.LevelWarn, "discarding packet larger than MTU",
+			"remote_addr", addr.String(), "mtu", s.mtu)
+		s.config.Monitor.Report(addr, monitor.EventMalformedPacket)
+	} else if err == nil {
+		s.processPacket(ctx, s.buf[0:packetLen], addr)
 	} else if nerr, ok := err.(net.Error); ok && !nerr.Timeout() {
 		return err
 	}
@@ -249,7 +513,18 @@ func (s *Server) poll(ctx context.Context) error {
 }
 
 // Run runs the server, blocking until the socket is closed or an error occurs.
+// If the context is cancelled, the server is closed and Run returns.
 func (s *Server) Run(ctx context.Context) {
+	defer s.stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
 	for {
 		if err := s.poll(ctx); err != nil {
 			return
@@ -257,8 +532,58 @@ func (s *Server) Run(ctx context.Context) {
 	}
 }
 
+func (s *Server) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+}
+
+// Healthy returns true if the server's socket is open and it is able to
+// accept clients. It returns false as soon as the server starts shutting
+// down or draining, or if Run has returned because of an error.
+func (s *Server) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.stopped && !s.draining
+}
+
+// Drain stops the server from accepting new clients. Clients that are
+// already connected are unaffected, so that games in progress can finish
+// before the server is shut down.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.draining {
+		s.log(slog.LevelInfo, "draining server; no new clients will be accepted",
+			"clients", len(s.clients))
+	}
+	s.draining = true
+}
+
+// Draining returns true if Drain has been called.
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// NumClients returns the number of clients currently connected that
+// draining waits for. Clients of LongLived protocols are not counted.
+func (s *Server) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := 0
+	for _, c := range s.clients {
+		if !IsLongLived(c.protocol) {
+			result++
+		}
+	}
+	return result
+}
+
 // Close closes the socket associated with the server to shut it down.
 func (s *Server) Close() error {
+	s.stop()
 	for _, client := range s.allClients() {
 		client.Close()
 	}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// recordingProtocol accepts every packet as a registration packet, and
+// passes received packets to a channel.
+type recordingProtocol struct {
+	packets chan *ipx.Packet
+	clients chan ipx.ReadWriteCloser
+}
+
+func (p *recordingProtocol) StartClient(ctx context.Context, c ipx.ReadWriteCloser, addr net.Addr) error {
+	p.clients <- c
+	for {
+		packet, err := c.ReadPacket(ctx)
+		if err != nil {
+			return err
+		}
+		p.packets <- packet
+	}
+}
+
+func (p *recordingProtocol) IsRegistrationPacket(*ipx.Packet) bool {
+	return true
+}
+
+func startServer(t *testing.T, mtu int) (*recordingProtocol, *net.UDPConn) {
+	t.Helper()
+	proto, _, conn := startServerWithHandle(t, mtu)
+	return proto, conn
+}
+
+func startServerWithHandle(t *testing.T, mtu int) (*recordingProtocol, *Server, *net.UDPConn) {
+	t.Helper()
+	proto, s := newServer(t, mtu)
+	go s.Run(context.Background())
+	return proto, s, dialServer(t, s)
+}
+
+// newServer creates a server that records the packets it receives, but
+// does not start running it.
+func newServer(t *testing.T, mtu int) (*recordingProtocol, *Server) {
+	t.Helper()
+	proto := &recordingProtocol{
+		packets: make(chan *ipx.Packet, 10),
+		clients: make(chan ipx.ReadWriteCloser, 1),
+	}
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{proto},
+		ClientTimeout: time.Minute,
+		MTU:           mtu,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return proto, s
+}
+
+func dialServer(t *testing.T, s *Server) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, s.socket.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func makePacket(payloadLen int) []byte {
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Length: uint16(ipx.HeaderLength + payloadLen),
+			Dest:   ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+		},
+		Payload: bytes.Repeat([]byte{0x5a}, payloadLen),
+	}
+	result, _ := packet.MarshalBinary()
+	return result
+}
+
+func expectPacket(t *testing.T, proto *recordingProtocol, length int) {
+	t.Helper()
+	select {
+	case packet := <-proto.packets:
+		if got := ipx.HeaderLength + len(packet.Payload); got != length {
+			t.Errorf("wrong packet length received: want %d, got %d", length, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("packet of length %d not received", length)
+	}
+}
+
+func TestMTU(t *testing.T) {
+	proto, conn := startServer(t, 0)
+	small, large := makePacket(100), makePacket(2000)
+	conn.Write(small)
+	expectPacket(t, proto, len(small))
+	c := <-proto.clients
+
+	// Packets larger than the default MTU must be discarded rather
+	// than truncated.
+	conn.Write(large)
+	conn.Write(small)
+	expectPacket(t, proto, len(small))
+
+	p := &ipx.Packet{}
+	p.UnmarshalBinary(large)
+	if err := c.WritePacket(p); !errors.Is(err, PacketTooLargeError) {
+		t.Errorf("sending oversized packet: want %v, got %v", PacketTooLargeError, err)
+	}
+}
+
+func TestLargeMTU(t *testing.T) {
+	proto, conn := startServer(t, 9000)
+	large := makePacket(2000)
+	conn.Write(large)
+	expectPacket(t, proto, len(large))
+	c := <-proto.clients
+
+	p := &ipx.Packet{}
+	p.UnmarshalBinary(large)
+	if err := c.WritePacket(p); err != nil {
+		t.Fatalf("sending large packet: %v", err)
+	}
+	var buf [ipx.MaxPacketLength]byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], large) {
+		t.Errorf("large packet was corrupted: sent %d bytes, got %d", len(large), n)
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	proto, conn := startServer(t, 0)
+	conn.Write(makePacket(10))
+	c := <-proto.clients
+	node, ok := c.(network.Node)
+	if !ok {
+		t.Fatalf("client does not implement network.Node")
+	}
+	got, want := network.NodeRemoteAddr(node), conn.LocalAddr()
+	if got == nil || got.String() != want.String() {
+		t.Errorf("wrong remote address: want %v, got %v", want, got)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	_, s, _ := startServerWithHandle(t, 0)
+	if !s.Healthy() {
+		t.Errorf("want server healthy once started")
+	}
+	s.Close()
+	if s.Healthy() {
+		t.Errorf("want server unhealthy after Close")
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	proto, s := newServer(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	conn := dialServer(t, s)
+	conn.Write(makePacket(10))
+	expectPacket(t, proto, ipx.HeaderLength+10)
+	c := <-proto.clients
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after context was cancelled")
+	}
+	if s.Healthy() {
+		t.Errorf("want server unhealthy after context was cancelled")
+	}
+	if _, err := c.ReadPacket(context.Background()); err == nil {
+		t.Errorf("client still open after context was cancelled")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	proto, s, conn := startServerWithHandle(t, 0)
+	conn.Write(makePacket(10))
+	expectPacket(t, proto, ipx.HeaderLength+10)
+	<-proto.clients
+
+	s.Drain()
+	if !s.Draining() || s.Healthy() {
+		t.Errorf("want server draining and unhealthy after Drain")
+	}
+
+	// Existing clients can still send packets, but new clients are
+	// not accepted.
+	conn.Write(makePacket(20))
+	expectPacket(t, proto, ipx.HeaderLength+20)
+	conn2, err := net.DialUDP("udp", nil, s.socket.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.Write(makePacket(30))
+	select {
+	case <-proto.packets:
+		t.Errorf("packet received from new client while draining")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := s.NumClients(); got != 1 {
+		t.Errorf("wrong number of clients: want 1, got %d", got)
+	}
+}
+
+// longLivedProtocol is a recordingProtocol whose clients stay connected
+// indefinitely.
+type longLivedProtocol struct {
+	*recordingProtocol
+}
+
+func (p *longLivedProtocol) LongLived() bool {
+	return true
+}
+
+func TestDrainLongLived(t *testing.T) {
+	proto := &recordingProtocol{
+		packets: make(chan *ipx.Packet, 10),
+		clients: make(chan ipx.ReadWriteCloser, 1),
+	}
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{&longLivedProtocol{proto}},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(context.Background())
+	conn := dialServer(t, s)
+	conn.Write(makePacket(10))
+	expectPacket(t, proto, ipx.HeaderLength+10)
+
+	// The client is connected, but draining does not wait for it.
+	s.Drain()
+	if got := s.NumClients(); got != 0 {
+		t.Errorf("wrong number of clients: want 0, got %d", got)
+	}
+	conn.Write(makePacket(20))
+	expectPacket(t, proto, ipx.HeaderLength+20)
+}
+
+// migratableProtocol is a recordingProtocol whose clients are identified by
+// the source address of their packets. Challenges are answered by sending
+// a packet to the challenge's source address.
+type migratableProtocol struct {
+	*recordingProtocol
+}
+
+func (p migratableProtocol) ClientAddress(packet *ipx.Packet) (ipx.Addr, bool) {
+	return packet.Header.Src.Addr, packet.Header.Src.Addr != ipx.AddrNull
+}
+
+func (p migratableProtocol) MigrationChallenge(nonce MigrationNonce) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 2},
+			Src:  ipx.HeaderAddr{Addr: ipx.Addr(nonce)},
+		},
+	}
+}
+
+func (p migratableProtocol) ChallengeResponse(packet *ipx.Packet) (MigrationNonce, bool) {
+	return MigrationNonce(packet.Header.Dest.Addr), packet.Header.Dest.Socket == 2
+}
+
+func makePacketFrom(src ipx.Addr) []byte {
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+			Src:  ipx.HeaderAddr{Addr: src},
+		},
+		Payload: []byte("hello"),
+	}
+	result, _ := packet.MarshalBinary()
+	return result
+}
+
+// makeResponse returns a reply to the given challenge.
+func makeResponse(src ipx.Addr, nonce ipx.Addr) []byte {
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: nonce, Socket: 2},
+			Src:  ipx.HeaderAddr{Addr: src, Socket: 2},
+		},
+	}
+	result, _ := packet.MarshalBinary()
+	return result
+}
+
+// readChallenge reads the migration challenge sent to the given socket and
+// returns the nonce it contains.
+func readChallenge(t *testing.T, conn *net.UDPConn) ipx.Addr {
+	t.Helper()
+	var buf [100]byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf[:])
+	if err != nil {
+		t.Fatalf("challenge not received: %v", err)
+	}
+	packet := &ipx.Packet{}
+	if err := packet.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return packet.Header.Src.Addr
+}
+
+func expectNoClient(t *testing.T, proto *recordingProtocol) {
+	t.Helper()
+	select {
+	case <-proto.clients:
+		t.Errorf("new client started despite migration")
+	case <-proto.packets:
+		t.Errorf("packet delivered before migration completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// startMigrationTest starts a server with migration enabled or disabled,
+// and connects a client with the given IPX address to it.
+func startMigrationTest(t *testing.T, allow bool, addr ipx.Addr) (*recordingProtocol, *Server, ipx.ReadWriteCloser) {
+	t.Helper()
+	proto := &recordingProtocol{
+		packets: make(chan *ipx.Packet, 10),
+		clients: make(chan ipx.ReadWriteCloser, 2),
+	}
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:      []Protocol{migratableProtocol{proto}},
+		ClientTimeout:  time.Minute,
+		AllowMigration: allow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	go s.Run(context.Background())
+
+	conn := dialServer(t, s)
+	conn.Write(makePacketFrom(ipx.AddrNull))
+	conn.Write(makePacketFrom(addr))
+	expectPacket(t, proto, ipx.HeaderLength+5)
+	expectPacket(t, proto, ipx.HeaderLength+5)
+	return proto, s, <-proto.clients
+}
+
+func TestMigrationDisabled(t *testing.T) {
+	addr1 := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	proto, s, _ := startMigrationTest(t, false, addr1)
+
+	// The client's NAT mapping is rebound to a new port.
+	conn2 := dialServer(t, s)
+	conn2.Write(makePacketFrom(addr1))
+	expectPacket(t, proto, ipx.HeaderLength+5)
+	select {
+	case <-proto.clients:
+	case <-time.After(time.Second):
+		t.Errorf("want new client started when migration is disabled")
+	}
+}
+
+func TestMigration(t *testing.T) {
+	addr1 := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	proto, s, c := startMigrationTest(t, true, addr1)
+	oldAddr := network.NodeRemoteAddr(c.(network.Node)).String()
+
+	// The client's NAT mapping is rebound to a new port. The packet is
+	// not delivered; a challenge is sent to the new port instead.
+	conn2 := dialServer(t, s)
+	conn2.Write(makePacketFrom(addr1))
+	nonce := readChallenge(t, conn2)
+	expectNoClient(t, proto)
+
+	// A reply with the wrong nonce does not migrate the client.
+	wrongNonce := nonce
+	wrongNonce[5]++
+	conn2.Write(makeResponse(addr1, wrongNonce))
+	expectNoClient(t, proto)
+	if got := network.NodeRemoteAddr(c.(network.Node)).String(); got != oldAddr {
+		t.Fatalf("client migrated without answering challenge: now at %v", got)
+	}
+
+	conn2.Write(makeResponse(addr1, nonce))
+	conn2.Write(makePacketFrom(addr1))
+	expectPacket(t, proto, ipx.HeaderLength+5)
+	expectNoClient(t, proto)
+	got := network.NodeRemoteAddr(c.(network.Node))
+	if got.String() != conn2.LocalAddr().String() {
+		t.Errorf("wrong remote address after migration: want %v, got %v", conn2.LocalAddr(), got)
+	}
+
+	// Packets to the client are now sent to the new port.
+	p := &ipx.Packet{}
+	p.UnmarshalBinary(makePacketFrom(ipx.AddrNull))
+	if err := c.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn2.Read(buf[:]); err != nil {
+		t.Errorf("packet not received at new address: %v", err)
+	}
+}
+
+func TestMigrationSpoofed(t *testing.T) {
+	addr1 := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	proto, s, c := startMigrationTest(t, true, addr1)
+	oldAddr := network.NodeRemoteAddr(c.(network.Node)).String()
+
+	// Someone who knows the client's IPX address, but cannot see the
+	// challenge sent to the new port, cannot take over the session.
+	conn2 := dialServer(t, s)
+	conn2.Write(makePacketFrom(addr1))
+	conn2.Write(makeResponse(addr1, ipx.Addr{0x02, 0xff, 0xff, 0xff, 0, 0}))
+	conn2.Write(makePacketFrom(addr1))
+	expectNoClient(t, proto)
+	if got := network.NodeRemoteAddr(c.(network.Node)).String(); got != oldAddr {
+		t.Errorf("client migrated without answering challenge: now at %v", got)
+	}
+}
@@ -0,0 +1,248 @@
+// Package tcp implements a server that sends and receives IPX frames over
+// TCP streams, for use on networks where UDP is blocked or unreliable. Each
+// accepted connection is handled by the same server.Protocol implementations
+// as the UDP server, so clients connecting over TCP become nodes on the
+// network just like UDP clients.
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	tcpclient "github.com/fragglet/ipxbox/client/tcp"
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/monitor"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/server"
+)
+
+var (
+	_ = (network.Node)(&client{})
+	_ = (io.Closer)(&Server{})
+)
+
+// idleConn wraps a net.Conn so that reads time out if nothing is received
+// for a period of time.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+// client wraps a TCP client connection so that the registration packet,
+// which was already read to identify the protocol, is returned again by
+// the first call to ReadPacket.
+type client struct {
+	*tcpclient.Client
+	mu          sync.Mutex
+	firstPacket *ipx.Packet
+	remoteAddr  net.Addr
+}
+
+func (c *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	c.mu.Lock()
+	packet := c.firstPacket
+	c.firstPacket = nil
+	c.mu.Unlock()
+	if packet != nil {
+		return packet, nil
+	}
+	return c.Client.ReadPacket(ctx)
+}
+
+// GetProperty implements the network.Node interface. The client's TCP
+// address can be fetched as a network.RemoteAddr property.
+func (c *client) GetProperty(x interface{}) bool {
+	switch x.(type) {
+	case *network.RemoteAddr:
+		*x.(*network.RemoteAddr) = network.RemoteAddr{Addr: c.remoteAddr}
+		return true
+	default:
+		return false
+	}
+}
+
+// Server is the top-level struct representing an IPX server that listens
+// on a TCP port.
+type Server struct {
+	mu       sync.Mutex
+	config   *server.Config
+	listener net.Listener
+	// clients maps each connected client to whether it is counted by
+	// NumClients; clients of LongLived protocols are not.
+	clients  map[*tcpclient.Client]bool
+	draining bool
+}
+
+// New creates a new Server, listening on the given address. The Network
+// field of the configuration is ignored.
+func New(addr string, c *server.Config) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		config:   c,
+		listener: listener,
+		clients:  map[*tcpclient.Client]bool{},
+	}, nil
+}
+
+// NewTLS is like New, but connections to the server are encrypted with TLS
+// using the given configuration, which must contain a certificate.
+func NewTLS(addr string, c *server.Config, config *tls.Config) (*Server, error) {
+	s, err := New(addr, c)
+	if err != nil {
+		return nil, err
+	}
+	s.listener = tls.NewListener(s.listener, config)
+	return s, nil
+}
+
+func (s *Server) log(level slog.Level, msg string, args ...any) {
+	if s.config.Logger != nil {
+		s.config.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// findProtocol checks the protocols supported by the server and returns
+// a Protocol that matches the given packet. If no valid protocols are
+// found then nil, false is returned.
+func (s *Server) findProtocol(packet *ipx.Packet) (server.Protocol, bool) {
+	for _, proto := range s.config.Protocols {
+		if proto.IsRegistrationPacket(packet) {
+			return proto, true
+		}
+	}
+	return nil, false
+}
+
+// handleConnection runs the protocol for a newly accepted connection,
+// returning when the connection is closed.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
+	addr := conn.RemoteAddr()
+	if s.config.Monitor.Blocked(addr) || s.Draining() {
+		conn.Close()
+		return
+	}
+	if s.config.ClientTimeout > 0 {
+		conn = &idleConn{Conn: conn, timeout: s.config.ClientTimeout}
+	}
+	c := tcpclient.NewWithHandler(conn, func(err error) {
+		s.config.Monitor.Report(addr, monitor.EventMalformedPacket)
+	})
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	// The first packet received identifies the protocol.
+	packet, err := c.ReadPacket(ctx)
+	if err != nil {
+		return
+	}
+	protocol, ok := s.findProtocol(packet)
+	if !ok {
+		s.log(slog.LevelWarn, "first packet was not a registration packet",
+			"remote_addr", addr.String())
+		return
+	}
+	s.mu.Lock()
+	s.clients[c] = !server.IsLongLived(protocol)
+	s.mu.Unlock()
+
+	subctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err = protocol.StartClient(subctx, &client{
+		Client:      c,
+		firstPacket: packet,
+		remoteAddr:  addr,
+	}, addr)
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = nil
+	}
+	if err != nil {
+		s.log(slog.LevelWarn, "client terminated abnormally",
+			"remote_addr", addr.String(), "err", err)
+	}
+}
+
+// Run runs the server, blocking until the listener is closed, the context
+// is cancelled or an error occurs.
+func (s *Server) Run(ctx context.Context) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.listener.Close()
+		case <-done:
+		}
+	}()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConnection(ctx, conn)
+	}
+}
+
+// Drain stops the server from accepting new clients. Clients that are
+// already connected are unaffected.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.draining {
+		s.log(slog.LevelInfo, "draining server; no new clients will be accepted",
+			"clients", len(s.clients))
+	}
+	s.draining = true
+}
+
+// Draining returns true if Drain has been called.
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// NumClients returns the number of clients currently connected that
+// draining waits for. Clients of server.LongLived protocols are not counted.
+func (s *Server) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := 0
+	for _, counted := range s.clients {
+		if counted {
+			result++
+		}
+	}
+	return result
+}
+
+// Close closes the listener and all client connections to shut down the
+// server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	for c := range s.clients {
+		c.Close()
+	}
+	s.mu.Unlock()
+	return s.listener.Close()
+}
@@ -0,0 +1,254 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	tcpclient "github.com/fragglet/ipxbox/client/tcp"
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/monitor"
+	"github.com/fragglet/ipxbox/server"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+// recordingProtocol accepts every packet as a registration packet, and
+// passes received packets to a channel.
+type recordingProtocol struct {
+	packets chan *ipx.Packet
+}
+
+func (p *recordingProtocol) StartClient(ctx context.Context, c ipx.ReadWriteCloser, addr net.Addr) error {
+	for {
+		packet, err := c.ReadPacket(ctx)
+		if err != nil {
+			return err
+		}
+		p.packets <- packet
+	}
+}
+
+func (p *recordingProtocol) IsRegistrationPacket(*ipx.Packet) bool {
+	return true
+}
+
+func startServer(t *testing.T, config *server.Config) (*Server, *recordingProtocol) {
+	t.Helper()
+	proto := &recordingProtocol{packets: make(chan *ipx.Packet, 10)}
+	config.Protocols = []server.Protocol{proto}
+	s, err := New("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Run(ctx)
+	return s, proto
+}
+
+func dial(t *testing.T, s *Server) *tcpclient.Client {
+	t.Helper()
+	c, err := tcpclient.Dial(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func expectPacket(t *testing.T, proto *recordingProtocol) *ipx.Packet {
+	t.Helper()
+	select {
+	case packet := <-proto.packets:
+		return packet
+	case <-time.After(time.Second):
+		t.Fatalf("packet not received")
+		return nil
+	}
+}
+
+func TestSendPackets(t *testing.T) {
+	s, proto := startServer(t, &server.Config{})
+	c := dial(t, s)
+	for _, packet := range ipxtesting.TestPackets {
+		if err := c.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+		if got := expectPacket(t, proto); string(got.Payload) != string(packet.Payload) {
+			t.Errorf("wrong packet received: want %v, got %v", packet, got)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	s, err := New("127.0.0.1:0", &server.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after context was cancelled")
+	}
+	if _, err := net.Dial("tcp", s.listener.Addr().String()); err == nil {
+		t.Errorf("server still accepting connections after Run returned")
+	}
+}
+
+func TestMalformedReported(t *testing.T) {
+	m := monitor.New(&monitor.Config{
+		Thresholds: map[monitor.EventType]int{
+			monitor.EventMalformedPacket: 1,
+		},
+		BlockTime: time.Minute,
+	})
+	s, _ := startServer(t, &server.Config{Monitor: m})
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		frame := binary.BigEndian.AppendUint16(nil, 5)
+		if _, err := conn.Write(append(frame, "short"...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for start := time.Now(); !m.Blocked(conn.LocalAddr()); {
+		if time.Since(start) > time.Second {
+			t.Fatalf("client not blocked after sending malformed frames")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewTLS(t *testing.T) {
+	cert, certPEM, err := ipxtesting.MakeCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto := &recordingProtocol{packets: make(chan *ipx.Packet, 10)}
+	s, err := NewTLS("127.0.0.1:0", &server.Config{
+		Protocols: []server.Protocol{proto},
+	}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	dialctx, dialcancel := context.WithTimeout(ctx, time.Second)
+	defer dialcancel()
+	c, err := tcpclient.DialTLS(dialctx, s.listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("DialTLS failed: %v", err)
+	}
+	defer c.Close()
+	packet := ipxtesting.TestPackets[1]
+	if err := c.WritePacket(packet); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	if got := expectPacket(t, proto); string(got.Payload) != string(packet.Payload) {
+		t.Errorf("wrong packet received: want %v, got %v", packet, got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s, proto := startServer(t, &server.Config{})
+	c := dial(t, s)
+	packet := ipxtesting.TestPackets[0]
+	if err := c.WritePacket(packet); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	expectPacket(t, proto)
+	if got := s.NumClients(); got != 1 {
+		t.Errorf("wrong number of clients: want 1, got %d", got)
+	}
+
+	s.Drain()
+	if !s.Draining() {
+		t.Errorf("server not draining after Drain")
+	}
+	// Connections are still accepted, but closed straight away.
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("new connection while draining: want %v, got %v", io.EOF, err)
+	}
+	if got := s.NumClients(); got != 1 {
+		t.Errorf("wrong number of clients while draining: want 1, got %d", got)
+	}
+
+	// The existing client is still served.
+	if err := c.WritePacket(packet); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	expectPacket(t, proto)
+	c.Close()
+	for start := time.Now(); s.NumClients() != 0; {
+		if time.Since(start) > time.Second {
+			t.Fatalf("client still counted after disconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// longLivedProtocol is a recordingProtocol whose clients stay connected
+// indefinitely.
+type longLivedProtocol struct {
+	*recordingProtocol
+}
+
+func (p *longLivedProtocol) LongLived() bool {
+	return true
+}
+
+func TestDrainLongLived(t *testing.T) {
+	proto := &recordingProtocol{packets: make(chan *ipx.Packet, 10)}
+	s, err := New("127.0.0.1:0", &server.Config{
+		Protocols: []server.Protocol{&longLivedProtocol{proto}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	c := dial(t, s)
+	if err := c.WritePacket(ipxtesting.TestPackets[0]); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	expectPacket(t, proto)
+
+	// The client is connected, but draining does not wait for it.
+	s.Drain()
+	if got := s.NumClients(); got != 0 {
+		t.Errorf("wrong number of clients: want 0, got %d", got)
+	}
+}
@@ -0,0 +1,57 @@
+package uplink
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// lookupCredentials reads the given credentials file and returns the
+// password for the given client ID. If ok is false, the client ID is not
+// listed in the file.
+func lookupCredentials(filename, clientID string) (password string, ok bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 && fields[0] == clientID {
+			return fields[1], true, nil
+		}
+	}
+	return "", false, scanner.Err()
+}
+
+// CredentialsFile returns a function that can be used as Protocol.Credentials
+// which looks up client passwords from the given file. Each line of the file
+// has the form "client-id:password"; blank lines and lines beginning with '#'
+// are ignored. The file is reread on every lookup, so it can be edited to
+// add, change or revoke passwords while the server is running.
+//
+// An error is returned if the file cannot be read now. If it cannot be read
+// later, clients are rejected and the error is logged to the given logger,
+// if it is not nil.
+func CredentialsFile(filename string, logger *slog.Logger) (func(clientID string) (string, bool), error) {
+	if _, _, err := lookupCredentials(filename, ""); err != nil {
+		return nil, err
+	}
+	return func(clientID string) (string, bool) {
+		password, ok, err := lookupCredentials(filename, clientID)
+		if err != nil {
+			if logger != nil {
+				logger.Error("failed to read uplink credentials file",
+					"filename", filename, "err", err)
+			}
+			return "", false
+		}
+		return password, ok
+	}, nil
+}
@@ -0,0 +1,168 @@
+package uplink
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func writeCredentials(t *testing.T, filename, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+	writeCredentials(t, filename, `
+# Comments and blank lines are ignored.
+alice:secret1
+
+  bob:secret:with:colons
+#carol:commented
+`)
+	credentials, err := CredentialsFile(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		clientID, password string
+		ok                 bool
+	}{
+		{"alice", "secret1", true},
+		{"bob", "secret:with:colons", true},
+		{"carol", "", false},
+		{"#carol", "", false},
+		{"", "", false},
+	} {
+		password, ok := credentials(tc.clientID)
+		if password != tc.password || ok != tc.ok {
+			t.Errorf("credentials(%q) = %q, %v; want %q, %v", tc.clientID, password, ok, tc.password, tc.ok)
+		}
+	}
+
+	// Edits to the file take effect without creating a new function.
+	writeCredentials(t, filename, "alice:secret2\ncarol:secret3\n")
+	if password, ok := credentials("alice"); !ok || password != "secret2" {
+		t.Errorf("want new password for alice after edit, got %q, %v", password, ok)
+	}
+	if _, ok := credentials("bob"); ok {
+		t.Errorf("bob still accepted after being removed from the file")
+	}
+	if password, ok := credentials("carol"); !ok || password != "secret3" {
+		t.Errorf("want carol accepted after being added, got %q, %v", password, ok)
+	}
+}
+
+func TestCredentialsFileErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+	if _, err := CredentialsFile(filename, nil); err == nil {
+		t.Fatalf("want error for missing credentials file")
+	}
+
+	writeCredentials(t, filename, "alice:secret\n")
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	credentials, err := CredentialsFile(filename, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// If the file disappears, clients are rejected and the error is
+	// logged.
+	os.Remove(filename)
+	if _, ok := credentials("alice"); ok {
+		t.Errorf("client accepted with missing credentials file")
+	}
+	if !strings.Contains(buf.String(), "failed to read uplink credentials file") {
+		t.Errorf("read error not logged: %q", buf.String())
+	}
+}
+
+// sendMessage sends an uplink control message to the server.
+func sendMessage(t *testing.T, c ipx.Writer, msg *Message) {
+	t.Helper()
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WritePacket(&ipx.Packet{
+		Header:  ipx.Header{Dest: ipx.HeaderAddr{Addr: Address}},
+		Payload: data,
+	})
+	if err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+}
+
+// recvMessage returns the next uplink control message sent by the server.
+func recvMessage(t *testing.T, c ipx.Reader) *Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	packet, err := c.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("no message received: %v", err)
+	}
+	var msg Message
+	if err := msg.Unmarshal(packet.Payload); err != nil {
+		t.Fatalf("bad message received: %v", err)
+	}
+	return &msg
+}
+
+func TestUnknownClientRejected(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+	writeCredentials(t, filename, "alice:secret\n")
+	credentials, err := CredentialsFile(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Protocol{
+		Network:       ipxswitch.New(0),
+		Credentials:   credentials,
+		KeepaliveTime: time.Minute,
+	}
+	for _, tc := range []struct {
+		clientID string
+		want     string
+	}{
+		{"alice", MessageTypeSubmitSolutionAccepted},
+		{"mallory", MessageTypeSubmitSolutionRejected},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+		go p.StartClient(ctx, serverEnd, ipxtesting.FakeAddress)
+
+		sendMessage(t, clientEnd, &Message{Type: MessageTypeGetChallengeRequest})
+		msg := recvMessage(t, clientEnd)
+		if msg.Type != MessageTypeGetChallengeResponse {
+			t.Fatalf("want %q, got %q", MessageTypeGetChallengeResponse, msg.Type)
+		}
+		challenge, err := NewChallenge(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The unknown client uses alice's password, which must not
+		// help it.
+		sendMessage(t, clientEnd, &Message{
+			Type:      MessageTypeSubmitSolution,
+			ClientID:  tc.clientID,
+			Solution:  SolveChallenge("client", "secret", msg.Challenge),
+			Challenge: challenge,
+		})
+		if msg := recvMessage(t, clientEnd); msg.Type != tc.want {
+			t.Errorf("client %q: want %q, got %q", tc.clientID, tc.want, msg.Type)
+		}
+	}
+}
@@ -11,12 +11,15 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/fragglet/ipxbox/admin"
+	"github.com/fragglet/ipxbox/audit"
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/monitor"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/stats"
 	"github.com/fragglet/ipxbox/server"
@@ -25,6 +28,7 @@ import (
 var (
 	_ = (ipx.ReadWriteCloser)(&client{})
 	_ = (server.Protocol)(&Protocol{})
+	_ = (server.LongLived)(&Protocol{})
 
 	// Address is a special IPX address used to identify control packets;
 	// control packets have this destination address.
@@ -47,9 +51,12 @@ const (
 	// MessageTypeSubmitSolution is the uplink message type sent from the
 	// client to server submitting its solution to the challenge from the
 	// server. It also contains its own reverse-challenge to the server.
+	// The optional client ID identifies which password the client is
+	// using, for servers that issue different passwords to each peer.
 	// {"message-type": "submit-solution",
 	//  "solution": "[base64 solution to server challenge]",
-	//  "challenge": "[base64 challenge bytes]"}
+	//  "challenge": "[base64 challenge bytes]",
+	//  "client-id": "[client identifier]"}
 	MessageTypeSubmitSolution = "submit-solution"
 
 	// MessageTypeSubmitSolutionAccepted is the uplink message type sent
@@ -80,13 +87,16 @@ const (
 )
 
 const (
+	// MinChallengeLength is the minimum length in bytes of the random
+	// challenges that each side sends to the other during the handshake.
 	MinChallengeLength = 64
 )
 
 type Message struct {
 	Type      string `json:"message-type"`
-	Challenge []byte `json:"challenge",omitempty`
-	Solution  []byte `json:"solution",omitempty`
+	Challenge []byte `json:"challenge,omitempty"`
+	Solution  []byte `json:"solution,omitempty"`
+	ClientID  string `json:"client-id,omitempty"`
 }
 
 func (m *Message) Marshal() ([]byte, error) {
@@ -107,25 +117,67 @@ type Protocol struct {
 
 	// If not nil, log entries are written as clients connect and
 	// disconnect.
-	Logger *log.Logger
+	Logger *slog.Logger
 
 	// Clients *must* supply a password. Uplink is always authenticated.
+	// This is the password used when Credentials is nil.
 	Password string
 
+	// If not nil, Credentials is called to look up the password for
+	// each client using the client ID it supplies. If ok is false, the
+	// client is rejected. Since the function is called on every
+	// authentication attempt, passwords can be changed or revoked
+	// without restarting the server.
+	Credentials func(clientID string) (password string, ok bool)
+
 	// If non-zero, always send at least one packet every few seconds to
 	// keep the UDP connection open. Some NAT networks and firewalls can be
 	// very aggressive about closing off the ability for clients to receive
 	// packets on particular ports if nothing is received for a while.
 	// This controls the time for keepalives.
 	KeepaliveTime time.Duration
+
+	// If not nil, authentication failures are reported to the monitor.
+	Monitor *monitor.Monitor
+
+	// ChallengeLength is the length in bytes of the challenge sent to
+	// clients, and the minimum length of the challenge that clients
+	// must send back. Values less than MinChallengeLength are raised
+	// to MinChallengeLength.
+	ChallengeLength int
+
+	// If not nil, connected clients are recorded in the registry so
+	// that they can be listed and disconnected through the admin API.
+	Registry *admin.Registry
+
+	// If not nil, a record of each client session is written to the
+	// audit log when the client disconnects.
+	Audit *audit.Log
 }
 
-func (p *Protocol) log(format string, args ...interface{}) {
+func (p *Protocol) log(level slog.Level, msg string, args ...any) {
 	if p.Logger != nil {
-		p.Logger.Printf(format, args...)
+		args = append([]any{"protocol", "uplink"}, args...)
+		p.Logger.Log(context.Background(), level, msg, args...)
 	}
 }
 
+// password returns the password that the client with the given ID should
+// use to authenticate. If ok is false, the client is not permitted to
+// connect.
+func (p *Protocol) password(clientID string) (password string, ok bool) {
+	if p.Credentials != nil {
+		return p.Credentials(clientID)
+	}
+	return p.Password, true
+}
+
+// LongLived returns true, since uplinks stay connected indefinitely and are
+// kept open by keepalives.
+func (p *Protocol) LongLived() bool {
+	return true
+}
+
 // IsRegistrationPacket returns true if this is an uplink packet of type
 // MessageTypeGetChallengeRequest, which is the opening packet of a
 // connection handshake.
@@ -146,24 +198,32 @@ func (p *Protocol) StartClient(ctx context.Context, inner ipx.ReadWriteCloser, r
 		p:             p,
 		inner:         inner,
 		authenticated: false,
-		challenge:     make([]byte, MinChallengeLength),
 		addr:          remoteAddr,
 	}
-	p.log("new uplink client from %s", remoteAddr)
-	if _, err := rand.Read(c.challenge); err != nil {
+	p.log(slog.LevelInfo, "client connected", "remote_addr", remoteAddr.String())
+	var err error
+	c.challenge, err = NewChallenge(p.ChallengeLength)
+	if err != nil {
 		return err
 	}
 	go c.sendKeepalives(ctx)
 
-	node := p.Network.NewNode()
+	node := network.WithRemoteAddr(p.Network.NewNode(), remoteAddr)
+	if err := network.NodeError(node); err != nil {
+		node.Close()
+		return err
+	}
 	defer func() {
 		node.Close()
 		statsString := stats.Summary(node)
 		if statsString != "" {
-			p.log("uplink client %s: final statistics: %s",
-				remoteAddr.String(), statsString)
+			p.log(slog.LevelInfo, "final statistics",
+				"remote_addr", remoteAddr.String(),
+				"stats", statsString)
 		}
 	}()
+	defer p.Registry.Add("uplink", &livenessNode{node, c}, remoteAddr)()
+	defer p.Audit.Start("uplink", node, remoteAddr)()
 	return ipx.DuplexCopyPackets(ctx, c, node)
 }
 
@@ -177,6 +237,29 @@ type client struct {
 	mu            sync.Mutex
 	addr          net.Addr
 	lastSendTime  time.Time
+	lastRecvTime  time.Time
+}
+
+// livenessNode wraps a client's node so that the time the client was last
+// heard from can be fetched as a *network.Liveness property.
+type livenessNode struct {
+	network.Node
+	c *client
+}
+
+func (n *livenessNode) GetProperty(x interface{}) bool {
+	switch x := x.(type) {
+	case *network.Liveness:
+		n.c.mu.Lock()
+		defer n.c.mu.Unlock()
+		*x = network.Liveness{
+			Connected:    n.c.authenticated,
+			LastReceived: n.c.lastRecvTime,
+		}
+		return true
+	default:
+		return n.Node.GetProperty(x)
+	}
 }
 
 func (c *client) sendKeepalives(ctx context.Context) {
@@ -198,6 +281,29 @@ func (c *client) sendKeepalives(ctx context.Context) {
 	}
 }
 
+// ChallengeLength returns the challenge length to use when the given length
+// has been configured, which is never less than MinChallengeLength.
+func ChallengeLength(length int) int {
+	if length < MinChallengeLength {
+		return MinChallengeLength
+	}
+	return length
+}
+
+// NewChallenge generates a random challenge of the given length; see
+// ChallengeLength.
+func NewChallenge(length int) ([]byte, error) {
+	challenge := make([]byte, ChallengeLength(length))
+	n, err := rand.Read(challenge)
+	switch {
+	case err != nil:
+		return nil, err
+	case n < len(challenge):
+		return nil, fmt.Errorf("generated challenge too short: want %d bytes, got %d", len(challenge), n)
+	}
+	return challenge, nil
+}
+
 func SolveChallenge(side, password string, challenge []byte) []byte {
 	hashData := append([]byte(side), challenge...)
 	hashData = append(hashData, []byte(password)...)
@@ -223,12 +329,14 @@ func (c *client) sendUplinkMessage(msg *Message) error {
 }
 
 func (c *client) authenticate(msg *Message) error {
-	if len(msg.Challenge) < MinChallengeLength {
-		return fmt.Errorf("client challenge too short: want minimum %d bytes, got %d", MinChallengeLength, len(msg.Challenge))
+	if minLength := ChallengeLength(c.p.ChallengeLength); len(msg.Challenge) < minLength {
+		return fmt.Errorf("client challenge too short: want minimum %d bytes, got %d", minLength, len(msg.Challenge))
 	}
-	solution := SolveChallenge("client", c.p.Password, c.challenge)
-	if !bytes.Equal(msg.Solution, solution) {
-		c.p.log("uplink client %s authentication rejected", c.addr)
+	password, ok := c.p.password(msg.ClientID)
+	if !ok || !bytes.Equal(msg.Solution, SolveChallenge("client", password, c.challenge)) {
+		c.p.log(slog.LevelWarn, "authentication rejected",
+			"remote_addr", c.addr.String(), "client_id", msg.ClientID)
+		c.p.Monitor.Report(c.addr, monitor.EventAuthFailure)
 		c.Close()
 		return c.sendUplinkMessage(&Message{
 			Type: MessageTypeSubmitSolutionRejected,
@@ -236,7 +344,8 @@ func (c *client) authenticate(msg *Message) error {
 	}
 	c.mu.Lock()
 	if !c.authenticated {
-		c.p.log("uplink from %s authenticated successfully", c.addr)
+		c.p.log(slog.LevelInfo, "authenticated successfully",
+			"remote_addr", c.addr.String(), "client_id", msg.ClientID)
 		c.authenticated = true
 		// Don't send a keepalive immediately.
 		c.lastSendTime = time.Now()
@@ -244,7 +353,7 @@ func (c *client) authenticate(msg *Message) error {
 	c.mu.Unlock()
 	return c.sendUplinkMessage(&Message{
 		Type:     MessageTypeSubmitSolutionAccepted,
-		Solution: SolveChallenge("server", c.p.Password, msg.Challenge),
+		Solution: SolveChallenge("server", password, msg.Challenge),
 	})
 }
 
@@ -262,7 +371,8 @@ func (c *client) handleUplinkPacket(packet *ipx.Packet) error {
 	case MessageTypeSubmitSolution:
 		return c.authenticate(&msg)
 	case MessageTypeClose:
-		c.p.log("uplink client %s closed connection", c.addr)
+		c.p.log(slog.LevelInfo, "client disconnected",
+			"remote_addr", c.addr.String())
 		c.Close()
 	}
 	return nil
@@ -280,8 +390,13 @@ func (c *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 		if err != nil {
 			return nil, err
 		}
+		c.mu.Lock()
+		c.lastRecvTime = time.Now()
+		c.mu.Unlock()
+		// Control messages are never forwarded to the network.
 		if packet.Header.Dest.Addr == Address {
 			c.handleUplinkPacket(packet)
+			continue
 		}
 
 		// Packets get silently discarded until authenticated.
@@ -4,29 +4,65 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/fragglet/ipxbox/client/uplink"
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network/filter"
 	"github.com/fragglet/ipxbox/phys"
+	svruplink "github.com/fragglet/ipxbox/server/uplink"
 )
 
 var (
-	uplinkServer = flag.String("uplink_server", "", "Address of IPX uplink server.")
-	password     = flag.String("password", "", "Password for uplink server.")
-	allowNetBIOS = flag.Bool("allow_netbios", false, "If true, allow packets to be forwarded that may contain Windows file sharing (NetBIOS) packets.")
+	uplinkServer     = flag.String("uplink_server", "", "Address of IPX uplink server.")
+	password         = flag.String("password", "", "Password for uplink server.")
+	clientID         = flag.String("client_id", "", "Client ID to identify this client to the uplink server, if the server uses per-client passwords.")
+	useTLS           = flag.Bool("tls", false, "If true, connect to the uplink server's --tls_port, so that all traffic is encrypted.")
+	tlsCAFile        = flag.String("tls_ca", "", "File containing PEM-encoded CA certificates to trust when verifying the server with --tls. If empty, the system roots are used.")
+	reconnectTimeout = flag.Duration("reconnect_timeout", uplink.DefaultReconnectTimeout, "Reconnect to the uplink server if nothing has been received from it for this long. The server sends keepalives when idle, so this must be more than 1.5 times the server's --keepalive_time.")
+	challengeLen     = flag.Int("challenge_length", svruplink.MinChallengeLength, "Length in bytes of the challenge sent to the uplink server during authentication, and the minimum length accepted from it. Cannot be less than the default.")
+	allowNetBIOS     = flag.Bool("allow_netbios", false, "If true, allow packets to be forwarded that may contain Windows file sharing (NetBIOS) packets.")
+	blockedPorts     = flag.String("blocked_ports", "default", `Comma-separated list of IPX sockets to block unless --allow_netbios is set. Entries can be socket numbers or the groups "default", "ncp", "sap", "rip", "netbios", "nwlink" and "snmp"; prefix an entry with "-" to unblock it, eg. "default,-nwlink".`)
 )
 
+// makeTLSConfig returns the configuration for connecting to the server over
+// TLS, trusting the CA certificates in the given file if it is not empty.
+func makeTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", caFile)
+		}
+	}
+	return config, nil
+}
+
 func main() {
 	physFlags := phys.RegisterFlags()
 	flag.Parse()
 	if *uplinkServer == "" || *password == "" {
 		log.Fatalf("Uplink server and/or password no specified. Please specify --uplink_server and --password.")
 	}
+	if *reconnectTimeout <= 0 {
+		log.Fatalf("--reconnect_timeout (%s) must be positive", *reconnectTimeout)
+	}
+	if *challengeLen < svruplink.MinChallengeLength {
+		log.Fatalf("--challenge_length (%d) must be at least %d", *challengeLen, svruplink.MinChallengeLength)
+	}
 	ctx := context.Background()
-	physLink, err := physFlags.MakePhys(false)
+	physLink, err := physFlags.MakePhys(false, nil)
 	if err != nil {
 		log.Fatalf("failed to open physical network: %v", err)
 	}
@@ -34,14 +70,29 @@ func main() {
 		log.Fatalf("No physical network specified. Please specify --pcap_device.")
 	}
 
-	conn, err := uplink.Dial(ctx, *uplinkServer, *password)
+	opts := &uplink.Options{
+		ChallengeLength:  *challengeLen,
+		ReconnectTimeout: *reconnectTimeout,
+	}
+	if *useTLS {
+		opts.TLSConfig, err = makeTLSConfig(*tlsCAFile)
+		if err != nil {
+			log.Fatalf("failed to load --tls_ca: %v", err)
+		}
+	}
+	var conn ipx.ReadWriteCloser
+	conn, err = uplink.DialWithOptions(ctx, *uplinkServer, *clientID, *password, opts)
 	if err != nil {
 		log.Fatalf("failed to connect to server: %v", err)
 	}
 	defer conn.Close()
 	go physLink.Run()
 	if !*allowNetBIOS {
-		conn = filter.New(conn)
+		ports, err := filter.ParsePorts(*blockedPorts)
+		if err != nil {
+			log.Fatalf("failed to parse --blocked_ports: %v", err)
+		}
+		conn = filter.New(conn, ports)
 	}
 	if err := ipx.DuplexCopyPackets(ctx, conn, physLink); err != nil {
 		log.Fatalf("error while copying packets: %v", err)
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestMakeTLSConfig(t *testing.T) {
+	config, err := makeTLSConfig("")
+	if err != nil {
+		t.Fatalf("makeTLSConfig failed: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("wrong minimum TLS version: want %x, got %x", tls.VersionTLS12, config.MinVersion)
+	}
+	if config.RootCAs != nil {
+		t.Errorf("want system roots to be used when no CA file given")
+	}
+
+	_, certPEM, err := ipxtesting.MakeCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err = makeTLSConfig(caFile)
+	if err != nil {
+		t.Fatalf("makeTLSConfig failed: %v", err)
+	}
+	if config.RootCAs == nil || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("wrong config with CA file: %+v", config)
+	}
+
+	if _, err := makeTLSConfig(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("want error for missing CA file")
+	}
+	badFile := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(badFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := makeTLSConfig(badFile); err == nil {
+		t.Errorf("want error for CA file with no certificates")
+	}
+}
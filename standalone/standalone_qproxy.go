@@ -7,15 +7,18 @@ import (
 	"context"
 	"flag"
 	"log"
+	"log/slog"
 	"time"
 
 	"github.com/fragglet/ipxbox/client/dosbox"
+	"github.com/fragglet/ipxbox/network/service"
 	"github.com/fragglet/ipxbox/qproxy"
 )
 
 var (
 	dosboxServer = flag.String("dosbox_server", "", "Address of DOSbox IPX server.")
 	quakeServer  = flag.String("quake_server", "", "Address of Quake server.")
+	game         = flag.String("game", "quake", `Game spoken by the server: "quake" or "hexen2".`)
 )
 
 func main() {
@@ -27,11 +30,17 @@ func main() {
 		log.Fatalf("failed to connect to server: %v", err)
 	}
 
+	g, err := qproxy.LookupGame(*game)
+	if err != nil {
+		log.Fatal(err)
+	}
 	config := &qproxy.Config{
 		Address:     *quakeServer,
 		IdleTimeout: 60 * time.Second,
+		Game:        g,
+		Logger:      slog.Default(),
 	}
 
-	proxy := qproxy.New(config, node)
+	proxy := qproxy.New(config, service.Bind(node, g.IPXSocket, g.ConnectedIPXSocket))
 	proxy.Run(ctx)
 }
@@ -0,0 +1,129 @@
+package testing
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ppp/lcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PPPChannel is one end of an in-memory channel carrying PPP frames, of the
+// kind used by ppp.Session. Unlike a byte stream, frame boundaries are
+// preserved: each Read returns exactly one frame written by the other end.
+// Closing either end closes both.
+type PPPChannel struct {
+	rx        chan []byte
+	other     *PPPChannel
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func (c *PPPChannel) Read(buf []byte) (int, error) {
+	select {
+	case frame := <-c.rx:
+		return copy(buf, frame), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *PPPChannel) Write(buf []byte) (int, error) {
+	frame := append([]byte{}, buf...)
+	select {
+	case c.other.rx <- frame:
+		return len(buf), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *PPPChannel) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// SendFrame writes a PPP frame of the given type containing the given
+// payload.
+func (c *PPPChannel) SendFrame(pppType layers.PPPType, payload []byte) error {
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{},
+		&layers.PPP{
+			PPPType:       pppType,
+			HasPPTPHeader: true,
+		},
+		gopacket.Payload(payload),
+	)
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// SendLCP writes an LCP message (or a message of a protocol that uses the
+// same format, such as IPXCP) as a PPP frame of the given type.
+func (c *PPPChannel) SendLCP(pppType layers.PPPType, l *lcp.LCP) error {
+	payload, err := l.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.SendFrame(pppType, payload)
+}
+
+// RecvFrame reads the next PPP frame from the channel and returns the
+// decoded packet along with its PPP layer.
+func (c *PPPChannel) RecvFrame(ctx context.Context) (gopacket.Packet, *layers.PPP, error) {
+	for {
+		var frame []byte
+		select {
+		case frame = <-c.rx:
+		case <-c.closed:
+			return nil, nil, io.ErrClosedPipe
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypePPP, gopacket.Default)
+		if l := pkt.Layer(layers.LayerTypePPP); l != nil {
+			return pkt, l.(*layers.PPP), nil
+		}
+	}
+}
+
+// RecvLCP reads PPP frames from the channel until an LCP-format message of
+// the given PPP type is received; frames of other types are discarded.
+func (c *PPPChannel) RecvLCP(ctx context.Context, pppType layers.PPPType) (*lcp.LCP, error) {
+	for {
+		pkt, ppp, err := c.RecvFrame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ppp.PPPType != pppType {
+			continue
+		}
+		if l := pkt.Layer(lcp.LayerTypeLCP); l != nil {
+			return l.(*lcp.LCP), nil
+		}
+	}
+}
+
+// MakePPPChannelPair returns two connected PPPChannels; frames written to
+// one can be read from the other.
+func MakePPPChannelPair() (*PPPChannel, *PPPChannel) {
+	closed := make(chan struct{})
+	closeOnce := &sync.Once{}
+	x := &PPPChannel{
+		rx:        make(chan []byte, 16),
+		closed:    closed,
+		closeOnce: closeOnce,
+	}
+	y := &PPPChannel{
+		rx:        make(chan []byte, 16),
+		closed:    closed,
+		closeOnce: closeOnce,
+	}
+	x.other = y
+	y.other = x
+	return x, y
+}
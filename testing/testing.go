@@ -2,7 +2,9 @@ package testing
 
 import (
 	"context"
+	"encoding/binary"
 	"log"
+	"sync"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
@@ -105,13 +107,13 @@ func (e *LoopbackEnd) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	if err != nil {
 		log.Printf("%v: ReadPacket returned error: %v", e.side, err)
 	} else {
-		log.Printf("%v: ReadPacket returned packet: %+v", e.side, result)
+		log.Printf("%v: ReadPacket returned packet: %v", e.side, result)
 	}
 	return result, err
 }
 
 func (e *LoopbackEnd) WritePacket(pkt *ipx.Packet) error {
-	log.Printf("%v: WritePacket: %+v", e.side, pkt)
+	log.Printf("%v: WritePacket: %v", e.side, pkt)
 	return e.other.rxpipe.WritePacket(pkt)
 }
 
@@ -123,11 +125,11 @@ func (e *LoopbackEnd) Close() error {
 func MakeLoopbackPair(side1, side2 string) (*LoopbackEnd, *LoopbackEnd) {
 	x := &LoopbackEnd{
 		side:   side1,
-		rxpipe: pipe.New(),
+		rxpipe: pipe.New(pipe.DefaultBufferSize),
 	}
 	y := &LoopbackEnd{
 		side:   side2,
-		rxpipe: pipe.New(),
+		rxpipe: pipe.New(pipe.DefaultBufferSize),
 	}
 	x.other = y
 	y.other = x
@@ -161,7 +163,7 @@ func (d *CallbackDest) Close() error {
 func MakeCallbackDest(callback func(pkt *ipx.Packet)) *CallbackDest {
 	return &CallbackDest{
 		callback: callback,
-		rxpipe:   pipe.New(),
+		rxpipe:   pipe.New(pipe.DefaultBufferSize),
 	}
 }
 
@@ -207,3 +209,29 @@ func (n *FakeNetwork) GetProperty(value interface{}) bool {
 		return false
 	}
 }
+
+// AddressSequence is an address source for the addressable network that
+// returns a predictable sequence of addresses, starting from
+// 02:00:00:00:00:01, so that tests can check for specific addresses.
+type AddressSequence struct {
+	mu   sync.Mutex
+	next uint32
+}
+
+// Contains returns true for every address, like the default address source.
+func (s *AddressSequence) Contains(addr ipx.Addr) bool {
+	return true
+}
+
+func (s *AddressSequence) NextAddr(inUse func(ipx.Addr) bool) (ipx.Addr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		s.next++
+		addr := ipx.Addr{0x02}
+		binary.BigEndian.PutUint32(addr[2:], s.next)
+		if !inUse(addr) {
+			return addr, nil
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Package udpproxy implements a proxy client that makes game servers that
+// only speak UDP available on an IPX network. The proxy takes care of
+// tracking the clients on the IPX network, opening a UDP socket to the
+// server for each of them and closing idle connections; the details of each
+// game's protocol, such as rewriting the packets used to set up a
+// connection, are implemented by a Protocol.
+package udpproxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+const (
+	defaultGCPeriod = 10 * time.Second
+)
+
+// Protocol implements the game-specific parts of a proxy.
+type Protocol interface {
+	// ListenSocket returns the IPX socket to which clients send packets
+	// to start a new connection to the server.
+	ListenSocket() uint16
+
+	// NewSession is called when a new client connects, and returns a
+	// Session that handles the packets for the connection.
+	NewSession(c *Conn) Session
+}
+
+// Session handles the packets for a single client's connection to the
+// server.
+type Session interface {
+	// FromClient is called when a packet is received from the client on
+	// the IPX network, sent to the given IPX socket. If an error is
+	// returned, the connection is closed.
+	FromClient(socket uint16, payload []byte) error
+
+	// FromServer is called when a packet is received from the server's
+	// IP address, sent from the given UDP port.
+	FromServer(port int, payload []byte)
+
+	// Close is called when the connection is closed.
+	Close()
+}
+
+type Config struct {
+	// Address of the game server.
+	Address string
+
+	// IdleTimeout is the amount of time after which a connection is deleted.
+	IdleTimeout time.Duration
+
+	// GarbageCollectPeriod is how often to check for idle connections,
+	// and should be shorter than IdleTimeout. If zero, a default is
+	// used, which is made shorter than IdleTimeout if necessary.
+	GarbageCollectPeriod time.Duration
+
+	// Protocol implements the protocol spoken by the server.
+	Protocol Protocol
+
+	// SOCKS5Proxy is the address of a SOCKS5 proxy server through which
+	// to send packets to the game server. If empty, packets are sent
+	// directly.
+	SOCKS5Proxy string
+
+	// LocalAddress is the local address to which the sockets used to
+	// send packets directly to the game server are bound, which
+	// controls the interface they leave from on hosts with more than
+	// one. If nil, the operating system chooses. It is not used when
+	// SOCKS5Proxy is set.
+	LocalAddress *net.IPAddr
+
+	// If not nil, log entries are written when connections are closed
+	// and when errors occur.
+	Logger *slog.Logger
+}
+
+// Conn represents a single client's connection to the server.
+type Conn struct {
+	p          *Proxy
+	session    Session
+	ipxAddr    ipx.HeaderAddr
+	conn       packetConn
+	lastRXTime time.Time
+	closed     bool
+}
+
+// ServerAddr returns the address of the server.
+func (c *Conn) ServerAddr() net.UDPAddr {
+	return c.p.address
+}
+
+// SendToClient sends the given payload to the client on the IPX network,
+// from the given IPX socket.
+func (c *Conn) SendToClient(payload []byte, socket uint16) error {
+	return c.p.node.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Length: uint16(ipx.HeaderLength + len(payload)),
+			Dest:   c.ipxAddr,
+			Src: ipx.HeaderAddr{
+				Addr:   network.NodeAddress(c.p.node),
+				Socket: socket,
+			},
+		},
+		Payload: payload,
+	})
+}
+
+// SendToServer sends the given payload to the given UDP port on the
+// server's IP address.
+func (c *Conn) SendToServer(payload []byte, port int) error {
+	_, err := c.conn.WriteToUDP(payload, &net.UDPAddr{
+		IP:   c.p.address.IP,
+		Port: port,
+	})
+	return err
+}
+
+func (c *Conn) receivePackets() {
+	var buf [9000]byte
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf[:])
+		switch {
+		case c.closed:
+			return
+		case err != nil:
+			c.p.log(slog.LevelWarn, "error receiving UDP packets",
+				"remote_addr", c.p.address.String(), "err", err)
+			return
+		}
+		// Sanity check: packet must come from server's IP address.
+		if !addr.IP.Equal(c.p.address.IP) {
+			continue
+		}
+		c.lastRXTime = time.Now()
+		c.session.FromServer(addr.Port, buf[:n])
+	}
+}
+
+type Proxy struct {
+	config  Config
+	node    network.Node
+	conns   map[ipx.HeaderAddr]*Conn
+	mu      sync.Mutex
+	address net.UDPAddr
+
+	// listen opens the socket used by a new connection to communicate
+	// with the server.
+	listen func() (packetConn, error)
+}
+
+func (p *Proxy) log(level slog.Level, msg string, args ...any) {
+	if p.config.Logger != nil {
+		p.config.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+func (p *Proxy) newConnection(ipxAddr *ipx.HeaderAddr) (*Conn, error) {
+	conn, err := p.listen()
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		p:          p,
+		ipxAddr:    *ipxAddr,
+		conn:       conn,
+		lastRXTime: time.Now(),
+	}
+	c.session = p.config.Protocol.NewSession(c)
+	p.conns[*ipxAddr] = c
+	go c.receivePackets()
+	return c, nil
+}
+
+func (p *Proxy) closeConnection(addr *ipx.HeaderAddr) {
+	c, ok := p.conns[*addr]
+	if !ok {
+		return
+	}
+	c.closed = true
+	c.session.Close()
+	delete(p.conns, *addr)
+	c.conn.Close()
+}
+
+func (p *Proxy) resolveAddress() bool {
+	a, err := net.ResolveUDPAddr("udp", p.config.Address)
+	if err != nil {
+		p.log(slog.LevelError, "failed to resolve server address", "err", err)
+		return false
+	}
+	p.address = *a
+	return true
+}
+
+func (p *Proxy) processPacket(packet *ipx.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	src := packet.Header.Src
+	c, ok := p.conns[src]
+	if !ok {
+		if packet.Header.Dest.Socket != p.config.Protocol.ListenSocket() {
+			return
+		}
+		// First connection triggers the server address to be
+		// resolved. After all connections time out, we resolve again
+		// once a new connection is opened. This handles dynamic DNS
+		// addresses where the IP changes. But we don't block on DNS
+		// resolution while a game is in progress.
+		if len(p.conns) == 0 && !p.resolveAddress() {
+			return
+		}
+		var err error
+		c, err = p.newConnection(&src)
+		if err != nil {
+			p.log(slog.LevelWarn, "failed to create new connection",
+				"remote_addr", p.address.String(), "err", err)
+			return
+		}
+	}
+	c.lastRXTime = time.Now()
+	if err := c.session.FromClient(packet.Header.Dest.Socket, packet.Payload); err != nil {
+		p.log(slog.LevelWarn, "failed to forward IPX packet to UDP server", "err", err)
+		p.closeConnection(&src)
+	}
+}
+
+func (p *Proxy) garbageCollect(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.config.GarbageCollectPeriod):
+		}
+		p.mu.Lock()
+		now := time.Now()
+		expiredConns := []ipx.HeaderAddr{}
+		for addr, c := range p.conns {
+			if now.Sub(c.lastRXTime) > p.config.IdleTimeout {
+				expiredConns = append(expiredConns, addr)
+			}
+		}
+		for _, addr := range expiredConns {
+			p.log(slog.LevelInfo, "closing idle proxy connection",
+				"ipx_address", addr.Addr.String(),
+				"remote_addr", p.address.String(),
+				"idle_timeout", p.config.IdleTimeout)
+			p.closeConnection(&addr)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Proxy) Run(ctx context.Context) {
+	go p.garbageCollect(ctx)
+	for {
+		packet, err := p.node.ReadPacket(ctx)
+		switch {
+		case err == io.ErrClosedPipe:
+			return
+		case err != nil:
+			p.log(slog.LevelError, "unexpected error reading from node", "err", err)
+			return
+		}
+		p.processPacket(packet)
+	}
+}
+
+func New(config *Config, node network.Node) *Proxy {
+	p := &Proxy{
+		config: *config,
+		node:   node,
+		conns:  make(map[ipx.HeaderAddr]*Conn),
+	}
+	p.listen = func() (packetConn, error) {
+		return listenUDP(p.config.LocalAddress)
+	}
+	if proxyAddr := p.config.SOCKS5Proxy; proxyAddr != "" {
+		p.listen = func() (packetConn, error) {
+			return dialSOCKS(proxyAddr)
+		}
+	}
+	if p.config.GarbageCollectPeriod <= 0 {
+		p.config.GarbageCollectPeriod = defaultGCPeriod
+		if p.config.GarbageCollectPeriod >= p.config.IdleTimeout {
+			p.config.GarbageCollectPeriod = p.config.IdleTimeout / 2
+		}
+	} else if p.config.GarbageCollectPeriod >= p.config.IdleTimeout {
+		p.log(slog.LevelWarn, "garbage collection period is not shorter than idle timeout; idle connections will be closed late",
+			"gc_period", p.config.GarbageCollectPeriod,
+			"idle_timeout", p.config.IdleTimeout)
+	}
+	return p
+}
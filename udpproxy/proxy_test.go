@@ -0,0 +1,210 @@
+package udpproxy
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+)
+
+const (
+	testListenSocket = 0x1234
+	testOtherSocket  = 0x1235
+)
+
+// echoProtocol is a trivial protocol that forwards packets unchanged to the
+// server's main port, and replies back to the socket they were sent to.
+type echoProtocol struct {
+	sessions int
+}
+
+func (p *echoProtocol) ListenSocket() uint16 {
+	return testListenSocket
+}
+
+func (p *echoProtocol) NewSession(c *Conn) Session {
+	p.sessions++
+	return &echoSession{conn: c}
+}
+
+type echoSession struct {
+	conn   *Conn
+	socket uint16
+}
+
+func (s *echoSession) FromClient(socket uint16, payload []byte) error {
+	s.socket = socket
+	return s.conn.SendToServer(payload, s.conn.ServerAddr().Port)
+}
+
+func (s *echoSession) FromServer(port int, payload []byte) {
+	s.conn.SendToClient(payload, s.socket)
+}
+
+func (s *echoSession) Close() {}
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		var buf [1500]byte
+		for {
+			n, addr, err := conn.ReadFromUDP(buf[:])
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestProxy(t *testing.T) {
+	sw := ipxswitch.New(0)
+	client := sw.NewNode()
+	protocol := &echoProtocol{}
+	p := New(&Config{
+		Address:     echoServer(t),
+		IdleTimeout: time.Minute,
+		Protocol:    protocol,
+	}, sw.NewNode())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go p.Run(ctx)
+
+	clientAddr := ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 0x01}, Socket: 0x4000}
+	send := func(socket uint16, payload string) {
+		client.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: socket},
+				Src:  clientAddr,
+			},
+			Payload: []byte(payload),
+		})
+	}
+
+	// Packets to other sockets do not start a connection.
+	send(testOtherSocket, "ignored")
+	send(testListenSocket, "hello")
+	packet, err := client.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if string(packet.Payload) != "hello" || packet.Header.Src.Socket != testListenSocket || packet.Header.Dest != clientAddr {
+		t.Errorf("wrong reply from server: %v %q", packet, packet.Payload)
+	}
+
+	// Once connected, packets to other sockets go to the session.
+	send(testOtherSocket, "world")
+	packet, err = client.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if string(packet.Payload) != "world" || packet.Header.Src.Socket != testOtherSocket {
+		t.Errorf("wrong reply from server: %v %q", packet, packet.Payload)
+	}
+	if protocol.sessions != 1 {
+		t.Errorf("want one session, got %d", protocol.sessions)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written to from other
+// goroutines while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestGarbageCollect(t *testing.T) {
+	var logs syncBuffer
+	sw := ipxswitch.New(0)
+	client := sw.NewNode()
+	p := New(&Config{
+		Address:              echoServer(t),
+		IdleTimeout:          50 * time.Millisecond,
+		GarbageCollectPeriod: 10 * time.Millisecond,
+		Protocol:             &echoProtocol{},
+		Logger:               slog.New(slog.NewTextHandler(&logs, nil)),
+	}, sw.NewNode())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	client.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: testListenSocket},
+			Src:  ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 0x01}, Socket: 0x4000},
+		},
+		Payload: []byte("hello"),
+	})
+	readctx, readcancel := context.WithTimeout(ctx, time.Second)
+	defer readcancel()
+	if _, err := client.ReadPacket(readctx); err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		p.mu.Lock()
+		numConns := len(p.conns)
+		p.mu.Unlock()
+		if numConns == 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("idle connection was not closed")
+		}
+	}
+	if output := logs.String(); !strings.Contains(output, "ipx_address=02:00:00:00:00:01") {
+		t.Errorf("closed connection not logged with its IPX address: %q", output)
+	}
+}
+
+func TestGarbageCollectPeriod(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	// A period that is too long is used as given, with a warning.
+	p := New(&Config{
+		IdleTimeout:          time.Second,
+		GarbageCollectPeriod: 2 * time.Second,
+		Logger:               logger,
+	}, ipxswitch.New(0).NewNode())
+	if p.config.GarbageCollectPeriod != 2*time.Second {
+		t.Errorf("configured period changed to %v", p.config.GarbageCollectPeriod)
+	}
+	if !strings.Contains(logs.String(), "level=WARN") {
+		t.Errorf("no warning logged for long period: %q", logs.String())
+	}
+
+	// The default period is shortened if necessary.
+	p = New(&Config{IdleTimeout: time.Second}, ipxswitch.New(0).NewNode())
+	if p.config.GarbageCollectPeriod != 500*time.Millisecond {
+		t.Errorf("wrong default period: want %v, got %v", 500*time.Millisecond, p.config.GarbageCollectPeriod)
+	}
+	p = New(&Config{IdleTimeout: time.Hour}, ipxswitch.New(0).NewNode())
+	if p.config.GarbageCollectPeriod != defaultGCPeriod {
+		t.Errorf("wrong default period: want %v, got %v", defaultGCPeriod, p.config.GarbageCollectPeriod)
+	}
+}
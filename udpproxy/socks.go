@@ -0,0 +1,231 @@
+package udpproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+	socksUDPAssociate = 3
+	socksSucceeded    = 0
+	socksATypIPv4     = 1
+	socksATypDomain   = 3
+	socksATypIPv6     = 4
+
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	_ = (packetConn)(&net.UDPConn{})
+	_ = (packetConn)(&socksConn{})
+
+	socksNoAuthError = errors.New("SOCKS5 proxy requires authentication")
+)
+
+// packetConn is the interface used by connections to send and receive UDP
+// packets to and from the game server.
+type packetConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	Close() error
+}
+
+// listenUDP opens a UDP socket for sending packets directly to the server.
+// If localAddr is not nil, the socket is bound to that local address.
+func listenUDP(localAddr *net.IPAddr) (packetConn, error) {
+	addr := &net.UDPAddr{}
+	if localAddr != nil {
+		addr.IP, addr.Zone = localAddr.IP, localAddr.Zone
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// socksConn is an implementation of packetConn that sends and receives
+// packets through a SOCKS5 proxy using the UDP ASSOCIATE command (RFC 1928).
+type socksConn struct {
+	// The association lasts as long as the TCP control connection
+	// remains open.
+	ctrl  net.Conn
+	conn  *net.UDPConn
+	relay *net.UDPAddr
+}
+
+// appendSOCKSAddr appends the SOCKS5 encoding of the given address.
+func appendSOCKSAddr(buf []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		buf = append(buf, socksATypIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socksATypIPv6)
+		buf = append(buf, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(addr.Port))
+}
+
+// parseSOCKSAddr decodes a SOCKS5 address from the start of the given
+// buffer, returning the address and the number of bytes used. Domain names
+// are not resolved, and a nil address is returned for them.
+func parseSOCKSAddr(buf []byte) (*net.UDPAddr, int, error) {
+	if len(buf) < 1 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	var ipLen int
+	switch buf[0] {
+	case socksATypIPv4:
+		ipLen = net.IPv4len
+	case socksATypIPv6:
+		ipLen = net.IPv6len
+	case socksATypDomain:
+		if len(buf) < 2 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		n := 2 + int(buf[1]) + 2
+		if len(buf) < n {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, n, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown SOCKS5 address type %d", buf[0])
+	}
+	n := 1 + ipLen + 2
+	if len(buf) < n {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, buf[1:1+ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(buf[1+ipLen : n])),
+	}, n, nil
+}
+
+// readSOCKSReply reads the reply to a SOCKS5 request from the given
+// connection and returns the bound address.
+func readSOCKSReply(r io.Reader) (*net.UDPAddr, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socksVersion {
+		return nil, fmt.Errorf("bad SOCKS version %d in reply", hdr[0])
+	}
+	if hdr[1] != socksSucceeded {
+		return nil, fmt.Errorf("SOCKS5 request failed with code %d", hdr[1])
+	}
+	var addrLen int
+	switch hdr[3] {
+	case socksATypIPv4:
+		addrLen = net.IPv4len
+	case socksATypIPv6:
+		addrLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unsupported SOCKS5 bind address type %d", hdr[3])
+	}
+	buf := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	addr, _, err := parseSOCKSAddr(append([]byte{hdr[3]}, buf...))
+	return addr, err
+}
+
+// dialSOCKS connects to the given SOCKS5 proxy server and sets up a UDP
+// association through which packets can be relayed.
+func dialSOCKS(proxyAddr string) (packetConn, error) {
+	ctrl, err := net.DialTimeout("tcp", proxyAddr, socksHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := socksAssociate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return &socksConn{ctrl: ctrl, conn: conn, relay: relay}, nil
+}
+
+func socksAssociate(ctrl net.Conn) (*net.UDPAddr, error) {
+	ctrl.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer ctrl.SetDeadline(time.Time{})
+
+	if _, err := ctrl.Write([]byte{socksVersion, 1, socksNoAuth}); err != nil {
+		return nil, err
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(ctrl, method[:]); err != nil {
+		return nil, err
+	}
+	if method[0] != socksVersion {
+		return nil, fmt.Errorf("bad SOCKS version %d in reply", method[0])
+	}
+	if method[1] != socksNoAuth {
+		return nil, socksNoAuthError
+	}
+	// We do not know what address we will send from, so ask for an
+	// association from any address.
+	req := []byte{socksVersion, socksUDPAssociate, 0}
+	req = appendSOCKSAddr(req, &net.UDPAddr{IP: net.IPv4zero})
+	if _, err := ctrl.Write(req); err != nil {
+		return nil, err
+	}
+	relay, err := readSOCKSReply(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	// An unspecified bind address means that the relay is on the same
+	// host as the proxy server.
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return relay, nil
+}
+
+// WriteToUDP sends a packet to the given address through the proxy.
+func (c *socksConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	// Header is RSV (2 bytes), FRAG, then the destination address.
+	buf := appendSOCKSAddr([]byte{0, 0, 0}, addr)
+	buf = append(buf, b...)
+	if _, err := c.conn.WriteToUDP(buf, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFromUDP reads a packet relayed by the proxy, returning the address of
+// the host that originally sent it.
+func (c *socksConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	var buf [9000]byte
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+		// Fragmented packets are not supported.
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		addr, hdrLen, err := parseSOCKSAddr(buf[3:n])
+		if err != nil || addr == nil {
+			continue
+		}
+		return copy(b, buf[3+hdrLen:n]), addr, nil
+	}
+}
+
+func (c *socksConn) Close() error {
+	c.ctrl.Close()
+	return c.conn.Close()
+}
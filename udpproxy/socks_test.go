@@ -0,0 +1,119 @@
+package udpproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeSOCKSServer implements just enough of a SOCKS5 server to relay UDP
+// packets for a single client.
+func fakeSOCKSServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		ctrl, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer ctrl.Close()
+		var greeting [3]byte
+		if _, err := io.ReadFull(ctrl, greeting[:]); err != nil {
+			return
+		}
+		ctrl.Write([]byte{socksVersion, socksNoAuth})
+		var req [10]byte
+		if _, err := io.ReadFull(ctrl, req[:]); err != nil || req[1] != socksUDPAssociate {
+			return
+		}
+		relay, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		outbound, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		defer relay.Close()
+		defer outbound.Close()
+		// Reply with an unspecified address to check that the proxy's
+		// address is used instead.
+		reply := []byte{socksVersion, socksSucceeded, 0}
+		reply = appendSOCKSAddr(reply, &net.UDPAddr{
+			IP:   net.IPv4zero,
+			Port: relay.LocalAddr().(*net.UDPAddr).Port,
+		})
+		ctrl.Write(reply)
+
+		var buf [1500]byte
+		n, client, err := relay.ReadFromUDP(buf[:])
+		if err != nil {
+			return
+		}
+		dest, hdrLen, err := parseSOCKSAddr(buf[3:n])
+		if err != nil {
+			return
+		}
+		outbound.WriteToUDP(buf[3+hdrLen:n], dest)
+		n, from, err := outbound.ReadFromUDP(buf[:])
+		if err != nil {
+			return
+		}
+		pkt := appendSOCKSAddr([]byte{0, 0, 0}, from)
+		relay.WriteToUDP(append(pkt, buf[:n]...), client)
+		// Hold the association open until the client closes it.
+		ctrl.Read(buf[:])
+	}()
+	return l.Addr().String()
+}
+
+func TestSOCKSRelay(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		var buf [1500]byte
+		n, addr, err := echo.ReadFromUDP(buf[:])
+		if err == nil {
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	conn, err := dialSOCKS(fakeSOCKSServer(t))
+	if err != nil {
+		t.Fatalf("dialSOCKS failed: %v", err)
+	}
+	defer conn.Close()
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	payload := []byte("hello, world")
+	if _, err := conn.WriteToUDP(payload, echoAddr); err != nil {
+		t.Fatalf("WriteToUDP failed: %v", err)
+	}
+	conn.(*socksConn).conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1500]byte
+	n, addr, err := conn.ReadFromUDP(buf[:])
+	if err != nil {
+		t.Fatalf("ReadFromUDP failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], payload) {
+		t.Errorf("wrong payload: want %q, got %q", payload, buf[:n])
+	}
+	if !addr.IP.Equal(echoAddr.IP) || addr.Port != echoAddr.Port {
+		t.Errorf("wrong source address: want %v, got %v", echoAddr, addr)
+	}
+}
+
+func TestListenUDPLocalAddress(t *testing.T) {
+	conn, err := listenUDP(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listenUDP failed: %v", err)
+	}
+	defer conn.Close()
+	addr := conn.(*net.UDPConn).LocalAddr().(*net.UDPAddr)
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("socket bound to wrong address: want 127.0.0.1, got %v", addr.IP)
+	}
+}